@@ -0,0 +1,451 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var audit_log = flag.String("audit_log", "", "the sink of the audit log, it can be 'none', 'file', 'file:<path>', 'syslog', 'syslog://host:port' or 'syslog+tcp://host:port', default is 'file' which writes to logs/audit.log.")
+
+// AuditEvent 是审计日志中的一行
+//
+//	session_start 和 session_end 是会话的开始和结束
+//	command       是在交互会话中输入的一行命令， 由按键重建
+//	exec          是 /cmd 和 /ssh_exec 执行的命令
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	SessionID  string    `json:"session_id,omitempty"`
+	User       string    `json:"user"`
+	Viewer     string    `json:"viewer,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	// Hidden 为 true 时表示输入的是密码， Command 为空
+	Hidden bool `json:"hidden,omitempty"`
+	// Action 和 Rule 是命令匹配的危险命令规则， Action 为 cancel 时表示
+	// 用户取消了需要确认的命令， 见 policy.go
+	Action string `json:"action,omitempty"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+// AuditSink 是审计日志的输出， 可以用 SetAuditSink 替换
+type AuditSink interface {
+	Write(event *AuditEvent) error
+	Close() error
+}
+
+var (
+	auditLock sync.RWMutex
+	auditSink AuditSink
+)
+
+// SetAuditSink 替换审计日志的输出， 返回原来的输出， sink 为 nil 时不记录
+func SetAuditSink(sink AuditSink) AuditSink {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	old := auditSink
+	auditSink = sink
+	return old
+}
+
+func writeAudit(event *AuditEvent) {
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+	if nil == auditSink {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := auditSink.Write(event); err != nil {
+		log.Println("write audit log fail,", err)
+	}
+}
+
+// openAuditSink 按 audit_log 参数打开审计日志的输出
+func openAuditSink(s string) (AuditSink, error) {
+	switch {
+	case "none" == s:
+		return nil, nil
+	case "" == s || "file" == s:
+		return newFileAuditSink(filepath.Join(LogDir, "audit.log"))
+	case strings.HasPrefix(s, "file:"):
+		return newFileAuditSink(strings.TrimPrefix(s, "file:"))
+	case "syslog" == s:
+		return newSyslogAuditSink("", "")
+	case strings.HasPrefix(s, "syslog://"):
+		return newSyslogAuditSink("udp", strings.TrimPrefix(s, "syslog://"))
+	case strings.HasPrefix(s, "syslog+tcp://"):
+		return newSyslogAuditSink("tcp", strings.TrimPrefix(s, "syslog+tcp://"))
+	}
+	return nil, errors.New("audit_log '" + s + "' is unsupported")
+}
+
+// fileAuditSink 将审计日志按 JSON 行追加到文件中
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileAuditSink(file string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New("open audit log '" + file + "' fail," + err.Error())
+	}
+	return &fileAuditSink{file: f}, nil
+}
+
+func (sink *fileAuditSink) Write(event *AuditEvent) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err = sink.file.Write(append(bs, '\n'))
+	return err
+}
+
+func (sink *fileAuditSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.file.Close()
+}
+
+// audit 记录会话的事件
+func (sess *LiveSession) audit(typ, command string) {
+	writeAudit(&AuditEvent{Type: typ,
+		SessionID:  sess.ID,
+		User:       sess.User,
+		RemoteAddr: sess.RemoteAddr,
+		Protocol:   sess.Protocol,
+		Target:     sess.Target,
+		Command:    command})
+}
+
+// filterInput 将会话读到的按键交给 lineAuditor， 返回要转发给会话的
+// 按键， 被禁止或等待确认的命令的回车不会转发
+func (sess *LiveSession) filterInput(p []byte) []byte {
+	sess.smu.Lock()
+	echoOff := sess.echoOff()
+	out, events, msgs := sess.auditor.feed(sess, p)
+	if nil != sess.recorder && len(out) > 0 {
+		if echoOff {
+			sess.recorder.WriteInput(maskInput(out))
+		} else {
+			sess.recorder.WriteInput(out)
+		}
+	}
+	sess.smu.Unlock()
+
+	for _, event := range events {
+		writeAudit(event)
+	}
+	for _, msg := range msgs {
+		sess.sendPolicy(msg)
+	}
+	return out
+}
+
+// maxAuditLine 是审计日志中一行命令的最大长度
+const maxAuditLine = 4096
+
+// secretPromptPattern 匹配输入密码的提示符， 它后面输入的内容不记录
+var secretPromptPattern = regexp.MustCompile(`(?i)(password|passphrase|passcode|口令|密码)[^:：]*[:：]\s*$`)
+
+// lineAuditor 从按键中重建命令行， 它处理退格、 光标移动和常用的行编辑
+// 快捷键。 使用了 tab 补全或上下键历史时， 命令行从屏幕上光标所在的行
+// 中提示符的后面读取
+type lineAuditor struct {
+	line    []rune
+	pos     int
+	started bool
+	prompt  string
+	// fromScreen 为 true 时按键不能反映命令行， 需要从屏幕读取
+	fromScreen bool
+	by         string
+	// typist 是正在输入的观察者， 为空时是会话的所有者， 见 LiveSession.write
+	typist string
+
+	// confirming 为 true 时命令在等待确认， held 是等待确认的命令，
+	// confirmed 为 true 时下一个回车不再检查规则
+	confirming bool
+	confirmed  bool
+	held       *policyMessage
+
+	pending []byte
+	esc     []byte
+	lastCR  bool
+	dropLF  bool
+}
+
+// feed 必须在持有 sess.smu 时调用， 返回要转发的按键、 输入完成的命令
+// 和要发给浏览器的规则消息
+func (a *lineAuditor) feed(sess *LiveSession, p []byte) ([]byte, []*AuditEvent, []*policyMessage) {
+	var events []*AuditEvent
+	var msgs []*policyMessage
+	bs := append(a.pending, p...)
+	a.pending = nil
+	out := make([]byte, 0, len(bs))
+	for len(bs) > 0 {
+		r, size := utf8.DecodeRune(bs)
+		if r == utf8.RuneError && size <= 1 && !utf8.FullRune(bs) {
+			a.pending = append([]byte(nil), bs...)
+			break
+		}
+		raw := bs[:size]
+		bs = bs[size:]
+
+		if r == '\r' || r == '\n' {
+			if r == '\n' && a.lastCR {
+				a.lastCR = false
+				if !a.dropLF {
+					out = append(out, raw...)
+				}
+				continue
+			}
+			a.lastCR = r == '\r'
+			a.esc = nil
+
+			event, msg, action := a.submit(sess)
+			if nil != event {
+				events = append(events, event)
+			}
+			if nil != msg {
+				msgs = append(msgs, msg)
+			}
+			a.dropLF = "block" == action || "hold" == action
+			switch action {
+			case "block":
+				out = append(out, killLine...)
+			case "hold":
+			default:
+				out = append(out, raw...)
+			}
+			continue
+		}
+
+		out = append(out, raw...)
+		a.lastCR = false
+		a.confirming = false
+		a.held = nil
+		if nil != a.esc {
+			a.escape(r)
+			continue
+		}
+		if r == 0x03 { // ^C
+			a.reset()
+			continue
+		}
+
+		if sess.screen.AltScreen() {
+			// 全屏的程序 (如 vi) 的按键不是命令
+			a.reset()
+			continue
+		}
+		if !a.started {
+			a.started = true
+			x, y, _ := sess.screen.Cursor()
+			a.prompt = sess.screen.Slice(y, 0, x)
+		}
+		if "" != a.typist {
+			a.by = a.typist
+		}
+
+		switch r {
+		case 0x1b:
+			a.esc = []byte{}
+		case 0x7f, 0x08: // 退格
+			if a.pos > 0 {
+				a.line = append(a.line[:a.pos-1], a.line[a.pos:]...)
+				a.pos--
+			}
+		case 0x01: // ^A
+			a.pos = 0
+		case 0x05: // ^E
+			a.pos = len(a.line)
+		case 0x02: // ^B
+			if a.pos > 0 {
+				a.pos--
+			}
+		case 0x06: // ^F
+			if a.pos < len(a.line) {
+				a.pos++
+			}
+		case 0x0b: // ^K
+			a.line = a.line[:a.pos]
+		case 0x15: // ^U
+			a.line = append([]rune{}, a.line[a.pos:]...)
+			a.pos = 0
+		case 0x17: // ^W
+			end := a.pos
+			for a.pos > 0 && a.line[a.pos-1] == ' ' {
+				a.pos--
+			}
+			for a.pos > 0 && a.line[a.pos-1] != ' ' {
+				a.pos--
+			}
+			a.line = append(a.line[:a.pos], a.line[end:]...)
+		case '\t', 0x10, 0x0e, 0x12, 0x19: // tab、 ^P、 ^N、 ^R 和 ^Y
+			a.fromScreen = true
+		default:
+			if r < 0x20 {
+				continue
+			}
+			if len(a.line) >= maxAuditLine {
+				continue
+			}
+			a.line = append(a.line, 0)
+			copy(a.line[a.pos+1:], a.line[a.pos:])
+			a.line[a.pos] = r
+			a.pos++
+		}
+	}
+	return out, events, msgs
+}
+
+// escape 处理 ESC 开始的按键， 如方向键 ESC [ A 和 ESC O A
+func (a *lineAuditor) escape(r rune) {
+	a.esc = append(a.esc, string(r)...)
+	if len(a.esc) == 1 && r != '[' && r != 'O' {
+		// Alt+键， 如 Alt+B， Alt+F， 光标的位置不确定了
+		a.esc = nil
+		a.fromScreen = true
+		return
+	}
+	if len(a.esc) == 1 || (a.esc[0] == '[' && (r < 0x40 || r > 0x7e)) {
+		if len(a.esc) > 16 {
+			a.esc = nil
+		}
+		return
+	}
+	seq := string(a.esc)
+	a.esc = nil
+	switch seq {
+	case "[A", "OA", "[B", "OB":
+		a.fromScreen = true
+	case "[C", "OC":
+		if a.pos < len(a.line) {
+			a.pos++
+		}
+	case "[D", "OD":
+		if a.pos > 0 {
+			a.pos--
+		}
+	case "[H", "OH", "[1~", "[7~":
+		a.pos = 0
+	case "[F", "OF", "[4~", "[8~":
+		a.pos = len(a.line)
+	case "[3~":
+		if a.pos < len(a.line) {
+			a.line = append(a.line[:a.pos], a.line[a.pos+1:]...)
+		}
+	}
+}
+
+func (a *lineAuditor) reset() {
+	a.line = a.line[:0]
+	a.pos = 0
+	a.started = false
+	a.prompt = ""
+	a.fromScreen = false
+	a.by = ""
+	a.confirming = false
+	a.confirmed = false
+	a.held = nil
+}
+
+// submit 在回车时调用， 返回输入的命令 (空行返回 nil)、 规则的消息和
+// 对回车的处理， 处理为 block 时要取消命令行， 为 hold 时命令在等待确认，
+// 回车不能转发
+func (a *lineAuditor) submit(sess *LiveSession) (*AuditEvent, *policyMessage, string) {
+	if !a.started || sess.screen.AltScreen() {
+		a.reset()
+		return nil, nil, ""
+	}
+
+	event := &AuditEvent{Type: "command",
+		SessionID:  sess.ID,
+		User:       sess.User,
+		Viewer:     a.by,
+		RemoteAddr: sess.RemoteAddr,
+		Protocol:   sess.Protocol,
+		Target:     sess.Target}
+	// 提示符可以被伪造成输入密码的提示符 (如 PS1='password: ')， 所以输入
+	// 密码时也要检查规则， 只是不记录输入的内容
+	hidden := secretPromptPattern.MatchString(a.prompt)
+	command := string(a.line)
+	if a.fromScreen {
+		// 不回显的输入在屏幕上是空的， 这时仍然使用按键
+		if s, ok := a.readScreen(sess); ok && !(hidden && "" == strings.TrimSpace(s)) {
+			command = s
+		}
+	}
+	command = strings.TrimSpace(command)
+	if hidden {
+		event.Hidden = true
+	}
+	if "" == command {
+		a.reset()
+		if hidden {
+			return event, nil, ""
+		}
+		return nil, nil, ""
+	}
+	if !hidden {
+		event.Command = redactLine(command)
+	}
+
+	rule := sess.matchPolicy(command)
+	if nil == rule {
+		a.reset()
+		return event, nil, ""
+	}
+	event.Action = rule.Action
+	event.Rule = rule.Name
+	msg := &policyMessage{Action: rule.Action,
+		Rule:    rule.Name,
+		Command: event.Command,
+		Message: rule.Message}
+	if "confirm" == rule.Action {
+		if a.confirmed {
+			a.reset()
+			return event, nil, ""
+		}
+		a.confirming = true
+		a.held = msg
+		return nil, msg, "hold"
+	}
+	a.reset()
+	return event, msg, rule.Action
+}
+
+// readScreen 从屏幕上读取提示符后面的命令， 命令较长时会折行， 所以从
+// 光标所在的行向上找到提示符开始的行
+func (a *lineAuditor) readScreen(sess *LiveSession) (string, bool) {
+	if "" == strings.TrimSpace(a.prompt) {
+		return "", false
+	}
+	rows, cols := sess.screen.Size()
+	_, y, _ := sess.screen.Cursor()
+	var text string
+	for row := y; row >= 0 && row < rows && y-row < 32; row-- {
+		s := sess.screen.Slice(row, 0, cols)
+		if strings.HasPrefix(s, a.prompt) {
+			return strings.TrimRight(strings.TrimPrefix(s, a.prompt)+text, " "), true
+		}
+		text = s + text
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"log/syslog"
+)
+
+// syslogAuditSink 将审计日志按 JSON 格式发送到 syslog
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogAuditSink 连接 syslog， network 为空时连接本机的 syslog
+func newSyslogAuditSink(network, raddr string) (AuditSink, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "web-terminal")
+	if err != nil {
+		if "" == raddr {
+			raddr = "local"
+		}
+		return nil, errors.New("connect to syslog '" + raddr + "' fail," + err.Error())
+	}
+	return &syslogAuditSink{w: w}, nil
+}
+
+func (sink *syslogAuditSink) Write(event *AuditEvent) error {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return sink.w.Info(string(bs))
+}
+
+func (sink *syslogAuditSink) Close() error {
+	return sink.w.Close()
+}
@@ -0,0 +1,7 @@
+package terminal
+
+import "errors"
+
+func newSyslogAuditSink(network, raddr string) (AuditSink, error) {
+	return nil, errors.New("syslog is unsupported on windows")
+}
@@ -0,0 +1,115 @@
+package terminal
+
+import (
+	"testing"
+
+	"github.com/runner-mei/web-terminal/vt"
+)
+
+// auditLines 交替地将 steps 中的输出写到屏幕和将按键交给 lineAuditor，
+// 偶数下标的是输出， 奇数下标的是按键， 返回记录的命令
+func auditLines(steps ...string) []*AuditEvent {
+	sess := &LiveSession{ID: "test", User: "admin", screen: vt.New(24, 40)}
+	var auditor lineAuditor
+	var results []*AuditEvent
+	for idx, step := range steps {
+		if 0 == idx%2 {
+			sess.screen.Write([]byte(step))
+			continue
+		}
+		_, events, _ := auditor.feed(sess, []byte(step))
+		results = append(results, events...)
+	}
+	return results
+}
+
+func assertCommands(t *testing.T, events []*AuditEvent, excepted ...string) {
+	t.Helper()
+	if len(events) != len(excepted) {
+		t.Fatalf("excepted %d commands, got %d", len(excepted), len(events))
+	}
+	for idx, event := range events {
+		if event.Command != excepted[idx] {
+			t.Errorf("%d: excepted %q, got %q", idx, excepted[idx], event.Command)
+		}
+	}
+}
+
+func TestLineAuditorBackspace(t *testing.T) {
+	events := auditLines("$ ", "ls -x\x7fl\r",
+		"ls -l\r\n$ ", "cd /tmpp\x08\r\n")
+	assertCommands(t, events, "ls -l", "cd /tmp")
+}
+
+func TestLineAuditorArrowKeys(t *testing.T) {
+	// 左右键移动光标后插入， Home/End 键和 Delete 键
+	events := auditLines("$ ", "ls -l\x1b[D\x1b[Da\r",
+		"\r\n$ ", "cat b\x1b[Ha \x1b[Fc\x1bOD\x1b[3~\r")
+	assertCommands(t, events, "ls a-l", "a cat b")
+
+	// 上键取历史命令时从屏幕读取
+	events = auditLines("$ ", "\x1b[A",
+		"echo hello", "\r")
+	assertCommands(t, events, "echo hello")
+}
+
+func TestLineAuditorTab(t *testing.T) {
+	events := auditLines("$ ", "cat /et\t",
+		"cat /etc/", "pa\t",
+		"passwd ", "\r")
+	assertCommands(t, events, "cat /etc/passwd")
+
+	// 补全的命令较长而折行时， 从提示符开始的行读取
+	events = auditLines("$ ", "echo 0123\t",
+		"echo 0123456789012345678901234567890123456789", "\r")
+	assertCommands(t, events, "echo 0123456789012345678901234567890123456789")
+}
+
+func TestLineAuditorEditKeys(t *testing.T) {
+	// ^W 删除一个单词， ^U 删除光标前的内容， ^C 取消输入
+	events := auditLines("$ ", "x\x17y \x15z\r",
+		"\r\n$ ", "abc\x03",
+		"^C\r\n$ ", "\r")
+	assertCommands(t, events, "z")
+}
+
+func TestLineAuditorPassword(t *testing.T) {
+	events := auditLines("Password: ", "sec\xe4\xb8",
+		"", "\xadret\r")
+	if len(events) != 1 || !events[0].Hidden || "" != events[0].Command {
+		t.Errorf("excepted a hidden command, got %+v", events)
+	}
+}
+
+func TestLineAuditorAltScreen(t *testing.T) {
+	events := auditLines("$ \x1b[?1049h", ":wq\r",
+		"\x1b[?1049l$ ", "ls\r")
+	assertCommands(t, events, "ls")
+}
+
+func TestLineAuditorPolicy(t *testing.T) {
+	sess := &LiveSession{ID: "test", User: "admin", screen: vt.New(24, 40)}
+	var auditor lineAuditor
+
+	// 伪造成输入密码的提示符时也要检查规则
+	for _, prompt := range []string{"[root@h ~]# ", "\r\npassword: "} {
+		sess.screen.Write([]byte(prompt))
+		out, events, msgs := auditor.feed(sess, []byte("rm -rf /\r"))
+		if excepted := "rm -rf /" + killLine; excepted != string(out) {
+			t.Errorf("%q: excepted %q, got %q", prompt, excepted, out)
+		}
+		if len(msgs) != 1 || "block" != msgs[0].Action || "rm-root" != msgs[0].Rule {
+			t.Errorf("%q: excepted a block message, got %+v", prompt, msgs)
+		}
+		if len(events) != 1 || "block" != events[0].Action {
+			t.Errorf("%q: excepted a block event, got %+v", prompt, events)
+		}
+	}
+
+	// 输入密码时不记录输入的内容
+	sess.screen.Write([]byte("\r\npassword: "))
+	_, events, msgs := auditor.feed(sess, []byte("secret\r"))
+	if len(events) != 1 || !events[0].Hidden || "" != events[0].Command || len(msgs) != 0 {
+		t.Errorf("excepted a hidden command, got %+v, %+v", events, msgs)
+	}
+}
@@ -0,0 +1,386 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupVersion 是一个设备配置的版本
+type BackupVersion struct {
+	Hostname string    `json:"hostname"`
+	Version  string    `json:"version"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+}
+
+// BackupResult 是一次备份的结果， 配置没有变化时不会保存新的版本
+type BackupResult struct {
+	Hostname string         `json:"hostname"`
+	Changed  bool           `json:"changed"`
+	Version  *BackupVersion `json:"version,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+const backupVersionLayout = "20060102-150405"
+
+var backupHostPattern = regexp.MustCompile(`^[0-9A-Za-z_\-.:]+$`)
+
+func backupDir(hostname string) (string, error) {
+	if !backupHostPattern.MatchString(hostname) || strings.Contains(hostname, "..") {
+		return "", errors.New("hostname '" + hostname + "' is invalid")
+	}
+	return filepath.Join(LogDir, "backups", strings.Replace(hostname, ":", "_", -1)), nil
+}
+
+// stripVolatile 删除每次都会变化的行和行尾的空白
+func stripVolatile(text string, patterns []*regexp.Regexp) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		volatile := false
+		for _, re := range patterns {
+			if re.MatchString(line) {
+				volatile = true
+				break
+			}
+		}
+		if !volatile {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
+
+// backupDevice 登录设备， 关闭分页后执行设备类型的 show_config 命令 (或
+// task.Commands 中的第一个命令)， 删除易变的行后保存为一个新版本， user
+// 是执行备份的用户
+func backupDevice(task *DeviceTask, user string) *BackupResult {
+	result := &BackupResult{Hostname: task.Hostname}
+	dir, err := backupDir(task.Hostname)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var profile *Profile
+	if "" != task.Profile {
+		p, ok := profileFor(task.Profile)
+		if !ok {
+			result.Error = "profile '" + task.Profile + "' is not found"
+			return result
+		}
+		profile = p
+	}
+
+	copied := *task
+	copied.Script = nil
+	if len(copied.Commands) == 0 {
+		if nil == profile || "" == profile.ShowConfig {
+			result.Error = "command of backup is required"
+			return result
+		}
+		copied.Commands = []string{profile.ShowConfig}
+	} else {
+		copied.Commands = copied.Commands[:1]
+	}
+
+	dr := runOnDevice(&copied, user, nil)
+	if "ok" != dr.Status {
+		result.Error = dr.Error
+		return result
+	}
+	if len(dr.Commands) == 0 || (nil != dr.ExitStatus && 0 != *dr.ExitStatus) {
+		result.Error = "command of backup is failed"
+		return result
+	}
+
+	var volatile []*regexp.Regexp
+	if nil != profile {
+		volatile = profile.volatile
+	}
+	config := stripVolatile(dr.Commands[0].Output, volatile)
+
+	versions, err := listBackupVersions(task.Hostname)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(versions) > 0 {
+		latest, err := readBackup(task.Hostname, versions[len(versions)-1].Version)
+		if nil == err && latest == config {
+			result.Version = versions[len(versions)-1]
+			return result
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	now := time.Now()
+	version := now.Format(backupVersionLayout)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, version+".cfg")); os.IsNotExist(err) {
+			break
+		}
+		version = now.Format(backupVersionLayout) + "-" + strconv.Itoa(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, version+".cfg"), []byte(config), 0600); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Changed = true
+	result.Version = &BackupVersion{Hostname: task.Hostname, Version: version, Time: now, Size: int64(len(config))}
+	return result
+}
+
+// listBackupVersions 返回设备的所有版本， 按时间从旧到新排序
+func listBackupVersions(hostname string) ([]*BackupVersion, error) {
+	dir, err := backupDir(hostname)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var versions []*BackupVersion
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".cfg") {
+			continue
+		}
+		version := strings.TrimSuffix(fi.Name(), ".cfg")
+		t := fi.ModTime()
+		if len(version) >= len(backupVersionLayout) {
+			if parsed, err := time.ParseInLocation(backupVersionLayout, version[:len(backupVersionLayout)], time.Local); nil == err {
+				t = parsed
+			}
+		}
+		versions = append(versions, &BackupVersion{Hostname: hostname, Version: version, Time: t, Size: fi.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Time.Equal(versions[j].Time) {
+			return len(versions[i].Version) < len(versions[j].Version) ||
+				(len(versions[i].Version) == len(versions[j].Version) && versions[i].Version < versions[j].Version)
+		}
+		return versions[i].Time.Before(versions[j].Time)
+	})
+	return versions, nil
+}
+
+func readBackup(hostname, version string) (string, error) {
+	dir, err := backupDir(hostname)
+	if err != nil {
+		return "", err
+	}
+	if !batchIDPattern.MatchString(version) {
+		return "", errors.New("version '" + version + "' is invalid")
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, version+".cfg"))
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// resolveBackupVersion 返回版本名， 空字符串或 latest 是最新的版本， previous
+// 是倒数第二个版本
+func resolveBackupVersion(versions []*BackupVersion, version string) (string, bool) {
+	switch version {
+	case "", "latest":
+		if len(versions) > 0 {
+			return versions[len(versions)-1].Version, true
+		}
+		return "", false
+	case "previous":
+		if len(versions) > 1 {
+			return versions[len(versions)-2].Version, true
+		}
+		return "", false
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// RunBackup 立即备份设备的配置， POST /backups/run， 请求是 JSON 格式的
+// DeviceTask 或它的数组
+func RunBackup(w http.ResponseWriter, r *http.Request) {
+	if "POST" != r.Method {
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		return
+	}
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var tasks []*DeviceTask
+	if bs = bytes.TrimSpace(bs); len(bs) > 0 && '[' == bs[0] {
+		err = json.Unmarshal(bs, &tasks)
+	} else {
+		var task DeviceTask
+		err = json.Unmarshal(bs, &task)
+		tasks = append(tasks, &task)
+	}
+	if err != nil {
+		renderError(w, http.StatusBadRequest, "request is invalid, "+err.Error())
+		return
+	}
+
+	for _, task := range tasks {
+		if err := task.useCredential(currentUser(r), true); err != nil {
+			renderError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	results := make([]*BackupResult, len(tasks))
+	for idx, task := range tasks {
+		results[idx] = backupDevice(task, currentUser(r))
+	}
+	renderJSON(w, http.StatusOK, results)
+}
+
+// ListBackups 返回有备份的设备， GET /backups， 或者一个设备的所有版本，
+// GET /backups?hostname=xxx
+func ListBackups(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	if hostname := r.URL.Query().Get("hostname"); "" != hostname {
+		versions, err := listBackupVersions(hostname)
+		if err != nil {
+			renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if nil == versions {
+			versions = []*BackupVersion{}
+		}
+		renderJSON(w, http.StatusOK, versions)
+		return
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(LogDir, "backups"))
+	if err != nil && !os.IsNotExist(err) {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	devices := []*BackupVersion{}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		versions, err := listBackupVersions(fi.Name())
+		if nil == err && len(versions) > 0 {
+			devices = append(devices, versions[len(versions)-1])
+		}
+	}
+	renderJSON(w, http.StatusOK, devices)
+}
+
+// GetBackup 返回配置的内容， GET /backups/content?hostname=xxx&version=latest
+func GetBackup(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	hostname := r.URL.Query().Get("hostname")
+	versions, err := listBackupVersions(hostname)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	version, ok := resolveBackupVersion(versions, r.URL.Query().Get("version"))
+	if !ok {
+		renderError(w, http.StatusNotFound, "version is not found")
+		return
+	}
+	config, err := readBackup(hostname, version)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(config))
+}
+
+// maxDiffContext 是 diff 中上下文行数的上限
+const maxDiffContext = 1000
+
+// DiffBackups 比较两个版本， GET /backups/diff?hostname=xxx&from=previous&to=latest，
+// 返回 unified 格式的差异
+func DiffBackups(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	query := r.URL.Query()
+	hostname := query.Get("hostname")
+	versions, err := listBackupVersions(hostname)
+	if err != nil {
+		renderError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fromVersion := query.Get("from")
+	if "" == fromVersion {
+		fromVersion = "previous"
+	}
+	from, ok := resolveBackupVersion(versions, fromVersion)
+	if !ok {
+		renderError(w, http.StatusNotFound, "version '"+fromVersion+"' is not found")
+		return
+	}
+	to, ok := resolveBackupVersion(versions, query.Get("to"))
+	if !ok {
+		renderError(w, http.StatusNotFound, "version '"+query.Get("to")+"' is not found")
+		return
+	}
+
+	fromText, err := readBackup(hostname, from)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	toText, err := readBackup(hostname, to)
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	context := toInt(query.Get("context"), 3)
+	if context < 0 {
+		renderError(w, http.StatusBadRequest, "context '"+query.Get("context")+"' is invalid")
+		return
+	}
+	if context > maxDiffContext {
+		context = maxDiffContext
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(unifiedDiff(hostname+"/"+from, hostname+"/"+to, fromText, toText, context)))
+}
@@ -0,0 +1,355 @@
+package terminal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// BatchHost 是批量执行中的一台设备， 空的项使用 BatchJob 中的值， 在 JSON
+// 中可以简写为 "hostname" 或 "hostname:port"
+type BatchHost struct {
+	DeviceTask
+}
+
+func (h *BatchHost) UnmarshalJSON(bs []byte) error {
+	if len(bs) > 0 && bs[0] == '"' {
+		var s string
+		if err := json.Unmarshal(bs, &s); err != nil {
+			return err
+		}
+		if host, port, err := net.SplitHostPort(s); nil == err {
+			h.Hostname, h.Port = host, port
+		} else {
+			h.Hostname = s
+		}
+		return nil
+	}
+	return json.Unmarshal(bs, &h.DeviceTask)
+}
+
+// BatchJob 是在多台设备上执行同样的命令或脚本的任务
+type BatchJob struct {
+	DeviceTask
+	Hosts []*BatchHost `json:"hosts"`
+	// Concurrency 是同时执行的设备数， 缺省为 10
+	Concurrency int `json:"concurrency,omitempty"`
+	// Timeout 是每台设备的超时时间， 缺省为 5 分钟
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// BatchSummary 是批量执行结果的统计
+type BatchSummary struct {
+	Total   int `json:"total"`
+	OK      int `json:"ok"`
+	Failed  int `json:"failed"`
+	Timeout int `json:"timeout"`
+}
+
+// BatchReport 是批量执行的报告， 它保存在日志目录的 batch 子目录中
+type BatchReport struct {
+	ID       string          `json:"id"`
+	User     string          `json:"user,omitempty"`
+	StartAt  time.Time       `json:"start_at"`
+	Duration float64         `json:"duration"`
+	Summary  BatchSummary    `json:"summary"`
+	Results  []*DeviceResult `json:"results,omitempty"`
+}
+
+var batchIDPattern = regexp.MustCompile(`^[0-9A-Za-z_\-]+$`)
+
+func batchDir() string {
+	return filepath.Join(LogDir, "batch")
+}
+
+func newBatchID() string {
+	return time.Now().Format("20060102-150405") + "-" + strconv.Itoa(rand.Intn(1000000))
+}
+
+// tasks 返回每台设备的任务， 设备中空的项使用 job 中的值
+func (job *BatchJob) tasks() ([]*DeviceTask, error) {
+	if len(job.Hosts) == 0 {
+		return nil, errors.New("hosts is empty")
+	}
+	if len(job.Commands) == 0 && nil == job.Script {
+		return nil, errors.New("commands or script is required")
+	}
+	if nil != job.Script {
+		if err := job.Script.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	tasks := make([]*DeviceTask, 0, len(job.Hosts))
+	for _, host := range job.Hosts {
+		if "" == host.Hostname {
+			return nil, errors.New("hostname is required")
+		}
+		task := host.DeviceTask
+		or := func(value *string, defaultValue string) {
+			if "" == *value {
+				*value = defaultValue
+			}
+		}
+		or(&task.Protocol, job.Protocol)
+		or(&task.Port, job.Port)
+		or(&task.User, job.User)
+		or(&task.Password, job.Password)
+		or(&task.EnablePassword, job.EnablePassword)
+		or(&task.Profile, job.Profile)
+		or(&task.Charset, job.Charset)
+		or(&task.Credential, job.Credential)
+		task.Commands = job.Commands
+		task.Script = job.Script
+		task.Timeout = time.Duration(job.Timeout)
+		tasks = append(tasks, &task)
+	}
+	return tasks, nil
+}
+
+type batchEvent struct {
+	Event    string        `json:"event"`
+	ID       string        `json:"id,omitempty"`
+	Hostname string        `json:"hostname,omitempty"`
+	Data     string        `json:"data,omitempty"`
+	Result   *DeviceResult `json:"result,omitempty"`
+	Summary  *BatchSummary `json:"summary,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// eventWriter 将设备的输出作为 output 事件发送
+type eventWriter struct {
+	send     func(*batchEvent)
+	hostname string
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.send(&batchEvent{Event: "output", Hostname: w.hostname, Data: string(p)})
+	return len(p), nil
+}
+
+// runBatch 按 job.Concurrency 并发地在所有设备上执行任务
+func runBatch(job *BatchJob, user string, tasks []*DeviceTask, send func(*batchEvent)) []*DeviceResult {
+	concurrency := job.Concurrency
+	if concurrency <= 0 {
+		concurrency = 10
+	} else if concurrency > 100 {
+		concurrency = 100
+	}
+
+	results := make([]*DeviceResult, len(tasks))
+	semaphore := make(chan struct{}, concurrency)
+	var wait sync.WaitGroup
+	for idx, task := range tasks {
+		wait.Add(1)
+		semaphore <- struct{}{}
+		go func(idx int, task *DeviceTask) {
+			defer func() {
+				<-semaphore
+				wait.Done()
+			}()
+
+			send(&batchEvent{Event: "start", Hostname: task.Hostname})
+			result := runOnDevice(task, user, &eventWriter{send: send, hostname: task.Hostname})
+			results[idx] = result
+			send(&batchEvent{Event: "done", Hostname: task.Hostname, Result: result})
+		}(idx, task)
+	}
+	wait.Wait()
+	return results
+}
+
+func summarize(results []*DeviceResult) BatchSummary {
+	summary := BatchSummary{Total: len(results)}
+	for _, result := range results {
+		switch result.Status {
+		case "ok":
+			summary.OK++
+		case "timeout":
+			summary.Timeout++
+		default:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// Batch 在多台设备上执行命令或脚本， 任务 (BatchJob) 是参数 job 或者
+// websocket 上的第一个消息， 执行的过程以 JSON 格式的事件发送， 最后是
+// report 事件， 报告可以通过 /batch/report?id=xxx 获取
+func Batch(ws *websocket.Conn) {
+	defer ws.Close()
+
+	var lock sync.Mutex
+	send := func(event *batchEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := websocket.JSON.Send(ws, event); err != nil {
+			log.Println("send batch event fail,", err)
+		}
+	}
+
+	text := ws.Request().URL.Query().Get("job")
+	if "" == text {
+		if err := websocket.Message.Receive(ws, &text); err != nil {
+			send(&batchEvent{Event: "error", Error: "read job fail, " + err.Error()})
+			return
+		}
+	}
+	var job BatchJob
+	if err := json.Unmarshal([]byte(text), &job); err != nil {
+		send(&batchEvent{Event: "error", Error: "job is invalid, " + err.Error()})
+		return
+	}
+	tasks, err := job.tasks()
+	if err != nil {
+		send(&batchEvent{Event: "error", Error: err.Error()})
+		return
+	}
+	for _, task := range tasks {
+		if err := task.useCredential(currentUser(ws.Request()), isAdmin(ws.Request())); err != nil {
+			send(&batchEvent{Event: "error", Error: err.Error()})
+			return
+		}
+	}
+
+	report := &BatchReport{ID: newBatchID(), User: currentUser(ws.Request()), StartAt: time.Now()}
+	send(&batchEvent{Event: "job", ID: report.ID})
+	report.Results = runBatch(&job, report.User, tasks, send)
+	report.Duration = toMillisecond(time.Since(report.StartAt))
+	report.Summary = summarize(report.Results)
+
+	event := &batchEvent{Event: "report", ID: report.ID, Summary: &report.Summary}
+	if err := saveBatchReport(report); err != nil {
+		log.Println(err)
+		event.Error = err.Error()
+	}
+	send(event)
+}
+
+func saveBatchReport(report *BatchReport) error {
+	dir := batchDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("save report fail, " + err.Error())
+	}
+
+	bs, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.New("save report fail, " + err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, report.ID+".json"), bs, 0644); err != nil {
+		return errors.New("save report fail, " + err.Error())
+	}
+
+	f, err := os.Create(filepath.Join(dir, report.ID+".csv"))
+	if err != nil {
+		return errors.New("save report fail, " + err.Error())
+	}
+	defer f.Close()
+	return writeBatchCSV(f, report)
+}
+
+func writeBatchCSV(out io.Writer, report *BatchReport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"hostname", "port", "protocol", "status", "exit_status", "start_at", "duration_ms", "error", "output"})
+	for _, result := range report.Results {
+		exitStatus := ""
+		if nil != result.ExitStatus {
+			exitStatus = strconv.Itoa(*result.ExitStatus)
+		}
+		w.Write([]string{result.Hostname, result.Port, result.Protocol, result.Status, exitStatus,
+			result.StartAt.Format(time.RFC3339), strconv.FormatFloat(result.Duration, 'f', 3, 64),
+			result.Error, result.Output})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// ListBatchReports 返回所有的批量执行报告 (不包含每台设备的结果)，
+// GET /batch/reports
+func ListBatchReports(w http.ResponseWriter, r *http.Request) {
+	files, err := filepath.Glob(filepath.Join(batchDir(), "*.json"))
+	if err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	user := currentUser(r)
+	admin := isAdmin(r)
+	reports := []*BatchReport{}
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var report BatchReport
+		if err := json.Unmarshal(bs, &report); err != nil {
+			continue
+		}
+		if !admin && report.User != user {
+			continue
+		}
+		report.Results = nil
+		reports = append(reports, &report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].StartAt.After(reports[j].StartAt)
+	})
+	renderJSON(w, http.StatusOK, reports)
+}
+
+// GetBatchReport 返回批量执行的报告， GET /batch/report?id=xxx&format=csv，
+// format 可以是 json (缺省) 或 csv
+func GetBatchReport(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !batchIDPattern.MatchString(id) {
+		renderError(w, http.StatusBadRequest, "'id' is invalid")
+		return
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(batchDir(), id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			renderError(w, http.StatusNotFound, "report '"+id+"' is not found")
+			return
+		}
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var report BatchReport
+	if err := json.Unmarshal(bs, &report); err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !isAdmin(r) && report.User != currentUser(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(bs)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename="+id+".csv")
+		http.ServeFile(w, r, filepath.Join(batchDir(), id+".csv"))
+	default:
+		renderError(w, http.StatusBadRequest, "format '"+format+"' is unsupported")
+	}
+}
@@ -0,0 +1,471 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Duration is a time.Duration which is written as "10s" or as seconds in
+// the configuration files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	if len(bs) > 0 && bs[0] == '"' {
+		var s string
+		if err := json.Unmarshal(bs, &s); err != nil {
+			return err
+		}
+		if "" == s {
+			*d = 0
+			return nil
+		}
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+		return nil
+	}
+
+	seconds, err := strconv.ParseFloat(string(bs), 64)
+	if err != nil {
+		return errors.New("'" + string(bs) + "' is an invalid duration")
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Command 是信任列表中的一个命令
+type Command struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	// Flags lists the allowed options, an empty list allows any option.
+	Flags []string `json:"flags,omitempty"`
+	// Patterns are the regexps which every argument that isn't an option
+	// (including the values of options) must match entirely, an empty list
+	// allows any argument.
+	Patterns []string `json:"patterns,omitempty"`
+	// DefaultArgs are inserted before the arguments of the request unless
+	// the first element of the group is already present, "${mibs_dir}" and
+	// "${executable_folder}" are expanded.
+	DefaultArgs [][]string `json:"default_args,omitempty"`
+
+	Timeout Duration `json:"timeout,omitempty"`
+	Charset string   `json:"charset,omitempty"`
+	PTY     bool     `json:"pty,omitempty"`
+	// Users lists who may run the command, an empty list allows anyone.
+	Users   []string `json:"users,omitempty"`
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+func (c *Command) init() error {
+	c.patterns = nil
+	for _, s := range c.Patterns {
+		// 模式必须匹配整个参数， 否则 [0-9.]+ 也接受 1.1.1.1;rm
+		re, err := regexp.Compile("^(?:" + s + ")$")
+		if err != nil {
+			return errors.New("pattern '" + s + "' of command '" + c.Name + "' is invalid, " + err.Error())
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	return nil
+}
+
+// IsAllowed 判断用户是否可以运行该命令
+func (c *Command) IsAllowed(user string) bool {
+	if len(c.Users) == 0 {
+		return true
+	}
+	for _, u := range c.Users {
+		if u == user || "*" == u {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Command) isFlagAllowed(arg string) bool {
+	if len(c.Flags) == 0 {
+		return true
+	}
+	for _, f := range c.Flags {
+		if arg == f {
+			return true
+		}
+		if strings.HasPrefix(arg, f) && (strings.HasSuffix(f, "=") || arg[len(f)] == '=') {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the arguments of a request.
+func (c *Command) Validate(args []string) error {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			if !c.isFlagAllowed(arg) {
+				return errors.New("参数 '" + arg + "' 不在 '" + c.Name + "' 的允许列表中")
+			}
+			continue
+		}
+
+		if len(c.patterns) == 0 {
+			continue
+		}
+		matched := false
+		for _, re := range c.patterns {
+			if re.MatchString(arg) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.New("参数 '" + arg + "' 不符合 '" + c.Name + "' 的格式要求")
+		}
+	}
+	return nil
+}
+
+func expandVariables(s string) string {
+	return strings.NewReplacer("${mibs_dir}", *mibs_dir,
+		"${executable_folder}", ExecutableFolder).Replace(s)
+}
+
+// ExpandArgs inserts the default arguments.
+func (c *Command) ExpandArgs(args []string) []string {
+	var defaults []string
+	for _, group := range c.DefaultArgs {
+		if len(group) == 0 {
+			continue
+		}
+
+		exists := false
+		for _, arg := range args {
+			if arg == group[0] {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		expanded := make([]string, 0, len(group))
+		for _, s := range group {
+			s = expandVariables(s)
+			if "" == s {
+				break
+			}
+			expanded = append(expanded, s)
+		}
+		if len(expanded) == len(group) {
+			defaults = append(defaults, expanded...)
+		}
+	}
+	if len(defaults) == 0 {
+		return args
+	}
+	return append(defaults, args...)
+}
+
+// CommandRegistry 是信任列表， 它可以在运行时重新加载
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]*Command
+}
+
+func (r *CommandRegistry) Get(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.commands[name]
+	return c, ok
+}
+
+// All returns the commands sorted by name.
+func (r *CommandRegistry) All() []*Command {
+	r.mu.RLock()
+	commands := make([]*Command, 0, len(r.commands))
+	for _, c := range r.commands {
+		commands = append(commands, c)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+func (r *CommandRegistry) Replace(commands map[string]*Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = commands
+}
+
+func setCommand(commands map[string]*Command, name, pa string) *Command {
+	c := &Command{Name: name, Path: pa}
+	commands[name] = c
+	return c
+}
+
+func lookupCommand(name string) (*Command, bool) {
+	if c, ok := Commands.Get(name); ok {
+		return c, true
+	}
+	if strings.HasPrefix(name, "runtime_env/") {
+		return Commands.Get(strings.TrimPrefix(name, "runtime_env/"))
+	}
+	return nil, false
+}
+
+// configLock 保护 sandbox、 translations、 profiles、 templates、 targets、
+// command_policy 和 login 的配置， 重新加载时它们在同一个锁内一起替换
+var configLock sync.RWMutex
+
+// reloadLock 保证同一时间只有一个 ReloadCommands 在执行
+var reloadLock sync.Mutex
+
+// ReloadCommands 重新加载信任列表， sandbox.json、 translations.json、
+// profiles.json、 templates.json、 targets.json、 command_policy.json 和
+// login.json， 所有文件都解析成功后才一起替换， 任何一个文件出错时保留
+// 原来的配置， 文件不存在时恢复为内置的配置
+func ReloadCommands() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	sandboxFile := searchConfFile(ExecutableFolder, "sandbox.json")
+	defaultSandbox, sandboxes, err := readSandboxes(sandboxFile)
+	if err != nil {
+		return err
+	}
+
+	translationFile := searchConfFile(ExecutableFolder, "translations.json")
+	translationRules, err := readTranslations(translationFile)
+	if err != nil {
+		return err
+	}
+
+	profileFile := searchConfFile(ExecutableFolder, "profiles.json")
+	profileList, err := readProfiles(profileFile)
+	if err != nil {
+		return err
+	}
+
+	templateFile := searchConfFile(ExecutableFolder, "templates.json")
+	templateList, err := readTemplates(templateFile)
+	if err != nil {
+		return err
+	}
+
+	targetFile := searchConfFile(ExecutableFolder, "targets.json")
+	targets, err := readTargetPolicy(targetFile)
+	if err != nil {
+		return err
+	}
+
+	policyFile := searchConfFile(ExecutableFolder, "command_policy.json")
+	policy, err := readCommandPolicy(policyFile)
+	if err != nil {
+		return err
+	}
+
+	loginFile := searchConfFile(ExecutableFolder, "login.json")
+	loginPrompts, err := readLoginPrompts(loginFile)
+	if err != nil {
+		return err
+	}
+
+	commands := loadCommands(ExecutableFolder)
+	commandList := searchConfFile(ExecutableFolder, "commands.list")
+	if commandList != "" {
+		if err := loadCommandList(commands, commandList); err != nil {
+			return errors.New("load '" + commandList + "' fail," + err.Error())
+		}
+	}
+
+	commandFile := searchConfFile(ExecutableFolder, "commands.json")
+	if commandFile != "" {
+		if err := loadCommandFile(commands, ExecutableFolder, commandFile); err != nil {
+			return err
+		}
+	}
+
+	configLock.Lock()
+	DefaultSandbox, Sandboxes = defaultSandbox, sandboxes
+	translations = translationRules
+	profiles = profileList
+	templates = templateList
+	targetPolicy = targets
+	commandPolicy = policy
+	DefaultLoginPrompts = loginPrompts
+	configLock.Unlock()
+	Commands.Replace(commands)
+
+	for _, file := range []string{sandboxFile, translationFile, profileFile,
+		templateFile, targetFile, policyFile, loginFile, commandFile} {
+		if "" != file {
+			log.Println("load '" + file + "' ok")
+		}
+	}
+	if "" != commandList {
+		log.Println("load '" + commandList + "' ok, it is deprecated, please use commands.json")
+	}
+	return nil
+}
+
+func reloadCommandsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := ReloadCommands(); err != nil {
+			log.Println("reload commands fail,", err)
+		} else {
+			log.Println("reload commands ok")
+		}
+	}
+}
+
+type commandInfo struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+// ListCommands 返回信任列表， 及命令的文件是否存在
+func ListCommands(w http.ResponseWriter, r *http.Request) {
+	if "GET" != r.Method {
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		return
+	}
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	var results []commandInfo
+	for _, c := range Commands.All() {
+		info := commandInfo{Name: c.Name, Path: c.Path}
+		if pa, err := exec.LookPath(c.Path); nil == err {
+			info.Path = abs(pa)
+			info.Exists = true
+		}
+		results = append(results, info)
+	}
+	renderJSON(w, http.StatusOK, results)
+}
+
+// ReloadCommandsHandler 是重新加载信任列表的管理接口
+func ReloadCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	if "POST" != r.Method {
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		return
+	}
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	if err := ReloadCommands(); err != nil {
+		renderError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	renderJSON(w, http.StatusOK, map[string]interface{}{"count": len(Commands.All())})
+}
+
+// loadCommandFile 读取 commands.json， 文件中的命令会覆盖同名的内置命令
+func loadCommandFile(commands map[string]*Command, executableFolder, file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.New("load '" + file + "' fail," + err.Error())
+	}
+
+	var list []*Command
+	if err := json.Unmarshal(bs, &list); err != nil {
+		return errors.New("load '" + file + "' fail," + err.Error())
+	}
+
+	for _, c := range list {
+		if "" == c.Name {
+			return errors.New("load '" + file + "' fail, name of command is missing")
+		}
+		if err := c.init(); err != nil {
+			return errors.New("load '" + file + "' fail," + err.Error())
+		}
+
+		if "" == c.Path {
+			if old, ok := commands[c.Name]; ok {
+				c.Path = old.Path
+			} else if pa, ok := lookPath(executableFolder, c.Name); ok {
+				c.Path = pa
+			} else {
+				c.Path = c.Name
+			}
+		} else {
+			c.Path = expandVariables(c.Path)
+		}
+		commands[c.Name] = c
+	}
+	return nil
+}
+
+// loadCommandList 读取旧的 commands.list， 每行的格式为 name=path
+func loadCommandList(commands map[string]*Command, file string) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.New("load '" + file + "' fail," + err.Error())
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		idx := bytes.IndexByte(line, '=')
+		if idx < 0 {
+			setCommand(commands, string(line), string(line))
+			continue
+		}
+
+		name := bytes.TrimSpace(line[:idx])
+		value := bytes.TrimSpace(line[idx+1:])
+
+		if len(name) == 0 {
+			if len(value) == 0 {
+				continue
+			}
+			setCommand(commands, string(value), string(value))
+			continue
+		}
+
+		if len(value) == 0 {
+			setCommand(commands, string(name), string(name))
+			continue
+		}
+
+		setCommand(commands, string(name), string(value))
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,158 @@
+package terminal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandValidate(t *testing.T) {
+	c := &Command{Name: "ping",
+		Flags:    []string{"-c", "-w", "--size="},
+		Patterns: []string{`[0-9.]+`, `[a-z][a-z0-9.-]*`}}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"1.1.1.1"},
+		{"-c", "4", "example.com"},
+		{"-c=4", "--size=10", "1.1.1.1"},
+	} {
+		if err := c.Validate(args); err != nil {
+			t.Errorf("%q: %v", args, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-x", "1.1.1.1"},
+		{"--evil=1"},
+		{"-cx"},
+		// 模式必须匹配整个参数
+		{"1.1.1.1;reboot"},
+		{"host name"},
+		{"a`id`"},
+		{"HOST"},
+	} {
+		if err := c.Validate(args); nil == err {
+			t.Errorf("%q: excepted error, got ok", args)
+		}
+	}
+
+	c = &Command{Name: "any", Patterns: []string{`(`}}
+	if err := c.init(); nil == err {
+		t.Error("excepted error for an invalid pattern, got ok")
+	}
+}
+
+func TestCommandIsAllowed(t *testing.T) {
+	if !(&Command{}).IsAllowed("") {
+		t.Error("a command without users must be allowed for anyone")
+	}
+	c := &Command{Users: []string{"alice"}}
+	if !c.IsAllowed("alice") || c.IsAllowed("bob") || c.IsAllowed("") {
+		t.Error("only alice is allowed")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	oldHeader, oldAdmins := *user_header, *admin_users
+	defer func() { *user_header, *admin_users = oldHeader, oldAdmins }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "root")
+	r.SetBasicAuth("root", "x")
+
+	*user_header, *admin_users = "", "root"
+	if isAdmin(r) {
+		t.Error("basic auth must not be trusted without user_header")
+	}
+
+	*user_header = "X-User"
+	if !isAdmin(r) {
+		t.Error("root is an admin")
+	}
+	r.Header.Set("X-User", "bob")
+	if isAdmin(r) {
+		t.Error("bob isn't an admin")
+	}
+
+	*admin_users = ""
+	r.Header.Set("X-User", "")
+	if isAdmin(r) {
+		t.Error("nobody is an admin if admin_users is empty")
+	}
+}
+
+func TestReloadCommands(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "conf")
+	if err := os.MkdirAll(conf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := ExecutableFolder
+	ExecutableFolder = filepath.Join(dir, "bin")
+	defer func() {
+		ExecutableFolder = old
+		if err := ReloadCommands(); err != nil {
+			t.Error(err)
+		}
+	}()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(conf, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("targets.json", `{"default": "allow"}`)
+	write("login.json", `{"prompt": ["\\$ $"]}`)
+	if err := ReloadCommands(); err != nil {
+		t.Fatal(err)
+	}
+	if nil == targetPolicy || "\\$ $" != defaultLoginPrompts().Prompt[0] {
+		t.Fatalf("excepted targets.json and login.json are loaded, got %+v, %+v", targetPolicy, defaultLoginPrompts())
+	}
+
+	// 任何一个文件出错时保留原来的配置
+	write("templates.json", `bad`)
+	os.Remove(filepath.Join(conf, "targets.json"))
+	os.Remove(filepath.Join(conf, "login.json"))
+	if err := ReloadCommands(); nil == err {
+		t.Fatal("excepted error, got ok")
+	}
+	if nil == targetPolicy || "\\$ $" != defaultLoginPrompts().Prompt[0] {
+		t.Error("the configuration is changed partially")
+	}
+
+	// 文件不存在时恢复为内置的配置
+	os.Remove(filepath.Join(conf, "templates.json"))
+	if err := ReloadCommands(); err != nil {
+		t.Fatal(err)
+	}
+	if nil != targetPolicy || builtinLoginPrompts != defaultLoginPrompts() {
+		t.Errorf("excepted the builtin configuration, got %+v, %+v", targetPolicy, defaultLoginPrompts())
+	}
+
+	write("login.json", `{"prompt": ["("]}`)
+	if err := ReloadCommands(); nil == err {
+		t.Error("excepted error for an invalid login prompt, got ok")
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	oldHeader, oldAdmins := *user_header, *admin_users
+	defer func() { *user_header, *admin_users = oldHeader, oldAdmins }()
+	*user_header, *admin_users = "X-User", "root"
+
+	for user, excepted := range map[string]int{"root": http.StatusOK, "bob": http.StatusForbidden, "": http.StatusForbidden} {
+		r := httptest.NewRequest("GET", "/commands", nil)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		ListCommands(w, r)
+		if excepted != w.Code {
+			t.Errorf("%q: excepted %d, got %d", user, excepted, w.Code)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package terminal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/web-terminal/expect"
+	"golang.org/x/crypto/ssh"
+)
+
+// DeviceTask 是在一台设备上执行的命令或脚本
+type DeviceTask struct {
+	Protocol       string `json:"protocol,omitempty"`
+	Hostname       string `json:"hostname"`
+	Port           string `json:"port,omitempty"`
+	User           string `json:"user,omitempty"`
+	Password       string `json:"password,omitempty"`
+	EnablePassword string `json:"enable_password,omitempty"`
+	Profile        string `json:"profile,omitempty"`
+	Charset        string `json:"charset,omitempty"`
+	// Credential 是凭据库中凭据的 ID， 执行时用它替换用户名和密码
+	Credential string `json:"credential,omitempty"`
+
+	Commands []string       `json:"commands,omitempty"`
+	Script   *expect.Script `json:"script,omitempty"`
+	Timeout  time.Duration  `json:"-"`
+
+	privateKey string
+	passphrase string
+}
+
+// CommandResult 是一个命令的输出， ExitStatus 只有 ssh 非交互执行时才有
+type CommandResult struct {
+	Command    string `json:"command"`
+	Output     string `json:"output"`
+	ExitStatus *int   `json:"exit_status,omitempty"`
+}
+
+// DeviceResult 是在一台设备上执行的结果
+type DeviceResult struct {
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	Protocol string `json:"protocol"`
+	// Status 是 ok、 failed 或 timeout
+	Status     string            `json:"status"`
+	ExitStatus *int              `json:"exit_status,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Output     string            `json:"output"`
+	Commands   []CommandResult   `json:"commands,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+	StartAt    time.Time         `json:"start_at"`
+	Duration   float64           `json:"duration"`
+}
+
+func (task *DeviceTask) params() url.Values {
+	params := url.Values{}
+	set := func(key, value string) {
+		if "" != value {
+			params.Set(key, value)
+		}
+	}
+	set("protocol", task.Protocol)
+	set("hostname", task.Hostname)
+	set("port", task.Port)
+	set("user", task.User)
+	set("password", task.Password)
+	set("enable_password", task.EnablePassword)
+	set("profile", task.Profile)
+	set("charset", task.Charset)
+	set("private_key", task.privateKey)
+	set("passphrase", task.passphrase)
+	return params
+}
+
+// lockedBuffer 是一个并发安全的 bytes.Buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runOnDevice 以用户 user 的身份在设备上执行命令或脚本， 终端的输出同时写
+// 到 output 中 (可以为 nil)。 没有脚本和设备类型的 ssh 任务用 exec 执行每
+// 一个命令， 其它的任务在交互式的终端中执行， 命令的输出是命令和下一个提示
+// 符之间的文本
+func runOnDevice(task *DeviceTask, user string, output io.Writer) *DeviceResult {
+	protocol := task.Protocol
+	if "" == protocol {
+		protocol = "ssh"
+	}
+	port := task.Port
+	if "" == port {
+		port = "22"
+		if "telnet" == protocol {
+			port = "23"
+		}
+	}
+	timeout := task.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+
+	result := &DeviceResult{Hostname: task.Hostname, Port: port, Protocol: protocol, StartAt: time.Now()}
+	transcript := &lockedBuffer{}
+	var w io.Writer = transcript
+	if nil != output {
+		w = io.MultiWriter(transcript, output)
+	}
+
+	var err error
+	switch {
+	case "ssh" != protocol && "telnet" != protocol:
+		err = errors.New("protocol '" + protocol + "' is unsupported")
+	case "" != task.Charset && nil == GetCharset(task.Charset):
+		err = errors.New("charset '" + task.Charset + "' is not exists.")
+	case "ssh" == protocol && nil == task.Script && "" == task.Profile && "" == task.EnablePassword:
+		var address string
+		if address, err = checkTarget("ssh", user, "", task.Hostname, port); nil == err {
+			err = execOnSSH(task, address, timeout, w, result)
+		}
+	default:
+		err = execOnTerminal(task, user, timeout, w, result)
+	}
+
+	elapsed := time.Since(result.StartAt)
+	result.Output = transcript.String()
+	result.Duration = toMillisecond(elapsed)
+	switch {
+	case nil != err && elapsed >= timeout:
+		result.Status = "timeout"
+		result.Error = "timeout after " + timeout.String()
+	case nil != err:
+		result.Status = "failed"
+		result.Error = err.Error()
+	default:
+		result.Status = "ok"
+	}
+	return result
+}
+
+func execOnSSH(task *DeviceTask, address string, timeout time.Duration, output io.Writer, result *DeviceResult) error {
+	signers, err := privateKeySigners(task.privateKey, task.passphrase)
+	if err != nil {
+		return err
+	}
+	client, err := dialSSH(address, task.User, task.Password, signers...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	timer := time.AfterFunc(timeout, func() {
+		client.Close()
+	})
+	defer timer.Stop()
+
+	for _, command := range task.Commands {
+		session, err := client.NewSession()
+		if err != nil {
+			return errors.New("Failed to create session: " + err.Error())
+		}
+
+		var buf bytes.Buffer
+		w := io.MultiWriter(&buf, output)
+		if "" != task.Charset {
+			w = decodeBy(task.Charset, w)
+		}
+		session.Stdout = w
+		session.Stderr = w
+		err = session.Run(command)
+		session.Close()
+
+		status := 0
+		if err != nil {
+			exitErr, ok := err.(*ssh.ExitError)
+			if !ok {
+				return err
+			}
+			status = exitErr.ExitStatus()
+		}
+		result.Commands = append(result.Commands, CommandResult{Command: command, Output: buf.String(), ExitStatus: &status})
+		result.ExitStatus = &status
+	}
+	return nil
+}
+
+func execOnTerminal(task *DeviceTask, user string, timeout time.Duration, output io.Writer, result *DeviceResult) error {
+	params := task.params()
+	opts, err := loginOptions(params)
+	if err != nil {
+		return err
+	}
+	conn, err := dialTerminal(params, user)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timer := time.AfterFunc(timeout, func() {
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	sess := expect.New(conn, conn, output)
+	defer sess.Close()
+	isTelnet := "telnet" == task.Protocol
+	if nil != task.Script {
+		if opts.needsPrepare(isTelnet) {
+			if err := prepareSession(sess, opts, isTelnet); err != nil {
+				return err
+			}
+		}
+		result.Vars, err = task.Script.Run(sess)
+		return err
+	}
+
+	if err := prepareSession(sess, opts, isTelnet); err != nil {
+		return err
+	}
+	prompts, err := opts.Prompts.compile()
+	if err != nil {
+		return err
+	}
+	prompts = prompts.only("prompt")
+	for _, command := range task.Commands {
+		if err := sess.Sendln(command); err != nil {
+			return err
+		}
+		m, err := sess.Expect(timeout, prompts.patterns...)
+		if err != nil {
+			return err
+		}
+		result.Commands = append(result.Commands, CommandResult{Command: command, Output: commandOutput(m.Before, command)})
+	}
+	return nil
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]|\x1b[()][AB012]|[\x08]`)
+
+// commandOutput 删除回显的命令、 终端控制字符和最后一行不完整的提示符
+func commandOutput(text, command string) string {
+	text = ansiEscape.ReplaceAllString(text, "")
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "", -1)
+	if idx := strings.IndexByte(text, '\n'); idx >= 0 && strings.Contains(text[:idx], strings.TrimSpace(command)) {
+		text = text[idx+1:]
+	}
+	if idx := strings.LastIndexByte(text, '\n'); idx >= 0 {
+		text = text[:idx+1]
+	}
+	return text
+}
@@ -0,0 +1,170 @@
+package terminal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxDiffCells 限制 LCS 表的大小， 超过时中间不同的部分整体作为删除和添加
+const maxDiffCells = 16 * 1024 * 1024
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines 用最长公共子序列比较两组文本行
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, s := range a[:prefix] {
+		lines = append(lines, diffLine{' ', s})
+	}
+
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(x)*len(y) > maxDiffCells {
+		for _, s := range x {
+			lines = append(lines, diffLine{'-', s})
+		}
+		for _, s := range y {
+			lines = append(lines, diffLine{'+', s})
+		}
+	} else {
+		// table[i][j] 是 x[i:] 和 y[j:] 的最长公共子序列的长度
+		width := len(y) + 1
+		table := make([]int32, (len(x)+1)*width)
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					table[i*width+j] = table[(i+1)*width+j+1] + 1
+				} else if table[(i+1)*width+j] >= table[i*width+j+1] {
+					table[i*width+j] = table[(i+1)*width+j]
+				} else {
+					table[i*width+j] = table[i*width+j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(x) && j < len(y) {
+			switch {
+			case x[i] == y[j]:
+				lines = append(lines, diffLine{' ', x[i]})
+				i++
+				j++
+			case table[(i+1)*width+j] >= table[i*width+j+1]:
+				lines = append(lines, diffLine{'-', x[i]})
+				i++
+			default:
+				lines = append(lines, diffLine{'+', y[j]})
+				j++
+			}
+		}
+		for ; i < len(x); i++ {
+			lines = append(lines, diffLine{'-', x[i]})
+		}
+		for ; j < len(y); j++ {
+			lines = append(lines, diffLine{'+', y[j]})
+		}
+	}
+
+	for _, s := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', s})
+	}
+	return lines
+}
+
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if "" == text {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// unifiedDiff 返回 unified 格式的差异， 没有差异时返回空字符串
+func unifiedDiff(fromName, toName, from, to string, context int) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	var buf strings.Builder
+	for start := 0; start < len(lines); {
+		// 找到下一个变化
+		for start < len(lines) && ' ' == lines[start].op {
+			start++
+		}
+		if start >= len(lines) {
+			break
+		}
+
+		// 合并间隔不超过 2*context 的变化
+		begin := start - context
+		if begin < 0 {
+			begin = 0
+		}
+		end := start
+		for end < len(lines) {
+			if ' ' != lines[end].op {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && ' ' == lines[next].op {
+				next++
+			}
+			if next >= len(lines) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		if 0 == buf.Len() {
+			buf.WriteString("--- " + fromName + "\n+++ " + toName + "\n")
+		}
+
+		fromLine, toLine := 1, 1
+		for _, l := range lines[:begin] {
+			if '+' != l.op {
+				fromLine++
+			}
+			if '-' != l.op {
+				toLine++
+			}
+		}
+		fromCount, toCount := 0, 0
+		for _, l := range lines[begin:stop] {
+			if '+' != l.op {
+				fromCount++
+			}
+			if '-' != l.op {
+				toCount++
+			}
+		}
+		if 0 == fromCount {
+			fromLine--
+		}
+		if 0 == toCount {
+			toLine--
+		}
+		buf.WriteString("@@ -" + strconv.Itoa(fromLine) + "," + strconv.Itoa(fromCount) +
+			" +" + strconv.Itoa(toLine) + "," + strconv.Itoa(toCount) + " @@\n")
+		for _, l := range lines[begin:stop] {
+			buf.WriteByte(l.op)
+			buf.WriteString(l.text)
+			buf.WriteByte('\n')
+		}
+		start = stop
+	}
+	return buf.String()
+}
@@ -0,0 +1,253 @@
+// Package expect 是一个类似 expect 的自动化引擎， 它只依赖 io.Reader 和
+// io.Writer， 因此可以用于 ssh 会话、 telnet 连接和本地的伪终端。
+package expect
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by Expect if no pattern is matched in time.
+var ErrTimeout = errors.New("expect: timeout")
+
+// ErrClosed is returned by Sleep if the session is closed.
+var ErrClosed = errors.New("expect: session is closed")
+
+// MaxBufferSize is the size of the unmatched output which is kept for
+// matching, the older output is dropped.
+const MaxBufferSize = 64 * 1024
+
+// Match is the result of Expect.
+type Match struct {
+	// Index is the index of the matched pattern.
+	Index int
+	// Groups are the submatches, Groups[0] is the whole match.
+	Groups []string
+	// Before is the output before the match.
+	Before string
+}
+
+// Session 是一个终端会话
+type Session struct {
+	w      io.Writer
+	output chan chunk
+	done   chan struct{}
+	once   sync.Once
+
+	mu         sync.Mutex
+	transcript io.Writer
+	err        error
+
+	buf        []byte
+	pending    []byte
+	responders []Responder
+}
+
+// Responder 在 Expect 时自动应答匹配的输出， 匹配的文本会从输出中删除，
+// 例如分页提示符 "--More--"
+type Responder struct {
+	Pattern *regexp.Regexp
+	Send    string
+}
+
+type chunk struct {
+	data        []byte
+	transcribed bool
+}
+
+// New 创建一个会话， r 是终端的输出， w 是终端的输入。 r 的内容会被同时
+// 复制到 transcript 中， transcript 可以为 nil
+func New(r io.Reader, w io.Writer, transcript io.Writer) *Session {
+	s := &Session{w: w, output: make(chan chunk, 16), done: make(chan struct{}), transcript: transcript}
+	go s.read(r)
+	return s
+}
+
+func (s *Session) read(r io.Reader) {
+	defer close(s.output)
+	for {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			transcribed := nil != s.transcript
+			if transcribed {
+				s.transcript.Write(buf[:n])
+			}
+			s.mu.Unlock()
+			select {
+			case s.output <- chunk{data: buf[:n], transcribed: transcribed}:
+			case <-s.done:
+				return
+			}
+		}
+		if nil != err {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close 停止读取终端的输出， 它不关闭终端， 读取的 goroutine 在终端关闭
+// 后退出。 会话不再使用时必须调用它， 否则没有人读取输出时 goroutine 会
+// 一直阻塞
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// Sleep 等待 d， 会话被 Close 时立即返回 ErrClosed
+func (s *Session) Sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.done:
+		return ErrClosed
+	}
+}
+
+// SetTranscript 修改输出的副本
+func (s *Session) SetTranscript(transcript io.Writer) {
+	s.mu.Lock()
+	s.transcript = transcript
+	s.mu.Unlock()
+}
+
+// Read 读取终端的输出， 已经写入 transcript 的输出会被跳过。 它用于在
+// SetTranscript(nil) 之后将终端交给其他的代码， 例如自动登录之后
+func (s *Session) Read(p []byte) (int, error) {
+	for 0 == len(s.pending) {
+		c, ok := <-s.output
+		if !ok {
+			return 0, s.readErr()
+		}
+		if !c.transcribed {
+			s.pending = c.data
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *Session) readErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nil == s.err {
+		return io.EOF
+	}
+	return s.err
+}
+
+// Send 发送文本
+func (s *Session) Send(text string) error {
+	_, err := io.WriteString(s.w, text)
+	return err
+}
+
+// Sendln 发送文本和一个回车
+func (s *Session) Sendln(text string) error {
+	return s.Send(text + "\r")
+}
+
+// AddResponder 添加一个自动应答
+func (s *Session) AddResponder(pattern *regexp.Regexp, send string) {
+	s.responders = append(s.responders, Responder{Pattern: pattern, Send: send})
+}
+
+// Buffered returns the output which isn't consumed by Expect.
+func (s *Session) Buffered() string {
+	return string(s.buf)
+}
+
+// Expect 等待输出匹配任意一个模式， 多个模式都匹配时返回位置最靠前的那个
+func (s *Session) Expect(timeout time.Duration, patterns ...*regexp.Regexp) (*Match, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	for {
+		if responded, err := s.respond(patterns); err != nil {
+			return nil, err
+		} else if responded {
+			continue
+		}
+		if m := s.match(patterns); nil != m {
+			return m, nil
+		}
+
+		select {
+		case c, ok := <-s.output:
+			if !ok {
+				return nil, s.readErr()
+			}
+			s.buf = append(s.buf, c.data...)
+			if len(s.buf) > MaxBufferSize {
+				s.buf = append([]byte(nil), s.buf[len(s.buf)-MaxBufferSize:]...)
+			}
+		case <-timer:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// respond 在自动应答的模式比所有的 patterns 都先匹配时发送应答
+func (s *Session) respond(patterns []*regexp.Regexp) (bool, error) {
+	index, start, end := -1, 0, 0
+	for i, r := range s.responders {
+		if l := r.Pattern.FindIndex(s.buf); nil != l && (index < 0 || l[0] < start) {
+			index, start, end = i, l[0], l[1]
+		}
+	}
+	if index < 0 {
+		return false, nil
+	}
+	for _, re := range patterns {
+		if l := re.FindIndex(s.buf); nil != l && l[0] < start {
+			return false, nil
+		}
+	}
+
+	s.buf = append(s.buf[:start], s.buf[end:]...)
+	return true, s.Send(s.responders[index].Send)
+}
+
+func (s *Session) match(patterns []*regexp.Regexp) *Match {
+	index, start, end := -1, 0, 0
+	var loc []int
+	for i, re := range patterns {
+		l := re.FindSubmatchIndex(s.buf)
+		if nil == l {
+			continue
+		}
+		if index < 0 || l[0] < start {
+			index, start, end, loc = i, l[0], l[1], l
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+
+	m := &Match{Index: index, Before: string(s.buf[:start])}
+	for i := 0; i+1 < len(loc); i += 2 {
+		if loc[i] < 0 {
+			m.Groups = append(m.Groups, "")
+		} else {
+			m.Groups = append(m.Groups, string(s.buf[loc[i]:loc[i+1]]))
+		}
+	}
+	s.buf = s.buf[end:]
+	return m
+}
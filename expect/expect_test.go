@@ -0,0 +1,101 @@
+package expect
+
+import (
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpect(t *testing.T) {
+	sess := New(strings.NewReader("login: admin\r\nrouter# "), io.Discard, nil)
+	defer sess.Close()
+
+	m, err := sess.Expect(time.Second, regexp.MustCompile(`login: (\w+)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "admin" != m.Groups[1] {
+		t.Errorf("excepted admin, got %q", m.Groups)
+	}
+	if _, err := sess.Expect(time.Second, regexp.MustCompile(`#\s*$`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Expect(100*time.Millisecond, regexp.MustCompile(`never`)); nil == err {
+		t.Error("excepted error, got ok")
+	}
+}
+
+func TestScriptRun(t *testing.T) {
+	script, err := Parse([]byte(`{"steps": [
+  {"expect": [{"pattern": "Version (\\S+)", "capture": ["version"]}]},
+  {"sendln": "exit ${version}"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent strings.Builder
+	sess := New(strings.NewReader("Cisco IOS Version 15.1\r\n"), &sent, nil)
+	defer sess.Close()
+	vars, err := script.Run(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if "15.1" != vars["version"] || "exit 15.1\r" != sent.String() {
+		t.Errorf("excepted version 15.1, got %v, %q", vars, sent.String())
+	}
+}
+
+func TestSleep(t *testing.T) {
+	for _, text := range []string{`{"steps": [{"sleep": "1000h"}]}`, `{"steps": [{"sleep": -1}]}`} {
+		if _, err := Parse([]byte(text)); nil == err {
+			t.Errorf("%s: excepted error, got ok", text)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	sess := New(pr, io.Discard, nil)
+	script, err := Parse([]byte(`{"steps": [{"sleep": "5m"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := script.Run(sess)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sess.Close()
+	select {
+	case err := <-done:
+		if nil == err {
+			t.Error("excepted error, got ok")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sleep isn't interrupted by Close")
+	}
+}
+
+func TestCloseStopsReader(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		pr, pw := io.Pipe()
+		go func() {
+			for {
+				if _, err := pw.Write([]byte("output")); err != nil {
+					return
+				}
+			}
+		}()
+		sess := New(pr, io.Discard, nil)
+		time.Sleep(5 * time.Millisecond)
+		sess.Close()
+		pr.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Errorf("excepted the readers exit, goroutines %d -> %d", before, n)
+	}
+}
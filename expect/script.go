@@ -0,0 +1,314 @@
+package expect
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSteps 限制一个脚本执行的步数， 防止死循环
+var MaxSteps = 10000
+
+// MaxSleep 是一个步骤中 sleep 的最大值
+var MaxSleep = 10 * time.Minute
+
+// Duration 在 JSON 中可以是 "10s" 或秒数
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); nil == err {
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+		return nil
+	}
+	var n float64
+	if err := json.Unmarshal(bs, &n); err != nil {
+		return errors.New("duration must be a string or a number of seconds")
+	}
+	*d = Duration(n * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Branch 是 expect 的一个分支
+type Branch struct {
+	Pattern string `json:"pattern"`
+	// Capture 是子匹配保存到的变量名， 模式中的命名分组 (?P<name>...) 也会被保存
+	Capture []string `json:"capture,omitempty"`
+	// Send 和 Sendln 是匹配后立即发送的文本
+	Send   *string `json:"send,omitempty"`
+	Sendln *string `json:"sendln,omitempty"`
+	// Continue 表示匹配后继续等待本步骤的模式， 常用于处理分页提示符
+	Continue bool   `json:"continue,omitempty"`
+	Goto     string `json:"goto,omitempty"`
+	Fail     string `json:"fail,omitempty"`
+	Exit     bool   `json:"exit,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Step 是脚本的一个步骤， 每个步骤按 set、 send、 sendln、 sleep、 expect、
+// fail、 exit、 goto 的顺序执行， 分支的 goto 和 on_timeout 优先于步骤的 goto
+type Step struct {
+	Label     string            `json:"label,omitempty"`
+	Set       map[string]string `json:"set,omitempty"`
+	Send      *string           `json:"send,omitempty"`
+	Sendln    *string           `json:"sendln,omitempty"`
+	Sleep     Duration          `json:"sleep,omitempty"`
+	Expect    []*Branch         `json:"expect,omitempty"`
+	Timeout   Duration          `json:"timeout,omitempty"`
+	OnTimeout string            `json:"on_timeout,omitempty"`
+	Fail      string            `json:"fail,omitempty"`
+	Goto      string            `json:"goto,omitempty"`
+	Exit      bool              `json:"exit,omitempty"`
+}
+
+// Script 是一个 expect 脚本， 例如
+//
+//	{"timeout": "10s",
+//	 "steps": [
+//	   {"expect": [{"pattern": "[>#]\\s*$"}]},
+//	   {"sendln": "show version",
+//	    "expect": [{"pattern": "--More--", "send": " ", "continue": true},
+//	               {"pattern": "Version (\\S+)", "capture": ["version"]}]}]}
+//
+// 发送的文本中的 ${name} 会被替换为变量的值。
+type Script struct {
+	Timeout Duration          `json:"timeout,omitempty"`
+	Vars    map[string]string `json:"vars,omitempty"`
+	Steps   []*Step           `json:"steps"`
+
+	labels map[string]int
+}
+
+// Error 是脚本执行失败的原因
+type Error struct {
+	Step    int    `json:"step"`
+	Label   string `json:"label,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if "" != e.Label {
+		return "step " + strconv.Itoa(e.Step) + "(" + e.Label + "): " + e.Message
+	}
+	return "step " + strconv.Itoa(e.Step) + ": " + e.Message
+}
+
+// Parse 解析和检查 JSON 格式的脚本
+func Parse(bs []byte) (*Script, error) {
+	var script Script
+	if err := json.Unmarshal(bs, &script); err != nil {
+		return nil, errors.New("script is invalid, " + err.Error())
+	}
+	if err := script.Compile(); err != nil {
+		return nil, err
+	}
+	return &script, nil
+}
+
+// Compile 编译模式并检查标签
+func (script *Script) Compile() error {
+	script.labels = map[string]int{}
+	for idx, step := range script.Steps {
+		if "" != step.Label {
+			if _, exists := script.labels[step.Label]; exists {
+				return &Error{Step: idx, Label: step.Label, Message: "label is duplicated"}
+			}
+			script.labels[step.Label] = idx
+		}
+	}
+
+	checkLabel := func(idx int, label string) error {
+		if "" == label {
+			return nil
+		}
+		if _, ok := script.labels[label]; !ok {
+			return &Error{Step: idx, Label: script.Steps[idx].Label, Message: "label '" + label + "' is not found"}
+		}
+		return nil
+	}
+
+	for idx, step := range script.Steps {
+		if step.Sleep < 0 || time.Duration(step.Sleep) > MaxSleep {
+			return &Error{Step: idx, Label: step.Label, Message: "sleep must be between 0 and " + MaxSleep.String()}
+		}
+		if err := checkLabel(idx, step.Goto); err != nil {
+			return err
+		}
+		if err := checkLabel(idx, step.OnTimeout); err != nil {
+			return err
+		}
+		for _, branch := range step.Expect {
+			re, err := regexp.Compile(branch.Pattern)
+			if err != nil {
+				return &Error{Step: idx, Label: step.Label, Message: "pattern '" + branch.Pattern + "' is invalid, " + err.Error()}
+			}
+			branch.re = re
+			if err := checkLabel(idx, branch.Goto); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Expand 替换文本中的 ${name}
+func Expand(s string, vars map[string]string) string {
+	var buf strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		buf.WriteString(s[:start])
+		buf.WriteString(vars[s[start+2:start+end]])
+		s = s[start+end+1:]
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
+
+// Run 在会话上执行脚本， 返回脚本结束时的变量
+func (script *Script) Run(sess *Session) (map[string]string, error) {
+	if nil == script.labels {
+		if err := script.Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	vars := map[string]string{}
+	for k, v := range script.Vars {
+		vars[k] = v
+	}
+
+	fail := func(idx int, msg string) (map[string]string, error) {
+		return vars, &Error{Step: idx, Label: script.Steps[idx].Label, Message: Expand(msg, vars)}
+	}
+	send := func(text *string, newline bool) error {
+		if nil == text {
+			return nil
+		}
+		if newline {
+			return sess.Sendln(Expand(*text, vars))
+		}
+		return sess.Send(Expand(*text, vars))
+	}
+
+	count := 0
+	for idx := 0; idx < len(script.Steps); {
+		if count++; count > MaxSteps {
+			return fail(idx, "too many steps are executed")
+		}
+
+		step := script.Steps[idx]
+		for k, v := range step.Set {
+			vars[k] = Expand(v, vars)
+		}
+		if err := send(step.Send, false); err != nil {
+			return fail(idx, err.Error())
+		}
+		if err := send(step.Sendln, true); err != nil {
+			return fail(idx, err.Error())
+		}
+		if step.Sleep > 0 {
+			if err := sess.Sleep(time.Duration(step.Sleep)); err != nil {
+				return fail(idx, err.Error())
+			}
+		}
+
+		next := idx + 1
+		if len(step.Expect) > 0 {
+			timeout := time.Duration(step.Timeout)
+			if 0 == timeout {
+				timeout = time.Duration(script.Timeout)
+			}
+			if 0 == timeout {
+				timeout = 30 * time.Second
+			}
+
+			patterns := make([]*regexp.Regexp, len(step.Expect))
+			for i, branch := range step.Expect {
+				patterns[i] = branch.re
+			}
+
+		expectLoop:
+			for {
+				if count++; count > MaxSteps {
+					return fail(idx, "too many steps are executed")
+				}
+
+				m, err := sess.Expect(timeout, patterns...)
+				if err == ErrTimeout && "" != step.OnTimeout {
+					next = script.labels[step.OnTimeout]
+					break
+				}
+				if err != nil {
+					if err == io.EOF {
+						return fail(idx, "connection is closed")
+					}
+					return fail(idx, err.Error())
+				}
+
+				branch := step.Expect[m.Index]
+				for i, name := range branch.Capture {
+					if i+1 < len(m.Groups) && "" != name {
+						vars[name] = m.Groups[i+1]
+					}
+				}
+				for i, name := range branch.re.SubexpNames() {
+					if "" != name && i < len(m.Groups) {
+						vars[name] = m.Groups[i]
+					}
+				}
+				if err := send(branch.Send, false); err != nil {
+					return fail(idx, err.Error())
+				}
+				if err := send(branch.Sendln, true); err != nil {
+					return fail(idx, err.Error())
+				}
+
+				switch {
+				case "" != branch.Fail:
+					return fail(idx, branch.Fail)
+				case branch.Exit:
+					return vars, nil
+				case "" != branch.Goto:
+					next = script.labels[branch.Goto]
+					break expectLoop
+				case branch.Continue:
+					continue
+				default:
+					break expectLoop
+				}
+			}
+		}
+
+		if "" != step.Fail {
+			return fail(idx, step.Fail)
+		}
+		if step.Exit {
+			return vars, nil
+		}
+		if "" != step.Goto && next == idx+1 {
+			next = script.labels[step.Goto]
+		}
+		idx = next
+	}
+	return vars, nil
+}
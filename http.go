@@ -0,0 +1,50 @@
+package terminal
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+var admin_users = flag.String("admin_users", "", "the users who can access the admin api, separated by ',', nobody is allowed if it is empty or user_header isn't configured.")
+
+// handle registers h at "/"+pattern and at appRoot+pattern.
+func handle(appRoot, pattern string, h http.Handler) {
+	http.Handle("/"+pattern, h)
+	if appRoot != "/" {
+		http.Handle(appRoot+pattern, h)
+	}
+}
+
+// isAdmin 判断请求的用户是否是管理员， 没有配置 user_header 时无法识别
+// 用户， 总是返回 false
+func isAdmin(r *http.Request) bool {
+	return isAdminUser(currentUser(r))
+}
+
+// isAdminUser 判断 user 是否在 admin_users 中， 用于没有请求的场合， 如
+// 定时任务
+func isAdminUser(user string) bool {
+	if "" == user {
+		return false
+	}
+	for _, s := range strings.Split(*admin_users, ",") {
+		if strings.TrimSpace(s) == user {
+			return true
+		}
+	}
+	return false
+}
+
+func renderJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		w.Write([]byte(err.Error()))
+	}
+}
+
+func renderError(w http.ResponseWriter, code int, msg string) {
+	renderJSON(w, code, map[string]interface{}{"error": msg})
+}
@@ -0,0 +1,399 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/runner-mei/web-terminal/expect"
+)
+
+// LoginPrompts 是自动登录时识别的提示符， 每一项都是正则表达式
+type LoginPrompts struct {
+	Username       []string `json:"username,omitempty"`
+	Password       []string `json:"password,omitempty"`
+	Failure        []string `json:"failure,omitempty"`
+	Prompt         []string `json:"prompt,omitempty"`
+	EnablePassword []string `json:"enable_password,omitempty"`
+}
+
+// builtinLoginPrompts 是内置的提示符
+var builtinLoginPrompts = &LoginPrompts{
+	Username:       []string{`(?i)(user ?name|login|user)\s*:\s*$`},
+	Password:       []string{`(?i)pass(word)?\s*:\s*$`},
+	Failure:        []string{`(?i)(login incorrect|login invalid|authentication failed|access denied|bad password|% ?bad (passwords|secrets)|error: .*(password|authentication))`},
+	Prompt:         []string{`[>#$%\]]\s*$`},
+	EnablePassword: []string{`(?i)pass(word)?\s*:\s*$`},
+}
+
+// merge 返回用 other 中非空的项覆盖后的副本
+func (prompts *LoginPrompts) merge(other *LoginPrompts) *LoginPrompts {
+	copied := *prompts
+	if nil == other {
+		return &copied
+	}
+	if len(other.Username) > 0 {
+		copied.Username = other.Username
+	}
+	if len(other.Password) > 0 {
+		copied.Password = other.Password
+	}
+	if len(other.Failure) > 0 {
+		copied.Failure = other.Failure
+	}
+	if len(other.Prompt) > 0 {
+		copied.Prompt = other.Prompt
+	}
+	if len(other.EnablePassword) > 0 {
+		copied.EnablePassword = other.EnablePassword
+	}
+	return &copied
+}
+
+// DefaultLoginPrompts 是被 conf/login.json 修改后的内置提示符， 由 configLock
+// 保护
+var DefaultLoginPrompts = builtinLoginPrompts
+
+func defaultLoginPrompts() *LoginPrompts {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return DefaultLoginPrompts
+}
+
+// readLoginPrompts 读取 login.json， 文件中非空的项覆盖内置的提示符， file
+// 为空时返回内置的提示符
+func readLoginPrompts(file string) (*LoginPrompts, error) {
+	if "" == file {
+		return builtinLoginPrompts, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	var prompts LoginPrompts
+	if err := json.Unmarshal(bs, &prompts); err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	if _, err := prompts.compile(); err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	return builtinLoginPrompts.merge(&prompts), nil
+}
+
+type compiledPrompts struct {
+	patterns []*regexp.Regexp
+	kinds    []string
+}
+
+func (c *compiledPrompts) add(kind string, patterns []string) error {
+	for _, s := range patterns {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return errors.New(kind + " prompt '" + s + "' is invalid, " + err.Error())
+		}
+		c.patterns = append(c.patterns, re)
+		c.kinds = append(c.kinds, kind)
+	}
+	return nil
+}
+
+func (prompts *LoginPrompts) compile() (*compiledPrompts, error) {
+	c := &compiledPrompts{}
+	for _, kind := range []struct {
+		name     string
+		patterns []string
+	}{{"failure", prompts.Failure},
+		{"username", prompts.Username},
+		{"password", prompts.Password},
+		{"prompt", prompts.Prompt},
+		{"enable_password", prompts.EnablePassword}} {
+		if err := c.add(kind.name, kind.patterns); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// only 返回指定类型的模式
+func (c *compiledPrompts) only(kinds ...string) *compiledPrompts {
+	results := &compiledPrompts{}
+	for idx, kind := range c.kinds {
+		for _, k := range kinds {
+			if k == kind {
+				results.patterns = append(results.patterns, c.patterns[idx])
+				results.kinds = append(results.kinds, kind)
+			}
+		}
+	}
+	return results
+}
+
+// LoginError 是自动登录失败的原因， 它以 "%tpt_error%" 加上 JSON 的格式发送给浏览器
+type LoginError struct {
+	// Stage 是失败时所处的步骤， username、 password 或 enable
+	Stage string `json:"stage"`
+	// Reason 是 timeout、 rejected、 closed 或 missing_credential
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Output 是失败前终端最后的输出
+	Output string `json:"output,omitempty"`
+}
+
+func (e *LoginError) Error() string {
+	return "login fail at " + e.Stage + ", " + e.Message
+}
+
+// LoginOptions 是自动登录的参数
+type LoginOptions struct {
+	User           string
+	Password       string
+	EnableCommand  string
+	EnablePassword string
+	Profile        *Profile
+	Prompts        *LoginPrompts
+	Timeout        time.Duration
+}
+
+// loginOptions 从请求参数中读取 user、 password、 enable_password、
+// enable_command、 login_timeout、 profile 和 username_prompt 等提示符
+func loginOptions(params url.Values) (*LoginOptions, error) {
+	opts := &LoginOptions{
+		User:           params.Get("user"),
+		Password:       params.Get("password"),
+		EnableCommand:  params.Get("enable_command"),
+		EnablePassword: params.Get("enable_password"),
+		Prompts:        defaultLoginPrompts(),
+		Timeout:        30 * time.Second,
+	}
+	if name := params.Get("profile"); "" != name {
+		profile, ok := profileFor(name)
+		if !ok {
+			return nil, errors.New("profile '" + name + "' is not found")
+		}
+		opts.Profile = profile
+		opts.Prompts = opts.Prompts.merge(profile.Login)
+	}
+	opts.Prompts = opts.Prompts.merge(&LoginPrompts{
+		Username:       params["username_prompt"],
+		Password:       params["password_prompt"],
+		Failure:        params["failure_prompt"],
+		Prompt:         params["prompt"],
+		EnablePassword: params["enable_password_prompt"],
+	})
+	if s := params.Get("login_timeout"); "" != s {
+		if t, e := time.ParseDuration(s); nil == e {
+			opts.Timeout = t
+		}
+	}
+	return opts, nil
+}
+
+// IsEnabled 是否需要自动登录
+func (opts *LoginOptions) IsEnabled() bool {
+	return "" != opts.User || "" != opts.Password || "" != opts.EnablePassword
+}
+
+func loginError(stage, reason, message string, sess *expect.Session) *LoginError {
+	output := sess.Buffered()
+	if len(output) > 512 {
+		output = output[len(output)-512:]
+	}
+	return &LoginError{Stage: stage, Reason: reason, Message: message, Output: strings.TrimSpace(output)}
+}
+
+func expectLogin(sess *expect.Session, stage string, timeout time.Duration, prompts *compiledPrompts) (string, error) {
+	kind, _, err := expectLoginMatch(sess, stage, timeout, prompts)
+	return kind, err
+}
+
+// expectLoginMatch 和 expectLogin 相同， 同时返回匹配的结果
+func expectLoginMatch(sess *expect.Session, stage string, timeout time.Duration, prompts *compiledPrompts) (string, *expect.Match, error) {
+	m, err := sess.Expect(timeout, prompts.patterns...)
+	if err == expect.ErrTimeout {
+		return "", nil, loginError(stage, "timeout", "wait for prompt timeout", sess)
+	}
+	if err != nil {
+		return "", nil, loginError(stage, "closed", "connection is closed, "+err.Error(), sess)
+	}
+	return prompts.kinds[m.Index], m, nil
+}
+
+// lastLine 返回文本的最后一行
+func lastLine(text string) string {
+	if idx := strings.LastIndexAny(text, "\r\n"); idx >= 0 {
+		return text[idx+1:]
+	}
+	return text
+}
+
+// privilegedPrompt 匹配特权模式的提示符， 用于没有指定 Prompt 的提权步骤
+var privilegedPrompt = regexp.MustCompile(`#\s*$`)
+
+// Login 在终端上识别用户名和密码的提示符并自动登录， 如果有 enable 密码
+// 则接着按 Escalate 进入特权模式
+func Login(sess *expect.Session, opts *LoginOptions) error {
+	prompts, err := opts.Prompts.compile()
+	if err != nil {
+		return &LoginError{Stage: "username", Reason: "invalid_prompt", Message: err.Error()}
+	}
+
+	stage := "username"
+	userSent, passwordSent := 0, 0
+	for done := false; !done; {
+		kind, err := expectLogin(sess, stage, opts.Timeout, prompts.only("failure", "username", "password", "prompt"))
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case "failure":
+			return loginError(stage, "rejected", "user or password is rejected", sess)
+		case "username":
+			if "" == opts.User {
+				return loginError(stage, "missing_credential", "user is required", sess)
+			}
+			if userSent++; userSent > 1 {
+				return loginError(stage, "rejected", "user or password is rejected", sess)
+			}
+			stage = "password"
+			if err := sess.Sendln(opts.User); err != nil {
+				return loginError(stage, "closed", err.Error(), sess)
+			}
+		case "password":
+			stage = "password"
+			if "" == opts.Password {
+				return loginError(stage, "missing_credential", "password is required", sess)
+			}
+			if passwordSent++; passwordSent > 1 {
+				return loginError(stage, "rejected", "user or password is rejected", sess)
+			}
+			if err := sess.Sendln(opts.Password); err != nil {
+				return loginError(stage, "closed", err.Error(), sess)
+			}
+		case "prompt":
+			done = true
+		}
+	}
+
+	return Escalate(sess, opts)
+}
+
+// Escalate 按设备类型的提权步骤进入特权模式， 没有 enable 密码时什么也不做
+func Escalate(sess *expect.Session, opts *LoginOptions) error {
+	if "" == opts.EnablePassword {
+		return nil
+	}
+
+	steps := defaultEscalation
+	if nil != opts.Profile && len(opts.Profile.Escalation) > 0 {
+		steps = opts.Profile.Escalation
+	}
+	for idx, step := range steps {
+		command := step.Command
+		if 0 == idx && "" != opts.EnableCommand {
+			command = opts.EnableCommand
+		}
+		prompts := opts.Prompts.merge(&LoginPrompts{EnablePassword: step.PasswordPrompt, Prompt: step.Prompt})
+		// 步骤指定了 Prompt 时它就是特权模式的提示符
+		privileged := privilegedPrompt
+		if len(step.Prompt) > 0 {
+			privileged = nil
+		}
+		if err := escalate(sess, command, prompts, privileged, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escalate 执行一个提权步骤， 没有要求密码就回到了提示符时， 如果提示符
+// 匹配 privileged (为 nil 时不检查)， 说明不需要密码或已经在特权模式中
+func escalate(sess *expect.Session, command string, prompts *LoginPrompts, privileged *regexp.Regexp, opts *LoginOptions) error {
+	const stage = "enable"
+	compiled, err := prompts.compile()
+	if err != nil {
+		return &LoginError{Stage: stage, Reason: "invalid_prompt", Message: err.Error()}
+	}
+	compiled = compiled.only("failure", "enable_password", "prompt")
+
+	if err := sess.Sendln(command); err != nil {
+		return loginError(stage, "closed", err.Error(), sess)
+	}
+	passwordSent := 0
+	for {
+		kind, m, err := expectLoginMatch(sess, stage, opts.Timeout, compiled)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case "failure":
+			return loginError(stage, "rejected", "enable password is rejected", sess)
+		case "enable_password":
+			if passwordSent++; passwordSent > 1 {
+				return loginError(stage, "rejected", "enable password is rejected", sess)
+			}
+			if err := sess.Sendln(opts.EnablePassword); err != nil {
+				return loginError(stage, "closed", err.Error(), sess)
+			}
+		case "prompt":
+			if nil != privileged && !privileged.MatchString(lastLine(m.Before+m.Groups[0])) {
+				if 0 == passwordSent {
+					return loginError(stage, "rejected", "'"+command+"' is rejected", sess)
+				}
+				return loginError(stage, "rejected", "enable password is rejected", sess)
+			}
+			return nil
+		}
+	}
+}
+
+// WaitPrompt 等待命令提示符
+func WaitPrompt(sess *expect.Session, opts *LoginOptions) error {
+	compiled, err := opts.Prompts.compile()
+	if err != nil {
+		return &LoginError{Stage: "prompt", Reason: "invalid_prompt", Message: err.Error()}
+	}
+	_, err = expectLogin(sess, "prompt", opts.Timeout, compiled.only("prompt"))
+	return err
+}
+
+// needsPrepare 是否需要在执行脚本之前调用 prepareSession， 即是否指定了
+// 设备类型、 enable 密码或 telnet 的用户名和密码
+func (opts *LoginOptions) needsPrepare(isTelnet bool) bool {
+	return nil != opts.Profile || "" != opts.EnablePassword || (isTelnet && opts.IsEnabled())
+}
+
+// prepareSession 为自动化的功能准备终端： 登录 (仅 telnet) 或等待提示符、
+// 进入特权模式、 关闭分页并自动应答分页提示符， 完成后终端处于命令提示符处
+func prepareSession(sess *expect.Session, opts *LoginOptions, isTelnet bool) error {
+	if isTelnet && opts.IsEnabled() {
+		if err := Login(sess, opts); err != nil {
+			return err
+		}
+	} else {
+		if err := WaitPrompt(sess, opts); err != nil {
+			return err
+		}
+		if err := Escalate(sess, opts); err != nil {
+			return err
+		}
+	}
+
+	if nil != opts.Profile {
+		return opts.Profile.Prepare(sess, opts)
+	}
+	return nil
+}
+
+func loginErrorText(err error) string {
+	if le, ok := err.(*LoginError); ok {
+		bs, _ := json.Marshal(le)
+		return "%tpt_error%" + string(bs)
+	}
+	return "%tpt%" + err.Error()
+}
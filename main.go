@@ -12,9 +12,11 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -23,6 +25,7 @@ import (
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/fd/go-shellwords/shellwords"
 	"github.com/kardianos/osext"
+	"github.com/runner-mei/web-terminal/expect"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/websocket"
 	"golang.org/x/text/transform"
@@ -35,7 +38,7 @@ var (
 	is_debug        = flag.Bool("debug", false, "show debug message.")
 	mibs_dir        = flag.String("mibs_dir", "", "set mibs directory.")
 
-	Commands = map[string]string{}
+	Commands = &CommandRegistry{commands: map[string]*Command{}}
 
 	LogDir           = ""
 	ExecutableFolder string
@@ -84,7 +87,7 @@ func decodeBy(charset string, dst io.Writer) io.Writer {
 
 func getErrText(pa, defText string) string {
 	if strings.HasSuffix(pa, "snmp") {
-		return "请安装一下 net-snmp-utils 包"
+		return "请安装一下 net-snmp-utils 包， 或者使用内置的 /snmp/get 和 /snmp/walk"
 	}
 	return defText
 }
@@ -157,6 +160,19 @@ func toInt(s string, v int) int {
 	return v
 }
 
+var user_header = flag.String("user_header", "", "the http header which contains the name of login user.")
+
+// currentUser returns the name of login user, it is passed by the reverse
+// proxy in the header. The user of basic authentication isn't trusted
+// because the password isn't verified here, "" is returned if user_header
+// isn't configured.
+func currentUser(r *http.Request) string {
+	if "" == *user_header {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(*user_header))
+}
+
 func logString(ws io.Writer, msg string) {
 	if nil != ws {
 		io.WriteString(ws, "%tpt%"+msg)
@@ -186,6 +202,14 @@ func SSHShell(ws *websocket.Conn) {
 	if "" == port {
 		port = "22"
 	}
+	address, err := allowTarget(ws.Request(), "ssh", hostname, port)
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	sess := openSession(ws, "ssh", net.JoinHostPort(hostname, port), address)
+	defer sess.Close()
+
 	user := ws.Request().URL.Query().Get("user")
 	pwd := ws.Request().URL.Query().Get("password")
 	columns := toInt(ws.Request().URL.Query().Get("columns"), 120)
@@ -246,11 +270,21 @@ func SSHShell(ws *websocket.Conn) {
 			}),
 		},
 	}
-	client, err := ssh.Dial("tcp", hostname+":"+port, config)
+	signers, err := privateKeySigners(ws.Request().URL.Query().Get("private_key"), ws.Request().URL.Query().Get("passphrase"))
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	if len(signers) > 0 {
+		config.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signers...)}, config.Auth...)
+	}
+	client, err := ssh.Dial("tcp", address, config)
 	if err != nil {
 		logString(ws, "Failed to dial: "+err.Error())
 		return
 	}
+	defer client.Close()
+	sess.OnKill(func() { client.Close() })
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -271,7 +305,10 @@ func SSHShell(ws *websocket.Conn) {
 		return
 	}
 
-	var combinedOut io.Writer = decodeBy(charset, ws)
+	input := newSessionInput(ws)
+	defer input.Close()
+
+	var combinedOut io.Writer = decodeBy(charset, sess.Output(input.Watch(sess.Client())))
 	if debug {
 		dump_out, err = os.OpenFile(filepath.Join(LogDir, hostname+".dump_ssh_out.txt"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
 		if nil == err {
@@ -284,9 +321,19 @@ func SSHShell(ws *websocket.Conn) {
 		}
 	}
 
+	opts, err := loginOptions(ws.Request().URL.Query())
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	if "" != opts.EnablePassword {
+		sshEscalate(ws, session, opts, combinedOut, warp(sess.Input(input), sess.MaskInput(dump_in)))
+		return
+	}
+
 	session.Stdout = combinedOut
 	session.Stderr = combinedOut
-	session.Stdin = warp(ws, dump_in)
+	session.Stdin = warp(sess.Input(input), sess.MaskInput(dump_in))
 	if err := session.Shell(); nil != err {
 		logString(ws, "Unable to execute command:"+err.Error())
 		return
@@ -296,6 +343,45 @@ func SSHShell(ws *websocket.Conn) {
 	}
 }
 
+// sshEscalate 启动 shell 并在进入特权模式后将终端交给浏览器
+func sshEscalate(ws *websocket.Conn, session *ssh.Session, opts *LoginOptions, output io.Writer, input io.Reader) {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		logString(ws, "Unable to execute command:"+err.Error())
+		return
+	}
+	pr, pw := io.Pipe()
+	session.Stdout = pw
+	session.Stderr = pw
+	if err := session.Shell(); nil != err {
+		logString(ws, "Unable to execute command:"+err.Error())
+		return
+	}
+	go func() {
+		pw.CloseWithError(session.Wait())
+	}()
+
+	sess := expect.New(pr, stdin, output)
+	defer sess.Close()
+	if err := WaitPrompt(sess, opts); err != nil {
+		io.WriteString(ws, loginErrorText(err))
+		return
+	}
+	if err := Escalate(sess, opts); err != nil {
+		io.WriteString(ws, loginErrorText(err))
+		return
+	}
+	sess.SetTranscript(nil)
+
+	go func() {
+		defer stdin.Close()
+		io.Copy(stdin, input)
+	}()
+	if _, err := io.Copy(output, sess); err != nil && err != io.EOF {
+		logString(ws, "Unable to execute command:"+err.Error())
+	}
+}
+
 func SSHExec(ws *websocket.Conn) {
 	var dump_out, dump_in io.WriteCloser
 	defer func() {
@@ -321,9 +407,18 @@ func SSHExec(ws *websocket.Conn) {
 	}
 
 	cmd := ws.Request().URL.Query().Get("cmd")
+	address, err := allowTarget(ws.Request(), "ssh", hostname, port)
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	sess := openSession(ws, "ssh_exec", net.JoinHostPort(hostname, port), address)
+	defer sess.Close()
+	sess.audit("exec", redactLine(cmd))
+
 	cmd_alias := ws.Request().URL.Query().Get("dump_file")
 	if "" == cmd_alias {
-		cmd_alias = strings.Replace(cmd, " ", "_", -1)
+		cmd_alias = strings.Replace(redactLine(cmd), " ", "_", -1)
 	}
 
 	password_count := 0
@@ -366,11 +461,21 @@ func SSHExec(ws *websocket.Conn) {
 				return answers, nil
 			})},
 	}
-	client, err := ssh.Dial("tcp", hostname+":"+port, config)
+	signers, err := privateKeySigners(ws.Request().URL.Query().Get("private_key"), ws.Request().URL.Query().Get("passphrase"))
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	if len(signers) > 0 {
+		config.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signers...)}, config.Auth...)
+	}
+	client, err := ssh.Dial("tcp", address, config)
 	if err != nil {
 		logString(ws, "Failed to dial: "+err.Error())
 		return
 	}
+	defer client.Close()
+	sess.OnKill(func() { client.Close() })
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -379,12 +484,18 @@ func SSHExec(ws *websocket.Conn) {
 	}
 	defer session.Close()
 
-	var combinedOut io.Writer = ws
+	var combinedOut io.Writer = sess.Output(ws)
+	parse := ws.Request().URL.Query().Get("parse")
+	var captured *lockedBuffer
+	if "" != parse {
+		captured = &lockedBuffer{}
+		combinedOut = io.MultiWriter(combinedOut, captured)
+	}
 	if debug {
 		dump_out, err = os.OpenFile(filepath.Join(LogDir, hostname+"_"+cmd_alias+".dump_ssh_out.txt"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
 		if nil == err {
 			fmt.Println("log to file", filepath.Join(LogDir, hostname+"_"+cmd_alias+".dump_ssh_out.txt"))
-			combinedOut = io.MultiWriter(dump_out, ws)
+			combinedOut = io.MultiWriter(dump_out, combinedOut)
 		} else {
 			fmt.Println("failed to open log file,", err)
 		}
@@ -400,13 +511,17 @@ func SSHExec(ws *websocket.Conn) {
 
 	session.Stdout = combinedOut
 	session.Stderr = combinedOut
-	session.Stdin = warp(ws, dump_in)
+	session.Stdin = warp(sess.Input(ws), sess.MaskInput(dump_in))
 
 	if err := session.Start(cmd); nil != err {
 		logString(combinedOut, "Unable to execute command:"+err.Error())
 		return
 	}
-	if err := session.Wait(); nil != err {
+	err = session.Wait()
+	if nil != captured {
+		writeParsed(ws, parse, cmd, ws.Request().URL.Query().Get("profile"), captured.String())
+	}
+	if nil != err {
 		logString(combinedOut, "Unable to execute command:"+err.Error())
 		return
 	}
@@ -420,6 +535,14 @@ func TelnetShell(ws *websocket.Conn) {
 	if "" == port {
 		port = "23"
 	}
+	address, err := allowTarget(ws.Request(), "telnet", hostname, port)
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	sess := openSession(ws, "telnet", net.JoinHostPort(hostname, port), address)
+	defer sess.Close()
+
 	charset := ws.Request().URL.Query().Get("charset")
 	if "" == charset {
 		if "windows" == runtime.GOOS {
@@ -434,7 +557,7 @@ func TelnetShell(ws *websocket.Conn) {
 	var dump_out io.WriteCloser
 	var dump_in io.WriteCloser
 
-	client, err := net.Dial("tcp", hostname+":"+port)
+	client, err := net.Dial("tcp", address)
 	if nil != err {
 		logString(ws, "Failed to dial: "+err.Error())
 		return
@@ -448,6 +571,7 @@ func TelnetShell(ws *websocket.Conn) {
 			dump_in.Close()
 		}
 	}()
+	sess.OnKill(func() { client.Close() })
 
 	debug := *is_debug
 	if "true" == strings.ToLower(ws.Request().URL.Query().Get("debug")) {
@@ -475,24 +599,79 @@ func TelnetShell(ws *websocket.Conn) {
 	rows := toInt(ws.Request().URL.Query().Get("rows"), 40)
 	conn.setWindowSize(byte(rows), byte(columns))
 
+	opts, err := loginOptions(ws.Request().URL.Query())
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	input := newSessionInput(ws)
+	defer input.Close()
+	out := sess.Output(input.Watch(sess.Client()))
+
+	var output io.Reader = conn
+	if opts.IsEnabled() {
+		sess := expect.New(conn, conn, decodeBy(charset, out))
+		defer sess.Close()
+		if err := Login(sess, opts); err != nil {
+			io.WriteString(ws, loginErrorText(err))
+			log.Println("login '"+hostname+"' fail,", err)
+			return
+		}
+		sess.SetTranscript(nil)
+		output = sess
+	}
+
 	go func() {
 		defer client.Close()
 
-		_, err := io.Copy(decodeBy(charset, client), warp(ws, dump_out))
+		_, err := io.Copy(decodeBy(charset, client), warp(sess.Input(input), sess.MaskInput(dump_out)))
 		if nil != err {
 			logString(nil, "copy of stdin failed:"+err.Error())
 		}
 	}()
 
-	if _, err := io.Copy(decodeBy(charset, ws), conn); err != nil {
+	if _, err := io.Copy(decodeBy(charset, out), output); err != nil {
 		logString(ws, "copy of stdout failed:"+err.Error())
 		return
 	}
 }
 
+// Replay 回放 file 指定的文件， 或者 id 指定的会话录像， 录像可以用
+// offset 跳到指定的秒数， 用 speed 控制回放的速度
 func Replay(ws *websocket.Conn) {
 	defer ws.Close()
-	file_name := ws.Request().URL.Query().Get("file")
+	if id := ws.Request().URL.Query().Get("id"); "" != id {
+		file, err := recordingFile(id)
+		if err != nil {
+			logString(ws, "open recording '"+id+"' failed:"+err.Error())
+			return
+		}
+		header, err := readRecordingHeader(file)
+		if err != nil {
+			logString(ws, err.Error())
+			return
+		}
+		if !isAdmin(ws.Request()) && header.Session.User != currentUser(ws.Request()) {
+			logString(ws, "permission denied")
+			return
+		}
+		offset, speed := replayParams(ws)
+		if err := replayRecording(ws, file, offset, speed); err != nil {
+			logString(ws, "replay '"+id+"' failed:"+err.Error())
+		}
+		return
+	}
+
+	// 调试的转储文件中有密码以外的所有输入， 只有管理员可以查看
+	if !isAdmin(ws.Request()) {
+		logString(ws, "permission denied")
+		return
+	}
+	file_name, err := dumpFile(ws.Request().URL.Query().Get("file"))
+	if nil != err {
+		logString(ws, err.Error())
+		return
+	}
 	charset := ws.Request().URL.Query().Get("charset")
 	if "" == charset {
 		if "windows" == runtime.GOOS {
@@ -514,6 +693,21 @@ func Replay(ws *websocket.Conn) {
 	}
 }
 
+var dumpFilePattern = regexp.MustCompile(`^[^/\\]+\.dump_(ssh|telnet)_(in|out)\.txt$`)
+
+// dumpFile 返回日志目录中的转储文件， name 可以是文件名， 也可以是日志
+// 目录中文件的路径， 其它的文件都不能被读取
+func dumpFile(name string) (string, error) {
+	base := filepath.Base(name)
+	if base != name && filepath.Clean(filepath.Dir(name)) != filepath.Clean(LogDir) {
+		return "", errors.New("'" + name + "' isn't in the log directory")
+	}
+	if !dumpFilePattern.MatchString(base) {
+		return "", errors.New("'" + name + "' isn't a dump file")
+	}
+	return filepath.Join(LogDir, base), nil
+}
+
 func ExecShell(ws *websocket.Conn) {
 	defer ws.Close()
 
@@ -524,6 +718,11 @@ func ExecShell(ws *websocket.Conn) {
 	timeout := query_params.Get("timeout")
 	stdin := query_params.Get("stdin")
 
+	execShell(ws, pa, queryArgs(query_params), charset, wd, stdin, timeout)
+}
+
+// queryArgs 读取参数 arg0, arg1, ... 中的命令参数
+func queryArgs(query_params url.Values) []string {
 	args := make([]string, 0, 10)
 	for i := 0; i < 1000; i++ {
 		arguments, ok := query_params["arg"+strconv.FormatInt(int64(i), 10)]
@@ -534,8 +733,7 @@ func ExecShell(ws *websocket.Conn) {
 			args = append(args, argument)
 		}
 	}
-
-	execShell(ws, pa, args, charset, wd, stdin, timeout)
+	return args
 }
 
 func ExecShell2(ws *websocket.Conn) {
@@ -574,25 +772,33 @@ func removeBatchOption(args []string) []string {
 	return args[:offset]
 }
 
-func addMibDir(args []string) []string {
-	has_mibs_dir := false
-	for _, argument := range args {
-		if "-M" == argument {
-			has_mibs_dir = true
+func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin, timeout_str string) {
+	command, ok := lookupCommand(pa)
+	if !ok {
+		io.WriteString(ws, getErrText(pa, "'"+pa+"' 不在信任列表中"))
+		return
+	}
+	if !command.IsAllowed(currentUser(ws.Request())) {
+		io.WriteString(ws, "没有执行 '"+pa+"' 的权限")
+		return
+	}
+	if err := command.Validate(args); err != nil {
+		io.WriteString(ws, err.Error())
+		return
+	}
+	args = command.ExpandArgs(args)
+	if "ssh" == command.Name || "plink" == command.Name {
+		checked, err := allowCommandTarget(ws.Request(), args)
+		if err != nil {
+			io.WriteString(ws, err.Error())
+			return
 		}
+		args = checked
 	}
 
-	if !has_mibs_dir {
-		new_args := make([]string, len(args)+2)
-		new_args[0] = "-M"
-		new_args[1] = *mibs_dir
-		copy(new_args[2:], args)
-		args = new_args
+	if "" == charset {
+		charset = command.Charset
 	}
-	return args
-}
-
-func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin, timeout_str string) {
 	if "" == charset {
 		if "windows" == runtime.GOOS {
 			charset = "GB18030"
@@ -602,12 +808,18 @@ func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin,
 	}
 
 	timeout := 10 * time.Minute
+	if command.Timeout > 0 {
+		timeout = time.Duration(command.Timeout)
+	}
 	if "" != timeout_str {
-		if t, e := time.ParseDuration(timeout_str); nil == e {
+		// 请求的超时不能超过命令配置的超时
+		if t, e := time.ParseDuration(timeout_str); nil == e && t > 0 &&
+			(command.Timeout <= 0 || t < time.Duration(command.Timeout)) {
 			timeout = t
 		}
 	}
 
+	sandbox := sandboxFor(command.Name).merge(command.Sandbox)
 	query_params := ws.Request().URL.Query()
 	if _, ok := query_params["file"]; ok {
 		file_content := query_params.Get("file")
@@ -631,89 +843,93 @@ func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin,
 			return
 		}
 		f.Close()
+		if e = sandbox.chown(filename); nil != e {
+			io.WriteString(ws, "修改临时文件的所有者失败：")
+			io.WriteString(ws, e.Error())
+			return
+		}
 
 		args = append(args, filename)
 	}
 
-	if pa == "ssh" && runtime.GOOS != "windows" {
-		linuxSSH(ws, args, charset, wd, timeout)
+	wd, err := resolveWorkDir(wd)
+	if err != nil {
+		io.WriteString(ws, err.Error())
 		return
 	}
 
-	if strings.HasPrefix(pa, "snmp") {
-		args = addMibDir(args)
-	} else if pa == "tpt" || pa == "tpt.exe" {
-		if "windows" == runtime.GOOS {
-			args = append([]string{"-gbk=true"}, args...)
-		}
-	}
+	sess := openSession(ws, "cmd", strings.TrimSpace(command.Name+" "+strings.Join(redactArgs(args), " ")), "")
+	defer sess.Close()
+	sess.audit("exec", sess.Target)
 
-	if c, ok := Commands[pa]; ok {
-		pa = c
-	} else {
-		if !strings.HasPrefix(pa, "runtime_env/") {
-			io.WriteString(ws, getErrText(pa, "'"+pa+"' 不在信任列表中"))
-			return
-		}
+	if pa == "ssh" && runtime.GOOS != "windows" {
+		linuxSSH(ws, args, charset, wd, timeout)
+		return
+	}
 
-		if c, ok := Commands[strings.TrimPrefix(pa, "runtime_env/")]; ok {
-			pa = c
+	program, args := translateCommand(command, args)
+	pa = command.Path
+	if "" != program {
+		if c, ok := lookupCommand(program); ok {
+			pa = c.Path
 		} else {
-			io.WriteString(ws, getErrText(pa, "'"+pa+"' 不在信任列表中"))
-			return
+			pa = program
 		}
+	}
 
-		// if newPa, ok := lookPath(ExecutableFolder, pa); ok {
-		// 	pa = newPa
-		// }
+	// parse 是解析输出的模板， 命令结束后发送解析的结果
+	parse := query_params.Get("parse")
+	commandLine := strings.TrimSpace(command.Name + " " + strings.Join(args, " "))
+	var captured *lockedBuffer
+	var dst io.Writer = sess.Output(sess.Client())
+	if "" != parse {
+		captured = &lockedBuffer{}
+		dst = io.MultiWriter(dst, captured)
 	}
 
 	is_connection_abandoned := false
-	var output io.Writer = decodeBy(charset, ws)
+	var output io.Writer = decodeBy(charset, dst)
 	if pp := strings.ToLower(pa); strings.HasSuffix(pp, "plink.exe") || strings.HasSuffix(pp, "plink") {
 		output = matchBy(output, "Connection abandoned.", func() {
 			is_connection_abandoned = true
 		})
 	}
 
-	if pa == "ping" {
-		if !isWindows {
-			hasCount := false
-			copyedArgs := make([]string, 0, len(args))
-			for _, arg := range args {
-				switch arg {
-				case "-i":
-					arg = "-t"
-				case "-l":
-					arg = "-s"
-				case "-n":
-					arg = "-c"
-					hasCount = true
-				case "-w":
-					arg = "-W"
-				case "-f":
-				}
-				copyedArgs = append(copyedArgs, arg)
-			}
-
-			if !hasCount {
-				copyedArgs = append(copyedArgs, "-c", "4")
-			}
-			args = copyedArgs
-		}
+	cmd, err := sandbox.Command(pa, args...)
+	if err != nil {
+		io.WriteString(ws, err.Error())
+		return
 	}
-
-	cmd := exec.Command(pa, args...)
+	output = limitOutput(output, sandbox.OutputSize, func() {
+		defer recover()
+		cmd.Process.Kill()
+	})
+	sess.OnKill(func() {
+		if nil != cmd.Process {
+			cmd.Process.Kill()
+		}
+	})
 	if "" != wd {
 		cmd.Dir = wd
 	}
-	if stdin == "on" {
-		cmd.Stdin = ws
+	if stdin == "on" && !command.PTY {
+		input := newSessionInput(ws)
+		defer input.Close()
+		cmd.Stdin = sess.Input(input)
+		output = input.Watch(output)
 	}
 	cmd.Stderr = output
 	cmd.Stdout = output
 
-	log.Println(cmd.Path, cmd.Args)
+	log.Println(cmd.Path, redactArgs(cmd.Args))
+
+	if command.PTY {
+		execInPty(ws, sess, cmd, output, timeout)
+		if nil != captured {
+			writeParsed(ws, parse, commandLine, "", captured.String())
+		}
+		return
+	}
 
 	if err := cmd.Start(); err != nil {
 		if !os.IsPermission(err) || runtime.GOOS == "windows" {
@@ -721,10 +937,14 @@ func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin,
 			return
 		}
 
-		newArgs := append(make([]string, len(args)+1))
+		newArgs := make([]string, len(args)+1)
 		newArgs[0] = pa
 		copy(newArgs[1:], args)
-		cmd = exec.Command(sh_execute, newArgs...)
+		cmd, err = sandbox.Command(sh_execute, newArgs...)
+		if err != nil {
+			io.WriteString(ws, err.Error())
+			return
+		}
 		if "" != wd {
 			cmd.Dir = wd
 		}
@@ -732,7 +952,7 @@ func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin,
 		cmd.Stderr = output
 		cmd.Stdout = output
 
-		log.Println(cmd.Path, cmd.Args)
+		log.Println(cmd.Path, redactArgs(cmd.Args))
 		if err := cmd.Start(); err != nil {
 			io.WriteString(ws, err.Error())
 			return
@@ -756,18 +976,25 @@ func execShell(ws *websocket.Conn, pa string, args []string, charset, wd, stdin,
 		}
 	}
 	timer.Stop()
+	if nil != captured {
+		writeParsed(ws, parse, commandLine, "", captured.String())
+	}
 	if err := ws.Close(); err != nil {
 		log.Println(err)
 	}
 
 	if is_connection_abandoned {
-		saveSessionKey(pa, args, wd)
+		saveSessionKey(sandbox, pa, args, wd)
 	}
 }
 
-func saveSessionKey(pa string, args []string, wd string) {
+func saveSessionKey(sandbox *Sandbox, pa string, args []string, wd string) {
 	args = removeBatchOption(args)
-	var cmd = exec.Command(pa, args...)
+	cmd, err := sandbox.Command(pa, args...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	if "" != wd {
 		cmd.Dir = wd
 	}
@@ -835,53 +1062,58 @@ func lookPath(executableFolder string, alias ...string) (string, bool) {
 	return "", false
 }
 
-func loadCommands(executableFolder string) {
+func loadCommands(executableFolder string) map[string]*Command {
+	commands := map[string]*Command{}
 	for _, nm := range []string{"snmpget", "snmpgetnext", "snmpdf", "snmpbulkget",
 		"snmpbulkwalk", "snmpdelta", "snmpnetstat", "snmpset", "snmpstatus",
 		"snmptable", "snmptest", "snmptools", "snmptranslate", "snmptrap", "snmpusm",
 		"snmpvacm", "snmpwalk", "wshell"} {
+		var c *Command
 		if pa, ok := lookPath(executableFolder, nm); ok {
-			Commands[nm] = pa
+			c = setCommand(commands, nm, pa)
 		} else if pa, ok := lookPath(executableFolder, "netsnmp/"+nm); ok {
-			Commands[nm] = pa
+			c = setCommand(commands, nm, pa)
 		} else if pa, ok := lookPath(executableFolder, "net-snmp/"+nm); ok {
-			Commands[nm] = pa
+			c = setCommand(commands, nm, pa)
 		} else {
-			Commands[nm] = nm
+			c = setCommand(commands, nm, nm)
+		}
+		if strings.HasPrefix(nm, "snmp") {
+			c.DefaultArgs = [][]string{{"-M", "${mibs_dir}"}}
 		}
 	}
 
 	if pa, ok := lookPath(executableFolder, "tpt"); ok {
-		Commands["tpt"] = pa
+		setCommand(commands, "tpt", pa)
 	}
 	if pa, ok := lookPath(executableFolder, "nmap/nping"); ok {
-		Commands["nping"] = pa
+		setCommand(commands, "nping", pa)
 	}
 	if pa, ok := lookPath(executableFolder, "nmap/nmap"); ok {
-		Commands["nmap"] = pa
+		setCommand(commands, "nmap", pa)
 	}
 	if pa, ok := lookPath(executableFolder, "putty/plink", "ssh"); ok {
-		Commands["plink"] = pa
-		Commands["ssh"] = pa
+		setCommand(commands, "plink", pa)
+		setCommand(commands, "ssh", pa)
 	}
 	if pa, ok := lookPath(executableFolder, "dig/dig", "dig"); ok {
-		Commands["dig"] = pa
-		Commands["runtime_env/dig/dig"] = pa
+		setCommand(commands, "dig", pa)
+		setCommand(commands, "runtime_env/dig/dig", pa)
 	}
 	if pa, ok := lookPath(executableFolder, "ping"); ok {
-		Commands["ping"] = pa
+		setCommand(commands, "ping", pa)
 	} else {
-		Commands["ping"] = "ping"
+		setCommand(commands, "ping", "ping")
 	}
 	if pa, ok := lookPath(executableFolder, "tracert"); ok {
-		Commands["tracert"] = pa
+		setCommand(commands, "tracert", pa)
 	} else {
-		Commands["tracert"] = "tracert"
+		setCommand(commands, "tracert", "tracert")
 	}
 	if pa, ok := lookPath(executableFolder, "traceroute"); ok {
-		Commands["traceroute"] = pa
+		setCommand(commands, "traceroute", pa)
 	} else {
-		Commands["traceroute"] = "traceroute"
+		setCommand(commands, "traceroute", "traceroute")
 	}
 
 	var files []string
@@ -906,9 +1138,23 @@ func loadCommands(executableFolder string) {
 	}
 	for _, pa := range files {
 		if s, ok := lookPath(executableFolder, pa); ok {
-			Commands["plink"] = s
+			setCommand(commands, "plink", s)
+		}
+	}
+	return commands
+}
+
+func searchConfFile(executableFolder, name string) string {
+	for _, nm := range []string{filepath.Join("conf", name),
+		filepath.Join("..", "conf", name),
+		filepath.Join(executableFolder, "conf", name),
+		filepath.Join(executableFolder, "..", "conf", name)} {
+		nm = abs(nm)
+		if st, e := os.Stat(nm); nil == e && nil != st && !st.IsDir() {
+			return nm
 		}
 	}
+	return ""
 }
 
 func New(appRoot string) (http.Handler, error) {
@@ -960,62 +1206,41 @@ func New(appRoot string) (http.Handler, error) {
 		}
 	}
 
-	loadCommands(executableFolder)
+	if err := ReloadCommands(); err != nil {
+		return nil, err
+	}
+	go reloadCommandsOnSignal()
 
-	var commandList string
-	for _, nm := range []string{filepath.Join("conf", "commands.list"),
-		filepath.Join("..", "conf", "commands.list"),
-		filepath.Join(executableFolder, "conf", "commands.list"),
-		filepath.Join(executableFolder, "..", "conf", "commands.list")} {
-		nm = abs(nm)
-		if st, e := os.Stat(nm); nil == e && nil != st && !st.IsDir() {
-			commandList = nm
-			break
-		}
+	scheduler, err := newJobScheduler(filepath.Join(LogDir, "scheduler"))
+	if err != nil {
+		return nil, err
 	}
+	Scheduler = scheduler
 
-	if commandList != "" {
-		bs, err := ioutil.ReadFile(commandList)
+	snippets, err := newSnippetStore(filepath.Join(LogDir, "snippets"))
+	if err != nil {
+		return nil, err
+	}
+	Snippets = snippets
+
+	masterKey, err := vaultMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	if "" != masterKey {
+		vault, err := newCredentialStore(filepath.Join(LogDir, "vault"), masterKey)
 		if err != nil {
-			return nil, errors.New("load '" + commandList + "' fail," + err.Error())
+			return nil, err
 		}
+		Vault = vault
+	}
 
-		scanner := bufio.NewScanner(bytes.NewReader(bs))
-		for scanner.Scan() {
-			if len(scanner.Bytes()) == 0 {
-				continue
-			}
-
-			bs := bytes.TrimSpace(bs)
-			if len(bs) == 0 {
-				continue
-			}
-
-			idx := bytes.IndexByte(bs, '=')
-			if idx < 0 {
-				Commands[string(bs)] = string(bs)
-				continue
-			}
-
-			name := bytes.TrimSpace(bs[:idx])
-			value := bytes.TrimSpace(bs[idx+1:])
-
-			if len(name) == 0 {
-				if len(value) == 0 {
-					continue
-				}
-				Commands[string(value)] = string(value)
-				continue
-			}
-
-			if len(value) == 0 {
-				Commands[string(name)] = string(name)
-				continue
-			}
-
-			Commands[string(name)] = string(value)
-		}
-		log.Println("load '" + commandList + "' ok")
+	sink, err := openAuditSink(*audit_log)
+	if err != nil {
+		return nil, err
+	}
+	if old := SetAuditSink(sink); nil != old {
+		old.Close()
 	}
 
 	files = []string{"web-terminal",
@@ -1054,21 +1279,51 @@ func New(appRoot string) (http.Handler, error) {
 		appRoot = "/" + appRoot
 	}
 
-	http.Handle("/replay", websocket.Handler(Replay))
-	http.Handle("/ssh", websocket.Handler(SSHShell))
-	http.Handle("/telnet", websocket.Handler(TelnetShell))
-	http.Handle("/cmd", websocket.Handler(ExecShell))
-	http.Handle("/cmd2", websocket.Handler(ExecShell2))
-	http.Handle("/ssh_exec", websocket.Handler(SSHExec))
-
-	if appRoot != "/" {
-		http.Handle(appRoot+"replay", websocket.Handler(Replay))
-		http.Handle(appRoot+"ssh", websocket.Handler(SSHShell))
-		http.Handle(appRoot+"telnet", websocket.Handler(TelnetShell))
-		http.Handle(appRoot+"cmd", websocket.Handler(ExecShell))
-		http.Handle(appRoot+"cmd2", websocket.Handler(ExecShell2))
-		http.Handle(appRoot+"ssh_exec", websocket.Handler(SSHExec))
-	}
+	handle(appRoot, "replay", websocket.Handler(Replay))
+	handle(appRoot, "ssh", withCredential(websocket.Handler(SSHShell)))
+	handle(appRoot, "telnet", withCredential(websocket.Handler(TelnetShell)))
+	handle(appRoot, "cmd", websocket.Handler(ExecShell))
+	handle(appRoot, "cmd2", websocket.Handler(ExecShell2))
+	handle(appRoot, "ssh_exec", withCredential(websocket.Handler(SSHExec)))
+	handle(appRoot, "script", withCredential(websocket.Handler(RunScript)))
+	handle(appRoot, "batch", websocket.Handler(Batch))
+	handle(appRoot, "batch/reports", http.HandlerFunc(ListBatchReports))
+	handle(appRoot, "batch/report", http.HandlerFunc(GetBatchReport))
+	handle(appRoot, "backups", http.HandlerFunc(ListBackups))
+	handle(appRoot, "backups/run", http.HandlerFunc(RunBackup))
+	handle(appRoot, "backups/content", http.HandlerFunc(GetBackup))
+	handle(appRoot, "backups/diff", http.HandlerFunc(DiffBackups))
+	handle(appRoot, "jobs", JobsHandler(""))
+	for _, action := range []string{"pause", "resume", "delete", "run", "history"} {
+		handle(appRoot, "jobs/"+action, JobsHandler(action))
+	}
+	handle(appRoot, "ping", websocket.Handler(Ping))
+	handle(appRoot, "traceroute", websocket.Handler(Traceroute))
+	handle(appRoot, "snmp/get", withCredential(websocket.Handler(SNMPGet)))
+	handle(appRoot, "snmp/walk", withCredential(websocket.Handler(SNMPWalk)))
+	handle(appRoot, "snmp/bulkwalk", withCredential(websocket.Handler(SNMPBulkWalk)))
+	handle(appRoot, "snmp/set", withCredential(websocket.Handler(SNMPSet)))
+	handle(appRoot, "commands", http.HandlerFunc(ListCommands))
+	handle(appRoot, "commands/reload", http.HandlerFunc(ReloadCommandsHandler))
+	handle(appRoot, "profiles", http.HandlerFunc(ListProfiles))
+	handle(appRoot, "sessions", http.HandlerFunc(SessionsHandler))
+	handle(appRoot, "sessions/", http.HandlerFunc(SessionsHandler))
+	handle(appRoot, "sessions/join", websocket.Handler(JoinSession))
+	handle(appRoot, "sessions/resume", websocket.Handler(ResumeSession))
+	handle(appRoot, "recordings", RecordingsHandler(""))
+	handle(appRoot, "recordings/search", RecordingsHandler("search"))
+	handle(appRoot, "recordings/reindex", RecordingsHandler("reindex"))
+	handle(appRoot, "snippets", SnippetsHandler(""))
+	handle(appRoot, "snippets/delete", SnippetsHandler("delete"))
+	handle(appRoot, "credentials", CredentialsHandler(""))
+	handle(appRoot, "credentials/delete", CredentialsHandler("delete"))
+	handle(appRoot, "parse", http.HandlerFunc(ParseHandler))
+	handle(appRoot, "templates", http.HandlerFunc(ListTemplates))
+	handle(appRoot, "mibs/translate", http.HandlerFunc(TranslateMIB))
+	handle(appRoot, "mibs/tree", http.HandlerFunc(BrowseMIBs))
+	handle(appRoot, "mibs/object", http.HandlerFunc(MIBObject))
+	handle(appRoot, "mibs/search", http.HandlerFunc(SearchMIBs))
+	handle(appRoot, "mibs/reload", http.HandlerFunc(ReloadMIBsHandler))
 
 	templateBox, err := rice.FindBox("static")
 	if err != nil {
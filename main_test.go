@@ -0,0 +1,42 @@
+package terminal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpFile(t *testing.T) {
+	old := LogDir
+	LogDir = filepath.Join(t.TempDir(), "logs")
+	defer func() { LogDir = old }()
+
+	for _, name := range []string{
+		"192.168.1.1.dump_ssh_out.txt",
+		"192.168.1.1_show.dump_ssh_in.txt",
+		"host.dump_telnet_out.txt",
+		filepath.Join(LogDir, "host.dump_telnet_in.txt"),
+	} {
+		actual, err := dumpFile(name)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+		} else if excepted := filepath.Join(LogDir, filepath.Base(name)); excepted != actual {
+			t.Errorf("%q: excepted %q, got %q", name, excepted, actual)
+		}
+	}
+
+	for _, name := range []string{
+		"",
+		"/etc/passwd",
+		"../../etc/passwd",
+		"/etc/x.dump_ssh_out.txt",
+		"../x.dump_ssh_out.txt",
+		filepath.Join(LogDir, "..", "x.dump_ssh_out.txt"),
+		filepath.Join(LogDir, "sub", "x.dump_ssh_out.txt"),
+		"x.dump_ssh_out.txt.bak",
+		"recordings.json",
+	} {
+		if actual, err := dumpFile(name); nil == err {
+			t.Errorf("%q: excepted error, got %q", name, actual)
+		}
+	}
+}
@@ -0,0 +1,810 @@
+package terminal
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MIBNode 是 MIB 树中的一个节点
+type MIBNode struct {
+	Name   string `json:"name"`
+	Module string `json:"module"`
+	OID    string `json:"oid"`
+	// Kind is the macro of the definition, e.g. "OBJECT-TYPE" or
+	// "OBJECT IDENTIFIER".
+	Kind string `json:"kind,omitempty"`
+
+	Syntax      string         `json:"syntax,omitempty"`
+	BaseType    string         `json:"base_type,omitempty"`
+	DisplayHint string         `json:"display_hint,omitempty"`
+	Enums       map[int]string `json:"enums,omitempty"`
+	Access      string         `json:"access,omitempty"`
+	Status      string         `json:"status,omitempty"`
+	Units       string         `json:"units,omitempty"`
+	Index       []string       `json:"index,omitempty"`
+	Description string         `json:"description,omitempty"`
+
+	parent   string
+	subids   []string
+	children []*MIBNode
+}
+
+// textualConvention 是 "Name ::= TEXTUAL-CONVENTION" 或 "Name ::= Type" 定义的类型
+type textualConvention struct {
+	syntax      string
+	displayHint string
+	enums       map[int]string
+}
+
+// MIBTree 是从 mibs_dir 目录中加载的 MIB 定义
+type MIBTree struct {
+	byName map[string][]*MIBNode
+	byOID  map[string]*MIBNode
+	types  map[string]*textualConvention
+}
+
+var (
+	mibLock sync.Mutex
+	mibTree *MIBTree
+)
+
+// MIBs 第一次使用时加载 mibs_dir 目录
+func MIBs() *MIBTree {
+	mibLock.Lock()
+	defer mibLock.Unlock()
+	if nil == mibTree {
+		mibTree = loadMIBTree()
+	}
+	return mibTree
+}
+
+// ReloadMIBs 重新加载 mibs_dir 目录
+func ReloadMIBs() *MIBTree {
+	tree := loadMIBTree()
+	mibLock.Lock()
+	defer mibLock.Unlock()
+	mibTree = tree
+	return tree
+}
+
+func loadMIBTree() *MIBTree {
+	tree := newMIBTree()
+	if "" != *mibs_dir {
+		tree.LoadDir(*mibs_dir)
+	}
+	tree.resolve()
+	return tree
+}
+
+func newMIBTree() *MIBTree {
+	tree := &MIBTree{byName: map[string][]*MIBNode{},
+		byOID: map[string]*MIBNode{},
+		types: map[string]*textualConvention{}}
+	for _, root := range []*MIBNode{
+		{Name: "ccitt", OID: "0"},
+		{Name: "iso", OID: "1"},
+		{Name: "joint-iso-ccitt", OID: "2"}} {
+		tree.add(root)
+	}
+	return tree
+}
+
+func (tree *MIBTree) add(node *MIBNode) {
+	tree.byName[node.Name] = append(tree.byName[node.Name], node)
+}
+
+// LoadDir loads all files in the directory, a file which can't be parsed
+// is skipped.
+func (tree *MIBTree) LoadDir(dir string) {
+	filepath.Walk(dir, func(pa string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		if e := tree.LoadFile(pa); e != nil {
+			log.Println("load mib '"+pa+"' fail,", e)
+		}
+		return nil
+	})
+}
+
+func (tree *MIBTree) LoadFile(pa string) error {
+	bs, err := ioutil.ReadFile(pa)
+	if err != nil {
+		return err
+	}
+	return tree.parse(tokenizeMIB(string(bs)))
+}
+
+// tokenizeMIB splits the ASN.1 text into tokens, comments are removed.
+func tokenizeMIB(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			// a comment ends at the end of line or at the next "--"
+			i += 2
+			for i < len(text) && text[i] != '\n' {
+				if text[i] == '-' && i+1 < len(text) && text[i+1] == '-' {
+					i += 2
+					break
+				}
+				i++
+			}
+		case c == '"':
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				end = len(text) - i - 1
+			}
+			tokens = append(tokens, text[i:i+end+2])
+			i += end + 2
+		case c == ':' && strings.HasPrefix(text[i:], "::="):
+			tokens = append(tokens, "::=")
+			i += 3
+		case c == '.' && strings.HasPrefix(text[i:], ".."):
+			tokens = append(tokens, "..")
+			i += 2
+		case strings.IndexByte("{}()[],;|", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			start := i
+			for i < len(text) && strings.IndexByte(" \t\r\n{}()[],;|\"", text[i]) < 0 &&
+				!strings.HasPrefix(text[i:], "::=") && !strings.HasPrefix(text[i:], "..") &&
+				!strings.HasPrefix(text[i:], "--") {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			tokens = append(tokens, text[start:i])
+		}
+	}
+	return tokens
+}
+
+var mibMacros = map[string]bool{
+	"OBJECT-TYPE":        true,
+	"MODULE-IDENTITY":    true,
+	"OBJECT-IDENTITY":    true,
+	"NOTIFICATION-TYPE":  true,
+	"OBJECT-GROUP":       true,
+	"NOTIFICATION-GROUP": true,
+	"MODULE-COMPLIANCE":  true,
+	"AGENT-CAPABILITIES": true,
+}
+
+func isLowerIdent(s string) bool {
+	return len(s) > 0 && s[0] >= 'a' && s[0] <= 'z'
+}
+
+func (tree *MIBTree) parse(tokens []string) error {
+	module := ""
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		next := func(n int) string {
+			if i+n < len(tokens) {
+				return tokens[i+n]
+			}
+			return ""
+		}
+
+		switch {
+		case "DEFINITIONS" == next(1):
+			module = tok
+		case "MACRO" == next(1):
+			for i < len(tokens) && "END" != tokens[i] {
+				i++
+			}
+		case isLowerIdent(tok) && "OBJECT" == next(1) && "IDENTIFIER" == next(2) && "::=" == next(3):
+			end, err := tree.define(&MIBNode{Name: tok, Module: module, Kind: "OBJECT IDENTIFIER"}, tokens, i+4)
+			if err != nil {
+				return err
+			}
+			i = end
+		case isLowerIdent(tok) && mibMacros[next(1)]:
+			j := i + 2
+			for j < len(tokens) && "::=" != tokens[j] {
+				j++
+			}
+			node := &MIBNode{Name: tok, Module: module, Kind: next(1)}
+			parseClauses(node, tokens[i+2:j])
+			end, err := tree.define(node, tokens, j+1)
+			if err != nil {
+				return err
+			}
+			i = end
+		case !isLowerIdent(tok) && "::=" == next(1) && "TEXTUAL-CONVENTION" == next(2):
+			j := i + 3
+			for j < len(tokens) && "SYNTAX" != tokens[j] {
+				j++
+			}
+			node := &MIBNode{}
+			end := clauseEnd(tokens, j+1)
+			parseClauses(node, tokens[i+3:end])
+			tree.types[tok] = &textualConvention{syntax: node.Syntax, displayHint: node.DisplayHint, enums: node.Enums}
+			i = end - 1
+		case !isLowerIdent(tok) && "::=" == next(1) && ("INTEGER" == next(2) || "OCTET" == next(2) || "Integer32" == next(2) || "Unsigned32" == next(2) || "BITS" == next(2)):
+			end := clauseEnd(tokens, i+3)
+			node := &MIBNode{}
+			parseClauses(node, append([]string{"SYNTAX"}, tokens[i+2:end]...))
+			tree.types[tok] = &textualConvention{syntax: node.Syntax, enums: node.Enums}
+			i = end - 1
+		}
+	}
+	if "" == module {
+		return errors.New("it isn't a mib file")
+	}
+	return nil
+}
+
+var mibClauses = map[string]bool{
+	"SYNTAX":            true,
+	"MAX-ACCESS":        true,
+	"ACCESS":            true,
+	"MIN-ACCESS":        true,
+	"STATUS":            true,
+	"DESCRIPTION":       true,
+	"REFERENCE":         true,
+	"UNITS":             true,
+	"INDEX":             true,
+	"AUGMENTS":          true,
+	"DEFVAL":            true,
+	"DISPLAY-HINT":      true,
+	"OBJECTS":           true,
+	"NOTIFICATIONS":     true,
+	"LAST-UPDATED":      true,
+	"ORGANIZATION":      true,
+	"CONTACT-INFO":      true,
+	"REVISION":          true,
+	"MODULE":            true,
+	"GROUP":             true,
+	"OBJECT":            true,
+	"PRODUCT-RELEASE":   true,
+	"SUPPORTS":          true,
+	"INCLUDES":          true,
+	"VARIATION":         true,
+	"ENTERPRISE":        true,
+	"VARIABLES":         true,
+	"WRITE-SYNTAX":      true,
+	"CREATION-REQUIRES": true,
+}
+
+// clauseEnd returns the position of the next clause keyword or of the next
+// definition after the SYNTAX of a type assignment.
+func clauseEnd(tokens []string, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "{", "(":
+			depth++
+		case "}", ")":
+			depth--
+		default:
+			if depth > 0 {
+				continue
+			}
+			if mibClauses[tokens[i]] && "SYNTAX" != tokens[i] {
+				return i
+			}
+			if i+1 < len(tokens) && ("::=" == tokens[i+1] || mibMacros[tokens[i+1]] || "OBJECT" == tokens[i+1]) {
+				return i
+			}
+			if "END" == tokens[i] {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// parseClauses parses "SYNTAX ... MAX-ACCESS ... DESCRIPTION ..." of a
+// definition.
+func parseClauses(node *MIBNode, tokens []string) {
+	for i := 0; i < len(tokens); {
+		keyword := tokens[i]
+		if !mibClauses[keyword] {
+			i++
+			continue
+		}
+		j := i + 1
+		depth := 0
+		for ; j < len(tokens); j++ {
+			if "{" == tokens[j] || "(" == tokens[j] {
+				depth++
+			} else if "}" == tokens[j] || ")" == tokens[j] {
+				depth--
+			} else if 0 == depth && mibClauses[tokens[j]] {
+				break
+			}
+		}
+		value := tokens[i+1 : j]
+		i = j
+
+		switch keyword {
+		case "SYNTAX":
+			if "" == node.Syntax {
+				node.Syntax, node.Enums = parseSyntax(value)
+			}
+		case "MAX-ACCESS", "ACCESS":
+			node.Access = strings.Join(value, " ")
+		case "STATUS":
+			node.Status = strings.Join(value, " ")
+		case "UNITS":
+			node.Units = unquote(strings.Join(value, " "))
+		case "DISPLAY-HINT":
+			node.DisplayHint = unquote(strings.Join(value, " "))
+		case "DESCRIPTION":
+			if "" == node.Description && len(value) > 0 {
+				node.Description = normalizeDescription(unquote(value[0]))
+			}
+		case "INDEX", "AUGMENTS":
+			for _, s := range value {
+				if "{" != s && "}" != s && "," != s && "IMPLIED" != s {
+					node.Index = append(node.Index, s)
+				}
+			}
+		}
+	}
+}
+
+func unquote(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(s, "\""), "\"")
+}
+
+func normalizeDescription(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// parseSyntax returns the syntax text and the named numbers of
+// "INTEGER { up(1), down(2) }".
+func parseSyntax(tokens []string) (string, map[int]string) {
+	var enums map[int]string
+	var text []string
+	for i := 0; i < len(tokens); i++ {
+		if "{" == tokens[i] && i > 0 && ("INTEGER" == tokens[i-1] || "BITS" == tokens[i-1] || "Integer32" == tokens[i-1]) {
+			enums = map[int]string{}
+			for i++; i < len(tokens) && "}" != tokens[i]; i++ {
+				if "(" == tokens[i] && i > 0 && i+1 < len(tokens) {
+					if n, err := strconv.Atoi(tokens[i+1]); nil == err {
+						enums[n] = tokens[i-1]
+					}
+				}
+			}
+			continue
+		}
+		text = append(text, tokens[i])
+	}
+	syntax := strings.Join(text, " ")
+	syntax = strings.NewReplacer("( ", "(", " )", ")", " .. ", "..").Replace(syntax)
+	return syntax, enums
+}
+
+// define parses the value "{ parent name(1) 2 }" at tokens[start].
+func (tree *MIBTree) define(node *MIBNode, tokens []string, start int) (int, error) {
+	if start >= len(tokens) || "{" != tokens[start] {
+		return start, nil
+	}
+
+	var elements []string
+	i := start + 1
+	for ; i < len(tokens) && "}" != tokens[i]; i++ {
+		if "(" == tokens[i] {
+			if i+2 >= len(tokens) {
+				break
+			}
+			if len(elements) == 0 {
+				return i, errors.New("value of '" + node.Name + "' is invalid")
+			}
+			// "name(1)" uses the number
+			elements[len(elements)-1] = tokens[i+1]
+			i += 2
+			continue
+		}
+		elements = append(elements, tokens[i])
+	}
+	if len(elements) < 2 {
+		return i, errors.New("value of '" + node.Name + "' is invalid")
+	}
+
+	node.parent = elements[0]
+	node.subids = elements[1:]
+	tree.add(node)
+	return i, nil
+}
+
+// resolve computes the oid of nodes.
+func (tree *MIBTree) resolve() {
+	var resolveNode func(node *MIBNode, depth int) string
+	resolveNode = func(node *MIBNode, depth int) string {
+		if "" != node.OID || depth > 128 {
+			return node.OID
+		}
+
+		var prefix string
+		if _, err := strconv.ParseUint(node.parent, 10, 32); nil == err {
+			prefix = node.parent
+		} else if parents := tree.byName[node.parent]; len(parents) > 0 {
+			prefix = resolveNode(tree.lookupParent(node), depth+1)
+		}
+		if "" == prefix {
+			return ""
+		}
+		node.OID = prefix + "." + strings.Join(node.subids, ".")
+		return node.OID
+	}
+
+	for _, nodes := range tree.byName {
+		for _, node := range nodes {
+			if "" != resolveNode(node, 0) {
+				if _, exists := tree.byOID[node.OID]; !exists {
+					tree.byOID[node.OID] = node
+				}
+			}
+		}
+	}
+
+	for oid, node := range tree.byOID {
+		if "" != node.Syntax {
+			tree.resolveType(node)
+		}
+		if idx := strings.LastIndexByte(oid, '.'); idx > 0 {
+			if parent, ok := tree.byOID[oid[:idx]]; ok {
+				parent.children = append(parent.children, node)
+			}
+		}
+	}
+	for _, node := range tree.byOID {
+		sort.Slice(node.children, func(i, j int) bool {
+			return compareOID(node.children[i].OID, node.children[j].OID) < 0
+		})
+	}
+}
+
+// resolveType fills BaseType, DisplayHint and Enums by the textual conventions.
+func (tree *MIBTree) resolveType(node *MIBNode) {
+	fields := strings.Fields(strings.NewReplacer("(", " ", "{", " ").Replace(node.Syntax))
+	if len(fields) == 0 {
+		return
+	}
+	typ := fields[0]
+	if "OCTET" == typ || "OBJECT" == typ || "SEQUENCE" == typ {
+		if len(fields) >= 2 {
+			typ = fields[0] + " " + fields[1]
+		}
+		node.BaseType = typ
+		return
+	}
+
+	for depth := 0; depth < 16; depth++ {
+		tc, ok := tree.types[typ]
+		if !ok || "" == tc.syntax {
+			break
+		}
+		if "" == node.DisplayHint {
+			node.DisplayHint = tc.displayHint
+		}
+		if nil == node.Enums {
+			node.Enums = tc.enums
+		}
+		next := strings.Fields(strings.NewReplacer("(", " ", "{", " ").Replace(tc.syntax))
+		if len(next) == 0 {
+			break
+		}
+		typ = next[0]
+		if ("OCTET" == typ || "OBJECT" == typ) && len(next) >= 2 {
+			typ = next[0] + " " + next[1]
+			break
+		}
+	}
+	node.BaseType = typ
+}
+
+func compareOID(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.ParseUint(as[i], 10, 64)
+		y, _ := strconv.ParseUint(bs[i], 10, 64)
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// lookupParent prefers the parent in the same module.
+func (tree *MIBTree) lookupParent(node *MIBNode) *MIBNode {
+	parents := tree.byName[node.parent]
+	for _, p := range parents {
+		if p.Module == node.Module {
+			return p
+		}
+	}
+	return parents[0]
+}
+
+func isNumericOID(s string) bool {
+	s = strings.TrimPrefix(s, ".")
+	if "" == s {
+		return false
+	}
+	for _, c := range s {
+		if c != '.' && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup finds the node by "name" or "MODULE::name".
+func (tree *MIBTree) Lookup(name string) (*MIBNode, bool) {
+	module := ""
+	if idx := strings.Index(name, "::"); idx >= 0 {
+		module, name = name[:idx], name[idx+2:]
+	}
+	for _, node := range tree.byName[name] {
+		if "" != node.OID && ("" == module || module == node.Module) {
+			return node, true
+		}
+	}
+	return nil, false
+}
+
+// ToOID translates "SNMPv2-MIB::sysDescr.0" or "sysDescr.0" to the
+// numeric oid.
+func (tree *MIBTree) ToOID(name string) (string, error) {
+	if isNumericOID(name) {
+		return strings.TrimPrefix(name, "."), nil
+	}
+
+	base, suffix := name, ""
+	nameStart := 0
+	if idx := strings.Index(name, "::"); idx >= 0 {
+		nameStart = idx + 2
+	}
+	if idx := strings.IndexByte(name[nameStart:], '.'); idx >= 0 {
+		base = name[:nameStart+idx]
+		suffix = name[nameStart+idx:]
+	}
+	node, ok := tree.Lookup(base)
+	if !ok {
+		return "", errors.New("'" + base + "' is not found in mibs")
+	}
+	if "" != suffix && !isNumericOID(suffix) {
+		return "", errors.New("'" + name + "' is invalid")
+	}
+	return node.OID + suffix, nil
+}
+
+// ToName translates the numeric oid to "MODULE::name.suffix", the oid is
+// returned if no node matches.
+func (tree *MIBTree) ToName(oid string) string {
+	oid = strings.TrimPrefix(oid, ".")
+	if node, suffix := tree.Match(oid); nil != node {
+		return node.Module + "::" + node.Name + suffix
+	}
+	return oid
+}
+
+// Match returns the node which is the longest prefix of the oid, and the
+// rest of the oid (the index of an instance).
+func (tree *MIBTree) Match(oid string) (*MIBNode, string) {
+	oid = strings.TrimPrefix(oid, ".")
+	prefix := oid
+	for {
+		if node, ok := tree.byOID[prefix]; ok && "" != node.Module {
+			return node, oid[len(prefix):]
+		}
+		idx := strings.LastIndexByte(prefix, '.')
+		if idx < 0 {
+			return nil, oid
+		}
+		prefix = prefix[:idx]
+	}
+}
+
+// Children returns the child nodes which are sorted by oid.
+func (tree *MIBTree) Children(oid string) []*MIBNode {
+	if node, ok := tree.byOID[strings.TrimPrefix(oid, ".")]; ok {
+		return node.children
+	}
+	var roots []*MIBNode
+	for _, nm := range []string{"ccitt", "iso", "joint-iso-ccitt"} {
+		roots = append(roots, tree.byName[nm][0])
+	}
+	return roots
+}
+
+// Search returns the nodes whose name contains the keyword.
+func (tree *MIBTree) Search(keyword string, limit int) []*MIBNode {
+	keyword = strings.ToLower(keyword)
+	var results []*MIBNode
+	for _, node := range tree.byOID {
+		if strings.Contains(strings.ToLower(node.Name), keyword) {
+			results = append(results, node)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return compareOID(results[i].OID, results[j].OID) < 0
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+type mibTreeNode struct {
+	*MIBNode
+	HasChildren bool           `json:"has_children"`
+	Children    []*mibTreeNode `json:"children,omitempty"`
+}
+
+func toTreeNodes(nodes []*MIBNode, depth int) []*mibTreeNode {
+	results := make([]*mibTreeNode, 0, len(nodes))
+	for _, node := range nodes {
+		tn := &mibTreeNode{MIBNode: node, HasChildren: len(node.children) > 0}
+		if depth > 1 {
+			tn.Children = toTreeNodes(node.children, depth-1)
+		}
+		results = append(results, tn)
+	}
+	return results
+}
+
+// TranslateMIB 转换 oid 和名称， GET /mibs/translate?oid=1.3.6.1.2.1.1.1.0
+// 或 /mibs/translate?name=SNMPv2-MIB::sysDescr.0
+func TranslateMIB(w http.ResponseWriter, r *http.Request) {
+	tree := MIBs()
+	query := r.URL.Query()
+	if oid := query.Get("oid"); "" != oid {
+		if !isNumericOID(oid) {
+			renderError(w, http.StatusBadRequest, "'"+oid+"' isn't a numeric oid")
+			return
+		}
+		node, suffix := tree.Match(oid)
+		if nil == node {
+			renderError(w, http.StatusNotFound, "'"+oid+"' is not found in mibs")
+			return
+		}
+		renderJSON(w, http.StatusOK, map[string]interface{}{
+			"oid":    strings.TrimPrefix(oid, "."),
+			"name":   node.Module + "::" + node.Name + suffix,
+			"object": node,
+			"index":  strings.TrimPrefix(suffix, "."),
+		})
+		return
+	}
+
+	name := query.Get("name")
+	if "" == name {
+		renderError(w, http.StatusBadRequest, "'oid' or 'name' is required")
+		return
+	}
+	oid, err := tree.ToOID(name)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	node, suffix := tree.Match(oid)
+	if nil == node {
+		renderError(w, http.StatusNotFound, "'"+name+"' is not found in mibs")
+		return
+	}
+	renderJSON(w, http.StatusOK, map[string]interface{}{
+		"oid":    oid,
+		"name":   node.Module + "::" + node.Name + suffix,
+		"object": node,
+		"index":  strings.TrimPrefix(suffix, "."),
+	})
+}
+
+// maxMIBTreeDepth 是 /mibs/tree 的 depth 的最大值
+const maxMIBTreeDepth = 5
+
+// BrowseMIBs 返回 oid 的子节点， GET /mibs/tree?oid=1.3.6.1.2.1&depth=2，
+// oid 为空时返回根节点， depth 不能超过 maxMIBTreeDepth
+func BrowseMIBs(w http.ResponseWriter, r *http.Request) {
+	tree := MIBs()
+	query := r.URL.Query()
+	depth := 1
+	if s := query.Get("depth"); "" != s {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 1 || i > maxMIBTreeDepth {
+			renderError(w, http.StatusBadRequest, "'depth' is invalid, it must be between 1 and "+strconv.Itoa(maxMIBTreeDepth))
+			return
+		}
+		depth = i
+	}
+
+	oid := query.Get("oid")
+	if "" != oid && !isNumericOID(oid) {
+		s, err := tree.ToOID(oid)
+		if err != nil {
+			renderError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		oid = s
+	}
+	if "" != oid {
+		if _, ok := tree.byOID[strings.TrimPrefix(oid, ".")]; !ok {
+			renderError(w, http.StatusNotFound, "'"+oid+"' is not found in mibs")
+			return
+		}
+	}
+	renderJSON(w, http.StatusOK, toTreeNodes(tree.Children(oid), depth))
+}
+
+// MIBObject 返回对象的定义， GET /mibs/object?name=ifOperStatus 或 ?oid=
+func MIBObject(w http.ResponseWriter, r *http.Request) {
+	tree := MIBs()
+	query := r.URL.Query()
+	name := query.Get("name")
+	if "" == name {
+		name = query.Get("oid")
+	}
+	if "" == name {
+		renderError(w, http.StatusBadRequest, "'oid' or 'name' is required")
+		return
+	}
+	oid, err := tree.ToOID(name)
+	if err != nil {
+		renderError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	node, ok := tree.byOID[oid]
+	if !ok {
+		renderError(w, http.StatusNotFound, "'"+name+"' is not found in mibs")
+		return
+	}
+	renderJSON(w, http.StatusOK, &mibTreeNode{MIBNode: node, HasChildren: len(node.children) > 0})
+}
+
+// SearchMIBs 按名称查找对象， GET /mibs/search?q=ifOper&limit=100
+func SearchMIBs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if "" == q {
+		renderError(w, http.StatusBadRequest, "'q' is required")
+		return
+	}
+	limit := 100
+	if s := query.Get("limit"); "" != s {
+		if i, err := strconv.Atoi(s); nil == err && i > 0 {
+			limit = i
+		}
+	}
+	renderJSON(w, http.StatusOK, MIBs().Search(q, limit))
+}
+
+// ReloadMIBsHandler 重新加载 mibs 目录， POST /mibs/reload
+func ReloadMIBsHandler(w http.ResponseWriter, r *http.Request) {
+	if "POST" != r.Method {
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		return
+	}
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	tree := ReloadMIBs()
+	renderJSON(w, http.StatusOK, map[string]interface{}{"count": len(tree.byOID)})
+}
@@ -0,0 +1,120 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMIB = `TEST-MIB DEFINITIONS ::= BEGIN
+IMPORTS enterprises FROM SNMPv2-SMI;
+
+test OBJECT IDENTIFIER ::= { iso 3 6 1 4 1 99999 }
+
+testStatus OBJECT-TYPE
+    SYNTAX      INTEGER { up(1), down(2) }
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "the status"
+    ::= { test 1 }
+
+-- SYNTAX 不完整时不能 panic
+testBroken OBJECT-TYPE
+    SYNTAX      OCTET
+    MAX-ACCESS  read-only
+    STATUS      current
+    ::= { test 2 }
+END
+`
+
+func withTestMIBs(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "TEST-MIB.txt"), []byte(testMIB), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := *mibs_dir
+	*mibs_dir = dir
+	ReloadMIBs()
+	t.Cleanup(func() {
+		*mibs_dir = old
+		ReloadMIBs()
+	})
+}
+
+func TestMIBParse(t *testing.T) {
+	tree := newMIBTree()
+	for _, text := range []string{
+		"A DEFINITIONS ::= BEGIN x OBJECT IDENTIFIER ::= { (1) 2 } END",
+		"A DEFINITIONS ::= BEGIN z OBJECT-TYPE SYNTAX ( MAX-ACCESS read-only ::= { iso 4 } END",
+	} {
+		tree.parse(tokenizeMIB(text))
+	}
+	tree.resolve()
+
+	withTestMIBs(t)
+	oid, err := MIBs().ToOID("TEST-MIB::testStatus.0")
+	if err != nil || "1.3.6.1.4.1.99999.1.0" != oid {
+		t.Fatalf("excepted 1.3.6.1.4.1.99999.1.0, got %q, %v", oid, err)
+	}
+	if name := MIBs().ToName("1.3.6.1.4.1.99999.1.0"); "TEST-MIB::testStatus.0" != name {
+		t.Errorf("excepted TEST-MIB::testStatus.0, got %q", name)
+	}
+}
+
+func TestTranslateMIB(t *testing.T) {
+	withTestMIBs(t)
+
+	for _, test := range []struct {
+		query string
+		code  int
+		name  string
+	}{
+		{"oid=1.3.6.1.4.1.99999.1.0", http.StatusOK, "TEST-MIB::testStatus.0"},
+		{"name=testStatus.3", http.StatusOK, "TEST-MIB::testStatus.3"},
+		{"name=noSuchName", http.StatusNotFound, ""},
+		// 数字的 name 不在 MIB 中时返回 404
+		{"name=5.3.6.1", http.StatusNotFound, ""},
+		{"oid=5.3.6.1", http.StatusNotFound, ""},
+		{"oid=abc", http.StatusBadRequest, ""},
+		{"", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		TranslateMIB(w, httptest.NewRequest("GET", "/mibs/translate?"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("%q: excepted %d, got %d %s", test.query, test.code, w.Code, w.Body.String())
+			continue
+		}
+		if "" != test.name {
+			var result struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &result)
+			if result.Name != test.name {
+				t.Errorf("%q: excepted %q, got %q", test.query, test.name, result.Name)
+			}
+		}
+	}
+}
+
+func TestBrowseMIBsDepth(t *testing.T) {
+	withTestMIBs(t)
+
+	for query, code := range map[string]int{
+		"oid=test":              http.StatusOK,
+		"depth=5":               http.StatusOK,
+		"depth=6":               http.StatusBadRequest,
+		"depth=1000":            http.StatusBadRequest,
+		"depth=0":               http.StatusBadRequest,
+		"oid=1.3.6.1.4.1.12345": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		BrowseMIBs(w, httptest.NewRequest("GET", "/mibs/tree?"+query, nil))
+		if w.Code != code {
+			t.Errorf("%q: excepted %d, got %d %s", query, code, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/runner-mei/web-terminal/textfsm"
+)
+
+// OutputTemplate 是一个解析命令输出的模板， Type 可以是 textfsm (缺省) 或
+// regex， regex 模板的每一个匹配是一行， 命名分组是列
+type OutputTemplate struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Commands 是正则表达式， parse=auto 时用它们选择模板
+	Commands []string `json:"commands,omitempty"`
+	// Profiles 是适用的设备类型， 空表示任意的设备
+	Profiles []string `json:"profiles,omitempty"`
+	Text     string   `json:"text,omitempty"`
+	// File 是模板的文件， 相对于配置文件所在的目录
+	File string `json:"file,omitempty"`
+
+	fsm      *textfsm.Template
+	re       *regexp.Regexp
+	commands []*regexp.Regexp
+}
+
+// ParsedOutput 是解析的结果， 它以 "%tpt_parsed%" 加上 JSON 的格式发送给浏览器
+type ParsedOutput struct {
+	Template string           `json:"template,omitempty"`
+	Rows     []textfsm.Record `json:"rows"`
+	Error    string           `json:"error,omitempty"`
+}
+
+func (t *OutputTemplate) compile() error {
+	var err error
+	switch t.Type {
+	case "", "textfsm":
+		t.Type = "textfsm"
+		t.fsm, err = textfsm.Parse(t.Text)
+	case "regex":
+		t.re, err = regexp.Compile("(?m)" + t.Text)
+		if nil == err && len(t.re.SubexpNames()) < 2 {
+			err = errors.New("named groups are required")
+		}
+	default:
+		err = errors.New("type '" + t.Type + "' is unsupported")
+	}
+	if err != nil {
+		return errors.New("template '" + t.Name + "' is invalid, " + err.Error())
+	}
+
+	t.commands = nil
+	for _, s := range t.Commands {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return errors.New("command '" + s + "' of template '" + t.Name + "' is invalid, " + err.Error())
+		}
+		t.commands = append(t.commands, re)
+	}
+	return nil
+}
+
+// Execute 解析文本
+func (t *OutputTemplate) Execute(text string) ([]textfsm.Record, error) {
+	text = ansiEscape.ReplaceAllString(text, "")
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if "regex" != t.Type {
+		return t.fsm.Execute(text)
+	}
+
+	rows := []textfsm.Record{}
+	names := t.re.SubexpNames()
+	for _, m := range t.re.FindAllStringSubmatch(text, -1) {
+		row := textfsm.Record{}
+		for i, name := range names {
+			if "" != name {
+				row[name] = strings.TrimSpace(m[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (t *OutputTemplate) matches(command, profile string) bool {
+	if len(t.Profiles) > 0 {
+		found := false
+		for _, p := range t.Profiles {
+			if p == profile {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, re := range t.commands {
+		if re.MatchString(strings.TrimSpace(command)) {
+			return true
+		}
+	}
+	return false
+}
+
+var templates map[string]*OutputTemplate
+
+func init() {
+	results := map[string]*OutputTemplate{}
+	for _, t := range defaultTemplates {
+		if err := t.compile(); err != nil {
+			panic(err)
+		}
+		results[t.Name] = t
+	}
+	templates = results
+}
+
+// readTemplates 读取 templates.json， 文件中的模板会覆盖同名的内置模板，
+// file 为空时只返回内置的模板
+func readTemplates(file string) (map[string]*OutputTemplate, error) {
+	results := map[string]*OutputTemplate{}
+	for _, t := range defaultTemplates {
+		results[t.Name] = t
+	}
+	if "" == file {
+		return results, nil
+	}
+
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	var custom []*OutputTemplate
+	if err := json.Unmarshal(bs, &custom); err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	for _, t := range custom {
+		if "" == t.Name {
+			return nil, errors.New("load '" + file + "' fail, name of template is required")
+		}
+		if "" != t.File {
+			text, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), t.File))
+			if err != nil {
+				return nil, errors.New("load '" + file + "' fail," + err.Error())
+			}
+			t.Text = string(text)
+		}
+		if err := t.compile(); err != nil {
+			return nil, errors.New("load '" + file + "' fail," + err.Error())
+		}
+		results[t.Name] = t
+	}
+	return results, nil
+}
+
+// templatesFor 返回 name 指定的模板， name 为 auto 时返回所有匹配命令和
+// 设备类型的模板
+func templatesFor(name, command, profile string) ([]*OutputTemplate, error) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	if "auto" != name {
+		t, ok := templates[name]
+		if !ok {
+			return nil, errors.New("template '" + name + "' is not found")
+		}
+		return []*OutputTemplate{t}, nil
+	}
+
+	var results []*OutputTemplate
+	for _, t := range templates {
+		if t.matches(command, profile) {
+			results = append(results, t)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		// 指定了设备类型的模板优先
+		if len(results[i].Profiles) != len(results[j].Profiles) {
+			return len(results[i].Profiles) > len(results[j].Profiles)
+		}
+		return results[i].Name < results[j].Name
+	})
+	if len(results) == 0 {
+		return nil, errors.New("no template matches '" + command + "'")
+	}
+	return results, nil
+}
+
+// parseOutput 用模板解析输出， name 为 auto 时使用第一个有结果的模板
+func parseOutput(name, command, profile, output string) *ParsedOutput {
+	candidates, err := templatesFor(name, command, profile)
+	if err != nil {
+		return &ParsedOutput{Rows: []textfsm.Record{}, Error: err.Error()}
+	}
+
+	var result *ParsedOutput
+	for _, t := range candidates {
+		rows, err := t.Execute(output)
+		if err != nil {
+			if nil == result {
+				result = &ParsedOutput{Template: t.Name, Rows: []textfsm.Record{}, Error: err.Error()}
+			}
+			continue
+		}
+		if nil == rows {
+			rows = []textfsm.Record{}
+		}
+		if len(rows) > 0 || nil == result || "" != result.Error {
+			result = &ParsedOutput{Template: t.Name, Rows: rows}
+		}
+		if len(rows) > 0 {
+			break
+		}
+	}
+	return result
+}
+
+// writeParsed 发送 "%tpt_parsed%" 加上 JSON 格式的解析结果
+func writeParsed(w io.Writer, name, command, profile, output string) {
+	bs, _ := json.Marshal(parseOutput(name, command, profile, output))
+	io.WriteString(w, "%tpt_parsed%"+string(bs))
+}
+
+// ParseHandler 解析文本， POST /parse， 请求是
+//
+//	{"template": "cisco_ios_show_ip_interface_brief", "output": "..."}
+//	{"template": "auto", "command": "show ip int brief", "profile": "cisco", "output": "..."}
+//	{"type": "textfsm", "text": "Value ...", "output": "..."}
+func ParseHandler(w http.ResponseWriter, r *http.Request) {
+	if "POST" != r.Method {
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		return
+	}
+	var req struct {
+		Template string `json:"template"`
+		Command  string `json:"command"`
+		Profile  string `json:"profile"`
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Output   string `json:"output"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderError(w, http.StatusBadRequest, "request is invalid, "+err.Error())
+		return
+	}
+
+	if "" != req.Text {
+		t := &OutputTemplate{Name: "inline", Type: req.Type, Text: req.Text}
+		if err := t.compile(); err != nil {
+			renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rows, err := t.Execute(req.Output)
+		if err != nil {
+			renderError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if nil == rows {
+			rows = []textfsm.Record{}
+		}
+		renderJSON(w, http.StatusOK, &ParsedOutput{Rows: rows})
+		return
+	}
+
+	if "" == req.Template {
+		req.Template = "auto"
+	}
+	result := parseOutput(req.Template, req.Command, req.Profile, req.Output)
+	if "" != result.Error {
+		renderJSON(w, http.StatusBadRequest, result)
+		return
+	}
+	renderJSON(w, http.StatusOK, result)
+}
+
+// ListTemplates 返回所有的模板， GET /templates
+func ListTemplates(w http.ResponseWriter, r *http.Request) {
+	configLock.RLock()
+	results := make([]*OutputTemplate, 0, len(templates))
+	for _, t := range templates {
+		results = append(results, t)
+	}
+	configLock.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	renderJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,82 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const showIPIntBrief = `Interface              IP-Address      OK? Method Status                Protocol
+GigabitEthernet0/0     10.0.0.1        YES manual up                    up
+GigabitEthernet0/1     unassigned      YES unset  administratively down down
+`
+
+func TestParseOutput(t *testing.T) {
+	result := parseOutput("auto", "sh ip int br", "cisco", showIPIntBrief)
+	if "" != result.Error || "cisco_ios_show_ip_interface_brief" != result.Template {
+		t.Fatalf("excepted cisco_ios_show_ip_interface_brief, got %+v", result)
+	}
+	if 2 != len(result.Rows) {
+		t.Fatalf("excepted 2 rows, got %v", result.Rows)
+	}
+	if "10.0.0.1" != result.Rows[0]["IP_ADDRESS"] || "administratively down" != result.Rows[1]["STATUS"] {
+		t.Errorf("rows are invalid, got %v", result.Rows)
+	}
+
+	if result := parseOutput("auto", "uptime", "cisco", "x"); "" == result.Error {
+		t.Errorf("excepted error, got %+v", result)
+	}
+	if result := parseOutput("not_exists", "", "", "x"); "" == result.Error {
+		t.Errorf("excepted error, got %+v", result)
+	}
+}
+
+func TestReadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "templates.json")
+	if err := os.WriteFile(filepath.Join(dir, "uptime.textfsm"),
+		[]byte("Value USERS (\\d+)\n\nStart\n  ^.*\\s${USERS}\\s+users? -> Record\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(`[
+  {"name": "uptime", "commands": ["^uptime$"], "file": "uptime.textfsm"},
+  {"name": "df", "type": "regex", "text": "^(?P<fs>\\S+)\\s+(?P<size>\\d+)"}
+]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results, err := readTemplates(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nil == results["uptime"] || nil == results["df"] || nil == results["cisco_ios_show_version"] {
+		t.Fatalf("excepted custom and builtin templates, got %v", results)
+	}
+	rows, err := results["uptime"].Execute(" 10:00:00 up 1 day,  3 users,  load average: 0.00\n")
+	if err != nil || 1 != len(rows) || "3" != rows[0]["USERS"] {
+		t.Errorf("excepted USERS=3, got %v, %v", rows, err)
+	}
+	rows, err = results["df"].Execute("/dev/sda1 100\n/dev/sdb1 200\n")
+	if err != nil || 2 != len(rows) || "/dev/sdb1" != rows[1]["fs"] || "200" != rows[1]["size"] {
+		t.Errorf("excepted 2 rows, got %v, %v", rows, err)
+	}
+
+	// 文件不存在时只有内置的模板
+	results, err = readTemplates("")
+	if err != nil || len(defaultTemplates) != len(results) {
+		t.Errorf("excepted builtin templates, got %v, %v", results, err)
+	}
+
+	for _, text := range []string{
+		`[{"text": "Value A (\\d+)\n\nStart\n"}]`,
+		`[{"name": "x", "type": "regex", "text": "\\d+"}]`,
+		`[{"name": "x", "type": "unknown", "text": "x"}]`,
+		`[{"name": "x", "file": "not_exists.textfsm"}]`,
+	} {
+		if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTemplates(file); nil == err {
+			t.Errorf("%s: excepted error, got ok", text)
+		}
+	}
+}
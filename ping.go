@@ -0,0 +1,378 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// icmpConn 优先使用非特权的 datagram socket， 不允许时再使用 raw socket
+type icmpConn struct {
+	*icmp.PacketConn
+	ipv6       bool
+	privileged bool
+}
+
+func listenICMP(isIPv6, privileged bool) (*icmpConn, error) {
+	network, address := "udp4", "0.0.0.0"
+	if isIPv6 {
+		network, address = "udp6", "::"
+	}
+	if !privileged {
+		if c, err := icmp.ListenPacket(network, address); nil == err {
+			return &icmpConn{PacketConn: c, ipv6: isIPv6}, nil
+		}
+	}
+
+	network = "ip4:icmp"
+	if isIPv6 {
+		network = "ip6:ipv6-icmp"
+	}
+	c, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		if os.IsPermission(err) {
+			return nil, errors.New("no permission to open icmp socket, please enable net.ipv4.ping_group_range or run with CAP_NET_RAW")
+		}
+		return nil, err
+	}
+	return &icmpConn{PacketConn: c, ipv6: isIPv6, privileged: true}, nil
+}
+
+func (c *icmpConn) proto() int {
+	if c.ipv6 {
+		return protocolIPv6ICMP
+	}
+	return protocolICMP
+}
+
+func (c *icmpConn) addr(ip net.IP) net.Addr {
+	if c.privileged {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+func (c *icmpConn) setTTL(ttl int) error {
+	if c.ipv6 {
+		return c.IPv6PacketConn().SetHopLimit(ttl)
+	}
+	return c.IPv4PacketConn().SetTTL(ttl)
+}
+
+func (c *icmpConn) enableTTL() {
+	if c.ipv6 {
+		c.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		c.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+}
+
+// read returns the message, the ttl (0 if it is unknown) and the peer.
+func (c *icmpConn) read(b []byte) (*icmp.Message, int, net.IP, error) {
+	var n, ttl int
+	var peer net.Addr
+	var err error
+	if c.ipv6 {
+		var cm *ipv6.ControlMessage
+		n, cm, peer, err = c.IPv6PacketConn().ReadFrom(b)
+		if nil != cm {
+			ttl = cm.HopLimit
+		}
+	} else {
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = c.IPv4PacketConn().ReadFrom(b)
+		if nil != cm {
+			ttl = cm.TTL
+		}
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	msg, err := icmp.ParseMessage(c.proto(), b[:n])
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return msg, ttl, addrIP(peer), nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func echoRequest(isIPv6 bool) icmp.Type {
+	if isIPv6 {
+		return ipv6.ICMPTypeEchoRequest
+	}
+	return ipv4.ICMPTypeEcho
+}
+
+func isEchoReply(t icmp.Type) bool {
+	return t == ipv4.ICMPTypeEchoReply || t == ipv6.ICMPTypeEchoReply
+}
+
+func resolveIP(host string, isIPv6 bool) (net.IP, error) {
+	network := "ip4"
+	if isIPv6 {
+		network = "ip6"
+	}
+	addr, err := net.ResolveIPAddr(network, host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// probeOutput 将探测结果以 json 或文本格式写到 websocket
+type probeOutput struct {
+	ws     *websocket.Conn
+	isJSON bool
+}
+
+func newProbeOutput(ws *websocket.Conn) *probeOutput {
+	return &probeOutput{ws: ws, isJSON: "json" == strings.ToLower(ws.Request().URL.Query().Get("format"))}
+}
+
+func (out *probeOutput) emit(value interface{}, text string) error {
+	if out.isJSON {
+		return websocket.JSON.Send(out.ws, value)
+	}
+	if "" == text {
+		return nil
+	}
+	_, err := io.WriteString(out.ws, text+"\r\n")
+	return err
+}
+
+func (out *probeOutput) fail(err error) {
+	if out.isJSON {
+		websocket.JSON.Send(out.ws, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	logString(out.ws, err.Error())
+}
+
+func toMillisecond(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+func queryDuration(s string, value time.Duration) time.Duration {
+	if "" == s {
+		return value
+	}
+	if t, e := time.ParseDuration(s); nil == e {
+		return t
+	}
+	if ms, e := strconv.ParseInt(s, 10, 64); nil == e {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return value
+}
+
+const (
+	maxPingCount    = 1000
+	minPingInterval = 200 * time.Millisecond
+	maxPingInterval = 10 * time.Second
+	// maxProbeTimeout 是 ping 和 traceroute 等待一次应答的最长时间
+	maxProbeTimeout = 10 * time.Second
+)
+
+// probeTimeout 读取等待应答的时间， 不大于 0 时使用 value， 超过
+// maxProbeTimeout 时使用 maxProbeTimeout
+func probeTimeout(s string, value time.Duration) time.Duration {
+	timeout := queryDuration(s, value)
+	if timeout <= 0 {
+		return value
+	}
+	if timeout > maxProbeTimeout {
+		return maxProbeTimeout
+	}
+	return timeout
+}
+
+type PingResult struct {
+	Seq     int     `json:"seq"`
+	Addr    string  `json:"addr"`
+	Size    int     `json:"size"`
+	TTL     int     `json:"ttl,omitempty"`
+	RTT     float64 `json:"rtt_ms,omitempty"`
+	Timeout bool    `json:"timeout,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type PingSummary struct {
+	Addr     string  `json:"addr"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"`
+	Min      float64 `json:"min_ms"`
+	Avg      float64 `json:"avg_ms"`
+	Max      float64 `json:"max_ms"`
+}
+
+// Ping 用 ICMP echo 探测主机， 参数有 hostname, count, size, timeout,
+// interval, ipv6 和 format(json 或 text)， count 不能超过 maxPingCount，
+// interval 在 minPingInterval 和 maxPingInterval 之间， timeout 不超过
+// maxProbeTimeout
+func Ping(ws *websocket.Conn) {
+	defer ws.Close()
+
+	query_params := ws.Request().URL.Query()
+	hostname := query_params.Get("hostname")
+	count := toInt(query_params.Get("count"), 4)
+	size := toInt(query_params.Get("size"), 32)
+	timeout := probeTimeout(query_params.Get("timeout"), 1*time.Second)
+	interval := queryDuration(query_params.Get("interval"), 1*time.Second)
+	useIPv6 := "true" == strings.ToLower(query_params.Get("ipv6"))
+	out := newProbeOutput(ws)
+
+	if size < 0 || size > 65500 {
+		out.fail(errors.New("size '" + strconv.Itoa(size) + "' is invalid"))
+		return
+	}
+	if count <= 0 || count > maxPingCount {
+		out.fail(errors.New("count '" + strconv.Itoa(count) + "' is invalid, it must be between 1 and " + strconv.Itoa(maxPingCount)))
+		return
+	}
+	if interval < minPingInterval {
+		interval = minPingInterval
+	} else if interval > maxPingInterval {
+		interval = maxPingInterval
+	}
+
+	ip, err := resolveIP(hostname, useIPv6)
+	if err != nil {
+		out.fail(err)
+		return
+	}
+	if err := allowTargetIP(ws.Request(), "ping", hostname, ip); err != nil {
+		out.fail(err)
+		return
+	}
+
+	c, err := listenICMP(useIPv6, false)
+	if err != nil {
+		out.fail(err)
+		return
+	}
+	defer c.Close()
+	c.enableTTL()
+
+	summary := PingSummary{Addr: ip.String()}
+	out.emit(map[string]interface{}{"addr": ip.String(), "hostname": hostname, "size": size},
+		"Pinging "+hostname+" ["+ip.String()+"] with "+strconv.Itoa(size)+" bytes of data:")
+
+	id := os.Getpid() & 0xffff
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte('a' + i%23)
+	}
+
+	var total float64
+	buf := make([]byte, 65536)
+	for seq := 0; seq < count; seq++ {
+		started := time.Now()
+		result := PingResult{Seq: seq, Addr: ip.String(), Size: size}
+
+		bs, err := (&icmp.Message{Type: echoRequest(useIPv6), Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq & 0xffff, Data: payload}}).Marshal(nil)
+		if nil == err {
+			_, err = c.WriteTo(bs, c.addr(ip))
+		}
+		summary.Sent++
+
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			c.SetReadDeadline(started.Add(timeout))
+			for {
+				msg, ttl, peer, err := c.read(buf)
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						result.Timeout = true
+					} else {
+						result.Error = err.Error()
+					}
+					break
+				}
+				if !isEchoReply(msg.Type) || !peer.Equal(ip) {
+					continue
+				}
+				echo, ok := msg.Body.(*icmp.Echo)
+				if !ok || echo.Seq != seq&0xffff || (c.privileged && echo.ID != id) {
+					continue
+				}
+
+				result.TTL = ttl
+				result.RTT = toMillisecond(time.Since(started))
+				break
+			}
+		}
+
+		var text string
+		switch {
+		case "" != result.Error:
+			text = "General failure: " + result.Error
+		case result.Timeout:
+			text = "Request timed out."
+		default:
+			summary.Received++
+			total += result.RTT
+			if 1 == summary.Received || result.RTT < summary.Min {
+				summary.Min = result.RTT
+			}
+			if result.RTT > summary.Max {
+				summary.Max = result.RTT
+			}
+			text = fmt.Sprintf("Reply from %s: bytes=%d time=%.3fms", result.Addr, result.Size, result.RTT)
+			if result.TTL > 0 {
+				text += " TTL=" + strconv.Itoa(result.TTL)
+			}
+		}
+		if err := out.emit(&result, text); err != nil {
+			return
+		}
+
+		if seq+1 < count {
+			if d := interval - time.Since(started); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+
+	if summary.Sent > 0 {
+		summary.Loss = math.Round(float64(summary.Sent-summary.Received)*10000/float64(summary.Sent)) / 100
+	}
+	if summary.Received > 0 {
+		summary.Avg = math.Round(total*1000/float64(summary.Received)) / 1000
+	}
+	out.emit(map[string]interface{}{"summary": &summary},
+		fmt.Sprintf("\r\nPing statistics for %s:\r\n    Packets: Sent = %d, Received = %d, Lost = %d (%v%% loss),\r\n"+
+			"Approximate round trip times in milli-seconds:\r\n    Minimum = %.3fms, Maximum = %.3fms, Average = %.3fms",
+			summary.Addr, summary.Sent, summary.Received, summary.Sent-summary.Received, summary.Loss,
+			summary.Min, summary.Max, summary.Avg))
+}
@@ -0,0 +1,261 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PolicyRule 是一条危险命令的规则， Pattern 匹配交互会话中输入的命令行，
+// Action 可以是
+//
+//	block   不执行命令， 并清除输入的命令行
+//	warn    执行命令， 并提示用户
+//	confirm 用户用 %tpt%{"confirm":true} 确认后才执行
+//
+// Groups 和 Profiles 为空时规则对所有的主机和设备类型有效
+type PolicyRule struct {
+	Name     string   `json:"name,omitempty"`
+	Pattern  string   `json:"pattern"`
+	Action   string   `json:"action"`
+	Message  string   `json:"message,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Profiles []string `json:"profiles,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// CommandPolicy 是 command_policy.json 的内容， Groups 是主机组， 每一项
+// 可以是 IP、 CIDR 或主机名的通配符 (如 core-*)
+type CommandPolicy struct {
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []*PolicyRule       `json:"rules"`
+}
+
+// defaultCommandPolicy 在 command_policy.json 不存在时使用
+const defaultCommandPolicy = `{
+  "rules": [
+    {"name": "rm-root", "pattern": "\\brm\\s+(-[\\w-]+\\s+)*(-\\w*[rR]\\w*|--recursive)\\s+(-[\\w-]+\\s+)*/\\*?(\\s|$)", "action": "block", "message": "deleting the root directory isn't allowed"},
+    {"name": "reload", "pattern": "(?i)^\\s*(reload|reboot)\\b", "action": "confirm", "message": "the device will be restarted"},
+    {"name": "erase-config", "pattern": "(?i)^\\s*(erase\\s+(startup-config|nvram:|flash:)|write\\s+erase|reset\\s+saved-configuration)", "action": "confirm", "message": "the saved configuration will be erased"},
+    {"name": "format", "pattern": "(?i)^\\s*(format|mkfs(\\.\\w+)?)\\b", "action": "confirm", "message": "the file system will be formatted"}
+  ]
+}`
+
+var commandPolicy *CommandPolicy
+
+func init() {
+	var err error
+	commandPolicy, err = parseCommandPolicy([]byte(defaultCommandPolicy))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func parseCommandPolicy(bs []byte) (*CommandPolicy, error) {
+	var policy CommandPolicy
+	if err := json.Unmarshal(bs, &policy); err != nil {
+		return nil, err
+	}
+	for idx, rule := range policy.Rules {
+		if "" == rule.Name {
+			rule.Name = "#" + strconv.Itoa(idx+1)
+		}
+		switch rule.Action {
+		case "block", "warn", "confirm":
+		default:
+			return nil, errors.New("action '" + rule.Action + "' of rule '" + rule.Name + "' is invalid, it must be block, warn or confirm")
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, errors.New("pattern of rule '" + rule.Name + "' is invalid, " + err.Error())
+		}
+		rule.re = re
+		for _, group := range rule.Groups {
+			if _, ok := policy.Groups[group]; !ok {
+				return nil, errors.New("group '" + group + "' of rule '" + rule.Name + "' is not found")
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// readCommandPolicy 读取 command_policy.json， 它替换内置的规则， file 为
+// 空时返回内置的规则
+func readCommandPolicy(file string) (*CommandPolicy, error) {
+	if "" == file {
+		return parseCommandPolicy([]byte(defaultCommandPolicy))
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	policy, err := parseCommandPolicy(bs)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	return policy, nil
+}
+
+// inGroup 判断 hosts 中的任何一个 (主机名或 IP) 是否在主机组中
+func (policy *CommandPolicy) inGroup(group string, hosts []string) bool {
+	for _, host := range hosts {
+		if policy.inGroupHost(group, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *CommandPolicy) inGroupHost(group, host string) bool {
+	ip := net.ParseIP(host)
+	for _, s := range policy.Groups[group] {
+		if strings.Contains(s, "/") {
+			if _, ipnet, err := net.ParseCIDR(s); nil == err && nil != ip && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(s, host) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(s), strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match 返回 command 匹配的第一条规则， 没有匹配时返回 nil， hosts 是
+// 目标的主机名和解析后的 IP
+func (policy *CommandPolicy) Match(hosts []string, profile, command string) *PolicyRule {
+	for _, rule := range policy.Rules {
+		if len(rule.Profiles) > 0 && !containsString(rule.Profiles, profile) {
+			continue
+		}
+		if len(rule.Groups) > 0 {
+			found := false
+			for _, group := range rule.Groups {
+				if policy.inGroup(group, hosts) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if rule.re.MatchString(command) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPolicy 按会话的主机和设备类型检查命令， 主机名和解析后的 IP 都用于
+// 匹配主机组， 用主机名连接时 CIDR 也可以匹配
+func (sess *LiveSession) matchPolicy(command string) *PolicyRule {
+	host := sess.Target
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	hosts := []string{host}
+	if "" != sess.Address && host != sess.Address {
+		hosts = append(hosts, sess.Address)
+	}
+	configLock.RLock()
+	defer configLock.RUnlock()
+	if nil == commandPolicy {
+		return nil
+	}
+	return commandPolicy.Match(hosts, sess.Profile, command)
+}
+
+// policyMessage 是规则匹配时发给浏览器的 "%tpt_policy%" 消息
+type policyMessage struct {
+	Action  string `json:"action"`
+	Rule    string `json:"rule"`
+	Command string `json:"command"`
+	Message string `json:"message,omitempty"`
+}
+
+// sendPolicy 将消息发给会话的所有者和观察者
+func (sess *LiveSession) sendPolicy(msg *policyMessage) {
+	bs, _ := json.Marshal(msg)
+	bs = append([]byte("%tpt_policy%"), bs...)
+
+	sess.mu.Lock()
+	for _, v := range sess.viewers {
+		select {
+		case v.out <- bs:
+		default:
+		}
+	}
+	sess.mu.Unlock()
+
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	if nil != sess.ws {
+		sess.ws.Write(bs)
+	}
+}
+
+// killLine 是取消命令行时发送的按键， ^E 将光标移到行尾， ^U 删除整行
+const killLine = "\x05\x15"
+
+// Confirm 回答 confirm 规则的确认， ok 为 false 时取消命令
+func (sess *LiveSession) Confirm(ok bool) error {
+	sess.mu.Lock()
+	input := sess.input
+	sess.mu.Unlock()
+	if nil == input {
+		return errors.New("session doesn't accept input")
+	}
+
+	sess.smu.Lock()
+	a := &sess.auditor
+	if !a.confirming || nil == a.held {
+		sess.smu.Unlock()
+		return errors.New("no command is waiting for confirmation")
+	}
+	a.confirming = false
+	a.confirmed = ok
+	event := &AuditEvent{Type: "command",
+		SessionID:  sess.ID,
+		User:       sess.User,
+		Viewer:     a.by,
+		RemoteAddr: sess.RemoteAddr,
+		Protocol:   sess.Protocol,
+		Target:     sess.Target,
+		Command:    a.held.Command,
+		Action:     "cancel",
+		Rule:       a.held.Rule}
+	a.held = nil
+	sess.smu.Unlock()
+
+	if !ok {
+		writeAudit(event)
+	}
+
+	var err error
+	if ok {
+		_, err = input.w.Write([]byte("\r"))
+	} else {
+		_, err = input.w.Write([]byte(killLine))
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandPolicyMatch(t *testing.T) {
+	policy, err := readCommandPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		command  string
+		excepted string
+	}{
+		{"rm -rf /", "rm-root"},
+		{"rm -rf /*", "rm-root"},
+		{"sudo rm -r -f /", "rm-root"},
+		{"rm --no-preserve-root -rf /", "rm-root"},
+		{"rm --recursive /", "rm-root"},
+		{"rm -Rf / ; ls", "rm-root"},
+		{"rm -rf /tmp/x", ""},
+		{"rm -f /", ""},
+		{"ls /", ""},
+		{"reload", "reload"},
+		{"  REBOOT now", "reload"},
+		{"show reload", ""},
+		{"write erase", "erase-config"},
+		{"erase startup-config", "erase-config"},
+		{"mkfs.ext4 /dev/sdb1", "format"},
+	} {
+		var actual string
+		if rule := policy.Match([]string{"h1"}, "", test.command); nil != rule {
+			actual = rule.Name
+		}
+		if actual != test.excepted {
+			t.Errorf("%q: excepted %q, got %q", test.command, test.excepted, actual)
+		}
+	}
+}
+
+func TestCommandPolicyGroups(t *testing.T) {
+	policy, err := parseCommandPolicy([]byte(`{
+  "groups": {"core": ["10.1.0.0/16", "core-*", "edge1"]},
+  "rules": [
+    {"name": "core-shutdown", "pattern": "^shutdown", "action": "block", "groups": ["core"]},
+    {"name": "cisco-debug", "pattern": "^debug all", "action": "warn", "profiles": ["cisco"]}
+  ]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		hosts    []string
+		profile  string
+		command  string
+		excepted string
+	}{
+		{[]string{"10.1.2.3"}, "", "shutdown", "core-shutdown"},
+		{[]string{"router", "10.1.2.3"}, "", "shutdown", "core-shutdown"},
+		{[]string{"CORE-SW1"}, "", "shutdown", "core-shutdown"},
+		{[]string{"edge1"}, "", "shutdown", "core-shutdown"},
+		{[]string{"edge2", "10.2.0.1"}, "", "shutdown", ""},
+		{[]string{"10.1.2.3"}, "", "no shutdown", ""},
+		{[]string{"h1"}, "cisco", "debug all", "cisco-debug"},
+		{[]string{"h1"}, "huawei", "debug all", ""},
+	} {
+		var actual string
+		if rule := policy.Match(test.hosts, test.profile, test.command); nil != rule {
+			actual = rule.Name
+		}
+		if actual != test.excepted {
+			t.Errorf("%v %q: excepted %q, got %q", test.hosts, test.command, test.excepted, actual)
+		}
+	}
+
+	for _, text := range []string{
+		`{"rules": [{"pattern": "x", "action": "deny"}]}`,
+		`{"rules": [{"pattern": "(", "action": "block"}]}`,
+		`{"rules": [{"pattern": "x", "action": "block", "groups": ["none"]}]}`,
+	} {
+		if _, err := parseCommandPolicy([]byte(text)); nil == err {
+			t.Errorf("%s: excepted error, got ok", text)
+		}
+	}
+}
+
+func TestReadCommandPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "command_policy.json")
+	if err := os.WriteFile(file, []byte(`{"rules": [{"pattern": "^halt", "action": "block"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := readCommandPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文件中的规则替换内置的规则
+	if nil == policy.Match(nil, "", "halt") || nil != policy.Match(nil, "", "rm -rf /") {
+		t.Errorf("excepted only the rules of the file, got %+v", policy.Rules)
+	}
+	if "#1" != policy.Rules[0].Name {
+		t.Errorf("excepted '#1', got %q", policy.Rules[0].Name)
+	}
+}
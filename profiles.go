@@ -0,0 +1,274 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/runner-mei/web-terminal/expect"
+)
+
+// Pager 是一个分页提示符和它的应答
+type Pager struct {
+	Pattern string `json:"pattern"`
+	Send    string `json:"send"`
+}
+
+// EscalationStep 是进入特权模式的一个步骤， 发送 Command 后在
+// PasswordPrompt 处输入 enable 密码， 然后等待 Prompt。 Prompt 是特权模式
+// 的提示符， 没有指定时以 # 结尾的提示符是特权模式的提示符
+type EscalationStep struct {
+	Command        string   `json:"command"`
+	PasswordPrompt []string `json:"password_prompt,omitempty"`
+	Prompt         []string `json:"prompt,omitempty"`
+}
+
+var defaultEscalation = []EscalationStep{{Command: "enable"}}
+
+// Profile 描述一类设备的提示符、 分页和提权的方式
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Base 是继承的设备类型， 本设备类型中非空的项覆盖 Base 中的项
+	Base          string           `json:"base,omitempty"`
+	Login         *LoginPrompts    `json:"login,omitempty"`
+	Pagers        []Pager          `json:"pagers,omitempty"`
+	DisablePaging []string         `json:"disable_paging,omitempty"`
+	Escalation    []EscalationStep `json:"escalation,omitempty"`
+	// ShowConfig 是备份配置时执行的命令， Volatile 是备份时删除的每次都会
+	// 变化的行
+	ShowConfig string   `json:"show_config,omitempty"`
+	Volatile   []string `json:"volatile,omitempty"`
+
+	pagers   []*regexp.Regexp
+	volatile []*regexp.Regexp
+}
+
+const defaultProfiles = `{
+  "cisco": {
+    "description": "Cisco IOS/IOS-XE/NX-OS",
+    "login": {
+      "prompt": ["(?m)^[\\w.\\-()/:]+[>#] ?$"],
+      "failure": ["(?i)(% ?login invalid|% ?authentication failed|% ?bad (passwords|secrets)|% ?access denied)"]
+    },
+    "pagers": [{"pattern": " ?--More-- ?(\\x08+ +\\x08+)?", "send": " "}],
+    "disable_paging": ["terminal length 0"],
+    "escalation": [{"command": "enable", "prompt": ["(?m)^[\\w.\\-()/:]+# ?$"]}],
+    "show_config": "show running-config",
+    "volatile": ["^Building configuration", "^Current configuration ?: ", "^! (Last configuration change|NVRAM config last updated|No configuration change)", "^ntp clock-period "]
+  },
+  "huawei": {
+    "description": "Huawei VRP",
+    "login": {
+      "prompt": ["(?m)^[<\\[][\\w.\\-/~:@]+[>\\]] ?$"],
+      "failure": ["(?i)(error: (username or password|failed to pass the authentication|authentication failed)|local authentication is rejected)"]
+    },
+    "pagers": [{"pattern": " *---- More ----(\\x1b\\[\\d+D *\\x1b\\[\\d+D)?", "send": " "}],
+    "disable_paging": ["screen-length 0 temporary"],
+    "escalation": [{"command": "super", "prompt": ["(?m)^[<\\[][\\w.\\-/~:@]+[>\\]] ?$"]}],
+    "show_config": "display current-configuration",
+    "volatile": ["^\\s*!(Software Version|Last configuration was|Time:)", "^\\s*!Config(uration)? (was )?(saved|updated)"]
+  },
+  "h3c": {
+    "description": "H3C Comware",
+    "base": "huawei",
+    "disable_paging": ["screen-length disable"]
+  },
+  "juniper": {
+    "description": "Juniper JunOS",
+    "login": {
+      "prompt": ["(?m)^([\\w.\\-]+@)?[\\w.\\-]+[>#%] ?$"]
+    },
+    "pagers": [{"pattern": "---\\(more( \\d+%)?\\)---", "send": " "}],
+    "disable_paging": ["set cli screen-length 0"],
+    "show_config": "show configuration",
+    "volatile": ["^## Last (commit|changed): "]
+  },
+  "linux": {
+    "description": "Linux/Unix shell",
+    "login": {
+      "prompt": ["[$#] ?$"],
+      "failure": ["(?i)(login incorrect|permission denied|authentication failure|sorry, try again)"],
+      "enable_password": ["(?i)(\\[sudo\\] password for [^:]+|password):\\s*$"]
+    },
+    "pagers": [{"pattern": "--More--(\\(\\d+%\\))?", "send": " "}],
+    "disable_paging": ["export PAGER=cat SYSTEMD_PAGER="],
+    "escalation": [{"command": "sudo -s", "prompt": ["# ?$"]}]
+  }
+}`
+
+var profiles map[string]*Profile
+
+func init() {
+	var err error
+	profiles, err = parseProfiles(nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// parseProfiles 解析内置的设备类型并用 bs 中的设备类型覆盖它们
+func parseProfiles(bs []byte) (map[string]*Profile, error) {
+	var builtins, custom map[string]*Profile
+	if err := json.Unmarshal([]byte(defaultProfiles), &builtins); err != nil {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &custom); err != nil {
+			return nil, err
+		}
+	}
+
+	results := map[string]*Profile{}
+	var resolve func(name string, depth int) (*Profile, error)
+	resolve = func(name string, depth int) (*Profile, error) {
+		if p, ok := results[name]; ok {
+			return p, nil
+		}
+		p, ok := custom[name]
+		if !ok {
+			p, ok = builtins[name]
+		}
+		if !ok {
+			return nil, errors.New("profile '" + name + "' is not found")
+		}
+		if depth > 8 {
+			return nil, errors.New("profile '" + name + "' inherits too deep")
+		}
+
+		if "" != p.Base {
+			base, err := resolve(p.Base, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			p = base.merge(p)
+		}
+		p.Name = name
+		p.pagers = nil
+		for _, pager := range p.Pagers {
+			re, err := regexp.Compile(pager.Pattern)
+			if err != nil {
+				return nil, errors.New("pager '" + pager.Pattern + "' of profile '" + name + "' is invalid, " + err.Error())
+			}
+			p.pagers = append(p.pagers, re)
+		}
+		p.volatile = nil
+		for _, pattern := range p.Volatile {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.New("volatile '" + pattern + "' of profile '" + name + "' is invalid, " + err.Error())
+			}
+			p.volatile = append(p.volatile, re)
+		}
+		if nil != p.Login {
+			if _, err := builtinLoginPrompts.merge(p.Login).compile(); err != nil {
+				return nil, errors.New("profile '" + name + "' is invalid, " + err.Error())
+			}
+		}
+		results[name] = p
+		return p, nil
+	}
+
+	for name := range builtins {
+		if _, err := resolve(name, 0); err != nil {
+			return nil, err
+		}
+	}
+	for name := range custom {
+		if _, err := resolve(name, 0); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// merge 返回用 other 中非空的项覆盖后的副本
+func (p *Profile) merge(other *Profile) *Profile {
+	copied := *p
+	copied.Base = other.Base
+	if "" != other.Description {
+		copied.Description = other.Description
+	}
+	if nil != other.Login {
+		if nil == copied.Login {
+			copied.Login = other.Login
+		} else {
+			copied.Login = copied.Login.merge(other.Login)
+		}
+	}
+	if len(other.Pagers) > 0 {
+		copied.Pagers = other.Pagers
+	}
+	if len(other.DisablePaging) > 0 {
+		copied.DisablePaging = other.DisablePaging
+	}
+	if len(other.Escalation) > 0 {
+		copied.Escalation = other.Escalation
+	}
+	if "" != other.ShowConfig {
+		copied.ShowConfig = other.ShowConfig
+	}
+	if len(other.Volatile) > 0 {
+		copied.Volatile = other.Volatile
+	}
+	return &copied
+}
+
+// readProfiles 读取 profiles.json， 文件中的设备类型会覆盖同名的内置设备类型，
+// file 为 "" 时返回内置的设备类型
+func readProfiles(file string) (map[string]*Profile, error) {
+	if "" == file {
+		return parseProfiles(nil)
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	results, err := parseProfiles(bs)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	return results, nil
+}
+
+func profileFor(name string) (*Profile, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// Prepare 添加分页提示符的自动应答并执行关闭分页的命令， 调用前终端应
+// 处于命令提示符处
+func (p *Profile) Prepare(sess *expect.Session, opts *LoginOptions) error {
+	for idx, re := range p.pagers {
+		sess.AddResponder(re, p.Pagers[idx].Send)
+	}
+	for _, command := range p.DisablePaging {
+		if err := sess.Sendln(command); err != nil {
+			return loginError("prompt", "closed", err.Error(), sess)
+		}
+		if err := WaitPrompt(sess, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListProfiles 返回所有的设备类型， GET /profiles
+func ListProfiles(w http.ResponseWriter, r *http.Request) {
+	configLock.RLock()
+	results := make([]*Profile, 0, len(profiles))
+	for _, p := range profiles {
+		results = append(results, p)
+	}
+	configLock.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	renderJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,97 @@
+package terminal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/runner-mei/web-terminal/expect"
+)
+
+func TestReadProfiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(file, []byte(`{"my-cisco": {"base": "cisco", "disable_paging": ["terminal len 0"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results, err := readProfiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := results["my-cisco"]
+	if nil == p || "terminal len 0" != p.DisablePaging[0] || "show running-config" != p.ShowConfig {
+		t.Errorf("excepted the profile inherits cisco, got %+v", p)
+	}
+	if _, ok := results["h3c"]; !ok {
+		t.Error("excepted the builtin profiles")
+	}
+
+	results, err = readProfiles("")
+	if err != nil || nil == results["cisco"] || nil != results["my-cisco"] {
+		t.Errorf("excepted the builtin profiles, got %v, %v", results, err)
+	}
+
+	for _, text := range []string{
+		`{"x": {"base": "y"}}`,
+		`{"x": {"pagers": [{"pattern": "("}]}}`,
+		`{"x": `,
+	} {
+		if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readProfiles(file); nil == err {
+			t.Errorf("%s: excepted error, got ok", text)
+		}
+	}
+}
+
+// runEscalate 在一个模拟的 cisco 设备上执行 enable， reply 根据收到的
+// 输入返回设备的输出
+func runEscalate(reply func(input string) string) error {
+	pr, pw := io.Pipe()
+	ir, iw := io.Pipe()
+	defer pw.Close()
+	defer ir.Close()
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := ir.Read(buf)
+			if err != nil {
+				return
+			}
+			io.WriteString(pw, reply(string(buf[:n])))
+		}
+	}()
+
+	sess := expect.New(pr, iw, nil)
+	defer sess.Close()
+	return Escalate(sess, &LoginOptions{EnablePassword: "secret", Timeout: time.Second, Prompts: DefaultLoginPrompts})
+}
+
+func TestEscalate(t *testing.T) {
+	// 没有 enable 密码时直接进入特权模式
+	if err := runEscalate(func(string) string { return "\r\nRouter#" }); err != nil {
+		t.Error(err)
+	}
+	// 命令被拒绝， 仍然是普通的提示符
+	if err := runEscalate(func(string) string { return "\r\nRouter>" }); nil == err {
+		t.Error("excepted error, got ok")
+	}
+
+	device := func(privileged string) func(string) string {
+		return func(input string) string {
+			if "enable\n" == input {
+				return "\r\nPassword: "
+			}
+			return "\r\n" + privileged
+		}
+	}
+	if err := runEscalate(device("Router#")); err != nil {
+		t.Error(err)
+	}
+	// 密码错误
+	if err := runEscalate(device("Router>")); nil == err {
+		t.Error("excepted error, got ok")
+	}
+}
@@ -0,0 +1,56 @@
+package terminal
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/net/websocket"
+)
+
+// startPty starts the command in a pseudo terminal, the returned file is
+// both stdin and stdout of the command.
+func startPty(cmd *exec.Cmd, rows, columns int) (*os.File, error) {
+	return pty.StartWithSize(cmd, &pty.Winsize{Rows: uint16(rows), Cols: uint16(columns)})
+}
+
+func execInPty(ws *websocket.Conn, sess *LiveSession, cmd *exec.Cmd, output io.Writer, timeout time.Duration) {
+	query_params := ws.Request().URL.Query()
+	columns := toInt(query_params.Get("columns"), 120)
+	rows := toInt(query_params.Get("rows"), 80)
+
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	ptmx, err := startPty(cmd, rows, columns)
+	if err != nil {
+		io.WriteString(ws, err.Error())
+		return
+	}
+	defer ptmx.Close()
+
+	input := newSessionInput(ws)
+	defer input.Close()
+	output = input.Watch(output)
+
+	go func() {
+		if _, err := io.Copy(ptmx, sess.Input(input)); err != nil {
+			log.Println("copy of stdin failed:", err)
+		}
+	}()
+
+	timer := time.AfterFunc(timeout, func() {
+		defer recover()
+		cmd.Process.Kill()
+	})
+
+	// the read error at the end of command (EIO on linux) is ignored.
+	io.Copy(output, ptmx)
+	if err := cmd.Wait(); err != nil {
+		io.WriteString(ws, err.Error())
+	}
+	timer.Stop()
+}
@@ -0,0 +1,636 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var record_sessions = flag.Bool("record_sessions", false, "record the output of all sessions, a session is also recorded if the parameter record is true.")
+
+// maxIndexedLine 是索引中一行的最大长度
+const maxIndexedLine = 1024
+
+// recordingsDir 是录像的目录， 录像按日期保存在子目录中， 每个会话有
+// 两个文件
+//
+//	<id>.cast 是 asciicast v2 格式的录像， 第一行是头， 后面每行是一个输出 (o) 或输入 (i) 事件
+//	<id>.idx  是去掉控制序列后的文本索引， 每行是 {"t": 秒, "line": "文本"}
+func recordingsDir() string {
+	return filepath.Join(LogDir, "recordings")
+}
+
+var recordingIDPattern = regexp.MustCompile(`^[0-9a-zA-Z_-]+$`)
+
+// RecordingHeader 是录像的头
+type RecordingHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Session   *RecordingSession `json:"session,omitempty"`
+}
+
+// RecordingSession 是录像中会话的信息
+type RecordingSession struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Protocol   string `json:"protocol"`
+	Target     string `json:"target"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// IndexEntry 是索引中的一行， T 是相对会话开始的秒数
+type IndexEntry struct {
+	T    float64 `json:"t"`
+	Line string  `json:"line"`
+}
+
+// recorder 将会话的输出保存为录像， 同时生成索引
+type recorder struct {
+	start time.Time
+	cast  *os.File
+	idx   *os.File
+	text  *textIndexer
+}
+
+// shouldRecord 判断是否录制会话， 参数 record=true 可以打开录制， 但不能
+// 关闭 record_sessions 要求的录制
+func shouldRecord(r *http.Request) bool {
+	return *record_sessions || "true" == r.URL.Query().Get("record")
+}
+
+func newRecorder(sess *LiveSession, rows, columns int) (*recorder, error) {
+	dir := filepath.Join(recordingsDir(), sess.StartAt.Format("20060102"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	cast, err := os.OpenFile(filepath.Join(dir, sess.ID+".cast"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := os.OpenFile(filepath.Join(dir, sess.ID+".idx"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		cast.Close()
+		return nil, err
+	}
+
+	header := RecordingHeader{Version: 2,
+		Width:     columns,
+		Height:    rows,
+		Timestamp: sess.StartAt.Unix(),
+		Title:     sess.Target,
+		Env:       map[string]string{"TERM": "xterm"},
+		Session: &RecordingSession{ID: sess.ID,
+			User:       sess.User,
+			Protocol:   sess.Protocol,
+			Target:     sess.Target,
+			RemoteAddr: sess.RemoteAddr}}
+	bs, _ := json.Marshal(header)
+	if _, err := cast.Write(append(bs, '\n')); err != nil {
+		cast.Close()
+		idx.Close()
+		return nil, err
+	}
+
+	rec := &recorder{start: sess.StartAt, cast: cast, idx: idx}
+	rec.text = newTextIndexer(func(entry IndexEntry) {
+		bs, _ := json.Marshal(entry)
+		idx.Write(append(bs, '\n'))
+	})
+	return rec, nil
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	t := time.Since(rec.start).Seconds()
+	bs, _ := json.Marshal([]interface{}{roundSeconds(t), "o", string(p)})
+	if _, err := rec.cast.Write(append(bs, '\n')); err != nil {
+		return 0, err
+	}
+	rec.text.write(t, p)
+	return len(p), nil
+}
+
+// WriteInput 保存输入事件， 回放时忽略它， 输入密码时调用者要先屏蔽它
+func (rec *recorder) WriteInput(p []byte) error {
+	t := time.Since(rec.start).Seconds()
+	bs, _ := json.Marshal([]interface{}{roundSeconds(t), "i", string(p)})
+	_, err := rec.cast.Write(append(bs, '\n'))
+	return err
+}
+
+func (rec *recorder) Close() error {
+	rec.text.flush()
+	rec.idx.Close()
+	return rec.cast.Close()
+}
+
+func roundSeconds(t float64) float64 {
+	return float64(int64(t*1000000)) / 1000000
+}
+
+// textIndexer 去掉输出中的控制序列， 每一行回调一次， 行的时间是这一行
+// 第一个字符输出的时间
+type textIndexer struct {
+	cb    func(IndexEntry)
+	state int
+	line  []rune
+	col   int
+	t     float64
+	valid bool
+	bs    []byte
+}
+
+const (
+	textGround = iota
+	textEscape
+	textCSI
+	textOSC
+	textOSCEscape
+	textCharset
+)
+
+func newTextIndexer(cb func(IndexEntry)) *textIndexer {
+	return &textIndexer{cb: cb}
+}
+
+func (ti *textIndexer) write(t float64, p []byte) {
+	data := p
+	if len(ti.bs) > 0 {
+		data = append(ti.bs, p...)
+		ti.bs = nil
+	}
+	s := string(data)
+	// 保留末尾不完整的 UTF-8 字符
+	if n := incompleteUTF8(data); n > 0 {
+		ti.bs = append([]byte(nil), data[len(data)-n:]...)
+		s = s[:len(s)-n]
+	}
+
+	for _, r := range s {
+		switch ti.state {
+		case textEscape:
+			switch r {
+			case '[':
+				ti.state = textCSI
+			case ']', 'P', 'X', '^', '_':
+				ti.state = textOSC
+			case '(', ')', '*', '+', '#', '%':
+				ti.state = textCharset
+			default:
+				ti.state = textGround
+			}
+			continue
+		case textCSI:
+			if r >= 0x40 && r <= 0x7e {
+				ti.state = textGround
+			}
+			continue
+		case textOSC:
+			if r == 0x07 {
+				ti.state = textGround
+			} else if r == 0x1b {
+				ti.state = textOSCEscape
+			}
+			continue
+		case textOSCEscape:
+			ti.state = textGround
+			if r != '\\' {
+				ti.state = textOSC
+			}
+			continue
+		case textCharset:
+			ti.state = textGround
+			continue
+		}
+
+		switch {
+		case r == 0x1b:
+			ti.state = textEscape
+		case r == '\n':
+			ti.flush()
+		case r == '\r':
+			ti.col = 0
+		case r == '\b':
+			if ti.col > 0 {
+				ti.col--
+			}
+		case r == '\t':
+			ti.put(t, ' ')
+		case r < 0x20 || r == 0x7f:
+		default:
+			ti.put(t, r)
+		}
+	}
+}
+
+func (ti *textIndexer) put(t float64, r rune) {
+	if !ti.valid {
+		ti.t = t
+		ti.valid = true
+	}
+	if ti.col < len(ti.line) {
+		ti.line[ti.col] = r
+	} else if len(ti.line) < maxIndexedLine {
+		ti.line = append(ti.line, r)
+	}
+	ti.col++
+}
+
+func (ti *textIndexer) flush() {
+	if line := strings.TrimSpace(string(ti.line)); "" != line {
+		ti.cb(IndexEntry{T: roundSeconds(ti.t), Line: line})
+	}
+	ti.line = ti.line[:0]
+	ti.col = 0
+	ti.valid = false
+}
+
+// incompleteUTF8 返回 bs 末尾不完整的 UTF-8 字符的字节数
+func incompleteUTF8(bs []byte) int {
+	for n := 1; n <= 3 && n <= len(bs); n++ {
+		b := bs[len(bs)-n]
+		if b < 0x80 {
+			return 0
+		}
+		if b >= 0xc0 {
+			size := 2
+			if b >= 0xf0 {
+				size = 4
+			} else if b >= 0xe0 {
+				size = 3
+			}
+			if size > n {
+				return n
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Recording 是一个录像
+type Recording struct {
+	RecordingHeader
+	Date     string  `json:"date"`
+	Size     int64   `json:"size"`
+	Duration float64 `json:"duration"`
+
+	file string
+}
+
+func readRecordingHeader(file string) (*RecordingHeader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var header RecordingHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, errors.New("read '" + file + "' fail, " + err.Error())
+	}
+	if nil == header.Session {
+		header.Session = &RecordingSession{ID: strings.TrimSuffix(filepath.Base(file), ".cast")}
+	}
+	return &header, nil
+}
+
+// listRecordings 返回所有的录像， 最新的在前面
+func listRecordings() ([]*Recording, error) {
+	files, err := filepath.Glob(filepath.Join(recordingsDir(), "*", "*.cast"))
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]*Recording, 0, len(files))
+	for _, file := range files {
+		header, err := readRecordingHeader(file)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		recording := &Recording{RecordingHeader: *header, Date: filepath.Base(filepath.Dir(file)), file: file}
+		if fi, err := os.Stat(file); nil == err {
+			recording.Size = fi.Size()
+			recording.Duration = fi.ModTime().Sub(time.Unix(header.Timestamp, 0)).Seconds()
+		}
+		recordings = append(recordings, recording)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Timestamp > recordings[j].Timestamp
+	})
+	return recordings, nil
+}
+
+// recordingFile 按会话的 id 查找录像
+func recordingFile(id string) (string, error) {
+	if !recordingIDPattern.MatchString(id) {
+		return "", errors.New("recording '" + id + "' is invalid")
+	}
+	files, err := filepath.Glob(filepath.Join(recordingsDir(), "*", id+".cast"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", os.ErrNotExist
+	}
+	return files[0], nil
+}
+
+// readCastEvents 读录像中的输出事件， cb 返回 false 时停止
+func readCastEvents(r io.Reader, cb func(t float64, data string) bool) error {
+	reader := bufio.NewReader(r)
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event []interface{}
+			if e := json.Unmarshal(line, &event); nil == e && len(event) == 3 && "o" == event[1] {
+				t, _ := event[0].(float64)
+				data, _ := event[2].(string)
+				if !cb(t, data) {
+					return nil
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// reindexRecording 从录像重新生成索引
+func reindexRecording(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	idxFile := strings.TrimSuffix(file, ".cast") + ".idx"
+	out, err := os.OpenFile(idxFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	ti := newTextIndexer(func(entry IndexEntry) {
+		bs, _ := json.Marshal(entry)
+		w.Write(append(bs, '\n'))
+	})
+	if err := readCastEvents(in, func(t float64, data string) bool {
+		ti.write(t, []byte(data))
+		return true
+	}); err != nil {
+		return errors.New("reindex '" + file + "' fail, " + err.Error())
+	}
+	ti.flush()
+	return w.Flush()
+}
+
+// SearchHit 是匹配的一行， Offset 是相对会话开始的秒数， 可以传给 /replay
+type SearchHit struct {
+	Offset float64 `json:"offset"`
+	Line   string  `json:"line"`
+}
+
+// SearchResult 是一个会话中匹配的行
+type SearchResult struct {
+	Recording *Recording  `json:"recording"`
+	Hits      []SearchHit `json:"hits"`
+	Total     int         `json:"total"`
+}
+
+// searchQuery 是搜索的条件， Pattern 为空时用 Text 做大小写无关的匹配
+type searchQuery struct {
+	Text    string
+	Pattern *regexp.Regexp
+	User    string
+	Target  string
+	From    time.Time
+	To      time.Time
+	MaxHits int
+	Limit   int
+}
+
+func (q *searchQuery) match(line string) bool {
+	if nil != q.Pattern {
+		return q.Pattern.MatchString(line)
+	}
+	return strings.Contains(strings.ToLower(line), q.Text)
+}
+
+func (q *searchQuery) accept(recording *Recording) bool {
+	var user, target string
+	if nil != recording.Session {
+		user, target = recording.Session.User, recording.Session.Target
+	}
+	if "" != q.User && user != q.User {
+		return false
+	}
+	if "" != q.Target && !strings.Contains(target, q.Target) {
+		return false
+	}
+	start := time.Unix(recording.Timestamp, 0)
+	if !q.From.IsZero() && start.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && start.After(q.To) {
+		return false
+	}
+	return true
+}
+
+func searchRecordings(q *searchQuery) ([]*SearchResult, error) {
+	recordings, err := listRecordings()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*SearchResult{}
+	for _, recording := range recordings {
+		if !q.accept(recording) {
+			continue
+		}
+		result, err := searchIndex(strings.TrimSuffix(recording.file, ".cast")+".idx", q)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if result.Total > 0 {
+			result.Recording = recording
+			results = append(results, result)
+			if q.Limit > 0 && len(results) >= q.Limit {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+func searchIndex(file string, q *searchQuery) (*SearchResult, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := &SearchResult{Hits: []SearchHit{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry IndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !q.match(entry.Line) {
+			continue
+		}
+		result.Total++
+		if len(result.Hits) < q.MaxHits {
+			result.Hits = append(result.Hits, SearchHit{Offset: entry.T, Line: entry.Line})
+		}
+	}
+	return result, scanner.Err()
+}
+
+// RecordingsHandler 处理 /recordings、 /recordings/search 和
+// /recordings/reindex， 只有管理员可以访问
+func RecordingsHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			renderError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		params := r.URL.Query()
+
+		switch action {
+		case "":
+			recordings, err := listRecordings()
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			renderJSON(w, http.StatusOK, recordings)
+		case "search":
+			q := &searchQuery{Text: strings.ToLower(params.Get("q")),
+				User:    params.Get("user"),
+				Target:  params.Get("target"),
+				MaxHits: toInt(params.Get("max_hits"), 20),
+				Limit:   toInt(params.Get("limit"), 100)}
+			if "" == q.Text {
+				renderError(w, http.StatusBadRequest, "q is missing")
+				return
+			}
+			if "true" == params.Get("regex") {
+				pattern, err := regexp.Compile(params.Get("q"))
+				if err != nil {
+					renderError(w, http.StatusBadRequest, "q is invalid, "+err.Error())
+					return
+				}
+				q.Pattern = pattern
+			}
+			for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+				if s := params.Get(name); "" != s {
+					value, err := time.Parse(time.RFC3339, s)
+					if err != nil {
+						renderError(w, http.StatusBadRequest, name+" is invalid, "+err.Error())
+						return
+					}
+					*t = value
+				}
+			}
+			results, err := searchRecordings(q)
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			renderJSON(w, http.StatusOK, results)
+		case "reindex":
+			if "POST" != r.Method {
+				renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+				return
+			}
+			files, err := filepath.Glob(filepath.Join(recordingsDir(), "*", "*.cast"))
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			failed := []string{}
+			for _, file := range files {
+				if err := reindexRecording(file); err != nil {
+					log.Println(err)
+					failed = append(failed, filepath.Base(file))
+				}
+			}
+			renderJSON(w, http.StatusOK, map[string]interface{}{"total": len(files), "failed": failed})
+		}
+	}
+}
+
+// replayRecording 回放录像， offset 之前的输出立即发送， 后面的输出按
+// 录像的时间间隔除以 speed 发送， speed 为 0 时全部立即发送
+func replayRecording(ws *websocket.Conn, file string, offset, speed float64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	started := false
+	var begin time.Time
+	return readCastEvents(f, func(t float64, data string) bool {
+		if t > offset && speed > 0 {
+			if !started {
+				started = true
+				begin = time.Now()
+			}
+			due := begin.Add(time.Duration((t - offset) / speed * float64(time.Second)))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		_, err := io.WriteString(ws, data)
+		return nil == err
+	})
+}
+
+func replayParams(ws *websocket.Conn) (offset, speed float64) {
+	params := ws.Request().URL.Query()
+	offset, _ = strconv.ParseFloat(params.Get("offset"), 64)
+	speed = 1
+	if s := params.Get("speed"); "" != s {
+		if v, err := strconv.ParseFloat(s, 64); nil == err && v >= 0 {
+			speed = v
+		}
+	}
+	return offset, speed
+}
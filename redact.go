@@ -0,0 +1,138 @@
+package terminal
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// redactedText 替换被屏蔽的密码
+const redactedText = "******"
+
+// secretFlags 是所有程序中值为密码的选项
+var secretFlags = map[string]bool{
+	"-pw":        true,
+	"-password":  true,
+	"--password": true,
+	"-passwd":    true,
+	"--passwd":   true,
+}
+
+// programSecretFlags 是特定程序中值为密码的选项， 如 sshpass 的 -p 和
+// snmp 工具的 community (-c)、 认证密码 (-A) 和加密密码 (-X)
+func programSecretFlags(program string) []string {
+	switch {
+	case "sshpass" == program:
+		return []string{"-p"}
+	case strings.HasPrefix(program, "snmp"):
+		return []string{"-c", "-A", "-X"}
+	}
+	return nil
+}
+
+func programName(arg string) string {
+	name := strings.ToLower(filepath.Base(strings.Replace(arg, "\\", "/", -1)))
+	return strings.TrimSuffix(name, ".exe")
+}
+
+// redactArgs 返回屏蔽了密码的参数， 用于写日志， 参数中可以有多个程序，
+// 如 sshpass -p xxx ssh host
+func redactArgs(args []string) []string {
+	results := make([]string, len(args))
+	program := ""
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		results[idx] = arg
+		if !strings.HasPrefix(arg, "-") {
+			switch name := programName(arg); {
+			case "sshpass" == name, "ssh" == name, "plink" == name, strings.HasPrefix(name, "snmp"):
+				program = name
+			}
+			continue
+		}
+
+		if eq := strings.Index(arg, "="); eq > 0 && secretFlags[arg[:eq]] {
+			results[idx] = arg[:eq+1] + redactedText
+			continue
+		}
+		isSecret := secretFlags[arg]
+		for _, flag := range programSecretFlags(program) {
+			if arg == flag {
+				isSecret = true
+			} else if strings.HasPrefix(arg, flag) {
+				// 选项和值连在一起， 如 -cpublic
+				results[idx] = flag + redactedText
+			}
+		}
+		if isSecret && idx+1 < len(args) {
+			idx++
+			results[idx] = redactedText
+		}
+	}
+	return results
+}
+
+// redactLine 屏蔽命令行中的密码， 没有密码时返回原来的命令行
+func redactLine(line string) string {
+	fields := strings.Fields(line)
+	redacted := redactArgs(fields)
+	for idx := range fields {
+		if fields[idx] != redacted[idx] {
+			return strings.Join(redacted, " ")
+		}
+	}
+	return line
+}
+
+// echoOff 判断会话是否在输入密码， 这时远端不回显输入， 必须在持有
+// sess.smu 时调用
+func (sess *LiveSession) echoOff() bool {
+	if sess.screen.AltScreen() {
+		return false
+	}
+	prompt := sess.auditor.prompt
+	if !sess.auditor.started {
+		x, y, _ := sess.screen.Cursor()
+		prompt = sess.screen.Slice(y, 0, x)
+	}
+	return secretPromptPattern.MatchString(prompt)
+}
+
+// maskInput 将输入中可显示的字符替换为 *
+func maskInput(p []byte) []byte {
+	return []byte(strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return '*'
+		}
+		return r
+	}, string(p)))
+}
+
+// MaskInput 返回的 Writer 在输入密码时屏蔽写入的按键， 用于调试时保存
+// 输入的文件
+func (sess *LiveSession) MaskInput(w io.Writer) io.Writer {
+	if nil == w {
+		return nil
+	}
+	return &maskWriter{sess: sess, w: w}
+}
+
+type maskWriter struct {
+	sess *LiveSession
+	w    io.Writer
+}
+
+func (w *maskWriter) Write(p []byte) (int, error) {
+	w.sess.smu.Lock()
+	echoOff := w.sess.echoOff()
+	w.sess.smu.Unlock()
+
+	if !echoOff {
+		return w.w.Write(p)
+	}
+	if _, err := w.w.Write(maskInput(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
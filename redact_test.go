@@ -0,0 +1,39 @@
+package terminal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	for _, test := range []struct {
+		args     string
+		excepted string
+	}{
+		{"ls -l /tmp", "ls -l /tmp"},
+		{"plink -pw secret root@host", "plink -pw ****** root@host"},
+		{"tool --password=secret -x", "tool --password=****** -x"},
+		{"sshpass -p secret ssh -p 2222 root@host", "sshpass -p ****** ssh -p 2222 root@host"},
+		{"sshpass -psecret ssh host", "sshpass -p****** ssh host"},
+		{"snmpwalk -v 3 -A auth -X priv -c public 1.1.1.1", "snmpwalk -v 3 -A ****** -X ****** -c ****** 1.1.1.1"},
+		{"C:\\tools\\snmpget.exe -cpublic host", "C:\\tools\\snmpget.exe -c****** host"},
+		// -c 只有在 snmp 工具中才是 community
+		{"ping -c 4 host", "ping -c 4 host"},
+		{"/bin/sh -c ulimit /usr/bin/snmpwalk -c public host", "/bin/sh -c ulimit /usr/bin/snmpwalk -c ****** host"},
+		{"plink -pw", "plink -pw"},
+	} {
+		actual := strings.Join(redactArgs(strings.Fields(test.args)), " ")
+		if actual != test.excepted {
+			t.Errorf("%q: excepted %q, got %q", test.args, test.excepted, actual)
+		}
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	if excepted := "ls   -l"; redactLine(excepted) != excepted {
+		t.Errorf("excepted %q, got %q", excepted, redactLine(excepted))
+	}
+	if excepted := "plink -pw ****** host"; redactLine("plink  -pw secret host") != excepted {
+		t.Errorf("excepted %q, got %q", excepted, redactLine("plink  -pw secret host"))
+	}
+}
@@ -0,0 +1,208 @@
+package terminal
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	session_grace     = flag.Duration("session_grace", 0, "the default time to keep the session after the browser disconnects, 0 is disabled.")
+	max_session_grace = flag.Duration("max_session_grace", 30*time.Minute, "the max value of the grace parameter.")
+	session_history   = flag.Int("session_history", 256*1024, "the bytes of output which is replayed after the session is resumed.")
+)
+
+// sessionGrace 返回浏览器断开后会话保留的时间， 参数 grace 可以覆盖缺省值
+func sessionGrace(r *http.Request) time.Duration {
+	grace := *session_grace
+	if s := r.URL.Query().Get("grace"); "" != s {
+		if t, err := time.ParseDuration(s); nil == err {
+			grace = t
+		}
+	}
+	if grace > *max_session_grace {
+		grace = *max_session_grace
+	}
+	return grace
+}
+
+// ringBuffer 保存最后 len(data) 个字节的输出
+type ringBuffer struct {
+	data []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	if size <= 0 {
+		size = 64 * 1024
+	}
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	size := len(r.data)
+	if len(p) >= size {
+		copy(r.data, p[len(p)-size:])
+		r.pos = 0
+		r.full = true
+		return len(p), nil
+	}
+	n := copy(r.data[r.pos:], p)
+	if n < len(p) {
+		r.pos = copy(r.data, p[n:])
+		r.full = true
+	} else if r.pos += n; r.pos == size {
+		r.pos = 0
+		r.full = true
+	}
+	return len(p), nil
+}
+
+// Bytes 返回缓存的输出， 去掉开头不完整的 UTF-8 字符
+func (r *ringBuffer) Bytes() []byte {
+	var bs []byte
+	if r.full {
+		bs = append(append(bs, r.data[r.pos:]...), r.data[:r.pos]...)
+	} else {
+		bs = append(bs, r.data[:r.pos]...)
+	}
+	for len(bs) > 0 && !utf8.RuneStart(bs[0]) {
+		bs = bs[1:]
+	}
+	return bs
+}
+
+// Client 返回写到会话所有者的浏览器的 Writer， 会话可以恢复时它同时
+// 缓存输出， 浏览器断开时输出只写到缓存中
+func (sess *LiveSession) Client() *clientWriter {
+	return &clientWriter{sess: sess}
+}
+
+type clientWriter struct {
+	sess *LiveSession
+}
+
+func (w *clientWriter) Write(p []byte) (int, error) {
+	sess := w.sess
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+
+	if nil != sess.history {
+		sess.history.Write(p)
+	}
+	if nil == sess.ws {
+		return len(p), nil
+	}
+	n, err := sess.ws.Write(p)
+	if err != nil && sess.resumable() {
+		// 连接断开由 sessionInput 处理， 输出继续缓存
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (sess *LiveSession) resumable() bool {
+	if sess.grace <= 0 {
+		return false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return nil != sess.input && !sess.killed
+}
+
+func (sess *LiveSession) closeClient() {
+	sess.wmu.Lock()
+	ws := sess.ws
+	sess.ws = nil
+	if nil != sess.detachTimer {
+		sess.detachTimer.Stop()
+		sess.detachTimer = nil
+	}
+	sess.wmu.Unlock()
+
+	if nil != ws {
+		ws.Close()
+	}
+}
+
+// detach 在浏览器断开时调用， 返回 true 表示会话被保留， 输入不要关闭
+func (sess *LiveSession) detach(ws *websocket.Conn) bool {
+	if !sess.resumable() {
+		return false
+	}
+
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	if sess.ws != ws {
+		// 已经被新的连接替换了
+		return true
+	}
+	sess.ws = nil
+	sess.detachTimer = time.AfterFunc(sess.grace, func() {
+		log.Println("session '" + sess.ID + "' isn't resumed in " + sess.grace.String() + ", it is closed")
+		sess.Kill()
+	})
+	log.Println("session '" + sess.ID + "' is detached")
+	return true
+}
+
+// attach 将会话交给新的连接， 并重放缓存的输出
+func (sess *LiveSession) attach(ws *websocket.Conn) (*sessionInput, error) {
+	if !sess.resumable() {
+		return nil, errors.New("session '" + sess.ID + "' can't be resumed")
+	}
+	sess.mu.Lock()
+	input := sess.input
+	sess.mu.Unlock()
+
+	sess.wmu.Lock()
+	if nil != sess.detachTimer {
+		sess.detachTimer.Stop()
+		sess.detachTimer = nil
+	}
+	old := sess.ws
+	sess.ws = ws
+	if nil != sess.history {
+		ws.Write(sess.history.Bytes())
+	}
+	sess.wmu.Unlock()
+
+	if nil != old {
+		go old.Close()
+	}
+	input.mu.Lock()
+	input.ws = ws
+	input.mu.Unlock()
+
+	log.Println("session '" + sess.ID + "' is resumed from " + ws.Request().RemoteAddr)
+	sess.notify()
+	return input, nil
+}
+
+// ResumeSession 处理 /sessions/resume?id=xxx&token=xxx， 浏览器断开后在
+// grace 时间内用 "%tpt_session%" 消息中的 token 恢复会话
+func ResumeSession(ws *websocket.Conn) {
+	defer ws.Close()
+
+	params := ws.Request().URL.Query()
+	id := params.Get("id")
+	sess, ok := lookupSession(id)
+	if !ok || 1 != subtle.ConstantTimeCompare([]byte(sess.token), []byte(params.Get("token"))) {
+		logString(ws, "session '"+id+"' is not found or token is invalid")
+		return
+	}
+
+	input, err := sess.attach(ws)
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	input.run(ws)
+}
@@ -0,0 +1,237 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	work_dir_root = flag.String("work_dir_root", "", "the 'wd' parameter of commands must be inside this directory.")
+
+	DefaultSandbox = &Sandbox{}
+	Sandboxes      = map[string]*Sandbox{}
+)
+
+// the environment variables which are passed to a command when the sandbox
+// doesn't declare any.
+var defaultEnvNames = []string{"PATH", "LANG", "LC_ALL", "TZ", "TMP", "TEMP", "TMPDIR",
+	"SystemRoot", "SYSTEMROOT", "windir", "ComSpec", "PATHEXT", "MIBS", "MIBDIRS"}
+
+// Sandbox 是受信命令的运行限制， 0 或空值表示不限制。
+type Sandbox struct {
+	// CPUTime is the limit of cpu time in seconds.
+	CPUTime int `json:"cpu_time,omitempty"`
+	// AddressSpace is the limit of virtual memory in bytes.
+	AddressSpace int64 `json:"address_space,omitempty"`
+	// OpenFiles is the limit of open file descriptors.
+	OpenFiles int `json:"open_files,omitempty"`
+	// OutputSize is the limit of bytes written to stdout and stderr.
+	OutputSize int64 `json:"output_size,omitempty"`
+
+	// User and Group are the name or id of the account which runs the command.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// Env lists the environment of the command, "NAME" copies the variable
+	// from the server, "NAME=VALUE" sets it and "*" inherits everything.
+	Env []string `json:"env,omitempty"`
+}
+
+func (sb *Sandbox) hasRlimits() bool {
+	return sb.CPUTime > 0 || sb.AddressSpace > 0 || sb.OpenFiles > 0
+}
+
+// merge returns a copy of sb which is overrided by the non-empty fields of other.
+func (sb *Sandbox) merge(other *Sandbox) *Sandbox {
+	copyed := *sb
+	if nil == other {
+		return &copyed
+	}
+	if other.CPUTime > 0 {
+		copyed.CPUTime = other.CPUTime
+	}
+	if other.AddressSpace > 0 {
+		copyed.AddressSpace = other.AddressSpace
+	}
+	if other.OpenFiles > 0 {
+		copyed.OpenFiles = other.OpenFiles
+	}
+	if other.OutputSize > 0 {
+		copyed.OutputSize = other.OutputSize
+	}
+	if "" != other.User {
+		copyed.User = other.User
+	}
+	if "" != other.Group {
+		copyed.Group = other.Group
+	}
+	if len(other.Env) > 0 {
+		copyed.Env = other.Env
+	}
+	return &copyed
+}
+
+func (sb *Sandbox) environ() []string {
+	names := sb.Env
+	if len(names) == 0 {
+		names = defaultEnvNames
+	}
+
+	var env []string
+	inherit := false
+	declared := map[string]bool{}
+	for _, nm := range names {
+		if "*" == nm {
+			inherit = true
+			continue
+		}
+		if idx := strings.Index(nm, "="); idx >= 0 {
+			env = append(env, nm)
+			declared[nm[:idx]] = true
+		} else if value, ok := os.LookupEnv(nm); ok {
+			env = append(env, nm+"="+value)
+			declared[nm] = true
+		}
+	}
+	if !inherit {
+		return env
+	}
+
+	// "*" 继承服务的所有变量， 其它的项不管在 "*" 前面还是后面都优先
+	var inherited []string
+	for _, kv := range os.Environ() {
+		if idx := strings.Index(kv, "="); idx > 0 && declared[kv[:idx]] {
+			continue
+		}
+		inherited = append(inherited, kv)
+	}
+	return append(inherited, env...)
+}
+
+// Command creates a command which runs pa with the limits of the sandbox.
+func (sb *Sandbox) Command(pa string, args ...string) (*exec.Cmd, error) {
+	cmd := sb.wrap(pa, args)
+	cmd.Env = sb.environ()
+	if err := sb.setCredential(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func sandboxFor(name string) *Sandbox {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return DefaultSandbox.merge(Sandboxes[name])
+}
+
+// readSandboxes 读取 sandbox.json， file 为 "" 时返回空的配置
+func readSandboxes(file string) (*Sandbox, map[string]*Sandbox, error) {
+	var cfg struct {
+		Default  *Sandbox            `json:"default"`
+		Commands map[string]*Sandbox `json:"commands"`
+	}
+	if "" != file {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, errors.New("load '" + file + "' fail," + err.Error())
+		}
+		if err := json.Unmarshal(bs, &cfg); err != nil {
+			return nil, nil, errors.New("load '" + file + "' fail," + err.Error())
+		}
+	}
+	if nil == cfg.Default {
+		cfg.Default = &Sandbox{}
+	}
+	if nil == cfg.Commands {
+		cfg.Commands = map[string]*Sandbox{}
+	}
+	return cfg.Default, cfg.Commands, nil
+}
+
+// resolveWorkDir 将 wd 限制在 work_dir_root 目录中。
+func resolveWorkDir(wd string) (string, error) {
+	if "" == *work_dir_root {
+		return wd, nil
+	}
+
+	root := abs(*work_dir_root)
+	if s, e := filepath.EvalSymlinks(root); nil == e {
+		root = s
+	}
+	if "" == wd {
+		return root, nil
+	}
+
+	pa := filepath.Clean(wd)
+	if !filepath.IsAbs(pa) {
+		pa = filepath.Join(root, pa)
+	}
+	pa = evalExistingSymlinks(pa)
+
+	rel, e := filepath.Rel(root, pa)
+	if nil != e || ".." == rel || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("工作目录 '" + wd + "' 不在允许的范围内")
+	}
+	return pa, nil
+}
+
+// evalExistingSymlinks 解析 pa 中已存在的部分的符号链接， 目录不存在时
+// 也不能通过它上级的符号链接跳出 work_dir_root
+func evalExistingSymlinks(pa string) string {
+	rest := ""
+	for dir := pa; ; {
+		if s, e := filepath.EvalSymlinks(dir); nil == e {
+			return filepath.Join(s, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return pa
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+type limitedWriter struct {
+	out      io.Writer
+	mu       sync.Mutex
+	remain   int64
+	exceeded func()
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.remain <= 0 {
+		return len(p), nil
+	}
+	if int64(len(p)) <= w.remain {
+		w.remain -= int64(len(p))
+		return w.out.Write(p)
+	}
+
+	w.out.Write(p[:w.remain])
+	w.remain = 0
+	io.WriteString(w.out, "\r\n输出超过限制，命令已被终止。\r\n")
+	if nil != w.exceeded {
+		go w.exceeded()
+	}
+	return len(p), nil
+}
+
+// limitOutput calls exceeded when more than limit bytes are written to out.
+func limitOutput(out io.Writer, limit int64, exceeded func()) io.Writer {
+	if limit <= 0 {
+		return out
+	}
+	return &limitedWriter{out: out, remain: limit, exceeded: exceeded}
+}
@@ -0,0 +1,117 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveWorkDir(t *testing.T) {
+	root := t.TempDir()
+	if s, e := filepath.EvalSymlinks(root); nil == e {
+		root = s
+	}
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	old := *work_dir_root
+	*work_dir_root = root
+	defer func() { *work_dir_root = old }()
+
+	for _, test := range []struct {
+		wd       string
+		excepted string
+	}{
+		{"", root},
+		{"a/b", filepath.Join(root, "a", "b")},
+		{filepath.Join(root, "a"), filepath.Join(root, "a")},
+		{"a/../a/b", filepath.Join(root, "a", "b")},
+	} {
+		actual, err := resolveWorkDir(test.wd)
+		if err != nil {
+			t.Errorf("%q: %v", test.wd, err)
+		} else if actual != test.excepted {
+			t.Errorf("%q: excepted %q, got %q", test.wd, test.excepted, actual)
+		}
+	}
+
+	for _, wd := range []string{"..", "../x", "a/../../x", "/etc", outside, "link", "link/x"} {
+		if actual, err := resolveWorkDir(wd); nil == err {
+			t.Errorf("%q: excepted error, got %q", wd, actual)
+		}
+	}
+
+	*work_dir_root = ""
+	if actual, err := resolveWorkDir("/etc"); err != nil || "/etc" != actual {
+		t.Errorf("excepted '/etc' without root, got %q, %v", actual, err)
+	}
+}
+
+func TestSandboxEnviron(t *testing.T) {
+	os.Setenv("TPT_SANDBOX_A", "a")
+	os.Setenv("TPT_SANDBOX_B", "b")
+	defer os.Unsetenv("TPT_SANDBOX_A")
+	defer os.Unsetenv("TPT_SANDBOX_B")
+
+	sb := &Sandbox{Env: []string{"TPT_SANDBOX_A", "X=1", "TPT_SANDBOX_MISSING"}}
+	if excepted := []string{"TPT_SANDBOX_A=a", "X=1"}; !reflect.DeepEqual(sb.environ(), excepted) {
+		t.Errorf("excepted %v, got %v", excepted, sb.environ())
+	}
+
+	// "*" 后面的项不能被丢弃， 并且覆盖继承的变量
+	sb = &Sandbox{Env: []string{"*", "TPT_SANDBOX_A=override", "Y=2"}}
+	env := sb.environ()
+	count := map[string]int{}
+	for _, kv := range env {
+		count[strings.SplitN(kv, "=", 2)[0]]++
+	}
+	if count["TPT_SANDBOX_A"] != 1 || count["Y"] != 1 || count["TPT_SANDBOX_B"] != 1 {
+		t.Errorf("excepted every variable once, got %v", env)
+	}
+	found := map[string]bool{}
+	for _, kv := range env {
+		found[kv] = true
+	}
+	if !found["TPT_SANDBOX_A=override"] || !found["Y=2"] || !found["TPT_SANDBOX_B=b"] {
+		t.Errorf("excepted overrides and inherited variables, got %v", env)
+	}
+}
+
+func TestReadSandboxes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sandbox.json")
+	if err := os.WriteFile(file, []byte(`{"default": {"cpu_time": 10, "output_size": 100},
+  "commands": {"ping": {"cpu_time": 5, "user": "nobody"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultSandbox, sandboxes, err := readSandboxes(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := defaultSandbox.merge(sandboxes["ping"])
+	if merged.CPUTime != 5 || merged.OutputSize != 100 || merged.User != "nobody" {
+		t.Errorf("merge is invalid, got %+v", merged)
+	}
+	if defaultSandbox.CPUTime != 10 {
+		t.Errorf("merge must not modify the default, got %+v", defaultSandbox)
+	}
+
+	// 文件不存在时恢复为不限制
+	defaultSandbox, sandboxes, err = readSandboxes("")
+	if err != nil || nil == defaultSandbox || 0 != len(sandboxes) || defaultSandbox.hasRlimits() {
+		t.Errorf("excepted empty sandbox, got %+v, %v, %v", defaultSandbox, sandboxes, err)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"default": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSandboxes(file); nil == err {
+		t.Error("excepted error, got ok")
+	}
+}
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package terminal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// wrap runs the command by sh because rlimits can't be set on a child
+// process by os/exec.
+func (sb *Sandbox) wrap(pa string, args []string) *exec.Cmd {
+	if !sb.hasRlimits() {
+		return exec.Command(pa, args...)
+	}
+
+	script := ""
+	if sb.CPUTime > 0 {
+		script += "ulimit -t " + strconv.Itoa(sb.CPUTime) + " && "
+	}
+	if sb.AddressSpace > 0 {
+		script += "ulimit -v " + strconv.FormatInt((sb.AddressSpace+1023)/1024, 10) + " && "
+	}
+	if sb.OpenFiles > 0 {
+		script += "ulimit -n " + strconv.Itoa(sb.OpenFiles) + " && "
+	}
+	script += "exec \"$0\" \"$@\""
+	return exec.Command("/bin/sh", append([]string{"-c", script, pa}, args...)...)
+}
+
+func (sb *Sandbox) setCredential(cmd *exec.Cmd) error {
+	credential, err := sb.credential()
+	if nil != err || nil == credential {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	return nil
+}
+
+// chown 将命令要读取的文件 (如 file 参数生成的临时文件) 交给运行命令的
+// 帐号， 否则切换了帐号的命令不能读取它
+func (sb *Sandbox) chown(file string) error {
+	credential, err := sb.credential()
+	if nil != err || nil == credential {
+		return err
+	}
+	return os.Chown(file, int(credential.Uid), int(credential.Gid))
+}
+
+// credential 返回运行命令的帐号， 没有配置 User 和 Group 时返回 nil
+func (sb *Sandbox) credential() (*syscall.Credential, error) {
+	if "" == sb.User && "" == sb.Group {
+		return nil, nil
+	}
+
+	var uid, gid uint64
+	var err error
+	// 附加组必须重新设置， 否则子进程会保留服务进程的附加组 (如 root 的 0)
+	groups := []uint32{}
+	if "" != sb.User {
+		u, e := user.Lookup(sb.User)
+		if nil != e {
+			u, e = user.LookupId(sb.User)
+			if nil != e {
+				return nil, errors.New("user '" + sb.User + "' is not found")
+			}
+		}
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); nil != err {
+			return nil, err
+		}
+		if gid, err = strconv.ParseUint(u.Gid, 10, 32); nil != err {
+			return nil, err
+		}
+		ids, e := u.GroupIds()
+		if nil != e {
+			return nil, errors.New("read groups of user '" + sb.User + "' fail, " + e.Error())
+		}
+		for _, id := range ids {
+			g, e := strconv.ParseUint(id, 10, 32)
+			if nil != e {
+				return nil, e
+			}
+			groups = append(groups, uint32(g))
+		}
+	}
+	if "" != sb.Group {
+		g, e := user.LookupGroup(sb.Group)
+		if nil != e {
+			g, e = user.LookupGroupId(sb.Group)
+			if nil != e {
+				return nil, errors.New("group '" + sb.Group + "' is not found")
+			}
+		}
+		if gid, err = strconv.ParseUint(g.Gid, 10, 32); nil != err {
+			return nil, err
+		}
+	}
+
+	if "" == sb.User {
+		u, e := user.Current()
+		if nil != e {
+			return nil, e
+		}
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); nil != err {
+			return nil, err
+		}
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
@@ -0,0 +1,22 @@
+package terminal
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// windows 不支持 rlimits， 只有 OutputSize 和 Env 生效。
+func (sb *Sandbox) wrap(pa string, args []string) *exec.Cmd {
+	return exec.Command(pa, args...)
+}
+
+func (sb *Sandbox) setCredential(cmd *exec.Cmd) error {
+	if "" != sb.User || "" != sb.Group {
+		return errors.New("run command as other user is unsupported on windows")
+	}
+	return nil
+}
+
+func (sb *Sandbox) chown(file string) error {
+	return nil
+}
@@ -0,0 +1,652 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maxJobOutput 是保存在历史记录中的输出的最大长度
+const maxJobOutput = 64 * 1024
+
+// maxJobHistory 是每个任务保留的历史记录数
+const maxJobHistory = 200
+
+// minJobInterval 是非管理员的任务两次执行之间的最小间隔
+const minJobInterval = time.Minute
+
+// ScheduledJob 是一个定时任务， Type 可以是
+//
+//	command - 执行信任列表中的本地命令 Command 和 Args
+//	device  - 在设备 Device 上执行命令或脚本 (ssh exec、 telnet 或 expect 脚本)
+//	backup  - 备份设备 Device 的配置
+type ScheduledJob struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Schedule 是 cron 表达式， 可以有秒， 也可以是 @every 1h 和 @daily 等
+	Schedule string      `json:"schedule"`
+	Type     string      `json:"type"`
+	Command  string      `json:"command,omitempty"`
+	Args     []string    `json:"args,omitempty"`
+	Device   *DeviceTask `json:"device,omitempty"`
+	Timeout  Duration    `json:"timeout,omitempty"`
+	Paused   bool        `json:"paused"`
+	Owner    string      `json:"owner,omitempty"`
+	Created  time.Time   `json:"created_at"`
+
+	entryID cron.EntryID
+}
+
+// jobView 是 API 返回的任务， 不包含设备的密码
+type jobView struct {
+	ScheduledJob
+	Device  *DeviceTask `json:"device,omitempty"`
+	NextRun *time.Time  `json:"next_run,omitempty"`
+	LastRun *JobRun     `json:"last_run,omitempty"`
+}
+
+// JobRun 是任务的一次执行
+type JobRun struct {
+	JobID      string    `json:"job_id"`
+	StartAt    time.Time `json:"start_at"`
+	Duration   float64   `json:"duration"`
+	Status     string    `json:"status"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	Output     string    `json:"output"`
+	Error      string    `json:"error,omitempty"`
+	// Trigger 是 schedule 或 manual
+	Trigger string `json:"trigger"`
+}
+
+// JobScheduler 按 cron 表达式执行任务， 任务保存在日志目录的
+// scheduler/jobs.json 中， 执行的历史保存在 scheduler/history 中
+type JobScheduler struct {
+	mu      sync.Mutex
+	cron    *cron.Cron
+	jobs    map[string]*ScheduledJob
+	lastRun map[string]*JobRun
+	running map[string]bool
+	dir     string
+}
+
+// Scheduler 在 New 中启动
+var Scheduler *JobScheduler
+
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour |
+	cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+func newJobScheduler(dir string) (*JobScheduler, error) {
+	s := &JobScheduler{
+		cron: cron.New(cron.WithParser(cronParser),
+			cron.WithChain(cron.Recover(cron.DefaultLogger), cron.SkipIfStillRunning(cron.DefaultLogger))),
+		jobs:    map[string]*ScheduledJob{},
+		lastRun: map[string]*JobRun{},
+		running: map[string]bool{},
+		dir:     dir,
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "jobs.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("load jobs fail, " + err.Error())
+	}
+	if len(bs) > 0 {
+		var jobs []*ScheduledJob
+		if err := json.Unmarshal(bs, &jobs); err != nil {
+			return nil, errors.New("load jobs fail, " + err.Error())
+		}
+		for _, job := range jobs {
+			s.jobs[job.ID] = job
+			if !job.Paused {
+				if err := s.schedule(job); err != nil {
+					log.Println("schedule job '"+job.ID+"' fail,", err)
+				}
+			}
+		}
+	}
+	s.cron.Start()
+	return s, nil
+}
+
+func (s *JobScheduler) schedule(job *ScheduledJob) error {
+	id, err := s.cron.AddFunc(job.Schedule, func() {
+		// 手动执行的任务还没有结束时跳过
+		if !s.acquire(job.ID) {
+			log.Println("job '" + job.ID + "' is still running, skip it")
+			return
+		}
+		defer s.release(job.ID)
+		s.run(job.ID, "schedule")
+	})
+	if err != nil {
+		return err
+	}
+	job.entryID = id
+	return nil
+}
+
+func (s *JobScheduler) unschedule(job *ScheduledJob) {
+	if 0 != job.entryID {
+		s.cron.Remove(job.entryID)
+		job.entryID = 0
+	}
+}
+
+// save 保存所有的任务， 调用时必须持有 s.mu
+func (s *JobScheduler) save() error {
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	bs, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	// 任务中有设备的密码
+	return ioutil.WriteFile(filepath.Join(s.dir, "jobs.json"), bs, 0600)
+}
+
+func (job *ScheduledJob) validate() error {
+	sched, err := cronParser.Parse(job.Schedule)
+	if err != nil {
+		return errors.New("schedule '" + job.Schedule + "' is invalid, " + err.Error())
+	}
+	if !isAdminUser(job.Owner) && minInterval(sched) < minJobInterval {
+		return errors.New("schedule '" + job.Schedule + "' is too frequent, the minimum interval is " + minJobInterval.String())
+	}
+	switch job.Type {
+	case "command":
+		command, ok := lookupCommand(job.Command)
+		if !ok {
+			return errors.New("'" + job.Command + "' 不在信任列表中")
+		}
+		if !command.IsAllowed(job.Owner) {
+			return errors.New("没有执行 '" + job.Command + "' 的权限")
+		}
+		return command.Validate(job.Args)
+	case "device", "backup":
+		if nil == job.Device || "" == job.Device.Hostname {
+			return errors.New("device is required")
+		}
+		// 密码不能明文保存在 jobs.json 中， 必须使用凭据库
+		if "" != job.Device.Password || "" != job.Device.EnablePassword {
+			return errors.New("password isn't allowed in a job, use a credential instead")
+		}
+		if "" == job.Device.Credential {
+			return errors.New("credential is required")
+		}
+		if "device" == job.Type && len(job.Device.Commands) == 0 && nil == job.Device.Script {
+			return errors.New("commands or script is required")
+		}
+		if nil != job.Device.Script {
+			return job.Device.Script.Compile()
+		}
+		return nil
+	default:
+		return errors.New("type '" + job.Type + "' is unsupported")
+	}
+}
+
+// minInterval 返回 sched 接下来的若干次执行之间的最小间隔
+func minInterval(sched cron.Schedule) time.Duration {
+	// 不再执行的任务没有间隔
+	shortest := time.Duration(1<<63 - 1)
+	prev := sched.Next(time.Now())
+	for i := 0; i < 100 && !prev.IsZero(); i++ {
+		next := sched.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if d := next.Sub(prev); d < shortest {
+			shortest = d
+		}
+		prev = next
+	}
+	return shortest
+}
+
+// Add 添加一个任务
+func (s *JobScheduler) Add(job *ScheduledJob) error {
+	if err := job.validate(); err != nil {
+		return err
+	}
+	job.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	job.Created = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !job.Paused {
+		if err := s.schedule(job); err != nil {
+			return err
+		}
+	}
+	s.jobs[job.ID] = job
+	return s.save()
+}
+
+// Get 返回任务
+func (s *JobScheduler) Get(id string) (*ScheduledJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// SetPaused 暂停或恢复任务
+func (s *JobScheduler) SetPaused(id string, paused bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return errors.New("job '" + id + "' is not found")
+	}
+	if paused {
+		s.unschedule(job)
+	} else if 0 == job.entryID {
+		if err := s.schedule(job); err != nil {
+			return err
+		}
+	}
+	job.Paused = paused
+	return s.save()
+}
+
+// Delete 删除任务和它的历史记录
+func (s *JobScheduler) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return errors.New("job '" + id + "' is not found")
+	}
+	s.unschedule(job)
+	delete(s.jobs, id)
+	delete(s.lastRun, id)
+	os.Remove(s.historyFile(id))
+	return s.save()
+}
+
+// List 返回 user 的任务， all 为 true 时返回所有的任务
+func (s *JobScheduler) List(user string, all bool) []*jobView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := []*jobView{}
+	for _, job := range s.jobs {
+		if all || job.Owner == user {
+			results = append(results, s.view(job))
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Created.Before(results[j].Created)
+	})
+	return results
+}
+
+// view 返回不包含密码的任务， 调用时必须持有 s.mu
+func (s *JobScheduler) view(job *ScheduledJob) *jobView {
+	v := &jobView{ScheduledJob: *job, LastRun: s.lastRun[job.ID]}
+	if nil != job.Device {
+		device := *job.Device
+		device.Password = ""
+		device.EnablePassword = ""
+		v.Device = &device
+	}
+	if 0 != job.entryID {
+		next := s.cron.Entry(job.entryID).Next
+		if !next.IsZero() {
+			v.NextRun = &next
+		}
+	}
+	return v
+}
+
+func (s *JobScheduler) historyFile(id string) string {
+	return filepath.Join(s.dir, "history", id+".jsonl")
+}
+
+// acquire 标记任务正在执行， 任务已经在执行时返回 false
+func (s *JobScheduler) acquire(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[id] {
+		return false
+	}
+	s.running[id] = true
+	return true
+}
+
+func (s *JobScheduler) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
+
+// start 在后台执行任务， 任务还在执行时返回 false
+func (s *JobScheduler) start(id, trigger string) bool {
+	if !s.acquire(id) {
+		return false
+	}
+	go func() {
+		defer s.release(id)
+		s.run(id, trigger)
+	}()
+	return true
+}
+
+// run 执行任务并保存历史记录
+func (s *JobScheduler) run(id, trigger string) *JobRun {
+	job, ok := s.Get(id)
+	if !ok {
+		return nil
+	}
+
+	timeout := time.Duration(job.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	r := &JobRun{JobID: job.ID, StartAt: time.Now(), Trigger: trigger}
+	var err error
+	switch job.Type {
+	case "command":
+		r.Output, r.ExitStatus, err = runLocalCommand(job.Owner, job.Command, job.Args, timeout)
+	case "device":
+		task := *job.Device
+		task.Timeout = timeout
+		if err = task.useCredential(job.Owner, false); nil != err {
+			break
+		}
+		result := runOnDevice(&task, job.Owner, nil)
+		r.Output, r.ExitStatus = result.Output, result.ExitStatus
+		if "ok" != result.Status {
+			err = errors.New(result.Error)
+		}
+	case "backup":
+		if !isAdminUser(job.Owner) {
+			err = errors.New("permission denied, backup requires an admin")
+			break
+		}
+		task := *job.Device
+		task.Timeout = timeout
+		if err = task.useCredential(job.Owner, false); nil != err {
+			break
+		}
+		result := backupDevice(&task, job.Owner)
+		if "" != result.Error {
+			err = errors.New(result.Error)
+		} else if result.Changed {
+			r.Output = "configuration is changed, version is " + result.Version.Version
+		} else {
+			r.Output = "configuration isn't changed"
+		}
+	default:
+		err = errors.New("type '" + job.Type + "' is unsupported")
+	}
+
+	r.Duration = toMillisecond(time.Since(r.StartAt))
+	if len(r.Output) > maxJobOutput {
+		r.Output = r.Output[len(r.Output)-maxJobOutput:]
+	}
+	switch {
+	case nil != err:
+		r.Status = "failed"
+		r.Error = err.Error()
+	case nil != r.ExitStatus && 0 != *r.ExitStatus:
+		r.Status = "failed"
+	default:
+		r.Status = "ok"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return r
+	}
+	s.lastRun[id] = r
+	if err := s.appendHistory(r); err != nil {
+		log.Println("save history of job '"+id+"' fail,", err)
+	}
+	return r
+}
+
+// appendHistory 保存执行记录， 只保留最后 maxJobHistory 条， 调用时必须持有 s.mu
+func (s *JobScheduler) appendHistory(r *JobRun) error {
+	runs, err := s.readHistory(r.JobID)
+	if err != nil {
+		return err
+	}
+	runs = append(runs, r)
+	if len(runs) > maxJobHistory {
+		runs = runs[len(runs)-maxJobHistory:]
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, "history"), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.historyFile(r.JobID), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, run := range runs {
+		if err := enc.Encode(run); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *JobScheduler) readHistory(id string) ([]*JobRun, error) {
+	f, err := os.Open(s.historyFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []*JobRun
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var r JobRun
+		if err := dec.Decode(&r); err != nil {
+			return runs, nil
+		}
+		runs = append(runs, &r)
+	}
+	return runs, nil
+}
+
+// History 返回任务最近的执行记录， 最新的在前
+func (s *JobScheduler) History(id string, limit int) ([]*JobRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs, err := s.readHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*JobRun, 0, len(runs))
+	for i := len(runs) - 1; i >= 0 && (limit <= 0 || len(results) < limit); i-- {
+		results = append(results, runs[i])
+	}
+	return results, nil
+}
+
+// runLocalCommand 在沙箱中执行信任列表中的命令， 返回输出和退出码
+func runLocalCommand(user, name string, args []string, timeout time.Duration) (string, *int, error) {
+	command, ok := lookupCommand(name)
+	if !ok {
+		return "", nil, errors.New("'" + name + "' 不在信任列表中")
+	}
+	if !command.IsAllowed(user) {
+		return "", nil, errors.New("没有执行 '" + name + "' 的权限")
+	}
+	if err := command.Validate(args); err != nil {
+		return "", nil, err
+	}
+	args = command.ExpandArgs(args)
+
+	program, args := translateCommand(command, args)
+	pa := command.Path
+	if "" != program {
+		if c, ok := lookupCommand(program); ok {
+			pa = c.Path
+		} else {
+			pa = program
+		}
+	}
+
+	sandbox := sandboxFor(command.Name).merge(command.Sandbox)
+	cmd, err := sandbox.Command(pa, args...)
+	if err != nil {
+		return "", nil, err
+	}
+	if wd, err := resolveWorkDir(""); nil == err && "" != wd {
+		cmd.Dir = wd
+	}
+
+	var output lockedBuffer
+	var w = limitOutput(&output, sandbox.OutputSize, func() {
+		defer recover()
+		cmd.Process.Kill()
+	})
+	if "" != command.Charset {
+		w = decodeBy(command.Charset, w)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		defer recover()
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+			status := exitErr.ExitCode()
+			return output.String(), &status, nil
+		}
+		return output.String(), nil, err
+	}
+	status := 0
+	return output.String(), &status, nil
+}
+
+func (s *JobScheduler) canAccess(r *http.Request, job *ScheduledJob) bool {
+	return isAdmin(r) || job.Owner == currentUser(r)
+}
+
+// JobsHandler 是定时任务的 API
+//
+//	GET  /jobs                   列出任务
+//	POST /jobs                   创建任务， 请求是 JSON 格式的 ScheduledJob
+//	POST /jobs/pause?id=xxx      暂停任务
+//	POST /jobs/resume?id=xxx     恢复任务
+//	POST /jobs/delete?id=xxx     删除任务
+//	POST /jobs/run?id=xxx        立即在后台执行任务， 结果在执行的历史记录中
+//	GET  /jobs/history?id=xxx    执行的历史记录， 可以用 limit 限制数量
+func JobsHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nil == Scheduler {
+			renderError(w, http.StatusServiceUnavailable, "scheduler isn't started")
+			return
+		}
+		if "" == action {
+			switch r.Method {
+			case "GET":
+				renderJSON(w, http.StatusOK, Scheduler.List(currentUser(r), isAdmin(r)))
+			case "POST":
+				var job ScheduledJob
+				if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+					renderError(w, http.StatusBadRequest, "job is invalid, "+err.Error())
+					return
+				}
+				job.Owner = currentUser(r)
+				if "backup" == job.Type && !isAdmin(r) {
+					renderError(w, http.StatusForbidden, "permission denied")
+					return
+				}
+				if err := Scheduler.Add(&job); err != nil {
+					renderError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				Scheduler.mu.Lock()
+				view := Scheduler.view(&job)
+				Scheduler.mu.Unlock()
+				renderJSON(w, http.StatusOK, view)
+			default:
+				renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+			}
+			return
+		}
+
+		id := r.URL.Query().Get("id")
+		job, ok := Scheduler.Get(id)
+		if !ok {
+			renderError(w, http.StatusNotFound, "job '"+id+"' is not found")
+			return
+		}
+		if !Scheduler.canAccess(r, job) {
+			renderError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		if "history" == action {
+			runs, err := Scheduler.History(id, toInt(r.URL.Query().Get("limit"), 20))
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			renderJSON(w, http.StatusOK, runs)
+			return
+		}
+		if "POST" != r.Method {
+			renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+			return
+		}
+
+		var err error
+		switch action {
+		case "pause":
+			err = Scheduler.SetPaused(id, true)
+		case "resume":
+			err = Scheduler.SetPaused(id, false)
+		case "delete":
+			err = Scheduler.Delete(id)
+		case "run":
+			if !Scheduler.start(id, "manual") {
+				renderError(w, http.StatusConflict, "job '"+id+"' is still running")
+				return
+			}
+			renderJSON(w, http.StatusAccepted, map[string]interface{}{"id": id})
+			return
+		}
+		if err != nil {
+			renderError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		renderJSON(w, http.StatusOK, map[string]interface{}{"id": id})
+	}
+}
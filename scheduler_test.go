@@ -0,0 +1,79 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobValidate(t *testing.T) {
+	old := *admin_users
+	*admin_users = "admin"
+	defer func() { *admin_users = old }()
+
+	device := func() *DeviceTask {
+		return &DeviceTask{Hostname: "192.168.1.1", Credential: "c1", Commands: []string{"show version"}}
+	}
+
+	for _, job := range []*ScheduledJob{
+		{Schedule: "@every 1m", Type: "device", Device: device(), Owner: "alice"},
+		{Schedule: "0 */5 * * * *", Type: "device", Device: device(), Owner: "alice"},
+		{Schedule: "@daily", Type: "backup", Device: device(), Owner: "admin"},
+		{Schedule: "@every 1s", Type: "device", Device: device(), Owner: "admin"},
+	} {
+		if err := job.validate(); err != nil {
+			t.Errorf("%s(%s): %v", job.Schedule, job.Owner, err)
+		}
+	}
+
+	withPassword := device()
+	withPassword.Password = "secret"
+	withEnable := device()
+	withEnable.EnablePassword = "secret"
+	withoutCredential := device()
+	withoutCredential.Credential = ""
+
+	for _, job := range []*ScheduledJob{
+		{Schedule: "@every 1s", Type: "device", Device: device(), Owner: "alice"},
+		{Schedule: "* * * * * *", Type: "device", Device: device(), Owner: "alice"},
+		// 每天只有两次， 但是两次的间隔只有一秒
+		{Schedule: "0,1 0 0 * * *", Type: "device", Device: device(), Owner: "alice"},
+		{Schedule: "@every 1s", Type: "device", Device: device(), Owner: ""},
+		{Schedule: "@every 1h", Type: "device", Device: withPassword, Owner: "alice"},
+		{Schedule: "@every 1h", Type: "device", Device: withEnable, Owner: "admin"},
+		{Schedule: "@every 1h", Type: "backup", Device: withoutCredential, Owner: "admin"},
+		{Schedule: "bad", Type: "device", Device: device(), Owner: "admin"},
+	} {
+		if err := job.validate(); nil == err {
+			t.Errorf("%s(%s): excepted error, got ok", job.Schedule, job.Owner)
+		}
+	}
+}
+
+func TestJobRunGuard(t *testing.T) {
+	s, err := newJobScheduler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cron.Stop()
+
+	if !s.acquire("job1") {
+		t.Fatal("excepted acquire ok")
+	}
+	// 定时执行还没有结束时不能手动执行
+	if s.start("job1", "manual") {
+		t.Error("excepted start fail while the job is running")
+	}
+	s.release("job1")
+
+	if !s.start("job1", "manual") {
+		t.Fatal("excepted start ok")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.acquire("job1") {
+		if time.Now().After(deadline) {
+			t.Fatal("the manual run isn't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.release("job1")
+}
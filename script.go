@@ -0,0 +1,325 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/runner-mei/web-terminal/expect"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// terminalConn 是一个交互式的终端， 可以是 ssh 会话、 telnet 连接或本地的伪终端
+type terminalConn struct {
+	io.Reader
+	io.Writer
+	closers []func() error
+	once    sync.Once
+	address string // 检查过的目标地址， 本地的伪终端为 ""
+}
+
+func (c *terminalConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		for i := len(c.closers) - 1; i >= 0; i-- {
+			if e := c.closers[i](); nil != e && nil == err {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// dialTerminal 按参数 protocol 打开一个终端， protocol 可以是 ssh (缺省)、
+// telnet 和 cmd (在伪终端中执行信任列表中的命令， 参数和 /cmd 一样是
+// arg0, arg1, ...)
+func dialTerminal(params url.Values, user string) (*terminalConn, error) {
+	columns := toInt(params.Get("columns"), 120)
+	rows := toInt(params.Get("rows"), 80)
+
+	var conn *terminalConn
+	var err error
+	switch protocol := params.Get("protocol"); protocol {
+	case "", "ssh":
+		port := params.Get("port")
+		if "" == port {
+			port = "22"
+		}
+		address, e := checkTarget("ssh", user, "", params.Get("hostname"), port)
+		if e != nil {
+			return nil, e
+		}
+		signers, e := privateKeySigners(params.Get("private_key"), params.Get("passphrase"))
+		if e != nil {
+			return nil, e
+		}
+		conn, err = dialSSHTerminal(address, params.Get("user"), params.Get("password"), rows, columns, signers...)
+		if nil == err {
+			conn.address = address
+		}
+	case "telnet":
+		port := params.Get("port")
+		if "" == port {
+			port = "23"
+		}
+		address, e := checkTarget("telnet", user, "", params.Get("hostname"), port)
+		if e != nil {
+			return nil, e
+		}
+		conn, err = dialTelnetTerminal(address, rows, columns)
+		if nil == err {
+			conn.address = address
+		}
+	case "cmd":
+		conn, err = startPtyTerminal(user, params.Get("cmd"), queryArgs(params), params.Get("wd"), rows, columns)
+	default:
+		return nil, errors.New("protocol '" + protocol + "' is unsupported")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if charset := params.Get("charset"); "" != charset {
+		cs := GetCharset(charset)
+		if nil == cs {
+			conn.Close()
+			return nil, errors.New("charset '" + charset + "' is not exists.")
+		}
+		if encoding.Nop != cs {
+			conn.Reader = transform.NewReader(conn.Reader, cs.NewDecoder())
+			conn.Writer = transform.NewWriter(conn.Writer, cs.NewEncoder())
+		}
+	}
+	return conn, nil
+}
+
+// dialSSH 连接 ssh 服务器， keyboard-interactive 的问题都用密码回答， 有私钥
+// 时先用私钥认证
+func dialSSH(address, user, pwd string, signers ...ssh.Signer) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		Config:          ssh.Config{Ciphers: SupportedCiphers, KeyExchanges: SupportedKeyExchanges},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:            user,
+		Timeout:         30 * time.Second,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(pwd),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					answers[i] = pwd
+				}
+				return answers, nil
+			}),
+		},
+	}
+	if len(signers) > 0 {
+		config.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signers...)}, config.Auth...)
+	}
+	client, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return nil, errors.New("Failed to dial: " + err.Error())
+	}
+	return client, nil
+}
+
+func dialSSHTerminal(address, user, pwd string, rows, columns int, signers ...ssh.Signer) (*terminalConn, error) {
+	client, err := dialSSH(address, user, pwd, signers...)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, errors.New("Failed to create session: " + err.Error())
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err = session.RequestPty("xterm", rows, columns, modes); err != nil {
+		session.Close()
+		client.Close()
+		return nil, errors.New("request for pseudo terminal failed:" + err.Error())
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	session.Stdout = pw
+	session.Stderr = pw
+	if err := session.Shell(); nil != err {
+		session.Close()
+		client.Close()
+		return nil, errors.New("Unable to execute command:" + err.Error())
+	}
+	go func() {
+		pw.CloseWithError(session.Wait())
+	}()
+
+	return &terminalConn{Reader: pr, Writer: stdin,
+		closers: []func() error{client.Close, session.Close}}, nil
+}
+
+func dialTelnetTerminal(address string, rows, columns int) (*terminalConn, error) {
+	client, err := net.DialTimeout("tcp", address, 30*time.Second)
+	if nil != err {
+		return nil, errors.New("Failed to dial: " + err.Error())
+	}
+	conn, err := NewConn(client)
+	if nil != err {
+		client.Close()
+		return nil, errors.New("failed to create connection: " + err.Error())
+	}
+	conn.setWindowSize(byte(rows), byte(columns))
+	return &terminalConn{Reader: conn, Writer: conn, closers: []func() error{conn.Close}}, nil
+}
+
+func startPtyTerminal(user, name string, args []string, wd string, rows, columns int) (*terminalConn, error) {
+	command, ok := lookupCommand(name)
+	if !ok {
+		return nil, errors.New("'" + name + "' 不在信任列表中")
+	}
+	if !command.IsAllowed(user) {
+		return nil, errors.New("没有执行 '" + name + "' 的权限")
+	}
+	if err := command.Validate(args); err != nil {
+		return nil, err
+	}
+	args = command.ExpandArgs(args)
+	wd, err := resolveWorkDir(wd)
+	if err != nil {
+		return nil, err
+	}
+
+	sandbox := sandboxFor(command.Name).merge(command.Sandbox)
+	cmd, err := sandbox.Command(command.Path, args...)
+	if err != nil {
+		return nil, err
+	}
+	if "" != wd {
+		cmd.Dir = wd
+	}
+	ptmx, err := startPty(cmd, rows, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &terminalConn{Reader: ptmx, Writer: ptmx, closers: []func() error{
+		func() error {
+			cmd.Process.Kill()
+			return ignoreExitError(cmd.Wait())
+		},
+		ptmx.Close}}
+	if sandbox.OutputSize > 0 {
+		// 输出经过 limitOutput， 超过限制时终止命令
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.Copy(limitOutput(pw, sandbox.OutputSize, func() {
+				defer recover()
+				cmd.Process.Kill()
+			}), ptmx)
+			pw.CloseWithError(err)
+		}()
+		conn.Reader = pr
+		conn.closers = append(conn.closers, pr.Close)
+	}
+	return conn, nil
+}
+
+func ignoreExitError(err error) error {
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil
+	}
+	return err
+}
+
+// maxScriptTimeout 是脚本执行时间的上限
+const maxScriptTimeout = 1 * time.Hour
+
+// RunScript 在终端上执行 expect 脚本， 并将终端的输出发送到 websocket，
+// 脚本可以是参数 script， 也可以是 websocket 上的第一个消息。 脚本结束后
+// 发送 "%tpt_result%" 加上 JSON 格式的变量和错误
+func RunScript(ws *websocket.Conn) {
+	defer ws.Close()
+
+	params := ws.Request().URL.Query()
+	text := params.Get("script")
+	if "" == text {
+		if err := websocket.Message.Receive(ws, &text); err != nil {
+			logString(ws, "read script fail, "+err.Error())
+			return
+		}
+	}
+	script, err := expect.Parse([]byte(text))
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+
+	opts, err := loginOptions(params)
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+
+	conn, err := dialTerminal(params, currentUser(ws.Request()))
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	target := params.Get("hostname")
+	if "cmd" == params.Get("protocol") {
+		target = params.Get("cmd")
+	}
+	live := openSession(ws, "script", target, conn.address)
+	defer live.Close()
+	live.OnKill(func() { conn.Close() })
+
+	timeout := 10 * time.Minute
+	if s := params.Get("timeout"); "" != s {
+		if t, e := time.ParseDuration(s); nil == e && t > 0 {
+			timeout = t
+		}
+	}
+	if timeout > maxScriptTimeout {
+		timeout = maxScriptTimeout
+	}
+	sess := expect.New(conn, conn, live.Output(ws))
+	defer sess.Close()
+	// 关闭 sess 使 sleep 和 expect 立即结束
+	timer := time.AfterFunc(timeout, func() {
+		conn.Close()
+		sess.Close()
+	})
+	defer timer.Stop()
+	if isTelnet := "telnet" == params.Get("protocol"); opts.needsPrepare(isTelnet) {
+		if err := prepareSession(sess, opts, isTelnet); err != nil {
+			io.WriteString(ws, loginErrorText(err))
+			return
+		}
+	}
+
+	vars, err := script.Run(sess)
+	result := map[string]interface{}{"vars": vars}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	bs, _ := json.Marshal(result)
+	io.WriteString(ws, "%tpt_result%"+string(bs))
+}
@@ -0,0 +1,410 @@
+package terminal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/runner-mei/web-terminal/vt"
+	"golang.org/x/net/websocket"
+)
+
+// LiveSession 是一个打开的终端会话， 它在 sessions 中登记， 管理员可以
+// 查看和强制关闭它
+type LiveSession struct {
+	// 下面三个字段用 atomic 访问， 放在最前面保证 64 位对齐
+	bytesIn      int64
+	bytesOut     int64
+	lastActivity int64
+
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Protocol   string    `json:"protocol"`
+	Target     string    `json:"target"`
+	Address    string    `json:"address,omitempty"` // Target 解析后的 IP， 用于匹配主机组
+	Profile    string    `json:"profile,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartAt    time.Time `json:"start_at"`
+
+	mu      sync.Mutex
+	closers []func()
+	killed  bool
+
+	// screen 是会话的屏幕， 由 smu 保护， 输出写入 screen 和发给观察者
+	// 都在 smu 中， 保证观察者加入时的屏幕和后面的输出是连续的
+	smu      sync.Mutex
+	screen   *vt.Screen
+	recorder *recorder
+	auditor  lineAuditor
+
+	// 下面的字段用于共享会话， 见 share.go
+	input    *sessionInput
+	viewers  map[string]*viewer
+	keyboard string
+
+	// 下面的字段用于恢复会话， 由 wmu 保护， 见 resume.go
+	wmu         sync.Mutex
+	ws          *websocket.Conn
+	token       string
+	grace       time.Duration
+	history     *ringBuffer
+	detachTimer *time.Timer
+}
+
+// sessionView 是 API 返回的会话
+type sessionView struct {
+	*LiveSession
+	BytesIn      int64        `json:"bytes_in"`
+	BytesOut     int64        `json:"bytes_out"`
+	LastActivity time.Time    `json:"last_activity"`
+	Duration     float64      `json:"duration"`
+	Viewers      []viewerInfo `json:"viewers"`
+	Keyboard     string       `json:"keyboard,omitempty"`
+}
+
+var (
+	sessionsLock sync.Mutex
+	sessions     = map[string]*LiveSession{}
+)
+
+func newSessionID() string {
+	var bs [12]byte
+	if _, err := io.ReadFull(rand.Reader, bs[:]); err != nil {
+		return newBatchID()
+	}
+	return hex.EncodeToString(bs[:])
+}
+
+// resolveAddress 返回地址中主机的 IP， 无法解析时返回 ""
+func resolveAddress(address string) string {
+	if "" == address {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := net.ParseIP(host); nil != ip {
+		return ip.String()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].IP.String()
+}
+
+// openSession 登记一个会话， 处理结束时必须调用 Close， address 是检查过的
+// 目标地址 (见 checkTarget)， 没有时为 ""
+func openSession(ws *websocket.Conn, protocol, target, address string) *LiveSession {
+	rows := toInt(ws.Request().URL.Query().Get("rows"), 80)
+	columns := toInt(ws.Request().URL.Query().Get("columns"), 120)
+	if rows > vt.MaxRows {
+		rows = vt.MaxRows
+	}
+	if columns > vt.MaxCols {
+		columns = vt.MaxCols
+	}
+	now := time.Now()
+	sess := &LiveSession{ID: newSessionID(),
+		User:         currentUser(ws.Request()),
+		Protocol:     protocol,
+		Target:       target,
+		Address:      resolveAddress(address),
+		Profile:      ws.Request().URL.Query().Get("profile"),
+		RemoteAddr:   ws.Request().RemoteAddr,
+		StartAt:      now,
+		lastActivity: now.UnixNano(),
+		viewers:      map[string]*viewer{},
+		screen:       vt.New(rows, columns),
+		ws:           ws,
+		token:        newSessionID(),
+		grace:        sessionGrace(ws.Request())}
+	if sess.grace > 0 {
+		sess.history = newRingBuffer(*session_history)
+	}
+	if shouldRecord(ws.Request()) {
+		rec, err := newRecorder(sess, rows, columns)
+		if err != nil {
+			log.Println("record session '"+sess.ID+"' fail,", err)
+		} else {
+			sess.recorder = rec
+		}
+	}
+	sess.OnKill(sess.closeClient)
+	if sess.grace > 0 || "true" == ws.Request().URL.Query().Get("session_info") {
+		sess.notify()
+	}
+
+	sessionsLock.Lock()
+	sessions[sess.ID] = sess
+	sessionsLock.Unlock()
+
+	sess.audit("session_start", "")
+	return sess
+}
+
+func lookupSession(id string) (*LiveSession, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sess, ok := sessions[id]
+	return sess, ok
+}
+
+// ListSessions 返回所有的会话， 按开始时间排序
+func ListSessions() []*LiveSession {
+	sessionsLock.Lock()
+	list := make([]*LiveSession, 0, len(sessions))
+	for _, sess := range sessions {
+		list = append(list, sess)
+	}
+	sessionsLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartAt.Before(list[j].StartAt)
+	})
+	return list
+}
+
+// Close 从 sessions 中删除会话， 并断开所有的观察者
+func (sess *LiveSession) Close() {
+	sessionsLock.Lock()
+	delete(sessions, sess.ID)
+	sessionsLock.Unlock()
+
+	sess.mu.Lock()
+	viewers := sess.viewers
+	sess.viewers = map[string]*viewer{}
+	sess.mu.Unlock()
+	for _, v := range viewers {
+		v.close()
+	}
+	sess.closeClient()
+
+	sess.smu.Lock()
+	if nil != sess.recorder {
+		if err := sess.recorder.Close(); err != nil {
+			log.Println("close recording of session '"+sess.ID+"' fail,", err)
+		}
+		sess.recorder = nil
+	}
+	sess.smu.Unlock()
+
+	sess.audit("session_end", "")
+}
+
+// OnKill 添加强制关闭会话时要执行的函数， 如关闭网络连接或杀死进程
+func (sess *LiveSession) OnKill(cb func()) {
+	sess.mu.Lock()
+	killed := sess.killed
+	if !killed {
+		sess.closers = append(sess.closers, cb)
+	}
+	sess.mu.Unlock()
+	if killed {
+		cb()
+	}
+}
+
+// Kill 强制关闭会话
+func (sess *LiveSession) Kill() {
+	sess.mu.Lock()
+	closers := sess.closers
+	sess.closers = nil
+	sess.killed = true
+	input := sess.input
+	sess.mu.Unlock()
+
+	if nil != input {
+		input.w.Close()
+	}
+
+	for idx := len(closers) - 1; idx >= 0; idx-- {
+		func() {
+			defer recover()
+			closers[idx]()
+		}()
+	}
+}
+
+func (sess *LiveSession) view() *sessionView {
+	sess.mu.Lock()
+	viewers, keyboard := sess.viewerList(), sess.keyboard
+	sess.mu.Unlock()
+
+	return &sessionView{LiveSession: sess,
+		BytesIn:      atomic.LoadInt64(&sess.bytesIn),
+		BytesOut:     atomic.LoadInt64(&sess.bytesOut),
+		LastActivity: time.Unix(0, atomic.LoadInt64(&sess.lastActivity)),
+		Duration:     time.Since(sess.StartAt).Seconds(),
+		Viewers:      viewers,
+		Keyboard:     keyboard}
+}
+
+// Input 返回的 Reader 统计浏览器发送给会话的字节数， r 是 sessionInput 时
+// 会话可以被其它人以读写方式加入
+func (sess *LiveSession) Input(r io.ReadCloser) io.ReadCloser {
+	if in, ok := r.(*sessionInput); ok {
+		sess.mu.Lock()
+		sess.input = in
+		sess.mu.Unlock()
+
+		in.mu.Lock()
+		in.session = sess
+		in.mu.Unlock()
+	}
+	return &countingReader{sess: sess, r: r}
+}
+
+// Output 返回的 Writer 统计会话发送给浏览器的字节数
+func (sess *LiveSession) Output(w io.Writer) io.Writer {
+	return &countingWriter{sess: sess, w: w}
+}
+
+// countingReader 读到的按键经过 filterInput 检查后才交给会话， buf 是
+// 检查后还没有返回的按键
+type countingReader struct {
+	sess *LiveSession
+	r    io.ReadCloser
+	buf  []byte
+	err  error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.buf) == 0 {
+		if nil != r.err {
+			return 0, r.err
+		}
+		n, err := r.r.Read(p)
+		r.err = err
+		if n > 0 {
+			atomic.AddInt64(&r.sess.bytesIn, int64(n))
+			atomic.StoreInt64(&r.sess.lastActivity, time.Now().UnixNano())
+			r.buf = r.sess.filterInput(p[:n])
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *countingReader) Close() error {
+	return r.r.Close()
+}
+
+type countingWriter struct {
+	sess *LiveSession
+	w    io.Writer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&w.sess.bytesOut, int64(n))
+		atomic.StoreInt64(&w.sess.lastActivity, time.Now().UnixNano())
+
+		w.sess.smu.Lock()
+		w.sess.screen.Write(p[:n])
+		if nil != w.sess.recorder {
+			w.sess.recorder.Write(p[:n])
+		}
+		w.sess.broadcast(p[:n])
+		w.sess.smu.Unlock()
+	}
+	return n, err
+}
+
+// sessionPath 返回 /sessions/ 后面的部分， 例如 /sessions/abc 返回 ["abc"]
+func sessionPath(r *http.Request) []string {
+	idx := strings.LastIndex(r.URL.Path, "sessions/")
+	if idx < 0 {
+		return nil
+	}
+	path := strings.Trim(r.URL.Path[idx+len("sessions/"):], "/")
+	if "" == path {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// renderScreen 返回会话的屏幕， format 可以是 text、 html 或 json (缺省)
+func renderScreen(w http.ResponseWriter, r *http.Request, sess *LiveSession) {
+	sess.smu.Lock()
+	defer sess.smu.Unlock()
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, sess.screen.Text())
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, sess.screen.HTML())
+	case "", "json":
+		renderJSON(w, http.StatusOK, sess.screen.Snapshot())
+	default:
+		renderError(w, http.StatusBadRequest, "format '"+format+"' is unsupported")
+	}
+}
+
+// SessionsHandler 处理 GET /sessions、 GET /sessions/{id}、
+// GET /sessions/{id}/screen 和 DELETE /sessions/{id}
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		renderError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	path := sessionPath(r)
+	if len(path) == 0 {
+		if "GET" != r.Method {
+			renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+			return
+		}
+		views := []*sessionView{}
+		for _, sess := range ListSessions() {
+			views = append(views, sess.view())
+		}
+		renderJSON(w, http.StatusOK, views)
+		return
+	}
+
+	sess, ok := lookupSession(path[0])
+	if !ok {
+		renderError(w, http.StatusNotFound, "session '"+path[0]+"' is not found")
+		return
+	}
+	if len(path) > 1 {
+		if len(path) == 2 && "screen" == path[1] && "GET" == r.Method {
+			renderScreen(w, r, sess)
+			return
+		}
+		renderError(w, http.StatusNotFound, "'"+r.URL.Path+"' is not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		renderJSON(w, http.StatusOK, sess.view())
+	case "DELETE":
+		sess.Kill()
+		renderJSON(w, http.StatusOK, map[string]interface{}{"id": sess.ID})
+	default:
+		renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+	}
+}
@@ -0,0 +1,261 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// viewerQueueSize 是发给观察者但还没有写出的输出块数， 超过时断开观察者
+const viewerQueueSize = 256
+
+// viewer 是加入共享会话的观察者， Mode 是 ro (只读) 或 rw (读写)
+type viewer struct {
+	viewerInfo
+	ws  *websocket.Conn
+	out chan []byte
+}
+
+type viewerInfo struct {
+	ID     string    `json:"id"`
+	User   string    `json:"user"`
+	Mode   string    `json:"mode"`
+	JoinAt time.Time `json:"join_at"`
+}
+
+// sessionInfo 是发给会话所有者和观察者的 "%tpt_session%" 消息
+type sessionInfo struct {
+	ID       string       `json:"id"`
+	Viewers  []viewerInfo `json:"viewers"`
+	Keyboard string       `json:"keyboard"`
+	// Token 和 Grace 只发给所有者， 用于断开后恢复会话
+	Token string  `json:"token,omitempty"`
+	Grace float64 `json:"grace,omitempty"`
+}
+
+func (v *viewer) run() {
+	for bs := range v.out {
+		if _, err := v.ws.Write(bs); err != nil {
+			break
+		}
+	}
+	for range v.out {
+	}
+}
+
+// close 在观察者从 viewers 中删除后调用
+func (v *viewer) close() {
+	close(v.out)
+	go v.ws.Close()
+}
+
+// viewerList 必须在持有 sess.mu 时调用
+func (sess *LiveSession) viewerList() []viewerInfo {
+	list := make([]viewerInfo, 0, len(sess.viewers))
+	for _, v := range sess.viewers {
+		list = append(list, v.viewerInfo)
+	}
+	return list
+}
+
+// broadcast 将会话的输出发给所有观察者， 太慢的观察者会被断开
+func (sess *LiveSession) broadcast(p []byte) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if len(sess.viewers) == 0 {
+		return
+	}
+	bs := append([]byte(nil), p...)
+	for id, v := range sess.viewers {
+		select {
+		case v.out <- bs:
+		default:
+			delete(sess.viewers, id)
+			if sess.keyboard == id {
+				sess.keyboard = ""
+			}
+			v.close()
+		}
+	}
+}
+
+// notify 将观察者列表和键盘的持有者发给所有者和观察者
+func (sess *LiveSession) notify() {
+	sess.mu.Lock()
+	info := sessionInfo{ID: sess.ID, Viewers: sess.viewerList(), Keyboard: sess.keyboard}
+	bs, _ := json.Marshal(info)
+	msg := append([]byte("%tpt_session%"), bs...)
+	for _, v := range sess.viewers {
+		select {
+		case v.out <- msg:
+		default:
+		}
+	}
+	sess.mu.Unlock()
+
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	if nil == sess.ws {
+		return
+	}
+	if sess.grace > 0 {
+		info.Token = sess.token
+		info.Grace = sess.grace.Seconds()
+		bs, _ = json.Marshal(info)
+		msg = append([]byte("%tpt_session%"), bs...)
+	}
+	sess.ws.Write(msg)
+}
+
+// Join 以 ro 或 rw 方式加入会话
+func (sess *LiveSession) Join(ws *websocket.Conn, user, mode string) (*viewer, error) {
+	switch mode {
+	case "", "ro":
+		mode = "ro"
+	case "rw":
+	default:
+		return nil, errors.New("mode '" + mode + "' is invalid, it must be ro or rw")
+	}
+
+	sess.mu.Lock()
+	if sess.killed {
+		sess.mu.Unlock()
+		return nil, errors.New("session is closed")
+	}
+	if "rw" == mode && nil == sess.input {
+		sess.mu.Unlock()
+		return nil, errors.New("session '" + sess.ID + "' doesn't accept input")
+	}
+	v := &viewer{viewerInfo: viewerInfo{ID: newSessionID()[:8],
+		User:   user,
+		Mode:   mode,
+		JoinAt: time.Now()},
+		ws:  ws,
+		out: make(chan []byte, viewerQueueSize)}
+	sess.mu.Unlock()
+
+	// 先发送当前的屏幕， 中途加入的观察者也能看到完整的内容
+	sess.smu.Lock()
+	v.out <- []byte(sess.screen.ANSI())
+	sess.mu.Lock()
+	sess.viewers[v.ID] = v
+	sess.mu.Unlock()
+	sess.smu.Unlock()
+
+	go v.run()
+	sess.notify()
+	return v, nil
+}
+
+// Leave 删除观察者， 观察者持有键盘时键盘还给所有者
+func (sess *LiveSession) Leave(v *viewer) {
+	sess.mu.Lock()
+	_, ok := sess.viewers[v.ID]
+	if ok {
+		delete(sess.viewers, v.ID)
+		if sess.keyboard == v.ID {
+			sess.keyboard = ""
+		}
+		v.close()
+	}
+	sess.mu.Unlock()
+
+	if ok {
+		sess.notify()
+	}
+}
+
+// PassKeyboard 由所有者调用， id 是可以输入的观察者， 为 "*" 时所有
+// 读写方式的观察者都可以输入， 为空时只有所有者可以输入。 所有者总是
+// 可以输入的
+func (sess *LiveSession) PassKeyboard(id string) error {
+	sess.mu.Lock()
+	if "" != id && "*" != id {
+		v, ok := sess.viewers[id]
+		if !ok {
+			sess.mu.Unlock()
+			return errors.New("viewer '" + id + "' is not found")
+		}
+		if "rw" != v.Mode {
+			sess.mu.Unlock()
+			return errors.New("viewer '" + id + "' is read only")
+		}
+	}
+	sess.keyboard = id
+	sess.mu.Unlock()
+
+	sess.notify()
+	return nil
+}
+
+// write 将观察者的输入写入会话
+func (sess *LiveSession) write(v *viewer, p []byte) error {
+	sess.mu.Lock()
+	input := sess.input
+	allowed := "rw" == v.Mode && ("*" == sess.keyboard || v.ID == sess.keyboard)
+	sess.mu.Unlock()
+
+	if !allowed {
+		return errors.New("keyboard isn't passed to you")
+	}
+	// 管道的 Write 在数据被会话读完后才返回， 这期间读到的按键属于观察者
+	sess.smu.Lock()
+	sess.auditor.typist = v.User
+	sess.smu.Unlock()
+	n, err := input.w.Write(p)
+	sess.smu.Lock()
+	sess.auditor.typist = ""
+	sess.smu.Unlock()
+
+	atomic.AddInt64(&sess.bytesIn, int64(n))
+	atomic.StoreInt64(&sess.lastActivity, time.Now().UnixNano())
+	return err
+}
+
+// JoinSession 处理 /sessions/join?id=xxx&mode=ro|rw， 加入一个正在进行的
+// 会话， 管理员可以加入所有的会话， 其他用户只能加入自己的会话
+func JoinSession(ws *websocket.Conn) {
+	defer ws.Close()
+
+	params := ws.Request().URL.Query()
+	id := params.Get("id")
+	sess, ok := lookupSession(id)
+	if !ok {
+		logString(ws, "session '"+id+"' is not found")
+		return
+	}
+	user := currentUser(ws.Request())
+	if !isAdmin(ws.Request()) && user != sess.User {
+		logString(ws, "permission denied")
+		return
+	}
+
+	v, err := sess.Join(ws, user, params.Get("mode"))
+	if err != nil {
+		logString(ws, err.Error())
+		return
+	}
+	defer sess.Leave(v)
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			if err != io.EOF {
+				logString(nil, "read from viewer '"+v.ID+"' fail, "+err.Error())
+			}
+			return
+		}
+		// 观察者不能执行控制帧
+		if bytes.HasPrefix(msg, controlPrefix) {
+			continue
+		}
+		if err := sess.write(v, msg); err != nil {
+			logString(nil, "session '"+sess.ID+"' viewer '"+v.ID+"' "+err.Error())
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// maxWatchedOutput 是等待提示符时保留的输出的最大长度
+const maxWatchedOutput = 4096
+
+// defaultSnippetTimeout 是等待提示符的默认超时时间
+const defaultSnippetTimeout = 10 * time.Second
+
+// Snippet 是保存在服务端的一段命令， Text 中可以有 ${name} 或
+// ${name:default} 形式的参数， 浏览器按名称触发后由服务端写入会话
+type Snippet struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Text        string `json:"text"`
+	// Params 是 Text 中的参数名， 保存时自动生成
+	Params []string `json:"params,omitempty"`
+	// Delay 是每行之间的间隔
+	Delay Duration `json:"delay,omitempty"`
+	// Prompt 是发送下一行前要等待的提示符 (正则表达式)
+	Prompt  string   `json:"prompt,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+	// Shared 的片段所有用户可见， 只有管理员可以修改
+	Shared  bool      `json:"shared"`
+	Owner   string    `json:"owner,omitempty"`
+	Updated time.Time `json:"updated_at"`
+}
+
+var snippetParam = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.-]*)(?::([^}]*))?\}`)
+
+func (snippet *Snippet) validate() error {
+	if "" == strings.TrimSpace(snippet.Name) {
+		return errors.New("name is missing")
+	}
+	if "" == snippet.Text {
+		return errors.New("text is missing")
+	}
+	if "" != snippet.Prompt {
+		if _, err := regexp.Compile(snippet.Prompt); err != nil {
+			return errors.New("prompt '" + snippet.Prompt + "' is invalid, " + err.Error())
+		}
+	}
+
+	snippet.Params = nil
+	seen := map[string]bool{}
+	for _, m := range snippetParam.FindAllStringSubmatch(snippet.Text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			snippet.Params = append(snippet.Params, m[1])
+		}
+	}
+	return nil
+}
+
+// Expand 替换 Text 中的参数， 没有值也没有缺省值的参数会返回错误
+func (snippet *Snippet) Expand(params map[string]string) (string, error) {
+	var missing []string
+	text := snippetParam.ReplaceAllStringFunc(snippet.Text, func(s string) string {
+		m := snippetParam.FindStringSubmatch(s)
+		if value, ok := params[m[1]]; ok {
+			return value
+		}
+		if strings.Contains(s, ":") {
+			return m[2]
+		}
+		missing = append(missing, m[1])
+		return s
+	})
+	if len(missing) > 0 {
+		return "", errors.New("snippet '" + snippet.Name + "' missing params: " + strings.Join(missing, ", "))
+	}
+	return text, nil
+}
+
+// SnippetStore 保存共享的和每个用户的片段， 保存在日志目录的
+// snippets/snippets.json 中
+type SnippetStore struct {
+	mu       sync.Mutex
+	dir      string
+	snippets []*Snippet
+}
+
+// Snippets 在 New 中创建
+var Snippets *SnippetStore
+
+func newSnippetStore(dir string) (*SnippetStore, error) {
+	s := &SnippetStore{dir: dir}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "snippets.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("load snippets fail, " + err.Error())
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &s.snippets); err != nil {
+			return nil, errors.New("load snippets fail, " + err.Error())
+		}
+	}
+	return s, nil
+}
+
+func (s *SnippetStore) save() error {
+	bs, err := json.MarshalIndent(s.snippets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, "snippets.json"), bs, 0600)
+}
+
+func (s *SnippetStore) indexOf(shared bool, owner, name string) int {
+	for idx, snippet := range s.snippets {
+		if snippet.Name == name && snippet.Shared == shared && (shared || snippet.Owner == owner) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// List 返回用户可见的片段， 用户自己的在前面
+func (s *SnippetStore) List(user string) []*Snippet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snippets := []*Snippet{}
+	for _, snippet := range s.snippets {
+		if snippet.Shared || snippet.Owner == user {
+			snippets = append(snippets, snippet)
+		}
+	}
+	sort.SliceStable(snippets, func(i, j int) bool {
+		if snippets[i].Shared != snippets[j].Shared {
+			return !snippets[i].Shared
+		}
+		return snippets[i].Name < snippets[j].Name
+	})
+	return snippets
+}
+
+// Get 查找片段， 用户自己的片段优先于共享的片段
+func (s *SnippetStore) Get(user, name string) (*Snippet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idx := s.indexOf(false, user, name); idx >= 0 {
+		return s.snippets[idx], true
+	}
+	if idx := s.indexOf(true, "", name); idx >= 0 {
+		return s.snippets[idx], true
+	}
+	return nil, false
+}
+
+// Put 新增或替换片段
+func (s *SnippetStore) Put(snippet *Snippet) error {
+	if err := snippet.validate(); err != nil {
+		return err
+	}
+	if snippet.Shared {
+		snippet.Owner = ""
+	}
+	snippet.Updated = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx := s.indexOf(snippet.Shared, snippet.Owner, snippet.Name); idx >= 0 {
+		s.snippets[idx] = snippet
+	} else {
+		s.snippets = append(s.snippets, snippet)
+	}
+	return s.save()
+}
+
+// Delete 删除片段
+func (s *SnippetStore) Delete(shared bool, owner, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.indexOf(shared, owner, name)
+	if idx < 0 {
+		return false, nil
+	}
+	s.snippets = append(s.snippets[:idx], s.snippets[idx+1:]...)
+	return true, s.save()
+}
+
+// SnippetsHandler 处理 /snippets 和 /snippets/delete
+func SnippetsHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nil == Snippets {
+			renderError(w, http.StatusServiceUnavailable, "snippets isn't loaded")
+			return
+		}
+		user := currentUser(r)
+
+		if "delete" == action {
+			if "POST" != r.Method && "DELETE" != r.Method {
+				renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+				return
+			}
+			name := r.URL.Query().Get("name")
+			shared := "true" == r.URL.Query().Get("shared")
+			if shared && !isAdmin(r) {
+				renderError(w, http.StatusForbidden, "permission denied")
+				return
+			}
+			found, err := Snippets.Delete(shared, user, name)
+			if err != nil {
+				renderError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !found {
+				renderError(w, http.StatusNotFound, "snippet '"+name+"' is not found")
+				return
+			}
+			renderJSON(w, http.StatusOK, map[string]interface{}{"name": name})
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			renderJSON(w, http.StatusOK, Snippets.List(user))
+		case "POST", "PUT":
+			var snippet Snippet
+			if err := json.NewDecoder(r.Body).Decode(&snippet); err != nil {
+				renderError(w, http.StatusBadRequest, "snippet is invalid, "+err.Error())
+				return
+			}
+			if snippet.Shared && !isAdmin(r) {
+				renderError(w, http.StatusForbidden, "permission denied")
+				return
+			}
+			snippet.Owner = user
+			if err := Snippets.Put(&snippet); err != nil {
+				renderError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			renderJSON(w, http.StatusOK, &snippet)
+		default:
+			renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		}
+	}
+}
+
+// controlPrefix 是浏览器发送的控制帧的前缀， 后面是 JSON， 例如
+//
+//	%tpt%{"snippet":"show-all","params":{"vlan":"10"}}
+//	%tpt%{"cancel":true}
+//	%tpt%{"keyboard":"viewer id"}
+//	%tpt%{"confirm":true}
+var controlPrefix = []byte("%tpt%")
+
+type controlFrame struct {
+	Snippet string            `json:"snippet"`
+	Params  map[string]string `json:"params"`
+	Cancel  bool              `json:"cancel"`
+	// Keyboard 是共享会话中可以输入的观察者， 见 LiveSession.PassKeyboard
+	Keyboard *string `json:"keyboard"`
+	// Confirm 回答危险命令的确认， 见 LiveSession.Confirm
+	Confirm *bool `json:"confirm"`
+}
+
+// sessionInput 将浏览器的输入转发给会话 (ssh、 telnet 或本地进程)，
+// 并执行控制帧， 它要和 Watch 返回的输出一起使用才能等待提示符
+type sessionInput struct {
+	ws      *websocket.Conn
+	user    string
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	session *LiveSession
+
+	mu      sync.Mutex
+	output  []byte
+	notify  chan struct{}
+	running chan struct{}
+}
+
+func newSessionInput(ws *websocket.Conn) *sessionInput {
+	r, w := io.Pipe()
+	in := &sessionInput{ws: ws,
+		user:   currentUser(ws.Request()),
+		r:      r,
+		w:      w,
+		notify: make(chan struct{}, 1)}
+	go in.run(ws)
+	return in
+}
+
+func (in *sessionInput) Read(p []byte) (int, error) {
+	return in.r.Read(p)
+}
+
+func (in *sessionInput) Close() error {
+	in.cancel()
+	return in.r.Close()
+}
+
+// run 读取浏览器的输入， 会话可以恢复时连接断开后不关闭输入， 见 resume.go
+func (in *sessionInput) run(ws *websocket.Conn) {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			in.mu.Lock()
+			session := in.session
+			in.mu.Unlock()
+			if nil != session && session.detach(ws) {
+				return
+			}
+			in.w.CloseWithError(err)
+			return
+		}
+		if bytes.HasPrefix(msg, controlPrefix) {
+			if err := in.control(msg[len(controlPrefix):]); err != nil {
+				logString(ws, err.Error())
+			}
+			continue
+		}
+		if _, err := in.w.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (in *sessionInput) control(bs []byte) error {
+	var frame controlFrame
+	if err := json.Unmarshal(bs, &frame); err != nil {
+		return errors.New("control frame is invalid, " + err.Error())
+	}
+	if frame.Cancel {
+		in.cancel()
+		return nil
+	}
+	if nil != frame.Keyboard {
+		in.mu.Lock()
+		session := in.session
+		in.mu.Unlock()
+		if nil == session {
+			return errors.New("session isn't shared")
+		}
+		return session.PassKeyboard(*frame.Keyboard)
+	}
+	if nil != frame.Confirm {
+		in.mu.Lock()
+		session := in.session
+		in.mu.Unlock()
+		if nil == session {
+			return errors.New("session doesn't accept input")
+		}
+		return session.Confirm(*frame.Confirm)
+	}
+	if "" == frame.Snippet {
+		return errors.New("control frame is invalid, snippet is missing")
+	}
+	if nil == Snippets {
+		return errors.New("snippets isn't loaded")
+	}
+	snippet, ok := Snippets.Get(in.user, frame.Snippet)
+	if !ok {
+		return errors.New("snippet '" + frame.Snippet + "' is not found")
+	}
+	text, err := snippet.Expand(frame.Params)
+	if err != nil {
+		return err
+	}
+	var prompt *regexp.Regexp
+	if "" != snippet.Prompt {
+		prompt = regexp.MustCompile(snippet.Prompt)
+	}
+
+	in.mu.Lock()
+	if nil != in.running {
+		in.mu.Unlock()
+		return errors.New("snippet is running")
+	}
+	running := make(chan struct{})
+	in.running = running
+	in.mu.Unlock()
+
+	go func() {
+		defer func() {
+			in.mu.Lock()
+			if in.running == running {
+				in.running = nil
+			}
+			in.mu.Unlock()
+		}()
+		if err := in.inject(snippet, text, prompt, running); err != nil {
+			in.mu.Lock()
+			ws := in.ws
+			in.mu.Unlock()
+			logString(ws, err.Error())
+		}
+	}()
+	return nil
+}
+
+func (in *sessionInput) cancel() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if nil != in.running {
+		close(in.running)
+		in.running = nil
+	}
+}
+
+// inject 逐行写入片段， 每行之间按 Delay 间隔并等待提示符
+func (in *sessionInput) inject(snippet *Snippet, text string, prompt *regexp.Regexp, cancelled chan struct{}) error {
+	timeout := time.Duration(snippet.Timeout)
+	if timeout <= 0 {
+		timeout = defaultSnippetTimeout
+	}
+
+	lines := strings.SplitAfter(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for idx, line := range lines {
+		if "" == line {
+			continue
+		}
+		if idx > 0 {
+			if snippet.Delay > 0 {
+				select {
+				case <-time.After(time.Duration(snippet.Delay)):
+				case <-cancelled:
+					return errors.New("snippet '" + snippet.Name + "' is cancelled")
+				}
+			}
+			if nil != prompt {
+				if err := in.waitFor(prompt, timeout, cancelled); err != nil {
+					return errors.New("snippet '" + snippet.Name + "' " + err.Error())
+				}
+			}
+		}
+
+		in.mu.Lock()
+		in.output = in.output[:0]
+		in.mu.Unlock()
+
+		if strings.HasSuffix(line, "\n") {
+			line = strings.TrimSuffix(line, "\n") + "\r"
+		}
+		if _, err := io.WriteString(in.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *sessionInput) waitFor(prompt *regexp.Regexp, timeout time.Duration, cancelled chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		in.mu.Lock()
+		matched := prompt.Match(in.output)
+		in.mu.Unlock()
+		if matched {
+			return nil
+		}
+		select {
+		case <-in.notify:
+		case <-timer.C:
+			return errors.New("wait prompt '" + prompt.String() + "' timeout")
+		case <-cancelled:
+			return errors.New("is cancelled")
+		}
+	}
+}
+
+func (in *sessionInput) observe(p []byte) {
+	in.mu.Lock()
+	in.output = append(in.output, p...)
+	if len(in.output) > maxWatchedOutput {
+		in.output = append(in.output[:0], in.output[len(in.output)-maxWatchedOutput:]...)
+	}
+	in.mu.Unlock()
+
+	select {
+	case in.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Watch 返回的 Writer 在写入 w 的同时记录会话的输出， 用于等待提示符
+func (in *sessionInput) Watch(w io.Writer) io.Writer {
+	return &outputWatcher{in: in, w: w}
+}
+
+type outputWatcher struct {
+	in *sessionInput
+	w  io.Writer
+}
+
+func (w *outputWatcher) Write(p []byte) (int, error) {
+	w.in.observe(p)
+	return w.w.Write(p)
+}
@@ -0,0 +1,484 @@
+package terminal
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gosnmp/gosnmp"
+	"golang.org/x/net/websocket"
+)
+
+var snmp_set_users = flag.String("snmp_set_users", "", "the users who can write to devices by /snmp/set besides the admin users, separated by ','.")
+
+const (
+	maxSNMPTimeout        = 60 * time.Second
+	maxSNMPRetries        = 10
+	maxSNMPMaxRepetitions = 1000
+)
+
+// Varbind 是 SNMP 返回的一个变量
+type Varbind struct {
+	OID   string      `json:"oid"`
+	Name  string      `json:"name,omitempty"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+	// Label is the name of the enumerated value, e.g. "up" of ifOperStatus.
+	Label string `json:"label,omitempty"`
+	// Text is the value rendered like net-snmp.
+	Text string `json:"text"`
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":        gosnmp.NoPriv,
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+// newSNMP creates the client by the parameters: hostname, port, version(1,
+// 2c or 3), community, timeout, retries, and user, security_level,
+// auth_protocol, auth_password, priv_protocol, priv_password, context
+// for v3. timeout, retries and max_repetitions are limited by maxSNMPTimeout,
+// maxSNMPRetries and maxSNMPMaxRepetitions.
+func newSNMP(query_params url.Values) (*gosnmp.GoSNMP, error) {
+	hostname := query_params.Get("hostname")
+	if "" == hostname {
+		return nil, errors.New("hostname is missing")
+	}
+	port := toInt(query_params.Get("port"), 161)
+	if port <= 0 || port > 65535 {
+		return nil, errors.New("port '" + query_params.Get("port") + "' is invalid")
+	}
+
+	timeout := queryDuration(query_params.Get("timeout"), 5*time.Second)
+	if timeout <= 0 || timeout > maxSNMPTimeout {
+		return nil, errors.New("timeout '" + query_params.Get("timeout") + "' is invalid, it must be between 0 and " + maxSNMPTimeout.String())
+	}
+	retries := toInt(query_params.Get("retries"), 1)
+	if retries < 0 || retries > maxSNMPRetries {
+		return nil, errors.New("retries '" + query_params.Get("retries") + "' is invalid, it must be between 0 and " + strconv.Itoa(maxSNMPRetries))
+	}
+	maxRepetitions := toInt(query_params.Get("max_repetitions"), 10)
+	if maxRepetitions <= 0 || maxRepetitions > maxSNMPMaxRepetitions {
+		return nil, errors.New("max_repetitions '" + query_params.Get("max_repetitions") + "' is invalid, it must be between 1 and " + strconv.Itoa(maxSNMPMaxRepetitions))
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:         hostname,
+		Port:           uint16(port),
+		Community:      query_params.Get("community"),
+		Timeout:        timeout,
+		Retries:        retries,
+		MaxOids:        gosnmp.MaxOids,
+		MaxRepetitions: uint32(maxRepetitions),
+	}
+	if "" == client.Community {
+		client.Community = "public"
+	}
+
+	switch strings.ToLower(query_params.Get("version")) {
+	case "1", "v1":
+		client.Version = gosnmp.Version1
+	case "", "2", "2c", "v2c":
+		client.Version = gosnmp.Version2c
+	case "3", "v3":
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.ContextName = query_params.Get("context")
+
+		authProtocol, ok := snmpAuthProtocols[strings.ToUpper(query_params.Get("auth_protocol"))]
+		if !ok {
+			return nil, errors.New("auth_protocol '" + query_params.Get("auth_protocol") + "' is unsupported")
+		}
+		privProtocol, ok := snmpPrivProtocols[strings.ToUpper(query_params.Get("priv_protocol"))]
+		if !ok {
+			return nil, errors.New("priv_protocol '" + query_params.Get("priv_protocol") + "' is unsupported")
+		}
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:                 query_params.Get("user"),
+			AuthenticationProtocol:   authProtocol,
+			AuthenticationPassphrase: query_params.Get("auth_password"),
+			PrivacyProtocol:          privProtocol,
+			PrivacyPassphrase:        query_params.Get("priv_password"),
+		}
+
+		switch strings.ToLower(query_params.Get("security_level")) {
+		case "noauthnopriv":
+			client.MsgFlags = gosnmp.NoAuthNoPriv
+		case "authnopriv":
+			client.MsgFlags = gosnmp.AuthNoPriv
+		case "authpriv":
+			client.MsgFlags = gosnmp.AuthPriv
+		case "":
+			if gosnmp.NoAuth == authProtocol {
+				client.MsgFlags = gosnmp.NoAuthNoPriv
+			} else if gosnmp.NoPriv == privProtocol {
+				client.MsgFlags = gosnmp.AuthNoPriv
+			} else {
+				client.MsgFlags = gosnmp.AuthPriv
+			}
+		default:
+			return nil, errors.New("security_level '" + query_params.Get("security_level") + "' is unsupported")
+		}
+		client.SecurityParameters = params
+	default:
+		return nil, errors.New("version '" + query_params.Get("version") + "' is unsupported")
+	}
+	return client, nil
+}
+
+func snmpTypeName(t gosnmp.Asn1BER) string {
+	switch t {
+	case gosnmp.Integer:
+		return "INTEGER"
+	case gosnmp.OctetString:
+		return "STRING"
+	case gosnmp.ObjectIdentifier:
+		return "OID"
+	case gosnmp.IPAddress:
+		return "IpAddress"
+	case gosnmp.Counter32:
+		return "Counter32"
+	case gosnmp.Gauge32:
+		return "Gauge32"
+	case gosnmp.TimeTicks:
+		return "Timeticks"
+	case gosnmp.Counter64:
+		return "Counter64"
+	case gosnmp.Uinteger32:
+		return "UInteger32"
+	case gosnmp.Opaque, gosnmp.OpaqueFloat, gosnmp.OpaqueDouble:
+		return "Opaque"
+	case gosnmp.BitString:
+		return "BITS"
+	case gosnmp.Null:
+		return "NULL"
+	case gosnmp.NoSuchObject:
+		return "noSuchObject"
+	case gosnmp.NoSuchInstance:
+		return "noSuchInstance"
+	case gosnmp.EndOfMibView:
+		return "endOfMibView"
+	}
+	return t.String()
+}
+
+func isPrintable(bs []byte) bool {
+	if !utf8.Valid(bs) {
+		return false
+	}
+	for _, r := range string(bs) {
+		if r < 0x20 && r != '\r' && r != '\n' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func toVarbind(tree *MIBTree, pdu gosnmp.SnmpPDU) *Varbind {
+	oid := strings.TrimPrefix(pdu.Name, ".")
+	vb := &Varbind{OID: oid, Type: snmpTypeName(pdu.Type), Value: pdu.Value}
+	node, suffix := tree.Match(oid)
+	if nil != node {
+		vb.Name = node.Module + "::" + node.Name + suffix
+	}
+
+	switch pdu.Type {
+	case gosnmp.OctetString, gosnmp.BitString, gosnmp.Opaque:
+		bs, _ := pdu.Value.([]byte)
+		if isPrintable(bs) {
+			vb.Value = string(bs)
+			vb.Text = vb.Type + ": \"" + string(bs) + "\""
+		} else {
+			vb.Type = "Hex-STRING"
+			vb.Value = strings.ToUpper(hex.EncodeToString(bs))
+			var parts []string
+			for _, b := range bs {
+				parts = append(parts, fmt.Sprintf("%02X", b))
+			}
+			vb.Text = vb.Type + ": " + strings.Join(parts, " ")
+		}
+	case gosnmp.ObjectIdentifier:
+		value, _ := pdu.Value.(string)
+		value = strings.TrimPrefix(value, ".")
+		vb.Value = value
+		vb.Text = vb.Type + ": " + tree.ToName(value)
+	case gosnmp.TimeTicks:
+		ticks := gosnmp.ToBigInt(pdu.Value).Uint64()
+		vb.Value = ticks
+		d := time.Duration(ticks) * 10 * time.Millisecond
+		vb.Text = fmt.Sprintf("%s: (%d) %d days, %d:%02d:%02d.%02d", vb.Type, ticks,
+			int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60, int(d.Seconds())%60, (ticks % 100))
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.Counter64, gosnmp.Uinteger32:
+		value := gosnmp.ToBigInt(pdu.Value)
+		if value.IsInt64() {
+			vb.Value = value.Int64()
+		} else {
+			vb.Value = value.Uint64()
+		}
+		vb.Text = vb.Type + ": " + value.String()
+		if nil != node && value.IsInt64() {
+			if label, ok := node.Enums[int(value.Int64())]; ok {
+				vb.Label = label
+				vb.Text = vb.Type + ": " + label + "(" + value.String() + ")"
+			}
+		}
+		if nil != node && "" != node.Units {
+			vb.Text += " " + node.Units
+		}
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		vb.Value = nil
+		vb.Text = vb.Type
+	default:
+		vb.Text = vb.Type + ": " + fmt.Sprint(pdu.Value)
+	}
+	return vb
+}
+
+func (vb *Varbind) String() string {
+	name := vb.Name
+	if "" == name {
+		name = "." + vb.OID
+	}
+	switch vb.Type {
+	case "noSuchObject":
+		return name + " = No Such Object available on this agent at this OID"
+	case "noSuchInstance":
+		return name + " = No Such Instance currently exists at this OID"
+	case "endOfMibView":
+		return name + " = No more variables left in this MIB View (It is past the end of the MIB tree)"
+	}
+	return name + " = " + vb.Text
+}
+
+// snmpSetPDU converts the net-snmp style type(i, u, s, x, o, a, t, c, g)
+// and value to a pdu.
+func snmpSetPDU(oid, typ, value string) (gosnmp.SnmpPDU, error) {
+	pdu := gosnmp.SnmpPDU{Name: oid}
+	switch typ {
+	case "i":
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return pdu, errors.New("value '" + value + "' isn't an integer")
+		}
+		pdu.Type, pdu.Value = gosnmp.Integer, i
+	case "u", "g", "c", "t":
+		u, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return pdu, errors.New("value '" + value + "' isn't an unsigned integer")
+		}
+		pdu.Value = uint32(u)
+		switch typ {
+		case "u", "g":
+			pdu.Type = gosnmp.Gauge32
+		case "c":
+			pdu.Type = gosnmp.Counter32
+		case "t":
+			pdu.Type = gosnmp.TimeTicks
+		}
+	case "C":
+		u, ok := new(big.Int).SetString(value, 10)
+		if !ok || !u.IsUint64() {
+			return pdu, errors.New("value '" + value + "' isn't an unsigned integer")
+		}
+		pdu.Type, pdu.Value = gosnmp.Counter64, u.Uint64()
+	case "s":
+		pdu.Type, pdu.Value = gosnmp.OctetString, value
+	case "x":
+		bs, err := hex.DecodeString(strings.NewReplacer(" ", "", ":", "").Replace(value))
+		if err != nil {
+			return pdu, errors.New("value '" + value + "' isn't a hex string")
+		}
+		pdu.Type, pdu.Value = gosnmp.OctetString, bs
+	case "o":
+		o, err := MIBs().ToOID(value)
+		if err != nil {
+			return pdu, err
+		}
+		pdu.Type, pdu.Value = gosnmp.ObjectIdentifier, o
+	case "a":
+		pdu.Type, pdu.Value = gosnmp.IPAddress, value
+	default:
+		return pdu, errors.New("type '" + typ + "' is unsupported")
+	}
+	return pdu, nil
+}
+
+// SNMPGet, SNMPWalk, SNMPBulkWalk 和 SNMPSet 用参数 oid 指定变量（可以有多个），
+// oid 可以是数字或 MIB 中的名字， SNMPSet 还需要与 oid 一一对应的 type 和 value
+func SNMPGet(ws *websocket.Conn) {
+	snmpExecute(ws, "get")
+}
+
+func SNMPWalk(ws *websocket.Conn) {
+	snmpExecute(ws, "walk")
+}
+
+func SNMPBulkWalk(ws *websocket.Conn) {
+	snmpExecute(ws, "bulkwalk")
+}
+
+func SNMPSet(ws *websocket.Conn) {
+	if !canSetSNMP(ws.Request()) {
+		defer ws.Close()
+		newProbeOutput(ws).fail(errors.New("permission denied"))
+		return
+	}
+	snmpExecute(ws, "set")
+}
+
+// canSetSNMP 判断用户是否可以用 /snmp/set 修改设备， 只有管理员和
+// snmp_set_users 中的用户可以
+func canSetSNMP(r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	user := currentUser(r)
+	if "" == user {
+		return false
+	}
+	for _, s := range strings.Split(*snmp_set_users, ",") {
+		if strings.TrimSpace(s) == user {
+			return true
+		}
+	}
+	return false
+}
+
+func snmpExecute(ws *websocket.Conn, op string) {
+	defer ws.Close()
+
+	query_params := ws.Request().URL.Query()
+	out := newProbeOutput(ws)
+	tree := MIBs()
+
+	var oids []string
+	for _, name := range query_params["oid"] {
+		oid, err := tree.ToOID(name)
+		if err != nil {
+			out.fail(err)
+			return
+		}
+		oids = append(oids, oid)
+	}
+	if len(oids) == 0 {
+		if "walk" != op && "bulkwalk" != op {
+			out.fail(errors.New("oid is missing"))
+			return
+		}
+		oids = []string{"1.3.6.1.2.1"}
+	}
+
+	var pdus []gosnmp.SnmpPDU
+	if "set" == op {
+		types := query_params["type"]
+		values := query_params["value"]
+		if len(types) != len(oids) || len(values) != len(oids) {
+			out.fail(errors.New("count of oid, type and value is mismatch"))
+			return
+		}
+		for idx, oid := range oids {
+			pdu, err := snmpSetPDU(oid, types[idx], values[idx])
+			if err != nil {
+				out.fail(err)
+				return
+			}
+			pdus = append(pdus, pdu)
+		}
+	}
+
+	client, err := newSNMP(query_params)
+	if err != nil {
+		out.fail(err)
+		return
+	}
+	address, err := allowTarget(ws.Request(), "snmp", client.Target, strconv.Itoa(int(client.Port)))
+	if err != nil {
+		out.fail(err)
+		return
+	}
+	if host, _, e := net.SplitHostPort(address); nil == e {
+		client.Target = host
+	}
+	if err := client.Connect(); err != nil {
+		out.fail(errors.New("Failed to connect: " + err.Error()))
+		return
+	}
+	defer client.Conn.Close()
+
+	var packet *gosnmp.SnmpPacket
+	switch op {
+	case "get":
+		packet, err = client.Get(oids)
+	case "set":
+		packet, err = client.Set(pdus)
+	case "walk", "bulkwalk":
+		walk := client.Walk
+		if "bulkwalk" == op && gosnmp.Version1 != client.Version {
+			walk = client.BulkWalk
+		}
+		for _, oid := range oids {
+			count := 0
+			err = walk(oid, func(pdu gosnmp.SnmpPDU) error {
+				count++
+				vb := toVarbind(tree, pdu)
+				return out.emit(vb, vb.String())
+			})
+			if err != nil {
+				break
+			}
+			if 0 == count {
+				vb := &Varbind{OID: oid, Name: tree.ToName(oid), Type: "noSuchObject"}
+				out.emit(vb, vb.String())
+			}
+		}
+	}
+	if err != nil {
+		if err != io.EOF {
+			out.fail(err)
+		}
+		return
+	}
+	if nil == packet {
+		return
+	}
+
+	if packet.Error != gosnmp.NoError {
+		msg := "Error in packet, Reason: " + packet.Error.String()
+		if packet.ErrorIndex > 0 && int(packet.ErrorIndex) <= len(oids) {
+			msg += ", Failed object: " + tree.ToName(oids[packet.ErrorIndex-1])
+		}
+		out.fail(errors.New(msg))
+		return
+	}
+	for _, pdu := range packet.Variables {
+		vb := toVarbind(tree, pdu)
+		if err := out.emit(vb, vb.String()); err != nil {
+			return
+		}
+	}
+}
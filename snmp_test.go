@@ -0,0 +1,49 @@
+package terminal
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewSNMPLimits(t *testing.T) {
+	client, err := newSNMP(url.Values{"hostname": {"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout != 5*time.Second || client.Retries != 1 || client.MaxRepetitions != 10 || client.Port != 161 {
+		t.Errorf("defaults are invalid, got %+v", client)
+	}
+
+	for _, params := range []url.Values{
+		{"port": {"70000"}},
+		{"timeout": {"-1s"}},
+		{"timeout": {"2h"}},
+		{"retries": {"-1"}},
+		{"retries": {"100"}},
+		{"max_repetitions": {"-1"}},
+		{"max_repetitions": {"0"}},
+		{"max_repetitions": {"100000"}},
+		{"version": {"4"}},
+	} {
+		params.Set("hostname", "127.0.0.1")
+		if _, err := newSNMP(params); nil == err {
+			t.Errorf("%v: excepted error, got ok", params)
+		}
+	}
+}
+
+func TestCanSetSNMP(t *testing.T) {
+	oldHeader, oldAdmins, oldUsers := *user_header, *admin_users, *snmp_set_users
+	defer func() { *user_header, *admin_users, *snmp_set_users = oldHeader, oldAdmins, oldUsers }()
+	*user_header, *admin_users, *snmp_set_users = "X-User", "root", "netops, alice"
+
+	r := httptest.NewRequest("GET", "/snmp/set", nil)
+	for user, excepted := range map[string]bool{"root": true, "alice": true, "netops": true, "bob": false, "": false} {
+		r.Header.Set("X-User", user)
+		if canSetSNMP(r) != excepted {
+			t.Errorf("%q: excepted %v", user, excepted)
+		}
+	}
+}
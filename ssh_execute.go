@@ -18,7 +18,7 @@ import (
 )
 
 func linuxSSH(ws *websocket.Conn, args []string, charset, wd string, timeout time.Duration) {
-	log.Println("begin to execute ssh:", args)
+	log.Println("begin to execute ssh:", redactArgs(args))
 
 	// [ssh -batch -pw 8498b2c7 root@192.168.1.18 -m /var/lib/tpt/etc/scripts/abc.sh]
 	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
@@ -60,11 +60,21 @@ func linuxSSH(ws *websocket.Conn, args []string, charset, wd string, timeout tim
 	var output io.Writer = decodeBy(charset, ws)
 
 	var cmd *exec.Cmd
+	var err error
+	sandbox := sandboxFor("ssh")
 	if *pw != "" {
-		cmd = exec.Command("sshpass", append([]string{"-p", *pw, "ssh"}, args...)...)
+		cmd, err = sandbox.Command("sshpass", append([]string{"-p", *pw, "ssh"}, args...)...)
 	} else {
-		cmd = exec.Command("ssh", args...)
+		cmd, err = sandbox.Command("ssh", args...)
 	}
+	if err != nil {
+		io.WriteString(ws, err.Error())
+		return
+	}
+	output = limitOutput(output, sandbox.OutputSize, func() {
+		defer recover()
+		cmd.Process.Kill()
+	})
 	if "" != wd {
 		cmd.Dir = wd
 	}
@@ -101,8 +111,20 @@ func Plink(ws *websocket.Conn) {
 	defer ws.Close()
 	hostname := ws.Request().URL.Query().Get("hostname")
 	port := ws.Request().URL.Query().Get("port")
+	checkPort := port
+	if "" == checkPort {
+		checkPort = "22"
+	}
+	address, err := allowTarget(ws.Request(), "ssh", hostname, checkPort)
+	if err != nil {
+		io.WriteString(ws, err.Error())
+		return
+	}
+	// plink 连接检查过的 IP
+	target, _, _ := net.SplitHostPort(address)
 	if port != "" {
 		hostname = net.JoinHostPort(hostname, port)
+		target = address
 	}
 
 	user := ws.Request().URL.Query().Get("user")
@@ -118,16 +140,29 @@ func Plink(ws *websocket.Conn) {
 		}
 	}
 
+	sess := openSession(ws, "ssh", hostname, address)
+	defer sess.Close()
+
 	pa := "plink"
-	if c, ok := Commands[pa]; ok {
-		pa = c
+	if c, ok := Commands.Get(pa); ok {
+		pa = c.Path
+	}
+	cmd, err := sandboxFor("plink").Command(pa, "-pw", pwd, user+"@"+target)
+	if err != nil {
+		io.WriteString(ws, err.Error())
+		return
 	}
-	cmd := exec.Command(pa, "-pw", pwd, user+"@"+hostname)
 
-	var combinedOut io.Writer = decodeBy(charset, ws)
+	sess.OnKill(func() {
+		if nil != cmd.Process {
+			cmd.Process.Kill()
+		}
+	})
+
+	var combinedOut io.Writer = decodeBy(charset, sess.Output(ws))
 	cmd.Stdout = combinedOut
 	cmd.Stderr = combinedOut
-	cmd.Stdin = ws
+	cmd.Stdin = sess.Input(ws)
 
 	if *is_debug || "true" == strings.ToLower(ws.Request().URL.Query().Get("debug")) {
 		dump_out, err := os.OpenFile(filepath.Join(LogDir, strings.Replace(hostname, ":", "_", -1)+".dump_ssh_out.txt"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
@@ -145,7 +180,7 @@ func Plink(ws *websocket.Conn) {
 		}
 		cmd.Stdout = combinedOut
 		cmd.Stderr = combinedOut
-		cmd.Stdin = warp(ws, dump_in)
+		cmd.Stdin = warp(sess.Input(ws), sess.MaskInput(dump_in))
 	}
 
 	if err := cmd.Start(); err != nil {
@@ -0,0 +1,407 @@
+package terminal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TargetRule 是一条目标主机的规则， 按顺序匹配， 第一条匹配的规则决定是否
+// 允许连接。 Hosts 中的每一项可以是 IP、 CIDR 或主机名的通配符 (如
+// *.example.com)， IP 和 CIDR 匹配 DNS 解析后的地址， 所以可以在前面用
+// deny 规则禁止解析到内网地址的主机名。 Ports 中的每一项是端口或端口
+// 范围 (如 2000-2100)。 Protocols、 Users、 Hosts 或 Ports 为空时匹配所有
+type TargetRule struct {
+	Action    string   `json:"action"`
+	Protocols []string `json:"protocols,omitempty"`
+	Users     []string `json:"users,omitempty"`
+	Hosts     []string `json:"hosts,omitempty"`
+	Ports     []string `json:"ports,omitempty"`
+
+	hosts hostMatcher
+	ports [][2]int
+}
+
+// hostMatcher 匹配 IP、 CIDR 或主机名的通配符
+type hostMatcher struct {
+	nets  []*net.IPNet
+	names []string
+}
+
+func parseHosts(hosts []string) (hostMatcher, error) {
+	var m hostMatcher
+	for _, host := range hosts {
+		if _, ipnet, err := net.ParseCIDR(host); nil == err {
+			m.nets = append(m.nets, ipnet)
+		} else if ip := net.ParseIP(host); nil != ip {
+			bits := 8 * net.IPv6len
+			if nil != ip.To4() {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			m.nets = append(m.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if strings.Contains(host, "/") {
+			return m, errors.New("host '" + host + "' is invalid, " + err.Error())
+		} else {
+			m.names = append(m.names, strings.ToLower(host))
+		}
+	}
+	return m, nil
+}
+
+// matchName 判断 hostname 是否匹配主机名的通配符
+func (m *hostMatcher) matchName(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, name := range m.names {
+		if ok, _ := path.Match(name, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchIP 判断 ip 是否在 IP 或 CIDR 中
+func (m *hostMatcher) matchIP(ip net.IP) bool {
+	for _, ipnet := range m.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetPolicy 是 targets.json 的内容， Default 是没有规则匹配时的动作，
+// 缺省为 deny
+type TargetPolicy struct {
+	Default string        `json:"default,omitempty"`
+	Rules   []*TargetRule `json:"rules"`
+}
+
+// targetPolicy 为 nil 时不限制目标主机
+var targetPolicy *TargetPolicy
+
+func parseTargetPolicy(bs []byte) (*TargetPolicy, error) {
+	var policy TargetPolicy
+	if err := json.Unmarshal(bs, &policy); err != nil {
+		return nil, err
+	}
+	switch policy.Default {
+	case "":
+		policy.Default = "deny"
+	case "allow", "deny":
+	default:
+		return nil, errors.New("default '" + policy.Default + "' is invalid, it must be allow or deny")
+	}
+
+	for idx, rule := range policy.Rules {
+		name := "#" + strconv.Itoa(idx+1)
+		switch rule.Action {
+		case "allow", "deny":
+		default:
+			return nil, errors.New("action '" + rule.Action + "' of rule '" + name + "' is invalid, it must be allow or deny")
+		}
+		hosts, err := parseHosts(rule.Hosts)
+		if err != nil {
+			return nil, errors.New(err.Error() + " in rule '" + name + "'")
+		}
+		rule.hosts = hosts
+		for _, s := range rule.Ports {
+			from, to := s, s
+			if idx := strings.Index(s, "-"); idx > 0 {
+				from, to = s[:idx], s[idx+1:]
+			}
+			start, err1 := strconv.Atoi(strings.TrimSpace(from))
+			end, err2 := strconv.Atoi(strings.TrimSpace(to))
+			if nil != err1 || nil != err2 || start <= 0 || end > 65535 || start > end {
+				return nil, errors.New("port '" + s + "' of rule '" + name + "' is invalid")
+			}
+			rule.ports = append(rule.ports, [2]int{start, end})
+		}
+	}
+	return &policy, nil
+}
+
+// readTargetPolicy 读取 targets.json， file 为空时返回 nil， 表示不限制
+// 目标主机
+func readTargetPolicy(file string) (*TargetPolicy, error) {
+	if "" == file {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	policy, err := parseTargetPolicy(bs)
+	if err != nil {
+		return nil, errors.New("load '" + file + "' fail," + err.Error())
+	}
+	return policy, nil
+}
+
+func (rule *TargetRule) match(protocol, user, hostname string, ip net.IP, port int) bool {
+	if len(rule.Protocols) > 0 && !containsString(rule.Protocols, protocol) {
+		return false
+	}
+	if len(rule.Users) > 0 && !containsString(rule.Users, user) {
+		return false
+	}
+	if len(rule.ports) > 0 {
+		found := false
+		for _, r := range rule.ports {
+			if r[0] <= port && port <= r[1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Hosts) == 0 {
+		return true
+	}
+	return rule.hosts.matchIP(ip) || rule.hosts.matchName(hostname)
+}
+
+// Allowed 判断是否允许用户 user 用 protocol 连接 hostname 解析后的 ip
+func (policy *TargetPolicy) Allowed(protocol, user, hostname string, ip net.IP, port int) bool {
+	for _, rule := range policy.Rules {
+		if rule.match(protocol, user, hostname, ip, port) {
+			return "allow" == rule.Action
+		}
+	}
+	return "allow" == policy.Default
+}
+
+// checkTarget 检查是否允许连接 hostname:port， 返回要连接的地址， 地址
+// 中的主机是检查过的 IP， 避免检查后 DNS 的结果改变
+func checkTarget(protocol, user, remoteAddr, hostname, port string) (string, error) {
+	configLock.RLock()
+	policy := targetPolicy
+	configLock.RUnlock()
+
+	address := net.JoinHostPort(hostname, port)
+	if nil == policy {
+		return address, nil
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 {
+		return "", errors.New("port '" + port + "' is invalid")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return "", errors.New("resolve '" + hostname + "' fail, " + err.Error())
+	}
+	for _, addr := range addrs {
+		if policy.Allowed(protocol, user, hostname, addr.IP, portNum) {
+			return net.JoinHostPort(addr.IP.String(), port), nil
+		}
+	}
+	return "", denyTarget(protocol, user, remoteAddr, address)
+}
+
+func denyTarget(protocol, user, remoteAddr, address string) error {
+	log.Println("[" + protocol + "] user '" + user + "' from '" + remoteAddr + "' is denied to connect to '" + address + "'")
+	writeAudit(&AuditEvent{Type: "target_denied",
+		User:       user,
+		RemoteAddr: remoteAddr,
+		Protocol:   protocol,
+		Target:     address})
+	return errors.New("connecting to '" + address + "' is denied")
+}
+
+// checkTargetIP 检查是否允许探测已经解析的 ip， 用于没有端口的协议， 如
+// ping 和 traceroute， 这时指定了 Ports 的规则不会匹配
+func checkTargetIP(protocol, user, remoteAddr, hostname string, ip net.IP) error {
+	configLock.RLock()
+	policy := targetPolicy
+	configLock.RUnlock()
+
+	if nil == policy || policy.Allowed(protocol, user, hostname, ip, 0) {
+		return nil
+	}
+	return denyTarget(protocol, user, remoteAddr, ip.String())
+}
+
+// allowTarget 用请求的用户和地址调用 checkTarget
+func allowTarget(r *http.Request, protocol, hostname, port string) (string, error) {
+	return checkTarget(protocol, currentUser(r), r.RemoteAddr, hostname, port)
+}
+
+// allowTargetIP 用请求的用户和地址调用 checkTargetIP
+func allowTargetIP(r *http.Request, protocol, hostname string, ip net.IP) error {
+	return checkTargetIP(protocol, currentUser(r), r.RemoteAddr, hostname, ip)
+}
+
+// plinkValueFlags 是 plink (和 linuxSSH) 中带值的选项
+var plinkValueFlags = map[string]bool{
+	"-P": true, "-l": true, "-pw": true, "-pwfile": true, "-i": true, "-m": true,
+	"-hostkey": true, "-sshlog": true, "-sshrawlog": true, "-loghost": true,
+}
+
+// plinkBoolFlags 是 plink 中不带值的选项， 端口转发、 -nc、 -proxycmd 和
+// -load 等可以连接其它主机的选项不在其中
+var plinkBoolFlags = map[string]bool{
+	"-ssh": true, "-telnet": true, "-batch": true, "-v": true, "-V": true,
+	"-agent": true, "-noagent": true, "-A": true, "-a": true, "-X": true, "-x": true,
+	"-T": true, "-t": true, "-C": true, "-N": true, "-1": true, "-2": true,
+	"-4": true, "-6": true, "-s": true, "-no-antispoof": true,
+	"-share": true, "-noshare": true, "-logoverwrite": true, "-logappend": true,
+}
+
+// forbiddenOptions 是 OpenSSH 中可以连接其它主机的选项， 如 -J jump、
+// -W host:port、 端口转发和 -o ProxyCommand=...， 选项的值可以直接跟在
+// 后面， 所以按前缀匹配
+var forbiddenOptions = []string{"-J", "-W", "-L", "-R", "-D", "-o"}
+
+// checkForbiddenOption 检查任何位置的参数 (包括选项的值) 中是否有可以
+// 连接其它主机的选项
+func checkForbiddenOption(args []string) error {
+	for _, arg := range args {
+		lower := strings.ToLower(arg)
+		if strings.Contains(lower, "proxycommand") || strings.Contains(lower, "proxyjump") {
+			return errors.New("option '" + arg + "' isn't allowed when the targets are restricted")
+		}
+		for _, opt := range forbiddenOptions {
+			if strings.HasPrefix(arg, opt) {
+				return errors.New("option '" + arg + "' isn't allowed when the targets are restricted")
+			}
+		}
+	}
+	return nil
+}
+
+// commandTarget 从 plink 风格的参数中取出协议、 目标主机和端口， 以及
+// 目标主机在 args 中的位置， 如 -batch -pw xxx -P 2222 -m abc.sh
+// root@192.168.1.18。 OpenSSH 也会解析主机后面的选项， 所以主机后面的参数
+// 不能以 - 开始
+func commandTarget(args []string) (protocol, hostname, port string, hostIdx int, err error) {
+	if err := checkForbiddenOption(args); err != nil {
+		return "", "", "", -1, err
+	}
+
+	protocol = "ssh"
+	hostIdx = -1
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if !strings.HasPrefix(arg, "-") {
+			hostIdx = idx
+			break
+		}
+		if "--" == arg {
+			if idx+1 < len(args) {
+				hostIdx = idx + 1
+			}
+			break
+		}
+		switch {
+		case "-telnet" == arg:
+			protocol = "telnet"
+		case "-ssh" == arg:
+			protocol = "ssh"
+		case plinkValueFlags[arg]:
+			if idx+1 >= len(args) {
+				return "", "", "", -1, errors.New("value of option '" + arg + "' is missing")
+			}
+			idx++
+			if "-P" == arg {
+				port = args[idx]
+			}
+		case plinkBoolFlags[arg]:
+		default:
+			return "", "", "", -1, errors.New("option '" + arg + "' isn't allowed when the targets are restricted")
+		}
+	}
+	if hostIdx < 0 {
+		return "", "", "", -1, errors.New("host is missing")
+	}
+	for _, arg := range args[hostIdx+1:] {
+		if strings.HasPrefix(arg, "-") {
+			return "", "", "", -1, errors.New("option '" + arg + "' after the host isn't allowed when the targets are restricted")
+		}
+	}
+
+	hostname = args[hostIdx]
+	if strings.HasPrefix(hostname, "ssh://") {
+		u, e := url.Parse(hostname)
+		if nil != e {
+			return "", "", "", -1, errors.New("host '" + hostname + "' is invalid, " + e.Error())
+		}
+		hostname = u.Hostname()
+		if "" != u.Port() {
+			port = u.Port()
+		}
+	} else if idx := strings.LastIndex(hostname, "@"); idx >= 0 {
+		hostname = hostname[idx+1:]
+	}
+	if "" == hostname || strings.HasPrefix(hostname, "-") {
+		return "", "", "", -1, errors.New("host is missing")
+	}
+	if "" == port {
+		port = "22"
+		if "telnet" == protocol {
+			port = "23"
+		}
+	}
+	return protocol, hostname, port, hostIdx, nil
+}
+
+// replaceTarget 将参数 arg 中的主机替换为 ip， arg 可以是 host、
+// user@host 或 ssh://user@host:port
+func replaceTarget(arg, ip string) string {
+	if strings.HasPrefix(arg, "ssh://") {
+		if u, err := url.Parse(arg); nil == err {
+			if "" != u.Port() {
+				u.Host = net.JoinHostPort(ip, u.Port())
+			} else if strings.Contains(ip, ":") {
+				u.Host = "[" + ip + "]"
+			} else {
+				u.Host = ip
+			}
+			return u.String()
+		}
+	}
+	if idx := strings.LastIndex(arg, "@"); idx >= 0 {
+		return arg[:idx+1] + ip
+	}
+	return ip
+}
+
+// allowCommandTarget 检查 /cmd 中 plink 或 ssh 的目标主机， 返回的参数中
+// 主机被替换为检查过的 IP， 避免检查后 DNS 的结果改变， 没有配置
+// targets.json 时不检查
+func allowCommandTarget(r *http.Request, args []string) ([]string, error) {
+	configLock.RLock()
+	policy := targetPolicy
+	configLock.RUnlock()
+	if nil == policy {
+		return args, nil
+	}
+
+	protocol, hostname, port, hostIdx, err := commandTarget(args)
+	if err != nil {
+		return nil, err
+	}
+	address, err := allowTarget(r, protocol, hostname, port)
+	if err != nil {
+		return nil, err
+	}
+	ip, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	results := append([]string(nil), args...)
+	results[hostIdx] = replaceTarget(args[hostIdx], ip)
+	return results, nil
+}
@@ -0,0 +1,174 @@
+package terminal
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCommandTarget(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		protocol string
+		hostname string
+		port     string
+		hostIdx  int
+	}{
+		{[]string{"192.168.1.18"}, "ssh", "192.168.1.18", "22", 0},
+		{[]string{"-batch", "-pw", "xxx", "-P", "2222", "-m", "abc.sh", "root@192.168.1.18"}, "ssh", "192.168.1.18", "2222", 7},
+		{[]string{"-telnet", "router", "show", "version"}, "telnet", "router", "23", 1},
+		{[]string{"--", "a@b@h1"}, "ssh", "h1", "22", 1},
+		{[]string{"ssh://root@[::1]:2200"}, "ssh", "::1", "2200", 0},
+	} {
+		protocol, hostname, port, hostIdx, err := commandTarget(test.args)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if protocol != test.protocol || hostname != test.hostname || port != test.port || hostIdx != test.hostIdx {
+			t.Errorf("%q: excepted %s %s %s %d, got %s %s %s %d", test.args,
+				test.protocol, test.hostname, test.port, test.hostIdx,
+				protocol, hostname, port, hostIdx)
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-batch"},
+		{"-P"},
+		{"root@allowed", "-oProxyCommand=nc evil 22"},
+		{"root@allowed", "-o", "ProxyCommand=nc evil 22"},
+		{"root@allowed", "ls", "-l"},
+		{"-J", "evil", "root@allowed"},
+		{"-Jevil", "root@allowed"},
+		{"-W", "evil:22", "allowed"},
+		{"-L", "8080:evil:80", "allowed"},
+		{"-L8080:evil:80", "allowed"},
+		{"-R", "8080:evil:80", "allowed"},
+		{"-D", "1080", "allowed"},
+		{"-l", "-oProxyJump=evil", "allowed"},
+		{"-nc", "evil:22", "allowed"},
+		{"-proxycmd", "nc evil 22", "allowed"},
+		{"allowed", "ProxyJump=evil"},
+		{"--", "-oProxyCommand=x"},
+	} {
+		if _, hostname, _, _, err := commandTarget(args); nil == err {
+			t.Errorf("%q: excepted error, got %q", args, hostname)
+		}
+	}
+}
+
+func TestReplaceTarget(t *testing.T) {
+	for _, test := range []struct {
+		arg, ip, excepted string
+	}{
+		{"router", "10.0.0.1", "10.0.0.1"},
+		{"root@router", "10.0.0.1", "root@10.0.0.1"},
+		{"a@b@router", "10.0.0.1", "a@b@10.0.0.1"},
+		{"ssh://root@router:2200", "10.0.0.1", "ssh://root@10.0.0.1:2200"},
+		{"ssh://root@router", "::1", "ssh://root@[::1]"},
+	} {
+		if actual := replaceTarget(test.arg, test.ip); actual != test.excepted {
+			t.Errorf("%q: excepted %q, got %q", test.arg, test.excepted, actual)
+		}
+	}
+}
+
+func TestTargetPolicyAllowed(t *testing.T) {
+	policy, err := parseTargetPolicy([]byte(`{"rules": [
+  {"action": "deny", "hosts": ["10.0.0.0/8"], "users": ["guest"]},
+  {"action": "allow", "protocols": ["ssh"], "hosts": ["10.0.0.0/8", "*.example.com"], "ports": ["22", "2000-2100"]},
+  {"action": "allow", "protocols": ["telnet"], "hosts": ["192.168.1.1"]}
+]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		protocol, user, hostname string
+		ip                       string
+		port                     int
+		excepted                 bool
+	}{
+		{"ssh", "alice", "10.1.1.1", "10.1.1.1", 22, true},
+		{"ssh", "alice", "10.1.1.1", "10.1.1.1", 2050, true},
+		{"ssh", "alice", "10.1.1.1", "10.1.1.1", 23, false},
+		{"ssh", "guest", "10.1.1.1", "10.1.1.1", 22, false},
+		{"ssh", "alice", "r1.example.com", "172.16.0.1", 22, true},
+		{"ssh", "alice", "r1.example.org", "172.16.0.1", 22, false},
+		{"telnet", "alice", "10.1.1.1", "10.1.1.1", 23, false},
+		{"telnet", "alice", "sw", "192.168.1.1", 23, true},
+	} {
+		actual := policy.Allowed(test.protocol, test.user, test.hostname, net.ParseIP(test.ip), test.port)
+		if actual != test.excepted {
+			t.Errorf("%+v: excepted %v, got %v", test, test.excepted, actual)
+		}
+	}
+
+	for _, text := range []string{
+		`{"default": "maybe", "rules": []}`,
+		`{"rules": [{"action": "permit"}]}`,
+		`{"rules": [{"action": "allow", "hosts": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"action": "allow", "ports": ["0"]}]}`,
+		`{"rules": [{"action": "allow", "ports": ["2100-2000"]}]}`,
+	} {
+		if _, err := parseTargetPolicy([]byte(text)); nil == err {
+			t.Errorf("%s: excepted error, got ok", text)
+		}
+	}
+}
+
+func TestAllowCommandTarget(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(file, []byte(`{"rules": [{"action": "allow", "hosts": ["127.0.0.1"], "ports": ["22"]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := readTargetPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configLock.Lock()
+	old := targetPolicy
+	targetPolicy = policy
+	configLock.Unlock()
+	defer func() {
+		configLock.Lock()
+		targetPolicy = old
+		configLock.Unlock()
+	}()
+
+	r := httptest.NewRequest("GET", "/cmd", nil)
+	args, err := allowCommandTarget(r, []string{"-batch", "root@127.0.0.1", "uptime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if excepted := []string{"-batch", "root@127.0.0.1", "uptime"}; !reflect.DeepEqual(args, excepted) {
+		t.Errorf("excepted %q, got %q", excepted, args)
+	}
+
+	// 主机名被替换为检查过的 IP
+	args, err = allowCommandTarget(r, []string{"root@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if excepted := []string{"root@127.0.0.1"}; !reflect.DeepEqual(args, excepted) {
+		t.Errorf("excepted %q, got %q", excepted, args)
+	}
+
+	for _, args := range [][]string{
+		{"root@127.0.0.2"},
+		{"-P", "23", "127.0.0.1"},
+		{"root@127.0.0.1", "-oProxyCommand=nc 10.0.0.1 22"},
+	} {
+		if _, err := allowCommandTarget(r, args); nil == err {
+			t.Errorf("%q: excepted error, got ok", args)
+		}
+	}
+
+	// 文件不存在时不限制目标主机
+	if policy, err := readTargetPolicy(""); nil != policy || nil != err {
+		t.Errorf("excepted nil, got %+v, %v", policy, err)
+	}
+}
@@ -0,0 +1,211 @@
+package terminal
+
+// defaultTemplates 是内置的模板， 可以被 templates.json 中的同名模板覆盖
+var defaultTemplates = []*OutputTemplate{
+	{
+		Name:        "cisco_ios_show_ip_interface_brief",
+		Description: "Cisco show ip interface brief",
+		Commands:    []string{`^sh(ow?)?\s+ip\s+int(e(r(f(a(c(e)?)?)?)?)?)?\s+br(i(e(f)?)?)?`},
+		Profiles:    []string{"cisco"},
+		Text: `Value INTERFACE (\S+)
+Value IP_ADDRESS (\S+)
+Value STATUS (up|down|administratively down|deleted)
+Value PROTOCOL (up|down)
+
+Start
+  ^${INTERFACE}\s+${IP_ADDRESS}\s+\w+\s+\w+\s+${STATUS}\s+${PROTOCOL}\s*$$ -> Record
+`,
+	},
+	{
+		Name:        "cisco_ios_show_version",
+		Description: "Cisco show version",
+		Commands:    []string{`^sh(ow?)?\s+ver(s(i(o(n)?)?)?)?\s*$`},
+		Profiles:    []string{"cisco"},
+		Text: `Value VERSION ([^,\s]+)
+Value HOSTNAME (\S+)
+Value UPTIME (.+)
+Value HARDWARE (\S+)
+Value List SERIAL (\S+)
+
+Start
+  ^.*Software.*Version\s+${VERSION}
+  ^\s*${HOSTNAME}\s+uptime\s+is\s+${UPTIME}
+  ^[Pp]rocessor\s+board\s+ID\s+${SERIAL}
+  ^[Cc]isco\s+${HARDWARE}\s+.*bytes\s+of\s+(physical\s+)?memory
+`,
+	},
+	{
+		Name:        "cisco_ios_show_interfaces_status",
+		Description: "Cisco show interfaces status",
+		Commands:    []string{`^sh(ow?)?\s+int(e(r(f(a(c(e(s)?)?)?)?)?)?)?\s+stat(u(s)?)?`},
+		Profiles:    []string{"cisco"},
+		Text: `Value PORT (\S+)
+Value NAME (.*?)
+Value STATUS (connected|notconnect|disabled|err-disabled|inactive|monitoring|sfpAbsent|\S+)
+Value VLAN (\S+)
+Value DUPLEX (\S+)
+Value SPEED (\S+)
+Value TYPE (.*?)
+
+Start
+  ^Port\s+Name\s+Status -> Table
+
+Table
+  ^${PORT}\s+${NAME}\s+${STATUS}\s+${VLAN}\s+${DUPLEX}\s+${SPEED}\s*${TYPE}\s*$$ -> Record
+`,
+	},
+	{
+		Name:        "huawei_vrp_display_interface_brief",
+		Description: "Huawei/H3C display interface brief",
+		Commands:    []string{`^dis(p(l(a(y)?)?)?)?\s+int(e(r(f(a(c(e)?)?)?)?)?)?\s+br(i(e(f)?)?)?`},
+		Profiles:    []string{"huawei", "h3c"},
+		Text: `Value INTERFACE (\S+)
+Value PHY (\S+)
+Value PROTOCOL (\S+)
+Value IN_UTI (\S+)
+Value OUT_UTI (\S+)
+Value IN_ERRORS (\d+)
+Value OUT_ERRORS (\d+)
+
+Start
+  ^Interface\s+PHY\s+Protocol -> Table
+
+Table
+  ^${INTERFACE}\s+${PHY}\s+${PROTOCOL}\s+${IN_UTI}\s+${OUT_UTI}\s+${IN_ERRORS}\s+${OUT_ERRORS}\s*$$ -> Record
+`,
+	},
+	{
+		Name:        "huawei_vrp_display_version",
+		Description: "Huawei display version",
+		Commands:    []string{`^dis(p(l(a(y)?)?)?)?\s+ver(s(i(o(n)?)?)?)?\s*$`},
+		Profiles:    []string{"huawei", "h3c"},
+		Text: `Value VERSION (\S+\s+\(\S+\s+\S+\))
+Value MODEL (\S+)
+Value UPTIME (.+)
+
+Start
+  ^VRP.*[Vv]ersion\s+${VERSION}
+  ^.*(Comware|VRP).*[Vv]ersion\s+${VERSION}
+  ^(HUAWEI|H3C|Quidway)\s+${MODEL}\s+(Routing Switch\s+)?uptime\s+is\s+${UPTIME}
+`,
+	},
+	{
+		Name:        "juniper_junos_show_interfaces_terse",
+		Description: "Juniper show interfaces terse",
+		Commands:    []string{`^show\s+interfaces\s+terse`},
+		Profiles:    []string{"juniper"},
+		Text: `Value INTERFACE (\S+)
+Value ADMIN (up|down)
+Value LINK (up|down)
+Value PROTOCOL (\S+)
+Value LOCAL (\S+)
+
+Start
+  ^${INTERFACE}\s+${ADMIN}\s+${LINK}\s+${PROTOCOL}\s+${LOCAL} -> Record
+  ^${INTERFACE}\s+${ADMIN}\s+${LINK}\s*$$ -> Record
+`,
+	},
+	{
+		Name:        "linux_df",
+		Description: "Linux df -h/-k",
+		Commands:    []string{`^df(\s|$)`},
+		Text: `Value FILESYSTEM (\S+)
+Value SIZE (\S+)
+Value USED (\S+)
+Value AVAILABLE (\S+)
+Value USE_PERCENT (\d+)
+Value MOUNTED_ON (\S.*)
+
+Start
+  ^${FILESYSTEM}\s+${SIZE}\s+${USED}\s+${AVAILABLE}\s+${USE_PERCENT}%\s+${MOUNTED_ON}$$ -> Record
+`,
+	},
+	{
+		Name:        "linux_ip_link",
+		Type:        "regex",
+		Description: "Linux ip link",
+		Commands:    []string{`^ip\s+(-\S+\s+)*l(i(n(k)?)?)?(\s+show)?\s*$`},
+		Text:        `^\d+:\s+(?P<interface>[^:@\s]+)(@\S+)?:\s+<(?P<flags>[^>]*)>.*\smtu\s+(?P<mtu>\d+).*\sstate\s+(?P<state>\S+)`,
+	},
+	{
+		Name:        "linux_ping",
+		Description: "ping summary of Linux/BSD",
+		Commands:    []string{`^ping(\.exe)?(\s|$)`},
+		Text: `Value DESTINATION (\S+)
+Value ADDRESS ([\d.:a-fA-F]+)
+Value Required TRANSMITTED (\d+)
+Value RECEIVED (\d+)
+Value LOSS (\d+(\.\d+)?)
+Value RTT_MIN (\d+(\.\d+)?)
+Value RTT_AVG (\d+(\.\d+)?)
+Value RTT_MAX (\d+(\.\d+)?)
+
+Start
+  ^PING\s+${DESTINATION}\s+\(${ADDRESS}\)
+  ^${TRANSMITTED}\s+packets\s+transmitted,\s+${RECEIVED}\s+(packets\s+)?received,.*?${LOSS}%\s+packet\s+loss
+  ^(rtt|round-trip)\s+min/avg/max\S*\s+=\s+${RTT_MIN}/${RTT_AVG}/${RTT_MAX} -> Record
+`,
+	},
+	{
+		Name:        "linux_ping_replies",
+		Description: "ping replies of Linux/BSD",
+		Text: `Value FROM ([^\s:]+)
+Value SEQ (\d+)
+Value TTL (\d+)
+Value TIME (\d+(\.\d+)?)
+
+Start
+  ^\d+\s+bytes\s+from\s+${FROM}.*icmp_seq=${SEQ}\s+ttl=${TTL}\s+time=${TIME} -> Record
+`,
+	},
+	{
+		Name:        "windows_ping",
+		Description: "ping summary of Windows",
+		Commands:    []string{`^ping(\.exe)?(\s|$)`},
+		Text: `Value ADDRESS (\S+)
+Value Required TRANSMITTED (\d+)
+Value RECEIVED (\d+)
+Value LOST (\d+)
+Value LOSS (\d+)
+Value RTT_MIN (\d+)
+Value RTT_MAX (\d+)
+Value RTT_AVG (\d+)
+
+Start
+  ^.*[Pp]ing.*\s+${ADDRESS}\s*:\s*$$
+  ^.*\s+=\s+${TRANSMITTED}[,，]\s*\S+\s+=\s+${RECEIVED}[,，]\s*\S+\s+=\s+${LOST}\s+\(${LOSS}%
+  ^.*\s+=\s+${RTT_MIN}ms[,，]\s*\S+\s+=\s+${RTT_MAX}ms[,，]\s*\S+\s+=\s+${RTT_AVG}ms -> Record
+`,
+	},
+	{
+		Name:        "linux_traceroute",
+		Description: "traceroute of Linux/BSD",
+		Commands:    []string{`^traceroute(\s|$)`},
+		Text: `Value HOP (\d+)
+Value HOST (\S+)
+Value ADDRESS ([\d.:a-fA-F]+)
+Value List RTT (\d+(\.\d+)?)
+
+Start
+  ^\s*${HOP}\s+\*(\s+\*)*\s*$$ -> Record
+  ^\s*${HOP}\s+${HOST}\s+\(${ADDRESS}\)\s+${RTT}\s+ms -> Continue
+  ^\s*\d+\s+\S+\s+\(\S+\)\s+\S+\s+ms\s+${RTT}\s+ms -> Continue
+  ^\s*\d+\s+\S+\s+\(\S+\)\s+\S+\s+ms\s+\S+\s+ms\s+${RTT}\s+ms -> Continue
+  ^\s*\d+\s+\S+\s+\( -> Record
+`,
+	},
+	{
+		Name:        "windows_tracert",
+		Description: "tracert of Windows",
+		Commands:    []string{`^tracert(\.exe)?(\s|$)`},
+		Text: `Value HOP (\d+)
+Value List RTT (<?\d+|\*)
+Value ADDRESS (\S+)
+
+Start
+  ^\s*${HOP}\s+\*\s+\*\s+\*\s+.*$$ -> Record
+  ^\s*${HOP}\s+${RTT}(\s+ms)?\s+${RTT}(\s+ms)?\s+${RTT}(\s+ms)?\s+${ADDRESS}\s*$$ -> Record
+  ^\s*${HOP}\s+${RTT}(\s+ms)?\s+${RTT}(\s+ms)?\s+${RTT}(\s+ms)?\s+\S+\s+\[${ADDRESS}\]\s*$$ -> Record
+`,
+	},
+}
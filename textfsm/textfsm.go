@@ -0,0 +1,375 @@
+// Package textfsm 是 TextFSM 模板的一个实现， 用于将命令的输出解析为表格，
+// 模板的格式见 https://github.com/google/textfsm/wiki/TextFSM
+package textfsm
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Value 是模板中的一个 "Value [Options] Name (Regex)" 定义
+type Value struct {
+	Name     string
+	Regex    string
+	Filldown bool
+	Key      bool
+	Required bool
+	List     bool
+	Fillup   bool
+}
+
+// Rule 是状态中的一条规则 "^Regex -> LineOp.RecordOp NewState"
+type Rule struct {
+	Regex    string
+	LineOp   string
+	RecordOp string
+	NewState string
+	Error    string
+
+	line int
+	re   *regexp.Regexp
+}
+
+// Template 是一个编译后的模板
+type Template struct {
+	Values []*Value
+	States map[string][]*Rule
+}
+
+// Record 是解析出的一行， List 类型的值是 []string， 其它的是 string
+type Record map[string]interface{}
+
+var (
+	valueOptions = map[string]bool{"Filldown": true, "Key": true, "Required": true, "List": true, "Fillup": true}
+	lineOps      = map[string]bool{"Next": true, "Continue": true}
+	recordOps    = map[string]bool{"Record": true, "NoRecord": true, "Clear": true, "Clearall": true}
+	varPattern   = regexp.MustCompile(`\$\{(\w+)\}|\$\$|\$(\w+)`)
+	statePattern = regexp.MustCompile(`^\w+$`)
+)
+
+func parseError(line int, msg string) error {
+	return errors.New("line " + strconv.Itoa(line) + ": " + msg)
+}
+
+// Parse 解析模板
+func Parse(text string) (*Template, error) {
+	t := &Template{States: map[string][]*Rule{}}
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+
+	idx := 0
+	// Value 定义， 以空行结束
+	for ; idx < len(lines); idx++ {
+		line := strings.TrimRight(lines[idx], " \t")
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if "" == line {
+			if len(t.Values) > 0 {
+				break
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "Value ") {
+			if len(t.Values) == 0 {
+				return nil, parseError(idx+1, "expect 'Value' definitions")
+			}
+			break
+		}
+		value, err := parseValue(line)
+		if err != nil {
+			return nil, parseError(idx+1, err.Error())
+		}
+		for _, v := range t.Values {
+			if v.Name == value.Name {
+				return nil, parseError(idx+1, "value '"+value.Name+"' is duplicated")
+			}
+		}
+		t.Values = append(t.Values, value)
+	}
+
+	// 状态定义， 状态之间以空行分隔
+	state := ""
+	for ; idx < len(lines); idx++ {
+		line := strings.TrimRight(lines[idx], " \t")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case "" == trimmed:
+			state = ""
+		case strings.HasPrefix(trimmed, "#"):
+		case "" == state:
+			if line != trimmed || !statePattern.MatchString(trimmed) {
+				return nil, parseError(idx+1, "state name '"+trimmed+"' is invalid")
+			}
+			if _, exists := t.States[trimmed]; exists {
+				return nil, parseError(idx+1, "state '"+trimmed+"' is duplicated")
+			}
+			state = trimmed
+			t.States[state] = nil
+		default:
+			if !strings.HasPrefix(trimmed, "^") {
+				return nil, parseError(idx+1, "rule must start with '^'")
+			}
+			rule, err := t.parseRule(trimmed)
+			if err != nil {
+				return nil, parseError(idx+1, err.Error())
+			}
+			rule.line = idx + 1
+			t.States[state] = append(t.States[state], rule)
+		}
+	}
+
+	if _, ok := t.States["Start"]; !ok {
+		return nil, errors.New("state 'Start' is required")
+	}
+	for name, rules := range t.States {
+		for _, rule := range rules {
+			if "" == rule.NewState || "End" == rule.NewState || "EOF" == rule.NewState {
+				continue
+			}
+			if _, ok := t.States[rule.NewState]; !ok {
+				return nil, parseError(rule.line, "state '"+rule.NewState+"' of '"+name+"' is not found")
+			}
+		}
+	}
+	return t, nil
+}
+
+func parseValue(line string) (*Value, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, errors.New("value definition is invalid")
+	}
+
+	value := &Value{}
+	rest := strings.TrimSpace(strings.TrimPrefix(line, "Value"))
+	if !strings.HasPrefix(fields[2], "(") {
+		for _, opt := range strings.Split(fields[1], ",") {
+			if !valueOptions[opt] {
+				return nil, errors.New("option '" + opt + "' is unsupported")
+			}
+			switch opt {
+			case "Filldown":
+				value.Filldown = true
+			case "Key":
+				value.Key = true
+			case "Required":
+				value.Required = true
+			case "List":
+				value.List = true
+			case "Fillup":
+				value.Fillup = true
+			}
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+	}
+
+	idx := strings.IndexAny(rest, " \t")
+	if idx < 0 {
+		return nil, errors.New("regex of value is required")
+	}
+	value.Name = rest[:idx]
+	value.Regex = strings.TrimSpace(rest[idx:])
+	if !strings.HasPrefix(value.Regex, "(") || !strings.HasSuffix(value.Regex, ")") {
+		return nil, errors.New("regex of value '" + value.Name + "' must be in parentheses")
+	}
+	if _, err := regexp.Compile(value.Regex); err != nil {
+		return nil, errors.New("regex of value '" + value.Name + "' is invalid, " + err.Error())
+	}
+	return value, nil
+}
+
+func (t *Template) value(name string) *Value {
+	for _, v := range t.Values {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (t *Template) parseRule(line string) (*Rule, error) {
+	rule := &Rule{Regex: line, LineOp: "Next"}
+	if idx := strings.LastIndex(line, " -> "); idx >= 0 {
+		rule.Regex = strings.TrimSpace(line[:idx])
+		action := strings.TrimSpace(line[idx+4:])
+
+		if strings.HasPrefix(action, "Error") {
+			rule.LineOp = "Error"
+			rule.Error = strings.Trim(strings.TrimSpace(strings.TrimPrefix(action, "Error")), `"`)
+		} else {
+			fields := strings.Fields(action)
+			if len(fields) > 2 {
+				return nil, errors.New("action '" + action + "' is invalid")
+			}
+			if len(fields) == 2 {
+				rule.NewState = fields[1]
+			}
+			if len(fields) > 0 {
+				ops := strings.SplitN(fields[0], ".", 2)
+				switch {
+				case len(ops) == 2 && lineOps[ops[0]] && recordOps[ops[1]]:
+					rule.LineOp, rule.RecordOp = ops[0], ops[1]
+				case len(ops) == 1 && lineOps[ops[0]]:
+					rule.LineOp = ops[0]
+				case len(ops) == 1 && recordOps[ops[0]]:
+					rule.RecordOp = ops[0]
+				case len(ops) == 1 && len(fields) == 1:
+					rule.NewState = ops[0]
+				default:
+					return nil, errors.New("action '" + action + "' is invalid")
+				}
+			}
+			if "Continue" == rule.LineOp && "" != rule.NewState {
+				return nil, errors.New("'Continue' can't change the state")
+			}
+		}
+	}
+
+	var err error
+	expanded := varPattern.ReplaceAllStringFunc(rule.Regex, func(s string) string {
+		if "$$" == s {
+			return "$"
+		}
+		name := strings.Trim(s, "${}")
+		v := t.value(name)
+		if nil == v {
+			err = errors.New("value '" + name + "' is not defined")
+			return s
+		}
+		return "(?P<" + name + ">" + v.Regex[1:len(v.Regex)-1] + ")"
+	})
+	if err != nil {
+		return nil, err
+	}
+	rule.re, err = regexp.Compile(expanded)
+	if err != nil {
+		return nil, errors.New("regex '" + rule.Regex + "' is invalid, " + err.Error())
+	}
+	return rule, nil
+}
+
+type parser struct {
+	t       *Template
+	current map[string]interface{}
+	records []Record
+}
+
+func (p *parser) clear(all bool) {
+	for _, v := range p.t.Values {
+		if all || !v.Filldown {
+			delete(p.current, v.Name)
+		}
+	}
+}
+
+func (p *parser) assign(v *Value, s string) {
+	if v.List {
+		list, _ := p.current[v.Name].([]string)
+		p.current[v.Name] = append(list, s)
+		return
+	}
+	p.current[v.Name] = s
+	if v.Fillup {
+		for i := len(p.records) - 1; i >= 0; i-- {
+			if old, _ := p.records[i][v.Name].(string); "" != old {
+				break
+			}
+			p.records[i][v.Name] = s
+		}
+	}
+}
+
+func (p *parser) record() {
+	record := Record{}
+	empty := true
+	for _, v := range p.t.Values {
+		value, ok := p.current[v.Name]
+		if !ok || "" == value {
+			if v.Required {
+				p.clear(false)
+				return
+			}
+			if v.List {
+				record[v.Name] = []string{}
+			} else {
+				record[v.Name] = ""
+			}
+			continue
+		}
+		empty = false
+		if list, ok := value.([]string); ok {
+			record[v.Name] = append([]string(nil), list...)
+		} else {
+			record[v.Name] = value
+		}
+	}
+	if !empty {
+		p.records = append(p.records, record)
+	}
+	p.clear(false)
+}
+
+// Execute 解析文本并返回所有的行
+func (t *Template) Execute(text string) ([]Record, error) {
+	p := &parser{t: t, current: map[string]interface{}{}}
+	state := "Start"
+
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	if n := len(lines); n > 0 && "" == lines[n-1] {
+		lines = lines[:n-1]
+	}
+	for _, line := range lines {
+		for _, rule := range t.States[state] {
+			loc := rule.re.FindStringSubmatchIndex(line)
+			if nil == loc {
+				continue
+			}
+			for i, name := range rule.re.SubexpNames() {
+				if "" == name || loc[2*i] < 0 {
+					continue
+				}
+				if v := t.value(name); nil != v {
+					p.assign(v, line[loc[2*i]:loc[2*i+1]])
+				}
+			}
+
+			if "Error" == rule.LineOp {
+				msg := rule.Error
+				if "" == msg {
+					msg = "error rule is matched"
+				}
+				return nil, errors.New("line '" + line + "': " + msg)
+			}
+			switch rule.RecordOp {
+			case "Record":
+				p.record()
+			case "Clear":
+				p.clear(false)
+			case "Clearall":
+				p.clear(true)
+			}
+			if "" != rule.NewState {
+				state = rule.NewState
+			}
+			if "Continue" != rule.LineOp {
+				break
+			}
+		}
+		if "End" == state || "EOF" == state {
+			break
+		}
+	}
+
+	if rules, ok := t.States["EOF"]; ok {
+		for _, rule := range rules {
+			if "Record" == rule.RecordOp {
+				p.record()
+			}
+		}
+	} else if "End" != state {
+		p.record()
+	}
+	return p.records, nil
+}
@@ -0,0 +1,143 @@
+package textfsm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func execute(t *testing.T, template, text string) []Record {
+	t.Helper()
+	tpl, err := Parse(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := tpl.Execute(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestExecuteFilldown(t *testing.T) {
+	records := execute(t, `Value Filldown Chassis (\S+)
+Value Slot (\d+)
+
+Start
+  ^Chassis ${Chassis}
+  ^Slot ${Slot} -> Record
+`, "Chassis A\nSlot 1\nSlot 2\nChassis B\nSlot 3\n")
+
+	excepted := []Record{
+		{"Chassis": "A", "Slot": "1"},
+		{"Chassis": "A", "Slot": "2"},
+		{"Chassis": "B", "Slot": "3"},
+		// 和 TextFSM 一样， Filldown 的值会保留到 EOF 时的隐式记录中
+		{"Chassis": "B", "Slot": ""},
+	}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+
+	records = execute(t, `Value Filldown Chassis (\S+)
+Value Required Slot (\d+)
+
+Start
+  ^Chassis ${Chassis}
+  ^Slot ${Slot} -> Record
+`, "Chassis A\nSlot 1\nChassis B\nSlot 3\n")
+
+	excepted = []Record{
+		{"Chassis": "A", "Slot": "1"},
+		{"Chassis": "B", "Slot": "3"},
+	}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+}
+
+func TestExecuteRequired(t *testing.T) {
+	records := execute(t, `Value Required Interface (\S+)
+Value Status (up|down)
+
+Start
+  ^Interface ${Interface}
+  ^Status ${Status}
+  ^$$ -> Record
+`, "Interface eth0\nStatus up\n\nStatus down\n\nInterface eth1\n\n")
+
+	excepted := []Record{
+		{"Interface": "eth0", "Status": "up"},
+		{"Interface": "eth1", "Status": ""},
+	}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+}
+
+func TestExecuteEOF(t *testing.T) {
+	template := `Value Name (\S+)
+
+Start
+  ^Name ${Name} -> Record
+  ^Last ${Name}
+`
+	// 没有 EOF 状态时， 最后一行会被隐式地记录
+	records := execute(t, template, "Name a\nLast b\n")
+	excepted := []Record{{"Name": "a"}, {"Name": "b"}}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+
+	// 空的 EOF 状态会禁止隐式的记录
+	records = execute(t, template+"\nEOF\n", "Name a\nLast b\n")
+	excepted = []Record{{"Name": "a"}}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+
+	// 进入 End 状态后不再处理后面的行， 也不会隐式地记录
+	records = execute(t, `Value Name (\S+)
+
+Start
+  ^Name ${Name} -> Record
+  ^Stop -> End
+`, "Name a\nStop\nName b\n")
+	excepted = []Record{{"Name": "a"}}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+}
+
+func TestExecuteList(t *testing.T) {
+	records := execute(t, `Value Group (\S+)
+Value List Member (\S+)
+
+Start
+  ^Group ${Group}
+  ^  ${Member}
+  ^End -> Record
+`, "Group g1\n  a\n  b\nEnd\nGroup g2\nEnd\n")
+
+	excepted := []Record{
+		{"Group": "g1", "Member": []string{"a", "b"}},
+		{"Group": "g2", "Member": []string{}},
+	}
+	if !reflect.DeepEqual(records, excepted) {
+		t.Errorf("excepted %v, got %v", excepted, records)
+	}
+}
+
+func TestExecuteError(t *testing.T) {
+	tpl, err := Parse(`Value Name (\S+)
+
+Start
+  ^Name ${Name}
+  ^% -> Error "invalid input"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpl.Execute("Name a\n% Invalid input\n"); nil == err {
+		t.Error("excepted error, got ok")
+	}
+}
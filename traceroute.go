@@ -0,0 +1,408 @@
+package terminal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/net/websocket"
+)
+
+type TraceHop struct {
+	TTL     int     `json:"ttl"`
+	Probe   int     `json:"probe"`
+	Addr    string  `json:"addr,omitempty"`
+	Name    string  `json:"name,omitempty"`
+	RTT     float64 `json:"rtt_ms,omitempty"`
+	Timeout bool    `json:"timeout,omitempty"`
+	Reached bool    `json:"reached,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type tracer struct {
+	protocol string
+	dst      net.IP
+	port     int
+	ipv6     bool
+	timeout  time.Duration
+	id       int
+
+	// raw is used to receive the "time exceeded" messages of routers,
+	// it is nil if the server has no permission to open a raw socket.
+	raw *icmpConn
+	udp net.PacketConn
+}
+
+// udpPort 返回 udp 探测的目标端口， 每次探测的端口不同， 超过 65535 时
+// 从 t.port 重新开始
+func (t *tracer) udpPort(seq int) int {
+	return t.port + seq%(65536-t.port)
+}
+
+// portAllocator 分配 tcp 探测的本地端口， 并发的探测不会使用同一个端口
+type portAllocator struct {
+	mu   sync.Mutex
+	base int
+	size int
+	next int
+	used map[int]bool
+}
+
+var tracePorts = &portAllocator{base: 40000, size: 20000, used: map[int]bool{}}
+
+func (a *portAllocator) get() (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < a.size; i++ {
+		port := a.base + (a.next+i)%a.size
+		if !a.used[port] {
+			a.used[port] = true
+			a.next = (a.next + i + 1) % a.size
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (a *portAllocator) put(port int) {
+	a.mu.Lock()
+	delete(a.used, port)
+	a.mu.Unlock()
+}
+
+func (t *tracer) close() {
+	if nil != t.raw {
+		t.raw.Close()
+	}
+	if nil != t.udp {
+		t.udp.Close()
+	}
+}
+
+func (t *tracer) probe(ttl, seq int) TraceHop {
+	hop := TraceHop{TTL: ttl, Probe: seq % 1000}
+	started := time.Now()
+
+	var tcpDone chan tcpResult
+	var localPort int
+	switch t.protocol {
+	case "icmp":
+		if err := t.raw.setTTL(ttl); err != nil {
+			hop.Error = err.Error()
+			return hop
+		}
+		bs, err := (&icmp.Message{Type: echoRequest(t.ipv6), Code: 0,
+			Body: &icmp.Echo{ID: t.id, Seq: seq, Data: []byte("web-terminal traceroute")}}).Marshal(nil)
+		if nil == err {
+			_, err = t.raw.WriteTo(bs, t.raw.addr(t.dst))
+		}
+		if err != nil {
+			hop.Error = err.Error()
+			return hop
+		}
+	case "udp":
+		var err error
+		if t.ipv6 {
+			err = ipv6.NewPacketConn(t.udp).SetHopLimit(ttl)
+		} else {
+			err = ipv4.NewPacketConn(t.udp).SetTTL(ttl)
+		}
+		if nil == err {
+			_, err = t.udp.WriteTo([]byte("web-terminal traceroute"), &net.UDPAddr{IP: t.dst, Port: t.udpPort(seq)})
+		}
+		if err != nil {
+			hop.Error = err.Error()
+			return hop
+		}
+	case "tcp":
+		var ok bool
+		if localPort, ok = tracePorts.get(); !ok {
+			hop.Error = "no local port is available"
+			return hop
+		}
+		tcpDone = make(chan tcpResult, 1)
+		go func() {
+			defer tracePorts.put(localPort)
+			dialer := &net.Dialer{
+				Timeout:   t.timeout,
+				LocalAddr: &net.TCPAddr{Port: localPort},
+				Control: func(network, address string, c syscall.RawConn) error {
+					var err error
+					if e := c.Control(func(fd uintptr) {
+						err = setSocketTTL(fd, ttl, t.ipv6)
+					}); nil != e {
+						return e
+					}
+					return err
+				},
+			}
+			conn, err := dialer.Dial("tcp", net.JoinHostPort(t.dst.String(), strconv.Itoa(t.port)))
+			if nil == err {
+				conn.Close()
+			}
+			tcpDone <- tcpResult{err: err, elapsed: time.Since(started)}
+		}()
+	}
+
+	deadline := started.Add(t.timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if nil != tcpDone {
+			select {
+			case result := <-tcpDone:
+				tcpDone = nil
+				err := result.err
+				if nil == err || isConnRefused(err) {
+					hop.Addr = t.dst.String()
+					hop.RTT = toMillisecond(result.elapsed)
+					hop.Reached = true
+					return hop
+				}
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					hop.Error = err.Error()
+					return hop
+				}
+			default:
+			}
+		}
+
+		if nil == t.raw {
+			if nil == tcpDone {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		readDeadline := deadline
+		if nil != tcpDone {
+			if d := time.Now().Add(50 * time.Millisecond); d.Before(deadline) {
+				readDeadline = d
+			}
+		}
+		t.raw.SetReadDeadline(readDeadline)
+		msg, _, peer, err := t.raw.read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			hop.Error = err.Error()
+			return hop
+		}
+
+		matched, reached := t.match(msg, peer, seq, localPort)
+		if !matched {
+			continue
+		}
+		hop.Addr = peer.String()
+		hop.RTT = toMillisecond(time.Since(started))
+		hop.Reached = reached
+		return hop
+	}
+	hop.Timeout = true
+	return hop
+}
+
+type tcpResult struct {
+	err     error
+	elapsed time.Duration
+}
+
+func isConnRefused(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "refused")
+}
+
+// match checks whether msg is the reply of the probe.
+func (t *tracer) match(msg *icmp.Message, peer net.IP, seq, localPort int) (matched, reached bool) {
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if "icmp" != t.protocol || !isEchoReply(msg.Type) {
+			return false, false
+		}
+		return body.ID == t.id && body.Seq == seq && peer.Equal(t.dst), true
+	case *icmp.TimeExceeded:
+		return t.matchInner(body.Data, seq, localPort), false
+	case *icmp.DstUnreach:
+		return t.matchInner(body.Data, seq, localPort), true
+	}
+	return false, false
+}
+
+// matchInner checks the original datagram which is included in the icmp error.
+func (t *tracer) matchInner(data []byte, seq, localPort int) bool {
+	var proto int
+	var dst net.IP
+	var payload []byte
+	if t.ipv6 {
+		if len(data) < ipv6.HeaderLen {
+			return false
+		}
+		proto = int(data[6])
+		dst = net.IP(data[24:40])
+		payload = data[ipv6.HeaderLen:]
+	} else {
+		if len(data) < ipv4.HeaderLen {
+			return false
+		}
+		hdrlen := int(data[0]&0x0f) << 2
+		if len(data) < hdrlen {
+			return false
+		}
+		proto = int(data[9])
+		dst = net.IP(data[16:20])
+		payload = data[hdrlen:]
+	}
+	if !dst.Equal(t.dst) || len(payload) < 8 {
+		return false
+	}
+
+	switch t.protocol {
+	case "icmp":
+		if proto != t.raw.proto() {
+			return false
+		}
+		return int(binary.BigEndian.Uint16(payload[4:6])) == t.id&0xffff &&
+			int(binary.BigEndian.Uint16(payload[6:8])) == seq&0xffff
+	case "udp":
+		return proto == syscall.IPPROTO_UDP && int(binary.BigEndian.Uint16(payload[2:4])) == t.udpPort(seq)
+	case "tcp":
+		return proto == syscall.IPPROTO_TCP && int(binary.BigEndian.Uint16(payload[0:2])) == localPort
+	}
+	return false
+}
+
+// Traceroute 探测到主机的路由， 参数有 hostname, protocol(udp, tcp 或 icmp),
+// port, max_hops, queries, timeout, ipv6, resolve 和 format(json 或 text)，
+// timeout 不超过 maxProbeTimeout
+func Traceroute(ws *websocket.Conn) {
+	defer ws.Close()
+
+	query_params := ws.Request().URL.Query()
+	hostname := query_params.Get("hostname")
+	protocol := strings.ToLower(query_params.Get("protocol"))
+	maxHops := toInt(query_params.Get("max_hops"), 30)
+	queries := toInt(query_params.Get("queries"), 3)
+	useIPv6 := "true" == strings.ToLower(query_params.Get("ipv6"))
+	resolve := "true" == strings.ToLower(query_params.Get("resolve"))
+	out := newProbeOutput(ws)
+
+	t := &tracer{
+		protocol: protocol,
+		ipv6:     useIPv6,
+		timeout:  probeTimeout(query_params.Get("timeout"), 3*time.Second),
+		id:       os.Getpid() & 0xffff,
+	}
+	switch protocol {
+	case "", "udp":
+		t.protocol = "udp"
+		t.port = toInt(query_params.Get("port"), 33434)
+	case "tcp":
+		t.port = toInt(query_params.Get("port"), 80)
+	case "icmp":
+	default:
+		out.fail(errors.New("protocol '" + protocol + "' is unsupported"))
+		return
+	}
+	if "icmp" != t.protocol && (t.port <= 0 || t.port > 65535) {
+		out.fail(errors.New("port '" + strconv.Itoa(t.port) + "' is invalid"))
+		return
+	}
+	if maxHops <= 0 || maxHops > 255 || queries <= 0 || queries > 10 {
+		out.fail(errors.New("max_hops or queries is invalid"))
+		return
+	}
+
+	var err error
+	t.dst, err = resolveIP(hostname, useIPv6)
+	if err != nil {
+		out.fail(err)
+		return
+	}
+	if err = allowTargetIP(ws.Request(), "traceroute", hostname, t.dst); err != nil {
+		out.fail(err)
+		return
+	}
+	defer t.close()
+
+	t.raw, err = listenICMP(useIPv6, true)
+	if err != nil {
+		if "tcp" != t.protocol {
+			out.fail(errors.New("traceroute by " + t.protocol + " requires raw socket, " + err.Error()))
+			return
+		}
+		// 没有 raw socket 时只能探测到目标主机， 中间的路由都显示为超时
+		t.raw = nil
+	}
+	if "udp" == t.protocol {
+		network, address := "udp4", "0.0.0.0:0"
+		if useIPv6 {
+			network, address = "udp6", "[::]:0"
+		}
+		if t.udp, err = net.ListenPacket(network, address); err != nil {
+			out.fail(err)
+			return
+		}
+	}
+
+	out.emit(map[string]interface{}{"hostname": hostname, "addr": t.dst.String(), "protocol": t.protocol, "max_hops": maxHops},
+		fmt.Sprintf("traceroute to %s (%s), %d hops max, %s", hostname, t.dst, maxHops, t.protocol))
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		reached := false
+		line := fmt.Sprintf("%3d ", ttl)
+		lastAddr := ""
+		for probe := 0; probe < queries; probe++ {
+			hop := t.probe(ttl, ttl*queries+probe)
+			hop.Probe = probe
+			if resolve && "" != hop.Addr {
+				if names, e := net.LookupAddr(hop.Addr); nil == e && len(names) > 0 {
+					hop.Name = strings.TrimSuffix(names[0], ".")
+				}
+			}
+			if hop.Reached {
+				reached = true
+			}
+
+			switch {
+			case "" != hop.Error:
+				line += " !(" + hop.Error + ")"
+			case hop.Timeout:
+				line += " *"
+			default:
+				if hop.Addr != lastAddr {
+					if "" != hop.Name {
+						line += " " + hop.Name + " (" + hop.Addr + ")"
+					} else {
+						line += " " + hop.Addr
+					}
+					lastAddr = hop.Addr
+				}
+				line += fmt.Sprintf("  %.3f ms", hop.RTT)
+			}
+
+			if out.isJSON {
+				if err := out.emit(&hop, ""); err != nil {
+					return
+				}
+			}
+		}
+		if !out.isJSON {
+			if err := out.emit(nil, line); err != nil {
+				return
+			}
+		}
+		if reached {
+			break
+		}
+	}
+}
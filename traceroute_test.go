@@ -0,0 +1,58 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracerUDPPort(t *testing.T) {
+	for _, port := range []int{1, 33434, 65000, 65535} {
+		tracer := &tracer{port: port}
+		for seq := 0; seq < 255*10+10; seq++ {
+			if p := tracer.udpPort(seq); p < port || p > 65535 {
+				t.Fatalf("port %d, seq %d: got %d", port, seq, p)
+			}
+		}
+	}
+	tracer := &tracer{port: 65534}
+	if tracer.udpPort(0) != 65534 || tracer.udpPort(1) != 65535 || tracer.udpPort(2) != 65534 {
+		t.Error("excepted the port wraps to the first port")
+	}
+}
+
+func TestPortAllocator(t *testing.T) {
+	a := &portAllocator{base: 100, size: 3, used: map[int]bool{}}
+	seen := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		port, ok := a.get()
+		if !ok || port < 100 || port >= 103 || seen[port] {
+			t.Fatalf("excepted a free port, got %d, %v", port, ok)
+		}
+		seen[port] = true
+	}
+	if port, ok := a.get(); ok {
+		t.Fatalf("excepted no port, got %d", port)
+	}
+	a.put(101)
+	if port, ok := a.get(); !ok || port != 101 {
+		t.Errorf("excepted 101, got %d, %v", port, ok)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		excepted time.Duration
+	}{
+		{"", time.Second},
+		{"500", 500 * time.Millisecond},
+		{"2s", 2 * time.Second},
+		{"-1s", time.Second},
+		{"0", time.Second},
+		{"100h", maxProbeTimeout},
+	} {
+		if actual := probeTimeout(test.s, time.Second); actual != test.excepted {
+			t.Errorf("%q: excepted %v, got %v", test.s, test.excepted, actual)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package terminal
+
+import "syscall"
+
+func setSocketTTL(fd uintptr, ttl int, isIPv6 bool) error {
+	if isIPv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
@@ -0,0 +1,10 @@
+package terminal
+
+import "syscall"
+
+func setSocketTTL(fd uintptr, ttl int, isIPv6 bool) error {
+	if isIPv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
@@ -0,0 +1,377 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// FlagRule 是一个选项的转换规则， 在配置文件中可以简写为目标选项的字符串
+type FlagRule struct {
+	// To is the option on the target os, an empty string drops the option
+	// (and its value), "-M do" is expanded to two arguments and an option
+	// ending with '=' is joined with its value.
+	To string `json:"to"`
+	// Scale multiplies the value of the option, e.g. 0.001 converts
+	// milliseconds to seconds.
+	Scale float64 `json:"scale,omitempty"`
+}
+
+func (r *FlagRule) UnmarshalJSON(bs []byte) error {
+	if len(bs) > 0 && bs[0] == '"' {
+		return json.Unmarshal(bs, &r.To)
+	}
+	type rule FlagRule
+	return json.Unmarshal(bs, (*rule)(r))
+}
+
+// TranslateRule 描述一个命令的参数在某个操作系统上的转换规则
+type TranslateRule struct {
+	// Program replaces the command, e.g. tracert is replaced by traceroute.
+	Program string `json:"program,omitempty"`
+	// IfMissing applies the rule only if the command isn't found.
+	IfMissing bool `json:"if_missing,omitempty"`
+	// ValueFlags lists the options which have a value, both of the request
+	// and of the target os, the option which isn't in Flags is passed
+	// through with its value.
+	ValueFlags []string            `json:"value_flags,omitempty"`
+	Flags      map[string]FlagRule `json:"flags,omitempty"`
+	Prepend    []string            `json:"prepend,omitempty"`
+	// Defaults are appended unless the first element of the group is
+	// present after the translation.
+	Defaults [][]string `json:"defaults,omitempty"`
+	// Positional reorders the arguments which aren't options, "{1}" is the
+	// first argument and "{@}" is the argument starts with '@' (without the
+	// '@'), an item is dropped if its argument is missing.
+	Positional []string `json:"positional,omitempty"`
+}
+
+// the key of rules is the request command and then the target os, "unix"
+// matches every os except windows.
+const defaultTranslations = `{
+  "ping": {
+    "unix": {
+      "value_flags": ["-n", "-l", "-w", "-i", "-c", "-s", "-W", "-M", "-I", "-p", "-Q", "-m"],
+      "flags": {
+        "-n": "-c",
+        "-l": "-s",
+        "-w": {"to": "-W", "scale": 0.001},
+        "-i": "-t",
+        "-f": "-M do",
+        "-t": "",
+        "-a": ""
+      },
+      "defaults": [["-c", "4"]]
+    }
+  },
+  "tracert": {
+    "unix": {
+      "program": "traceroute",
+      "value_flags": ["-h", "-w", "-j", "-S", "-m", "-q", "-f", "-p", "-s", "-N", "-t", "-i", "-g", "-z"],
+      "flags": {
+        "-d": "-n",
+        "-h": "-m",
+        "-w": {"to": "-w", "scale": 0.001},
+        "-j": "",
+        "-S": "-s"
+      }
+    }
+  },
+  "traceroute": {
+    "windows": {
+      "program": "tracert",
+      "value_flags": ["-m", "-w", "-q", "-f", "-p", "-s", "-h", "-j"],
+      "flags": {
+        "-n": "-d",
+        "-m": "-h",
+        "-w": {"to": "-w", "scale": 1000},
+        "-q": "",
+        "-f": "",
+        "-p": "",
+        "-s": "-S",
+        "-I": "",
+        "-T": ""
+      }
+    }
+  },
+  "nslookup": {
+    "unix": {
+      "program": "dig",
+      "if_missing": true,
+      "flags": {
+        "-type=": "-t",
+        "-querytype=": "-t",
+        "-q=": "-t",
+        "-port=": "-p",
+        "-timeout=": "+time=",
+        "-retry=": "+tries="
+      },
+      "positional": ["@{2}", "{1}"]
+    }
+  },
+  "dig": {
+    "windows": {
+      "program": "nslookup",
+      "if_missing": true,
+      "value_flags": ["-t", "-p", "-c", "-b", "-f", "-k", "-q", "-x", "-y"],
+      "flags": {
+        "-t": "-type=",
+        "-p": "-port=",
+        "-c": "-class="
+      },
+      "positional": ["{1}", "{@}"]
+    }
+  },
+  "netstat": {
+    "unix": {
+      "value_flags": ["-p"],
+      "flags": {
+        "-o": "-p",
+        "-b": "-p",
+        "-p": ""
+      }
+    },
+    "windows": {
+      "flags": {
+        "-t": "-p TCP",
+        "-u": "-p UDP",
+        "-l": "",
+        "-p": "-o",
+        "-e": "-e"
+      }
+    }
+  },
+  "tpt": {
+    "windows": {
+      "prepend": ["-gbk=true"]
+    }
+  }
+}`
+
+var translations map[string]map[string]*TranslateRule
+
+func init() {
+	if err := json.Unmarshal([]byte(defaultTranslations), &translations); err != nil {
+		panic(err)
+	}
+}
+
+// readTranslations 读取 translations.json， 它会覆盖同一个命令和操作系统的
+// 内置规则， file 为 "" 时返回内置的规则
+func readTranslations(file string) (map[string]map[string]*TranslateRule, error) {
+	var rules map[string]map[string]*TranslateRule
+	if "" != file {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.New("load '" + file + "' fail," + err.Error())
+		}
+		if err := json.Unmarshal(bs, &rules); err != nil {
+			return nil, errors.New("load '" + file + "' fail," + err.Error())
+		}
+	}
+
+	var merged map[string]map[string]*TranslateRule
+	if err := json.Unmarshal([]byte(defaultTranslations), &merged); err != nil {
+		return nil, err
+	}
+	for name, byOS := range rules {
+		if _, ok := merged[name]; !ok {
+			merged[name] = map[string]*TranslateRule{}
+		}
+		for goos, rule := range byOS {
+			merged[name][goos] = rule
+		}
+	}
+
+	return merged, nil
+}
+
+func translateRuleFor(name string) *TranslateRule {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "runtime_env/"), ".exe")
+
+	configLock.RLock()
+	defer configLock.RUnlock()
+	byOS := translations[name]
+	if nil == byOS {
+		return nil
+	}
+	if rule, ok := byOS[runtime.GOOS]; ok {
+		return rule
+	}
+	if "windows" != runtime.GOOS {
+		return byOS["unix"]
+	}
+	return nil
+}
+
+// translateCommand 将命令和参数转换成当前操作系统的格式， 返回新的命令名（为空时
+// 表示不变）和参数
+func translateCommand(command *Command, args []string) (string, []string) {
+	rule := translateRuleFor(command.Name)
+	if nil == rule {
+		return "", args
+	}
+	if rule.IfMissing {
+		if _, err := exec.LookPath(command.Path); nil == err {
+			return "", args
+		}
+	}
+	return rule.Program, rule.Translate(args)
+}
+
+func (rule *TranslateRule) hasValue(flag string) bool {
+	for _, s := range rule.ValueFlags {
+		if s == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *TranslateRule) lookupFlag(arg string) (FlagRule, string, bool) {
+	if r, ok := rule.Flags[arg]; ok {
+		return r, "", true
+	}
+	for nm, r := range rule.Flags {
+		if strings.HasSuffix(nm, "=") && strings.HasPrefix(arg, nm) {
+			return r, strings.TrimPrefix(arg, nm), true
+		}
+	}
+	return FlagRule{}, "", false
+}
+
+func scaleValue(value string, scale float64) string {
+	if 0 == scale {
+		return value
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	f = f * scale
+	if f > 0 && f < 1 {
+		f = 1
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (rule *TranslateRule) Translate(args []string) []string {
+	var results []string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			positional = append(positional, arg)
+			continue
+		}
+
+		flagRule, value, ok := rule.lookupFlag(arg)
+		hasValue := "" != value
+		if !hasValue && rule.hasValue(arg) && i+1 < len(args) {
+			i++
+			value = args[i]
+			hasValue = true
+		}
+
+		if !ok {
+			results = append(results, arg)
+			if hasValue {
+				results = append(results, value)
+			}
+			continue
+		}
+		if "" == flagRule.To {
+			continue
+		}
+
+		if hasValue {
+			value = scaleValue(value, flagRule.Scale)
+			if strings.HasSuffix(flagRule.To, "=") {
+				results = append(results, flagRule.To+value)
+				continue
+			}
+		}
+		results = append(results, strings.Fields(flagRule.To)...)
+		if hasValue {
+			results = append(results, value)
+		}
+	}
+
+	if len(rule.Positional) > 0 {
+		results = append(results, rule.reorder(positional)...)
+	} else {
+		results = append(results, positional...)
+	}
+
+	for _, group := range rule.Defaults {
+		if len(group) == 0 {
+			continue
+		}
+		exists := false
+		for _, arg := range results {
+			if arg == group[0] {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			results = append(results, group...)
+		}
+	}
+
+	if len(rule.Prepend) > 0 {
+		results = append(append([]string{}, rule.Prepend...), results...)
+	}
+	return results
+}
+
+func (rule *TranslateRule) reorder(positional []string) []string {
+	var server string
+	var others []string
+	for _, s := range positional {
+		if strings.HasPrefix(s, "@") && "" == server {
+			server = strings.TrimPrefix(s, "@")
+			continue
+		}
+		others = append(others, s)
+	}
+
+	var results []string
+	for _, tpl := range rule.Positional {
+		start := strings.IndexByte(tpl, '{')
+		end := strings.IndexByte(tpl, '}')
+		if start < 0 || end < start {
+			results = append(results, tpl)
+			continue
+		}
+
+		var value string
+		if key := tpl[start+1 : end]; "@" == key {
+			value = server
+		} else if idx, err := strconv.Atoi(key); nil == err && idx >= 1 && idx <= len(others) {
+			value = others[idx-1]
+		}
+		if "" == value {
+			continue
+		}
+		results = append(results, tpl[:start]+value+tpl[end+1:])
+	}
+
+	// the arguments which aren't referenced by the template are kept
+	used := map[string]bool{}
+	for _, tpl := range rule.Positional {
+		if start := strings.IndexByte(tpl, '{'); start >= 0 {
+			used[tpl[start:]] = true
+		}
+	}
+	for idx, s := range others {
+		if !used["{"+strconv.Itoa(idx+1)+"}"] {
+			results = append(results, s)
+		}
+	}
+	return results
+}
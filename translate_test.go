@@ -0,0 +1,72 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	rules, err := readTranslations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		command, goos string
+		args          string
+		excepted      string
+	}{
+		// windows 的 ping 参数在 unix 上
+		{"ping", "unix", "-n 2 -l 100 -w 3000 -t host", "-c 2 -s 100 -W 3 host"},
+		{"ping", "unix", "-f -a host", "-M do host -c 4"},
+		// 目标系统自己的选项和它的值保持在一起
+		{"ping", "unix", "-c 3 -I eth0 -W 2 host", "-c 3 -I eth0 -W 2 host"},
+		{"ping", "unix", "host", "host -c 4"},
+		{"tracert", "unix", "-d -h 5 -w 500 host", "-n -m 5 -w 1 host"},
+		{"tracert", "unix", "-q 1 -m 5 -p 33434 host", "-q 1 -m 5 -p 33434 host"},
+		{"traceroute", "windows", "-n -m 5 -w 2 -q 3 -p 80 host", "-d -h 5 -w 2000 host"},
+		{"traceroute", "windows", "-h 5 -j 1.1.1.1 host", "-h 5 -j 1.1.1.1 host"},
+		{"nslookup", "unix", "-type=MX example.com 8.8.8.8", "-t MX @8.8.8.8 example.com"},
+		{"nslookup", "unix", "-timeout=3 example.com", "+time=3 example.com"},
+		{"dig", "windows", "-t MX @8.8.8.8 example.com", "-type=MX example.com 8.8.8.8"},
+		{"dig", "windows", "-x 1.1.1.1 -b 10.0.0.1 @8.8.8.8", "-x 1.1.1.1 -b 10.0.0.1 8.8.8.8"},
+		{"netstat", "unix", "-ano", "-ano"},
+		{"netstat", "unix", "-a -o", "-a -p"},
+		{"netstat", "windows", "-t -l -p", "-p TCP -o"},
+		{"tpt", "windows", "snmpwalk", "-gbk=true snmpwalk"},
+	} {
+		actual := rules[test.command][test.goos].Translate(strings.Fields(test.args))
+		if excepted := strings.Fields(test.excepted); !reflect.DeepEqual(actual, excepted) {
+			t.Errorf("%s(%s) %q: excepted %q, got %q", test.command, test.goos, test.args, excepted, actual)
+		}
+	}
+}
+
+func TestReadTranslations(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "translations.json")
+	if err := os.WriteFile(file, []byte(`{"ping": {"unix": {"flags": {"-n": "-c"}}},
+  "mtr": {"unix": {"flags": {"-n": "--no-dns"}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readTranslations(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文件中的规则替换内置的同一个命令和操作系统的规则， 其它的内置规则保留
+	if _, ok := rules["ping"]["unix"].Flags["-l"]; ok {
+		t.Error("the builtin rule of ping must be replaced")
+	}
+	if nil == rules["mtr"]["unix"] || nil == rules["tracert"]["unix"] {
+		t.Error("excepted the new and the builtin rules")
+	}
+
+	if err := os.WriteFile(file, []byte(`{"ping": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTranslations(file); nil == err {
+		t.Error("excepted error, got ok")
+	}
+}
@@ -0,0 +1,529 @@
+package terminal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+var vault_key_file = flag.String("vault_key_file", "", "the file which contains the master key of the credential vault, the environment variable WEB_TERMINAL_VAULT_KEY is used if it is empty, the vault is disabled if both are empty.")
+
+// Vault 是凭据库， 没有配置主密钥时为 nil
+var Vault *CredentialStore
+
+// vaultCheck 用主密钥加密后保存在凭据库中， 打开时用它检查主密钥是否正确
+const vaultCheck = "web-terminal credential vault"
+
+var credentialIDPattern = regexp.MustCompile(`^[0-9a-zA-Z_.\-]+$`)
+
+// Credential 是凭据库中的一个凭据， 密码等保存在 CredentialSecrets 中，
+// 加密后保存， API 只返回 Secrets 中有哪些密码。 Users 是可以使用凭据的
+// 用户， "*" 表示所有用户， 管理员和 Owner 总是可以使用和修改。 Hosts 是
+// 可以使用凭据的目标主机 (IP、 CIDR 或主机名的通配符， "*" 表示所有主机)，
+// 防止用户将凭据用在自己的主机上读出密码
+type Credential struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Users       []string  `json:"users,omitempty"`
+	Hosts       []string  `json:"hosts"`
+	Owner       string    `json:"owner,omitempty"`
+	Secrets     []string  `json:"secrets"`
+	Updated     time.Time `json:"updated_at"`
+}
+
+// CredentialSecrets 是凭据中的密码， 字段名和 ssh、 telnet 和 snmp 的参数
+// 名相同
+type CredentialSecrets struct {
+	Password       string `json:"password,omitempty"`
+	EnablePassword string `json:"enable_password,omitempty"`
+	PrivateKey     string `json:"private_key,omitempty"`
+	Passphrase     string `json:"passphrase,omitempty"`
+	Community      string `json:"community,omitempty"`
+	AuthPassword   string `json:"auth_password,omitempty"`
+	PrivPassword   string `json:"priv_password,omitempty"`
+}
+
+// params 返回凭据中非空的参数
+func (secrets *CredentialSecrets) params() map[string]string {
+	params := map[string]string{}
+	set := func(key, value string) {
+		if "" != value {
+			params[key] = value
+		}
+	}
+	set("password", secrets.Password)
+	set("enable_password", secrets.EnablePassword)
+	set("private_key", secrets.PrivateKey)
+	set("passphrase", secrets.Passphrase)
+	set("community", secrets.Community)
+	set("auth_password", secrets.AuthPassword)
+	set("priv_password", secrets.PrivPassword)
+	return params
+}
+
+func (c *Credential) allowed(user string) bool {
+	return ("" != c.Owner && c.Owner == user) ||
+		containsString(c.Users, "*") ||
+		containsString(c.Users, user)
+}
+
+// checkHost 检查是否可以在 hostname 上使用凭据， hostname 匹配主机名的通配
+// 符， 或者它解析后的所有地址都在 Hosts 中时才可以使用。 按地址匹配时返回
+// 解析后的第一个地址， 调用者应该连接这个地址， 避免检查后 DNS 的结果改变
+func (c *Credential) checkHost(hostname string) (string, error) {
+	denied := errors.New("credential '" + c.ID + "' can't be used on '" + hostname + "'")
+	hosts, err := parseHosts(c.Hosts)
+	if err != nil {
+		return "", err
+	}
+	if hosts.matchName(hostname) {
+		return "", nil
+	}
+	if "" == hostname {
+		return "", denied
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return "", errors.New("resolve '" + hostname + "' fail, " + err.Error())
+	}
+	if len(addrs) == 0 {
+		return "", denied
+	}
+	for _, addr := range addrs {
+		if !hosts.matchIP(addr.IP) {
+			return "", denied
+		}
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// storedCredential 是保存在文件中的凭据， Data 是加密后的 CredentialSecrets
+type storedCredential struct {
+	*Credential
+	Data []byte `json:"data"`
+}
+
+type vaultFile struct {
+	Salt        []byte              `json:"salt"`
+	Check       []byte              `json:"check"`
+	Credentials []*storedCredential `json:"credentials"`
+}
+
+// CredentialStore 保存凭据， 文件是日志目录下的 vault/credentials.json，
+// 密码用 AES-GCM 加密， 密钥由主密钥用 scrypt 生成
+type CredentialStore struct {
+	dir  string
+	aead cipher.AEAD
+
+	mu   sync.Mutex
+	data vaultFile
+}
+
+// vaultMasterKey 返回主密钥， 没有配置时返回空字符串
+func vaultMasterKey() (string, error) {
+	if "" != *vault_key_file {
+		bs, err := ioutil.ReadFile(*vault_key_file)
+		if err != nil {
+			return "", errors.New("load '" + *vault_key_file + "' fail," + err.Error())
+		}
+		key := strings.TrimSpace(string(bs))
+		if "" == key {
+			return "", errors.New("master key in '" + *vault_key_file + "' is empty")
+		}
+		return key, nil
+	}
+	return os.Getenv("WEB_TERMINAL_VAULT_KEY"), nil
+}
+
+func newCredentialStore(dir, masterKey string) (*CredentialStore, error) {
+	s := &CredentialStore{dir: dir}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "credentials.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("load credentials fail, " + err.Error())
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &s.data); err != nil {
+			return nil, errors.New("load credentials fail, " + err.Error())
+		}
+	}
+
+	isNew := len(s.data.Salt) == 0
+	if isNew {
+		s.data.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, s.data.Salt); err != nil {
+			return nil, err
+		}
+	}
+	key, err := scrypt.Key([]byte(masterKey), s.data.Salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	if isNew {
+		if s.data.Check, err = s.seal([]byte(vaultCheck), ""); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if check, err := s.open(s.data.Check, ""); err != nil || vaultCheck != string(check) {
+		return nil, errors.New("load credentials fail, master key is wrong")
+	}
+	return s, nil
+}
+
+// seal 加密 plaintext， 凭据的 ID 作为附加数据， 密文不能被移到其他凭据中
+func (s *CredentialStore) seal(plaintext []byte, id string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func (s *CredentialStore) open(data []byte, id string) ([]byte, error) {
+	size := s.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("credential '" + id + "' is corrupted")
+	}
+	plaintext, err := s.aead.Open(nil, data[:size], data[size:], []byte(id))
+	if err != nil {
+		return nil, errors.New("decrypt credential '" + id + "' fail, " + err.Error())
+	}
+	return plaintext, nil
+}
+
+func (s *CredentialStore) save() error {
+	bs, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, "credentials.json"), bs, 0600)
+}
+
+func (s *CredentialStore) indexOf(id string) int {
+	for idx, c := range s.data.Credentials {
+		if c.ID == id {
+			return idx
+		}
+	}
+	return -1
+}
+
+// List 返回用户可以使用的凭据， admin 为 true 时返回所有的凭据
+func (s *CredentialStore) List(user string, admin bool) []*Credential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := []*Credential{}
+	for _, c := range s.data.Credentials {
+		if admin || c.allowed(user) {
+			copied := *c.Credential
+			results = append(results, &copied)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Put 新增或替换凭据， secrets 为 nil 时保留原来的密码， 只有管理员和
+// Owner 可以修改凭据
+func (s *CredentialStore) Put(user string, admin bool, c *Credential, secrets *CredentialSecrets) error {
+	if !credentialIDPattern.MatchString(c.ID) {
+		return errors.New("id '" + c.ID + "' is invalid")
+	}
+	if len(c.Hosts) == 0 {
+		return errors.New("hosts is required")
+	}
+	if _, err := parseHosts(c.Hosts); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.indexOf(c.ID)
+	var data []byte
+	if idx >= 0 {
+		old := s.data.Credentials[idx]
+		if !admin && old.Owner != user {
+			return errors.New("permission denied")
+		}
+		c.Owner = old.Owner
+		c.Secrets = old.Secrets
+		data = old.Data
+	} else {
+		if nil == secrets {
+			secrets = &CredentialSecrets{}
+		}
+		c.Owner = user
+	}
+
+	if nil != secrets {
+		bs, err := json.Marshal(secrets)
+		if err != nil {
+			return err
+		}
+		if data, err = s.seal(bs, c.ID); err != nil {
+			return err
+		}
+		c.Secrets = []string{}
+		for key := range secrets.params() {
+			c.Secrets = append(c.Secrets, key)
+		}
+		sort.Strings(c.Secrets)
+	}
+	c.Updated = time.Now()
+
+	stored := &storedCredential{Credential: c, Data: data}
+	if idx >= 0 {
+		s.data.Credentials[idx] = stored
+	} else {
+		s.data.Credentials = append(s.data.Credentials, stored)
+	}
+	return s.save()
+}
+
+// Delete 删除凭据， 只有管理员和 Owner 可以删除
+func (s *CredentialStore) Delete(user string, admin bool, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.indexOf(id)
+	if idx < 0 {
+		return false, nil
+	}
+	if !admin && s.data.Credentials[idx].Owner != user {
+		return false, errors.New("permission denied")
+	}
+	s.data.Credentials = append(s.data.Credentials[:idx], s.data.Credentials[idx+1:]...)
+	return true, s.save()
+}
+
+// Resolve 返回用户可以使用的凭据和它的密码
+func (s *CredentialStore) Resolve(user string, admin bool, id string) (*Credential, *CredentialSecrets, error) {
+	s.mu.Lock()
+	idx := s.indexOf(id)
+	var stored *storedCredential
+	if idx >= 0 {
+		stored = s.data.Credentials[idx]
+	}
+	s.mu.Unlock()
+
+	if nil == stored || (!admin && !stored.allowed(user)) {
+		return nil, nil, errors.New("credential '" + id + "' is not found or permission denied")
+	}
+	bs, err := s.open(stored.Data, stored.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var secrets CredentialSecrets
+	if err := json.Unmarshal(bs, &secrets); err != nil {
+		return nil, nil, errors.New("decrypt credential '" + id + "' fail, " + err.Error())
+	}
+	copied := *stored.Credential
+	return &copied, &secrets, nil
+}
+
+func resolveCredential(user string, admin bool, id string) (*Credential, *CredentialSecrets, error) {
+	if nil == Vault {
+		return nil, nil, errors.New("credential vault isn't enabled")
+	}
+	return Vault.Resolve(user, admin, id)
+}
+
+// checkCredentialProtocol 检查凭据是否可以用于 protocol， 凭据只能用于连接
+// hostname 的 ssh 和 telnet， 如 /script 的 protocol=cmd 不使用 hostname，
+// 密码会被输入到本地的进程中
+func checkCredentialProtocol(protocol string) error {
+	switch protocol {
+	case "", "ssh", "telnet":
+		return nil
+	default:
+		return errors.New("credential can't be used with protocol '" + protocol + "'")
+	}
+}
+
+// withCredential 将参数 credential=<id> 替换为凭据中的用户名和密码，
+// 浏览器不需要知道密码
+func withCredential(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		id := params.Get("credential")
+		if "" == id {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if err := checkCredentialProtocol(params.Get("protocol")); err != nil {
+			renderError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		c, secrets, err := resolveCredential(currentUser(r), isAdmin(r), id)
+		var pinned string
+		if nil == err {
+			pinned, err = c.checkHost(params.Get("hostname"))
+		}
+		if err != nil {
+			renderError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		params.Del("credential")
+		if "" != pinned {
+			params.Set("hostname", pinned)
+		}
+		if "" != c.Username {
+			params.Set("user", c.Username)
+		}
+		for key, value := range secrets.params() {
+			params.Set(key, value)
+		}
+		copied := *r
+		u := *r.URL
+		u.RawQuery = params.Encode()
+		copied.URL = &u
+		h.ServeHTTP(w, &copied)
+	})
+}
+
+// useCredential 用凭据替换任务中的用户名和密码， user 是执行任务的用户
+func (task *DeviceTask) useCredential(user string, admin bool) error {
+	if "" == task.Credential {
+		return nil
+	}
+	if err := checkCredentialProtocol(task.Protocol); err != nil {
+		return err
+	}
+	c, secrets, err := resolveCredential(user, admin, task.Credential)
+	if err != nil {
+		return err
+	}
+	pinned, err := c.checkHost(task.Hostname)
+	if err != nil {
+		return err
+	}
+	if "" != pinned {
+		task.Hostname = pinned
+	}
+	if "" != c.Username {
+		task.User = c.Username
+	}
+	if "" != secrets.Password {
+		task.Password = secrets.Password
+	}
+	if "" != secrets.EnablePassword {
+		task.EnablePassword = secrets.EnablePassword
+	}
+	task.privateKey = secrets.PrivateKey
+	task.passphrase = secrets.Passphrase
+	return nil
+}
+
+// privateKeySigners 返回参数 private_key 中的私钥， 私钥有密码时密码在
+// 参数 passphrase 中
+func privateKeySigners(privateKey, passphrase string) ([]ssh.Signer, error) {
+	if "" == privateKey {
+		return nil, nil
+	}
+	var signer ssh.Signer
+	var err error
+	if "" != passphrase {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	}
+	if err != nil {
+		return nil, errors.New("private key is invalid, " + err.Error())
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+// CredentialsHandler 处理 /credentials (GET 列出， POST/PUT 保存) 和
+// /credentials/delete?id=xxx， 返回的凭据中不包含密码
+func CredentialsHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nil == Vault {
+			renderError(w, http.StatusServiceUnavailable, "credential vault isn't enabled")
+			return
+		}
+		user, admin := currentUser(r), isAdmin(r)
+
+		if "delete" == action {
+			if "POST" != r.Method && "DELETE" != r.Method {
+				renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+				return
+			}
+			id := r.URL.Query().Get("id")
+			found, err := Vault.Delete(user, admin, id)
+			if err != nil {
+				renderError(w, http.StatusForbidden, err.Error())
+				return
+			}
+			if !found {
+				renderError(w, http.StatusNotFound, "credential '"+id+"' is not found")
+				return
+			}
+			renderJSON(w, http.StatusOK, map[string]interface{}{"id": id})
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			renderJSON(w, http.StatusOK, Vault.List(user, admin))
+		case "POST", "PUT":
+			var req struct {
+				Credential
+				Secrets *CredentialSecrets `json:"secrets"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				renderError(w, http.StatusBadRequest, "credential is invalid, "+err.Error())
+				return
+			}
+			c := req.Credential
+			if err := Vault.Put(user, admin, &c, req.Secrets); err != nil {
+				if "permission denied" == err.Error() {
+					renderError(w, http.StatusForbidden, err.Error())
+				} else {
+					renderError(w, http.StatusBadRequest, err.Error())
+				}
+				return
+			}
+			renderJSON(w, http.StatusOK, &c)
+		default:
+			renderError(w, http.StatusMethodNotAllowed, "method isn't allowed")
+		}
+	}
+}
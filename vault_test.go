@@ -0,0 +1,158 @@
+package terminal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCredentialStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newCredentialStore(dir, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Credential{ID: "core", Username: "admin", Users: []string{"bob"}, Hosts: []string{"10.0.0.0/8"}}
+	if err := s.Put("alice", false, c, &CredentialSecrets{Password: "p1", EnablePassword: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后可以解密
+	s, err = newCredentialStore(dir, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		c, secrets, err := s.Resolve(user, false, "core")
+		if err != nil {
+			t.Errorf("%s: %v", user, err)
+		} else if "admin" != c.Username || "p1" != secrets.Password || "e1" != secrets.EnablePassword {
+			t.Errorf("%s: excepted the secrets, got %+v, %+v", user, c, secrets)
+		}
+	}
+	if _, _, err := s.Resolve("eve", false, "core"); nil == err {
+		t.Error("eve isn't allowed to use the credential")
+	}
+	if err := s.Put("bob", false, &Credential{ID: "core", Hosts: []string{"*"}}, nil); nil == err {
+		t.Error("bob isn't allowed to modify the credential")
+	}
+
+	// 密文不能被移到其他凭据中
+	data := s.data.Credentials[0].Data
+	if _, err := s.open(data, "other"); nil == err {
+		t.Error("excepted error when the id is changed, got ok")
+	}
+	data[len(data)-1] ^= 1
+	if _, err := s.open(data, "core"); nil == err {
+		t.Error("excepted error when the data is changed, got ok")
+	}
+
+	if _, err := newCredentialStore(dir, "wrong"); nil == err {
+		t.Error("excepted error for a wrong master key, got ok")
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	c := &Credential{ID: "c1", Hosts: []string{"core-*", "127.0.0.0/8", "192.168.1.1"}}
+	for _, test := range []struct {
+		hostname string
+		pinned   string
+	}{
+		{"core-sw1", ""},
+		{"CORE-SW2", ""},
+		{"127.0.0.1", "127.0.0.1"},
+		{"192.168.1.1", "192.168.1.1"},
+		{"localhost", "127.0.0.1"},
+	} {
+		pinned, err := c.checkHost(test.hostname)
+		if err != nil {
+			t.Errorf("%q: %v", test.hostname, err)
+		} else if pinned != test.pinned {
+			t.Errorf("%q: excepted %q, got %q", test.hostname, test.pinned, pinned)
+		}
+	}
+	for _, hostname := range []string{"", "edge-sw1", "10.0.0.1", "192.168.1.2"} {
+		if _, err := c.checkHost(hostname); nil == err {
+			t.Errorf("%q: excepted error, got ok", hostname)
+		}
+	}
+}
+
+func withTestVault(t *testing.T) {
+	s, err := newCredentialStore(t.TempDir(), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("alice", false, &Credential{ID: "lo", Username: "root", Hosts: []string{"127.0.0.0/8"}},
+		&CredentialSecrets{Password: "secret", EnablePassword: "enable"}); err != nil {
+		t.Fatal(err)
+	}
+	old := Vault
+	Vault = s
+	t.Cleanup(func() { Vault = old })
+}
+
+func TestUseCredential(t *testing.T) {
+	withTestVault(t)
+
+	// 按地址匹配时连接检查过的地址
+	task := &DeviceTask{Hostname: "localhost", Credential: "lo"}
+	if err := task.useCredential("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if "127.0.0.1" != task.Hostname || "root" != task.User || "secret" != task.Password || "enable" != task.EnablePassword {
+		t.Errorf("excepted the credential, got %+v", task)
+	}
+
+	for _, task := range []*DeviceTask{
+		{Hostname: "127.0.0.1", Credential: "lo", Protocol: "cmd"},
+		{Hostname: "10.0.0.1", Credential: "lo"},
+		{Hostname: "127.0.0.1", Credential: "not_exists"},
+	} {
+		if err := task.useCredential("alice", false); nil == err {
+			t.Errorf("%+v: excepted error, got ok", task)
+		}
+	}
+}
+
+func TestWithCredential(t *testing.T) {
+	withTestVault(t)
+
+	var params map[string]string
+	h := withCredential(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = map[string]string{}
+		for key := range r.URL.Query() {
+			params[key] = r.URL.Query().Get(key)
+		}
+	}))
+
+	oldHeader := *user_header
+	*user_header = "X-User"
+	defer func() { *user_header = oldHeader }()
+
+	serve := func(query string) int {
+		params = nil
+		r := httptest.NewRequest("GET", "/script?"+query, nil)
+		r.Header.Set("X-User", "alice")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve("protocol=telnet&hostname=localhost&credential=lo"); http.StatusOK != code {
+		t.Fatalf("excepted 200, got %d", code)
+	}
+	if "127.0.0.1" != params["hostname"] || "secret" != params["password"] || "" != params["credential"] {
+		t.Errorf("excepted the credential, got %v", params)
+	}
+
+	// protocol=cmd 不使用 hostname， 密码会被输入到本地的进程中
+	for _, query := range []string{
+		"protocol=cmd&cmd=cat&hostname=127.0.0.1&credential=lo",
+		"hostname=10.0.0.1&credential=lo",
+	} {
+		if code := serve(query); http.StatusForbidden != code || nil != params {
+			t.Errorf("%s: excepted 403, got %d, %v", query, code, params)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package vt
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// palette 是 xterm 的前 16 个颜色
+var palette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// Hex 返回颜色的 CSS 值， 缺省颜色返回空字符串
+func (c Color) Hex() string {
+	switch {
+	case c == DefaultColor:
+		return ""
+	case c&rgbFlag != 0:
+		return fmt.Sprintf("#%06x", uint32(c&0xffffff))
+	}
+	n := int(c) - 1
+	switch {
+	case n < 16:
+		return palette[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) int {
+			if v == 0 {
+				return 0
+			}
+			return 55 + v*40
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	default:
+		v := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
+
+// sgr 返回设置颜色的 SGR 参数， fg 为 true 时是前景色
+func (c Color) sgr(fg bool) string {
+	base := 38
+	if !fg {
+		base = 48
+	}
+	switch {
+	case c == DefaultColor:
+		return strconv.Itoa(base + 1)
+	case c&rgbFlag != 0:
+		return fmt.Sprintf("%d;2;%d;%d;%d", base, (c>>16)&0xff, (c>>8)&0xff, c&0xff)
+	}
+	n := int(c) - 1
+	switch {
+	case n < 8:
+		return strconv.Itoa(base - 8 + n)
+	case n < 16:
+		return strconv.Itoa(base + 52 + n - 8)
+	}
+	return fmt.Sprintf("%d;5;%d", base, n)
+}
+
+// Slice 返回 y 行 from 列到 to 列 (不包含) 的文本
+func (s *Screen) Slice(y, from, to int) string {
+	if y < 0 || y >= s.rows {
+		return ""
+	}
+	line := s.lines[y]
+	if from < 0 {
+		from = 0
+	}
+	if to > len(line) {
+		to = len(line)
+	}
+	var sb strings.Builder
+	for x := from; x < to; x++ {
+		if line[x].Ch != 0 {
+			sb.WriteRune(line[x].Ch)
+		}
+	}
+	return sb.String()
+}
+
+// Lines 返回屏幕上每一行的文本， 去掉了行尾的空格
+func (s *Screen) Lines() []string {
+	lines := make([]string, s.rows)
+	var sb strings.Builder
+	for y, line := range s.lines {
+		sb.Reset()
+		for _, cell := range line {
+			if cell.Ch != 0 {
+				sb.WriteRune(cell.Ch)
+			}
+		}
+		lines[y] = strings.TrimRight(sb.String(), " ")
+	}
+	return lines
+}
+
+// Text 返回屏幕的文本， 去掉了末尾的空行
+func (s *Screen) Text() string {
+	lines := s.Lines()
+	for len(lines) > 0 && "" == lines[len(lines)-1] {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (attr Attr) style() string {
+	fg, bg := attr.FG.Hex(), attr.BG.Hex()
+	if attr.Reverse {
+		fg, bg = bg, fg
+		if "" == fg {
+			fg = "var(--screen-bg, #000000)"
+		}
+		if "" == bg {
+			bg = "var(--screen-fg, #e5e5e5)"
+		}
+	}
+	var styles []string
+	if "" != fg {
+		styles = append(styles, "color:"+fg)
+	}
+	if "" != bg {
+		styles = append(styles, "background-color:"+bg)
+	}
+	if attr.Bold {
+		styles = append(styles, "font-weight:bold")
+	}
+	if attr.Faint {
+		styles = append(styles, "opacity:0.6")
+	}
+	if attr.Italic {
+		styles = append(styles, "font-style:italic")
+	}
+	if attr.Underline {
+		styles = append(styles, "text-decoration:underline")
+	}
+	if attr.Hidden {
+		styles = append(styles, "visibility:hidden")
+	}
+	return strings.Join(styles, ";")
+}
+
+// HTML 返回屏幕的 HTML， 相同属性的字符放在同一个 span 中， 光标所在的
+// 字符的 class 为 cursor
+func (s *Screen) HTML() string {
+	var sb strings.Builder
+	sb.WriteString(`<pre class="screen">`)
+	for y, line := range s.lines {
+		if y > 0 {
+			sb.WriteString("\n")
+		}
+		for x := 0; x < len(line); {
+			if line[x].Ch == 0 {
+				x++
+				continue
+			}
+			attr := line[x].Attr
+			isCursor := s.visible && y == s.y && x == s.x
+			end := x + 1
+			if !isCursor {
+				for end < len(line) && line[end].Attr == attr && !(s.visible && y == s.y && end == s.x) {
+					end++
+				}
+			}
+
+			var text strings.Builder
+			for _, cell := range line[x:end] {
+				if cell.Ch != 0 {
+					text.WriteRune(cell.Ch)
+				}
+			}
+			style := attr.style()
+			switch {
+			case isCursor:
+				sb.WriteString(`<span class="cursor"`)
+				if "" != style {
+					sb.WriteString(` style="` + style + `"`)
+				}
+				sb.WriteString(">" + html.EscapeString(text.String()) + "</span>")
+			case "" == style:
+				sb.WriteString(html.EscapeString(text.String()))
+			default:
+				sb.WriteString(`<span style="` + style + `">` + html.EscapeString(text.String()) + "</span>")
+			}
+			x = end
+		}
+	}
+	sb.WriteString("</pre>")
+	return sb.String()
+}
+
+func (attr Attr) sgr() string {
+	params := []string{"0"}
+	if attr.Bold {
+		params = append(params, "1")
+	}
+	if attr.Faint {
+		params = append(params, "2")
+	}
+	if attr.Italic {
+		params = append(params, "3")
+	}
+	if attr.Underline {
+		params = append(params, "4")
+	}
+	if attr.Blink {
+		params = append(params, "5")
+	}
+	if attr.Reverse {
+		params = append(params, "7")
+	}
+	if attr.Hidden {
+		params = append(params, "8")
+	}
+	if attr.FG != DefaultColor {
+		params = append(params, attr.FG.sgr(true))
+	}
+	if attr.BG != DefaultColor {
+		params = append(params, attr.BG.sgr(false))
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+// ANSI 返回重画屏幕的控制序列， 用于让新的终端显示当前的屏幕
+func (s *Screen) ANSI() string {
+	var sb strings.Builder
+	sb.WriteString("\x1b[0m\x1b[H\x1b[2J")
+	for y, line := range s.lines {
+		sb.WriteString("\x1b[" + strconv.Itoa(y+1) + ";1H")
+		end := len(line)
+		for end > 0 && line[end-1].Ch == ' ' && line[end-1].Attr == (Attr{}) {
+			end--
+		}
+		attr := Attr{}
+		for _, cell := range line[:end] {
+			if cell.Ch == 0 {
+				continue
+			}
+			if cell.Attr != attr {
+				attr = cell.Attr
+				sb.WriteString(attr.sgr())
+			}
+			sb.WriteRune(cell.Ch)
+		}
+		if attr != (Attr{}) {
+			sb.WriteString("\x1b[0m")
+		}
+	}
+	if s.attr != (Attr{}) {
+		sb.WriteString(s.attr.sgr())
+	}
+	sb.WriteString("\x1b[" + strconv.Itoa(s.y+1) + ";" + strconv.Itoa(s.x+1) + "H")
+	if s.visible {
+		sb.WriteString("\x1b[?25h")
+	} else {
+		sb.WriteString("\x1b[?25l")
+	}
+	return sb.String()
+}
+
+// SnapshotCell 是 Snapshot 中的一个字符， 颜色是 CSS 值
+type SnapshotCell struct {
+	Ch        string `json:"ch"`
+	Width     int    `json:"width,omitempty"`
+	FG        string `json:"fg,omitempty"`
+	BG        string `json:"bg,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Faint     bool   `json:"faint,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Blink     bool   `json:"blink,omitempty"`
+	Reverse   bool   `json:"reverse,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"`
+}
+
+// Snapshot 是屏幕的 JSON 格式， Cells 中宽字符的第二列被省略
+type Snapshot struct {
+	Rows          int              `json:"rows"`
+	Cols          int              `json:"cols"`
+	CursorX       int              `json:"cursor_x"`
+	CursorY       int              `json:"cursor_y"`
+	CursorVisible bool             `json:"cursor_visible"`
+	AltScreen     bool             `json:"alt_screen"`
+	Title         string           `json:"title,omitempty"`
+	Lines         []string         `json:"lines"`
+	Cells         [][]SnapshotCell `json:"cells"`
+}
+
+// Snapshot 返回屏幕的快照
+func (s *Screen) Snapshot() *Snapshot {
+	snapshot := &Snapshot{Rows: s.rows,
+		Cols:          s.cols,
+		CursorX:       s.x,
+		CursorY:       s.y,
+		CursorVisible: s.visible,
+		AltScreen:     nil != s.main,
+		Title:         s.title,
+		Lines:         s.Lines(),
+		Cells:         make([][]SnapshotCell, s.rows)}
+	for y, line := range s.lines {
+		cells := make([]SnapshotCell, 0, len(line))
+		for x, cell := range line {
+			if cell.Ch == 0 {
+				continue
+			}
+			sc := SnapshotCell{Ch: string(cell.Ch),
+				FG:        cell.FG.Hex(),
+				BG:        cell.BG.Hex(),
+				Bold:      cell.Bold,
+				Faint:     cell.Faint,
+				Italic:    cell.Italic,
+				Underline: cell.Underline,
+				Blink:     cell.Blink,
+				Reverse:   cell.Reverse,
+				Hidden:    cell.Hidden}
+			if x+1 < len(line) && line[x+1].Ch == 0 {
+				sc.Width = 2
+			}
+			cells = append(cells, sc)
+		}
+		snapshot.Cells[y] = cells
+	}
+	return snapshot
+}
@@ -0,0 +1,804 @@
+// Package vt 是一个简单的 VT100/xterm 终端模拟器， 用于在服务端保存
+// 会话的屏幕内容
+package vt
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Color 是字符的颜色， 0 是缺省颜色， 1 到 256 是调色板中的颜色加一，
+// 设置了 rgbFlag 时低 24 位是 RGB 值
+type Color uint32
+
+const rgbFlag Color = 1 << 24
+
+// DefaultColor 是终端缺省的颜色
+const DefaultColor Color = 0
+
+// IndexColor 返回调色板中的第 n 个颜色
+func IndexColor(n int) Color {
+	if n < 0 || n > 255 {
+		return DefaultColor
+	}
+	return Color(n + 1)
+}
+
+// RGBColor 返回 24 位颜色
+func RGBColor(r, g, b int) Color {
+	return rgbFlag | Color(r&0xff)<<16 | Color(g&0xff)<<8 | Color(b&0xff)
+}
+
+// Attr 是字符的属性
+type Attr struct {
+	FG, BG    Color
+	Bold      bool
+	Faint     bool
+	Italic    bool
+	Underline bool
+	Blink     bool
+	Reverse   bool
+	Hidden    bool
+}
+
+// Cell 是屏幕上的一个字符， 宽字符的第二个 Cell 的 Ch 为 0
+type Cell struct {
+	Ch rune
+	Attr
+}
+
+type cursor struct {
+	x, y int
+	attr Attr
+}
+
+const (
+	stateGround = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateOSC
+	stateOSCEscape
+	stateString
+	stateStringEscape
+)
+
+// maxSequenceSize 是控制序列的最大长度， 超过时丢弃
+const maxSequenceSize = 1024
+
+// Screen 是终端的屏幕， 它不是线程安全的
+type Screen struct {
+	rows, cols int
+	lines      [][]Cell
+	x, y       int
+	attr       Attr
+	top        int
+	bottom     int
+	wrapNext   bool
+	autowrap   bool
+	insert     bool
+	visible    bool
+	saved      cursor
+	title      string
+
+	// 备用屏幕 (?1049) 打开时 main 保存主屏幕
+	main      [][]Cell
+	mainSaved cursor
+
+	state   int
+	seq     []byte
+	pending []byte
+}
+
+// MaxRows 和 MaxCols 是屏幕的最大尺寸， 超过时按最大尺寸创建
+const (
+	MaxRows = 500
+	MaxCols = 500
+)
+
+func clampSize(rows, cols int) (int, int) {
+	if rows > MaxRows {
+		rows = MaxRows
+	}
+	if cols > MaxCols {
+		cols = MaxCols
+	}
+	return rows, cols
+}
+
+// New 创建一个 rows 行 cols 列的屏幕
+func New(rows, cols int) *Screen {
+	if rows <= 0 {
+		rows = 24
+	}
+	if cols <= 0 {
+		cols = 80
+	}
+	rows, cols = clampSize(rows, cols)
+	s := &Screen{rows: rows, cols: cols}
+	s.Reset()
+	return s
+}
+
+// Reset 清除屏幕并恢复初始的状态
+func (s *Screen) Reset() {
+	s.lines = newLines(s.rows, s.cols, Attr{})
+	s.x, s.y = 0, 0
+	s.attr = Attr{}
+	s.top, s.bottom = 0, s.rows-1
+	s.wrapNext = false
+	s.autowrap = true
+	s.insert = false
+	s.visible = true
+	s.saved = cursor{}
+	s.main = nil
+	s.state = stateGround
+	s.seq = s.seq[:0]
+}
+
+func newLines(rows, cols int, attr Attr) [][]Cell {
+	lines := make([][]Cell, rows)
+	for y := range lines {
+		lines[y] = newLine(cols, attr)
+	}
+	return lines
+}
+
+func newLine(cols int, attr Attr) []Cell {
+	line := make([]Cell, cols)
+	for x := range line {
+		line[x] = Cell{Ch: ' ', Attr: blankAttr(attr)}
+	}
+	return line
+}
+
+// blankAttr 是擦除后的字符属性， 只保留背景色
+func blankAttr(attr Attr) Attr {
+	return Attr{BG: attr.BG}
+}
+
+// Size 返回屏幕的行数和列数
+func (s *Screen) Size() (rows, cols int) {
+	return s.rows, s.cols
+}
+
+// Cursor 返回光标的位置 (从 0 开始) 和是否可见
+func (s *Screen) Cursor() (x, y int, visible bool) {
+	return s.x, s.y, s.visible
+}
+
+// AltScreen 返回是否在备用屏幕中， 全屏的程序 (如 vi) 使用备用屏幕
+func (s *Screen) AltScreen() bool {
+	return nil != s.main
+}
+
+// Title 返回 OSC 0 或 2 设置的标题
+func (s *Screen) Title() string {
+	return s.title
+}
+
+// Cell 返回 x 列 y 行的字符
+func (s *Screen) Cell(x, y int) Cell {
+	if y < 0 || y >= s.rows || x < 0 || x >= s.cols {
+		return Cell{Ch: ' '}
+	}
+	return s.lines[y][x]
+}
+
+// Resize 改变屏幕的大小， 保留左上角的内容
+func (s *Screen) Resize(rows, cols int) {
+	if rows <= 0 || cols <= 0 {
+		return
+	}
+	rows, cols = clampSize(rows, cols)
+	if rows == s.rows && cols == s.cols {
+		return
+	}
+	resize := func(lines [][]Cell) [][]Cell {
+		if nil == lines {
+			return nil
+		}
+		// 行数减少时去掉上面的行， 保证光标所在的行可见
+		if len(lines) > rows {
+			lines = lines[len(lines)-rows:]
+		}
+		for y := range lines {
+			line := newLine(cols, Attr{})
+			copy(line, lines[y])
+			lines[y] = line
+		}
+		for len(lines) < rows {
+			lines = append(lines, newLine(cols, Attr{}))
+		}
+		return lines
+	}
+	if s.rows > rows {
+		s.y -= s.rows - rows
+	}
+	s.lines = resize(s.lines)
+	s.main = resize(s.main)
+	s.rows, s.cols = rows, cols
+	s.top, s.bottom = 0, rows-1
+	s.clampCursor()
+}
+
+func (s *Screen) clampCursor() {
+	s.wrapNext = false
+	if s.x < 0 {
+		s.x = 0
+	} else if s.x >= s.cols {
+		s.x = s.cols - 1
+	}
+	if s.y < 0 {
+		s.y = 0
+	} else if s.y >= s.rows {
+		s.y = s.rows - 1
+	}
+}
+
+// Write 处理终端的输出， p 必须是 UTF-8 编码
+func (s *Screen) Write(p []byte) (int, error) {
+	data := p
+	if len(s.pending) > 0 {
+		data = append(s.pending, p...)
+		s.pending = nil
+	}
+	for i := 0; i < len(data); {
+		if b := data[i]; b < utf8.RuneSelf {
+			s.handleByte(b)
+			i++
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			s.pending = append([]byte(nil), data[i:]...)
+			break
+		}
+		r, n := utf8.DecodeRune(data[i:])
+		s.handleRune(r)
+		i += n
+	}
+	return len(p), nil
+}
+
+func (s *Screen) handleRune(r rune) {
+	switch s.state {
+	case stateGround:
+		if r >= 0x80 && r < 0xa0 {
+			// C1 控制字符
+			return
+		}
+		s.put(r)
+	case stateOSC, stateString:
+		if len(s.seq) < maxSequenceSize {
+			s.seq = append(s.seq, string(r)...)
+		}
+	default:
+		s.state = stateGround
+	}
+}
+
+func (s *Screen) handleByte(b byte) {
+	switch s.state {
+	case stateGround:
+		if b < 0x20 || b == 0x7f {
+			s.control(b)
+			return
+		}
+		s.put(rune(b))
+	case stateEscape:
+		s.escape(b)
+	case stateEscapeIntermediate:
+		// ESC ( B 等字符集的设置被忽略
+		s.state = stateGround
+	case stateCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			s.state = stateGround
+			s.csi(b)
+		case b == 0x1b:
+			s.state = stateEscape
+		case b < 0x20:
+			s.control(b)
+		default:
+			if len(s.seq) < maxSequenceSize {
+				s.seq = append(s.seq, b)
+			}
+		}
+	case stateOSC:
+		switch b {
+		case 0x07:
+			s.state = stateGround
+			s.osc()
+		case 0x1b:
+			s.state = stateOSCEscape
+		default:
+			if len(s.seq) < maxSequenceSize {
+				s.seq = append(s.seq, b)
+			}
+		}
+	case stateOSCEscape:
+		s.state = stateGround
+		if b == '\\' {
+			s.osc()
+		}
+	case stateString:
+		if b == 0x1b {
+			s.state = stateStringEscape
+		} else if b == 0x07 {
+			s.state = stateGround
+		}
+	case stateStringEscape:
+		if b == '\\' {
+			s.state = stateGround
+		} else {
+			s.state = stateString
+		}
+	}
+}
+
+func (s *Screen) control(b byte) {
+	switch b {
+	case 0x08: // BS
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case 0x09: // HT
+		s.x = (s.x/8 + 1) * 8
+		if s.x >= s.cols {
+			s.x = s.cols - 1
+		}
+		s.wrapNext = false
+	case 0x0a, 0x0b, 0x0c: // LF, VT, FF
+		s.index()
+	case 0x0d: // CR
+		s.x = 0
+		s.wrapNext = false
+	case 0x1b:
+		s.state = stateEscape
+		s.seq = s.seq[:0]
+	}
+}
+
+func (s *Screen) escape(b byte) {
+	s.state = stateGround
+	switch b {
+	case '[':
+		s.state = stateCSI
+		s.seq = s.seq[:0]
+	case ']':
+		s.state = stateOSC
+		s.seq = s.seq[:0]
+	case 'P', 'X', '^', '_':
+		s.state = stateString
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%', ' ':
+		s.state = stateEscapeIntermediate
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.index()
+	case 'E':
+		s.x = 0
+		s.index()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.Reset()
+	}
+}
+
+func (s *Screen) osc() {
+	text := string(s.seq)
+	if idx := strings.IndexByte(text, ';'); idx > 0 {
+		switch text[:idx] {
+		case "0", "2":
+			s.title = text[idx+1:]
+		}
+	}
+}
+
+func (s *Screen) put(r rune) {
+	width := runeWidth(r)
+	if width == 0 {
+		return
+	}
+	if s.wrapNext {
+		s.wrapNext = false
+		if s.autowrap {
+			s.x = 0
+			s.index()
+		}
+	}
+	if width == 2 && s.cols < 2 {
+		// 只有一列时放不下宽字符
+		r, width = '?', 1
+	}
+	if width == 2 && s.x == s.cols-1 {
+		if !s.autowrap {
+			return
+		}
+		s.clearWide(s.x, s.y)
+		s.lines[s.y][s.x] = Cell{Ch: ' ', Attr: blankAttr(s.attr)}
+		s.x = 0
+		s.index()
+	}
+
+	line := s.lines[s.y]
+	if s.insert {
+		copy(line[s.x+width:], line[s.x:])
+	}
+	s.clearWide(s.x, s.y)
+	line[s.x] = Cell{Ch: r, Attr: s.attr}
+	if width == 2 {
+		s.clearWide(s.x+1, s.y)
+		line[s.x+1] = Cell{Ch: 0, Attr: s.attr}
+	}
+	if s.x+width >= s.cols {
+		s.x = s.cols - 1
+		s.wrapNext = true
+	} else {
+		s.x += width
+	}
+}
+
+// clearWide 在覆盖 x 列的字符前清除被破坏的宽字符的另一半
+func (s *Screen) clearWide(x, y int) {
+	line := s.lines[y]
+	if x >= len(line) {
+		return
+	}
+	if line[x].Ch == 0 && x > 0 {
+		line[x-1].Ch = ' '
+	} else if x+1 < len(line) && line[x+1].Ch == 0 {
+		line[x+1].Ch = ' '
+	}
+}
+
+func (s *Screen) index() {
+	if s.y == s.bottom {
+		s.scrollUp(1)
+	} else if s.y < s.rows-1 {
+		s.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	if s.y == s.top {
+		s.scrollDown(1)
+	} else if s.y > 0 {
+		s.y--
+	}
+}
+
+func (s *Screen) scrollUp(n int) {
+	s.deleteLinesAt(s.top, n)
+}
+
+func (s *Screen) scrollDown(n int) {
+	s.insertLinesAt(s.top, n)
+}
+
+func (s *Screen) insertLinesAt(y, n int) {
+	if y < s.top || y > s.bottom {
+		return
+	}
+	if n > s.bottom-y+1 {
+		n = s.bottom - y + 1
+	}
+	region := s.lines[y : s.bottom+1]
+	copy(region[n:], region[:len(region)-n])
+	for i := 0; i < n; i++ {
+		region[i] = newLine(s.cols, s.attr)
+	}
+}
+
+func (s *Screen) deleteLinesAt(y, n int) {
+	if y < s.top || y > s.bottom {
+		return
+	}
+	if n > s.bottom-y+1 {
+		n = s.bottom - y + 1
+	}
+	region := s.lines[y : s.bottom+1]
+	copy(region, region[n:])
+	for i := len(region) - n; i < len(region); i++ {
+		region[i] = newLine(s.cols, s.attr)
+	}
+}
+
+func (s *Screen) erase(y, from, to int) {
+	line := s.lines[y]
+	if to > len(line) {
+		to = len(line)
+	}
+	for x := from; x < to; x++ {
+		line[x] = Cell{Ch: ' ', Attr: blankAttr(s.attr)}
+	}
+}
+
+func (s *Screen) saveCursor() {
+	s.saved = cursor{x: s.x, y: s.y, attr: s.attr}
+}
+
+func (s *Screen) restoreCursor() {
+	s.x, s.y, s.attr = s.saved.x, s.saved.y, s.saved.attr
+	s.clampCursor()
+}
+
+func (s *Screen) params() (private byte, params []int) {
+	seq := s.seq
+	if len(seq) > 0 && seq[0] >= '<' && seq[0] <= '?' {
+		private = seq[0]
+		seq = seq[1:]
+	}
+	// 去掉中间字符
+	for len(seq) > 0 && seq[len(seq)-1] >= 0x20 && seq[len(seq)-1] <= 0x2f {
+		seq = seq[:len(seq)-1]
+	}
+	if len(seq) == 0 {
+		return private, nil
+	}
+	for _, field := range strings.FieldsFunc(string(seq), func(r rune) bool { return r == ';' || r == ':' }) {
+		n, _ := strconv.Atoi(field)
+		params = append(params, n)
+	}
+	if seq[len(seq)-1] == ';' {
+		params = append(params, 0)
+	}
+	return private, params
+}
+
+func param(params []int, idx, def int) int {
+	if idx < len(params) && params[idx] > 0 {
+		return params[idx]
+	}
+	return def
+}
+
+func (s *Screen) csi(final byte) {
+	private, params := s.params()
+	n := param(params, 0, 1)
+
+	switch final {
+	case '@':
+		line := s.lines[s.y]
+		if n > s.cols-s.x {
+			n = s.cols - s.x
+		}
+		copy(line[s.x+n:], line[s.x:])
+		s.erase(s.y, s.x, s.x+n)
+	case 'A':
+		s.y -= n
+		if s.y < s.top && s.y+n >= s.top {
+			s.y = s.top
+		}
+		s.clampCursor()
+	case 'B', 'e':
+		s.y += n
+		if s.y > s.bottom && s.y-n <= s.bottom {
+			s.y = s.bottom
+		}
+		s.clampCursor()
+	case 'C', 'a':
+		s.x += n
+		s.clampCursor()
+	case 'D':
+		s.x -= n
+		s.clampCursor()
+	case 'E':
+		s.x = 0
+		s.y += n
+		s.clampCursor()
+	case 'F':
+		s.x = 0
+		s.y -= n
+		s.clampCursor()
+	case 'G', '`':
+		s.x = n - 1
+		s.clampCursor()
+	case 'H', 'f':
+		s.y = n - 1
+		s.x = param(params, 1, 1) - 1
+		s.clampCursor()
+	case 'd':
+		s.y = n - 1
+		s.clampCursor()
+	case 'J':
+		switch param(params, 0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+			for y := s.y + 1; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		case 1:
+			for y := 0; y < s.y; y++ {
+				s.erase(y, 0, s.cols)
+			}
+			s.erase(s.y, 0, s.x+1)
+		case 2, 3:
+			for y := 0; y < s.rows; y++ {
+				s.erase(y, 0, s.cols)
+			}
+		}
+	case 'K':
+		switch param(params, 0, 0) {
+		case 0:
+			s.erase(s.y, s.x, s.cols)
+		case 1:
+			s.erase(s.y, 0, s.x+1)
+		case 2:
+			s.erase(s.y, 0, s.cols)
+		}
+	case 'L':
+		s.insertLinesAt(s.y, n)
+		s.x = 0
+	case 'M':
+		s.deleteLinesAt(s.y, n)
+		s.x = 0
+	case 'P':
+		line := s.lines[s.y]
+		if n > s.cols-s.x {
+			n = s.cols - s.x
+		}
+		copy(line[s.x:], line[s.x+n:])
+		s.erase(s.y, s.cols-n, s.cols)
+	case 'S':
+		s.scrollUp(n)
+	case 'T':
+		if 0 == private {
+			s.scrollDown(n)
+		}
+	case 'X':
+		s.erase(s.y, s.x, s.x+n)
+	case 'm':
+		if 0 == private {
+			s.sgr(params)
+		}
+	case 'r':
+		if 0 == private {
+			top := param(params, 0, 1) - 1
+			bottom := param(params, 1, s.rows) - 1
+			if bottom >= s.rows {
+				bottom = s.rows - 1
+			}
+			if top < bottom {
+				s.top, s.bottom = top, bottom
+				s.x, s.y = 0, 0
+				s.wrapNext = false
+			}
+		}
+	case 's':
+		if 0 == private {
+			s.saveCursor()
+		}
+	case 'u':
+		if 0 == private {
+			s.restoreCursor()
+		}
+	case 'h', 'l':
+		s.setMode(private, params, final == 'h')
+	}
+}
+
+func (s *Screen) setMode(private byte, params []int, on bool) {
+	for _, mode := range params {
+		if '?' != private {
+			if 4 == mode {
+				s.insert = on
+			}
+			continue
+		}
+		switch mode {
+		case 7:
+			s.autowrap = on
+		case 25:
+			s.visible = on
+		case 47, 1047, 1049:
+			if on && nil == s.main {
+				if 1049 == mode {
+					s.saveCursor()
+				}
+				s.main, s.mainSaved = s.lines, s.saved
+				s.lines = newLines(s.rows, s.cols, Attr{})
+			} else if !on && nil != s.main {
+				s.lines, s.saved = s.main, s.mainSaved
+				s.main = nil
+				if 1049 == mode {
+					s.restoreCursor()
+				}
+			}
+		}
+	}
+}
+
+func (s *Screen) sgr(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			s.attr = Attr{}
+		case p == 1:
+			s.attr.Bold = true
+		case p == 2:
+			s.attr.Faint = true
+		case p == 3:
+			s.attr.Italic = true
+		case p == 4:
+			s.attr.Underline = true
+		case p == 5 || p == 6:
+			s.attr.Blink = true
+		case p == 7:
+			s.attr.Reverse = true
+		case p == 8:
+			s.attr.Hidden = true
+		case p == 21 || p == 22:
+			s.attr.Bold, s.attr.Faint = false, false
+		case p == 23:
+			s.attr.Italic = false
+		case p == 24:
+			s.attr.Underline = false
+		case p == 25:
+			s.attr.Blink = false
+		case p == 27:
+			s.attr.Reverse = false
+		case p == 28:
+			s.attr.Hidden = false
+		case p >= 30 && p <= 37:
+			s.attr.FG = IndexColor(p - 30)
+		case p == 39:
+			s.attr.FG = DefaultColor
+		case p >= 40 && p <= 47:
+			s.attr.BG = IndexColor(p - 40)
+		case p == 49:
+			s.attr.BG = DefaultColor
+		case p >= 90 && p <= 97:
+			s.attr.FG = IndexColor(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			s.attr.BG = IndexColor(p - 100 + 8)
+		case p == 38 || p == 48:
+			var color Color
+			if i+2 < len(params) && params[i+1] == 5 {
+				color = IndexColor(params[i+2])
+				i += 2
+			} else if i+4 < len(params) && params[i+1] == 2 {
+				color = RGBColor(params[i+2], params[i+3], params[i+4])
+				i += 4
+			} else {
+				i = len(params)
+				continue
+			}
+			if p == 38 {
+				s.attr.FG = color
+			} else {
+				s.attr.BG = color
+			}
+		}
+	}
+}
+
+// runeWidth 返回字符在终端上占的列数
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x20 || (r >= 0x7f && r < 0xa0):
+		return 0
+	case r == 0x200b || (r >= 0x300 && r <= 0x36f) || (r >= 0x200c && r <= 0x200f) || r == 0xfeff:
+		return 0
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
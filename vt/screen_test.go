@@ -0,0 +1,158 @@
+package vt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func write(s *Screen, text string) {
+	s.Write([]byte(text))
+}
+
+func TestPutWrap(t *testing.T) {
+	s := New(3, 5)
+	write(s, "abcdefg")
+	if excepted := []string{"abcde", "fg", ""}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+
+	// 关闭自动换行后， 行尾的字符被覆盖
+	s = New(3, 5)
+	write(s, "\x1b[?7labcdefg")
+	if excepted := []string{"abcdg", "", ""}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+}
+
+func TestPutWide(t *testing.T) {
+	s := New(2, 5)
+	write(s, "ab中文")
+	if excepted := []string{"ab中", "文"}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+	if c := s.Cell(3, 0); c.Ch != 0 {
+		t.Errorf("excepted the second half of a wide rune, got %q", c.Ch)
+	}
+
+	// 覆盖宽字符的一半时， 另一半被清除
+	write(s, "\x1b[1;4Hx")
+	if excepted := "ab x"; s.Lines()[0] != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines()[0])
+	}
+
+	// 只有一列时宽字符被替换为 '?'
+	s = New(2, 1)
+	write(s, "中a")
+	if excepted := []string{"?", "a"}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+}
+
+func TestPutSplitUTF8(t *testing.T) {
+	s := New(1, 10)
+	write(s, "a\xe4\xb8")
+	write(s, "\xadb")
+	if excepted := "a中b"; s.Text() != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Text())
+	}
+}
+
+func TestControl(t *testing.T) {
+	s := New(3, 20)
+	write(s, "abc\bX\r\nline2\tY\rZ")
+	if excepted := []string{"abX", "Zine2   Y", ""}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+}
+
+func TestEscape(t *testing.T) {
+	s := New(3, 10)
+	write(s, "hello\x1b[2;3Hx\x1b[1;1H\x1b[K\x1b[31mred\x1b[0m")
+	if excepted := []string{"red", "  x", ""}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+	if c := s.Cell(0, 0); c.FG != IndexColor(1) {
+		t.Errorf("excepted red, got %v", c.FG)
+	}
+	if x, y, _ := s.Cursor(); x != 3 || y != 0 {
+		t.Errorf("excepted cursor at (3, 0), got (%d, %d)", x, y)
+	}
+
+	// 保存和恢复光标
+	write(s, "\x1b7\x1b[3;1Hz\x1b8!")
+	if excepted := []string{"red!", "  x", "z"}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+
+	// 清屏
+	write(s, "\x1b[2J")
+	if "" != s.Text() {
+		t.Errorf("excepted empty screen, got %q", s.Text())
+	}
+}
+
+func TestEscapeSplit(t *testing.T) {
+	s := New(2, 10)
+	write(s, "a\x1b[")
+	write(s, "2")
+	write(s, ";2Hb")
+	if excepted := []string{"a", " b"}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+}
+
+func TestOSC(t *testing.T) {
+	s := New(2, 10)
+	write(s, "\x1b]0;my title\x07a\x1b]2;other\x1b\\b")
+	if "other" != s.Title() {
+		t.Errorf("excepted 'other', got %q", s.Title())
+	}
+	if excepted := "ab"; s.Text() != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Text())
+	}
+
+	// DCS 等字符串被忽略
+	write(s, "\x1bPignored\x1b\\c")
+	if excepted := "abc"; s.Text() != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Text())
+	}
+}
+
+func TestAltScreen(t *testing.T) {
+	s := New(2, 10)
+	write(s, "main")
+	write(s, "\x1b[?1049h")
+	if !s.AltScreen() {
+		t.Error("excepted alt screen")
+	}
+	write(s, "\x1b[Hvi")
+	if excepted := "vi"; s.Text() != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Text())
+	}
+	write(s, "\x1b[?1049l")
+	if s.AltScreen() {
+		t.Error("excepted main screen")
+	}
+	if excepted := "main"; s.Text() != excepted {
+		t.Errorf("excepted %q, got %q", excepted, s.Text())
+	}
+}
+
+func TestScroll(t *testing.T) {
+	s := New(2, 10)
+	write(s, "1\r\n2\r\n3")
+	if excepted := []string{"2", "3"}; !reflect.DeepEqual(s.Lines(), excepted) {
+		t.Errorf("excepted %q, got %q", excepted, s.Lines())
+	}
+}
+
+func TestSize(t *testing.T) {
+	s := New(100000, 100000)
+	if rows, cols := s.Size(); rows != MaxRows || cols != MaxCols {
+		t.Errorf("excepted %dx%d, got %dx%d", MaxRows, MaxCols, rows, cols)
+	}
+	s.Resize(10, 100000)
+	if rows, cols := s.Size(); rows != 10 || cols != MaxCols {
+		t.Errorf("excepted 10x%d, got %dx%d", MaxCols, rows, cols)
+	}
+}